@@ -3,6 +3,7 @@ package util
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -28,84 +29,140 @@ import (
 type API struct {
 	// JWT token secret
 	TokenSec []byte
-	// AuthToken type JWT token string
+	// Keys verifies RS/ES signed tokens, e.g. of an OIDC provider, optional
+	Keys KeySource
+	// AuthToken type JWT token string, no longer set by the authentication
+	// Deprecated: always empty, use TokenFromContext
 	Token AuthToken
-	// authenticated JWT claims map
+	// authenticated JWT claims map, no longer set by the authentication
+	// Deprecated: always empty, use ClaimsFromContext or IdentityFromContext
 	Claims jwt.MapClaims
-	// gRPC api list not requir auth check
+	// routes not requiring auth check, see NoAuthMatch for the patterns
 	NoAuth []string
 	Log    *log.Entry
+	// Audit records the handled requests and RPCs, optional
+	Audit *AuditLogger
+	// Revoker rejects revoked tokens before expiry, optional
+	Revoker TokenRevoker
+	// Policy are the claim requirements per route or gRPC method, optional
+	Policy Policy
+	// TokenTTL is the validity of the tokens issued by LoginHandler, zero means 1h
+	TokenTTL time.Duration
+	// MaxBody limits the request body read by Bind, zero means DefaultMaxBody
+	MaxBody int64
+	// StrictJSON rejects unknown fields in the body read by Bind
+	StrictJSON bool
+
+	health *Health
 }
 
 // Error is REST api error handling function
+// err items are messages or errors
 // log 1st error message if exist
 // report joint 2nd up to the end error messages if exist, otherwise report the same 1st message
-// response http error code with json body using key "error"
-func (api *API) Error(w http.ResponseWriter, code int, err ...string) {
-	if len(err) == 0 {
-		err = append(err, "server error")
-	}
-	api.Log.Error(err[0])
-	res := make(map[string]string)
-	if len(err) == 1 {
-		res["error"] = err[0]
+// zero code is resolved from the first error by the status mapping, see StatusOf
+// response http error code with json body using key "error", "fields"
+// for ValidationErrors, and "requestID" if set by the middlewares, see Envelope
+func (api *API) Error(w http.ResponseWriter, code int, err ...interface{}) {
+	msgs, first := errArgs(err)
+	if code == 0 {
+		code = HTTPStatus(first)
+		if first == nil {
+			code = http.StatusInternalServerError
+		}
+	}
+	rid := w.Header().Get(RequestIDHeader)
+	lg := api.Log.WithFields(ErrFields(first))
+	if rid != "" {
+		lg = lg.WithField("request_id", rid)
+	}
+	lg.Error(msgs[0])
+	res := make(map[string]interface{})
+	var ve ValidationErrors
+	if errors.As(first, &ve) {
+		res["fields"] = ve
+	}
+	if len(msgs) == 1 {
+		res["error"] = msgs[0]
 	} else {
-		res["error"] = strings.Join(err[1:], ", ")
+		res["error"] = strings.Join(msgs[1:], ", ")
+	}
+	if rid != "" {
+		res["requestID"] = rid
 	}
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Content-Type", ContentJSON)
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(res)
 }
 
 // Errpc is gRPC api error handling function
+// err items are messages or errors
 // log 1st error message if exist
 // report joint 2nd up to the end error messages if exist, otherwise report the same 1st message
+// codes.Unknown is resolved from the first error by the status mapping, see StatusOf
 // generate gRPC status message
-func (api *API) Errpc(code codes.Code, err ...string) error {
-	if len(err) == 0 {
-		err = append(err, "server error")
+func (api *API) Errpc(code codes.Code, err ...interface{}) error {
+	msgs, first := errArgs(err)
+	if code == codes.Unknown && first != nil {
+		code = GRPCCode(first)
 	}
-	api.Log.Error(err[0])
+	api.Log.WithFields(ErrFields(first)).Error(msgs[0])
 	var res string
-	if len(err) == 1 {
-		res = err[0]
+	if len(msgs) == 1 {
+		res = msgs[0]
 	} else {
-		res = strings.Join(err[1:], ", ")
+		res = strings.Join(msgs[1:], ", ")
 	}
-	return status.Errorf(code, res)
+	return status.Error(code, res)
 }
 
 // Auth http handler function
 // perform JWT authentication and pass token to the next handler by context
+// the request is recorded to the audit logger if configured
 func (api *API) Auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
-		if len(authHeader) != 2 {
-			api.Error(w, http.StatusUnauthorized, "Malformed token", "Unauthorized")
-			return
-		}
-		jwtToken := authHeader[1]
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-			return api.TokenSec, nil
-		})
-		if err != nil {
-			api.Error(w, http.StatusUnauthorized, fmt.Sprintf("JWT auth fail: %v", err), "Unauthorized")
+		if api.Audit == nil {
+			api.authHTTP(w, r, next)
 			return
 		}
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			api.Token = AuthToken(r.Header.Get("Authorization"))
-			api.Claims = claims
-			next(w, r)
-		} else {
-			api.Error(w, http.StatusUnauthorized, "invalid token claims", "Unauthorized")
-		}
-		return
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		claims := api.authHTTP(sw, r, next)
+		api.Audit.recordHTTP(r, sw, claims, time.Since(start))
 	}
 }
 
+// authHTTP performs the JWT authentication of Auth, returns the claims, nil if denied
+// routes exempted by NoAuth pass with empty claims
+func (api *API) authHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) jwt.MapClaims {
+	if NoAuthMatch(api.NoAuth, r.Method, r.URL.Path) {
+		ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, rid)
+		next(w, r.WithContext(ctx))
+		return jwt.MapClaims{}
+	}
+	authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+	if len(authHeader) != 2 {
+		api.Error(w, http.StatusUnauthorized, "Malformed token", "Unauthorized")
+		return nil
+	}
+	claims, err := api.parseToken(r.Context(), authHeader[1], TokenAccess)
+	if err != nil {
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("JWT auth fail: %v", err), "Unauthorized")
+		return nil
+	}
+	// correlate the log lines of the request, see LoggerFromContext
+	ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+	w.Header().Set(RequestIDHeader, rid)
+	ctx = ContextWithToken(ContextWithClaims(ctx, claims), authHeader[1])
+	if err := api.Policy.check(claims, r.Method, r.URL.Path); err != nil {
+		api.Error(w, http.StatusForbidden, err, "Forbidden")
+		return claims
+	}
+	next(w, r.WithContext(ctx))
+	return claims
+}
+
 /*
 func auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -135,13 +192,90 @@ func auth(next http.Handler) http.Handler {
 
 // AuthGrpcUnary gRPC handler function, called by gRPC interceptor for api JWT authentication
 // perform Unary function JWT authentication and pass token to the next handler by context
+// the call is recorded to the audit logger if configured
 func (api *API) AuthGrpcUnary(ctx context.Context, req interface{}, srv *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if api.Audit == nil {
+		return api.authGrpcUnary(ctx, req, srv, handler, nil)
+	}
+	start := time.Now()
+	// fix the request ID ahead to have it in the record
+	md, _ := metadata.FromIncomingContext(ctx)
+	if md = md.Copy(); len(md.Get(RequestIDHeader)) == 0 {
+		md.Set(RequestIDHeader, NewRequestID())
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	var claims jwt.MapClaims
+	resp, err := api.authGrpcUnary(ctx, req, srv, handler, &claims)
+	api.Audit.recordRPC(ctx, srv.FullMethod, claims, err, time.Since(start))
+	return resp, err
+}
+
+// authGrpcUnary performs the JWT authentication of AuthGrpcUnary,
+// the claims of an authenticated call are saved to authed if not nil
+func (api *API) authGrpcUnary(ctx context.Context, req interface{}, srv *grpc.UnaryServerInfo, handler grpc.UnaryHandler, authed *jwt.MapClaims) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
 	// skip calls no auth requirement
-	for _, a := range api.NoAuth {
-		if a == srv.FullMethod {
-			return handler(ctx, req)
+	if NoAuthMatch(api.NoAuth, "", srv.FullMethod) {
+		return handler(api.grpcRequestID(ctx, md), req)
+	}
+	claims, err := api.grpcClaims(ctx, srv.FullMethod)
+	if authed != nil {
+		*authed = claims
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handler(api.grpcAuthContext(ctx, md, claims), req)
+}
+
+// AuthGrpcStream gRPC stream interceptor for api JWT authentication, see AuthGrpcUnary
+func (api *API) AuthGrpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := ss.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	if md = md.Copy(); len(md.Get(RequestIDHeader)) == 0 {
+		md.Set(RequestIDHeader, NewRequestID())
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+	start := time.Now()
+	var claims jwt.MapClaims
+	err := func() error {
+		if NoAuthMatch(api.NoAuth, "", info.FullMethod) {
+			return handler(srv, &ctxStream{ss, api.grpcRequestID(ctx, md)})
 		}
+		var err error
+		if claims, err = api.grpcClaims(ctx, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, &ctxStream{ss, api.grpcAuthContext(ctx, md, claims)})
+	}()
+	if api.Audit != nil {
+		api.Audit.recordRPC(ctx, info.FullMethod, claims, err, time.Since(start))
+	}
+	return err
+}
+
+// ctxStream overrides the context of a gRPC server stream
+type ctxStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *ctxStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcAuthContext attaches the request ID, claims, identity and token to the context
+func (api *API) grpcAuthContext(ctx context.Context, md metadata.MD, claims jwt.MapClaims) context.Context {
+	ctx = ContextWithClaims(api.grpcRequestID(ctx, md), claims)
+	if v := md.Get("authorization"); len(v) > 0 {
+		ctx = ContextWithToken(ctx, strings.TrimPrefix(v[0], "Bearer "))
 	}
+	return ctx
+}
+
+// grpcClaims verifies the JWT of the gRPC call metadata and the policy of
+// the method, returns the claims, which are nil if the token is rejected
+func (api *API) grpcClaims(ctx context.Context, method string) (jwt.MapClaims, error) {
 	// retrieve token from gRPC meta
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
@@ -154,47 +288,42 @@ func (api *API) AuthGrpcUnary(ctx context.Context, req interface{}, srv *grpc.Un
 			return nil, api.Errpc(codes.Unauthenticated, "JWT auth missing authorization field in metadata", "Unauthorized")
 		}
 	}
-	token, err := jwt.Parse(strings.TrimPrefix(ts[0], "Bearer "), func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return api.TokenSec, nil
-	})
+	claims, err := api.parseToken(ctx, strings.TrimPrefix(ts[0], "Bearer "), TokenAccess)
 	if err != nil {
 		return nil, api.Errpc(codes.Unauthenticated, fmt.Sprintf("JWT auth fail: %v", err), "Unauthorized")
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		api.Token = AuthToken(ts[0])
-		api.Claims = claims
-		return handler(ctx, req)
+	if err := api.Policy.check(claims, "", method); err != nil {
+		return claims, api.Errpc(codes.PermissionDenied, err, "Forbidden")
 	}
-	return nil, api.Errpc(codes.Unauthenticated, fmt.Sprintf("invalid token claims: %v", err), "Unauthorized")
+	return claims, nil
+}
+
+// grpcRequestID attaches the request ID from the incoming metadata, or a new one,
+// and the log entry carrying it to the context, the ID is sent back in the header
+func (api *API) grpcRequestID(ctx context.Context, md metadata.MD) context.Context {
+	id := ""
+	if v := md.Get(RequestIDHeader); len(v) > 0 {
+		id = v[0]
+	}
+	ctx, id = withRequestID(ctx, api.Log, id)
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+	return ctx
 }
 
 // ApiGet pass JWT from original request to target api
 // result will be saved to the given address
+// a non 2xx response is returned as *HTTPError matching the sentinel errors,
+// e.g. errors.Is(err, ErrNotFound) for 404
+// the trace and the request ID of the original request are continued, see Tracer
 func ApiGet(r *http.Request, url string, rb interface{}) error {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", r.Header.Get("Authorization"))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	json.NewDecoder(resp.Body).Decode(rb)
-	resp.Body.Close()
-	return nil
+	return forwardClient(r).Get(r.Context(), url, rb)
 }
 
-// http websocket upgrader
+// http websocket upgrader, browsers of other origins are rejected,
+// see WSConfig to allow them
 var Upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
 // AuthToken is a PerRPCCredentials interface,
@@ -213,32 +342,96 @@ func (t AuthToken) RequireTransportSecurity() bool {
 	return true
 }
 
+// DefaultMongoTimeout bounds the MongoOpr operations whose context has no
+// deadline, if MongoOpr.Timeout is zero
+const DefaultMongoTimeout = 10 * time.Second
+
 // MongoOpr define methods for mongo database operation
+// every operation takes its context, bounded by Timeout unless it has a
+// deadline, the collection is selected by Collection or Set
+// given the sessCtx of WithTransaction the operations join the transaction
+/*
+	devices := svc.Mongo.Collection("devices")
+	var d Device
+	ok, err := devices.GetData(r.Context(), &d, map[string]interface{}{"name": name}, nil)
+*/
 type MongoOpr struct {
-	Mdb     *mongo.Database
-	Mcoll   *mongo.Collection
-	Mctx    context.Context
+	Mdb   *mongo.Database
+	Mcoll *mongo.Collection
+	// Timeout of the operations without deadline, zero means DefaultMongoTimeout
+	Timeout time.Duration
+	// Audit stamps createdAt on the inserts, updatedAt and updatedBy, the
+	// subject of the caller identity of the context, on all writes
+	Audit bool
+	// SoftDelete sets deletedAt instead of deleting, the other operations
+	// skip the deleted documents unless WithDeleted, see Purge and Restore
+	SoftDelete bool
+	// Deprecated: expires and is shared by concurrent operations, pass the
+	// context to the operations, a nil context falls back to it
+	Mctx context.Context
+	// Deprecated: see Mctx
 	Mcancel context.CancelFunc
+
+	withDeleted bool
 }
 
+// Collection returns a copy of dba operating on the collection, safe to
+// use concurrently with dba
+func (dba *MongoOpr) Collection(col string) *MongoOpr {
+	return &MongoOpr{Mdb: dba.Mdb, Mcoll: dba.Mdb.Collection(col), Timeout: dba.Timeout,
+		Audit: dba.Audit, SoftDelete: dba.SoftDelete, withDeleted: dba.withDeleted}
+}
+
+// Set selects the collection of the operations
+// Deprecated: mutates the shared MongoOpr, use Collection
 func (dba *MongoOpr) Set(col string) {
-	dba.Mctx, dba.Mcancel = context.WithTimeout(context.Background(), 10*time.Second)
+	dba.SetContext(context.Background(), col)
+}
+
+// SetContext is Set storing a 10 seconds context derived from ctx in Mctx
+// Deprecated: pass the context to the operations, use Collection
+func (dba *MongoOpr) SetContext(ctx context.Context, col string) {
+	dba.Mctx, dba.Mcancel = context.WithTimeout(ctx, 10*time.Second)
 	dba.Mcoll = dba.Mdb.Collection(col)
 }
 
+// opCtx bounds the context of an operation by Timeout unless it has a
+// deadline, nil ctx falls back to the deprecated Mctx
+func (dba *MongoOpr) opCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = dba.Mctx
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	t := dba.Timeout
+	if t <= 0 {
+		t = DefaultMongoTimeout
+	}
+	return context.WithTimeout(ctx, t)
+}
+
 // GetID find the exact data based on the given mongo _id and projection
 // return false if no found
-func (dba *MongoOpr) GetID(res interface{}, id primitive.ObjectID, projection map[string]interface{}) (bool, error) {
-	f := bson.D{{"_id", id}}
-	p, err := bson.Marshal(projection)
+func (dba *MongoOpr) GetID(ctx context.Context, res interface{}, id primitive.ObjectID, projection map[string]interface{}) (bool, error) {
+	f, err := dba.filter(map[string]interface{}{"_id": id})
 	if err != nil {
 		return false, err
 	}
-	if err := dba.Mcoll.FindOne(dba.Mctx, f, options.FindOne().SetProjection(p)).Decode(res); err != nil {
+	p, err := bson.Marshal(projection)
+	if err != nil {
+		return false, ErrBadInput.Wrap(err)
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	if err := dba.Mcoll.FindOne(ctx, f, options.FindOne().SetProjection(p)).Decode(res); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return false, nil
 		} else {
-			return false, err
+			return false, mongoErr(err)
 		}
 	}
 	return true, nil
@@ -246,46 +439,140 @@ func (dba *MongoOpr) GetID(res interface{}, id primitive.ObjectID, projection ma
 
 // GetData find the first data based on the given filter and projection
 // return false if no found
-func (dba *MongoOpr) GetData(res interface{}, filter, projection map[string]interface{}) (bool, error) {
-	f, err := bson.Marshal(filter)
+func (dba *MongoOpr) GetData(ctx context.Context, res interface{}, filter, projection map[string]interface{}) (bool, error) {
+	f, err := dba.filter(filter)
 	if err != nil {
 		return false, err
 	}
 	p, err := bson.Marshal(projection)
 	if err != nil {
-		return false, err
+		return false, ErrBadInput.Wrap(err)
 	}
-	if err := dba.Mcoll.FindOne(dba.Mctx, f, options.FindOne().SetProjection(p)).Decode(res); err != nil {
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	if err := dba.Mcoll.FindOne(ctx, f, options.FindOne().SetProjection(p)).Decode(res); err != nil {
 		if err == mongo.ErrNoDocuments {
 			return false, nil
 		} else {
-			return false, err
+			return false, mongoErr(err)
 		}
 	}
 	return true, nil
 }
 
 // GetDataset returns ordered data set based on given filter and projection
-func (dba *MongoOpr) GetDataset(res interface{}, filter, projection, order map[string]interface{}) error {
-	f, err := bson.Marshal(filter)
+func (dba *MongoOpr) GetDataset(ctx context.Context, res interface{}, filter, projection, order map[string]interface{}) error {
+	f, err := dba.filter(filter)
 	if err != nil {
 		return err
 	}
 	p, err := bson.Marshal(projection)
 	if err != nil {
-		return err
+		return ErrBadInput.Wrap(err)
 	}
 	o, err := bson.Marshal(order)
 	if err != nil {
-		return err
+		return ErrBadInput.Wrap(err)
 	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
 	// find all but only return projected fields
-	cursor, err := dba.Mcoll.Find(dba.Mctx, f, options.Find().SetSort(o).SetProjection(p))
+	cursor, err := dba.Mcoll.Find(ctx, f, options.Find().SetSort(o).SetProjection(p))
 	if err != nil {
-		return err
+		return mongoErr(err)
 	}
-	if err := cursor.All(dba.Mctx, res); err != nil {
-		return err
+	if err := cursor.All(ctx, res); err != nil {
+		return mongoErr(err)
 	}
 	return nil
 }
+
+// Count returns the number of documents matching the filter, nil counts
+// the whole collection
+func (dba *MongoOpr) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	n, err := dba.Mcoll.CountDocuments(ctx, f)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	return n, nil
+}
+
+// Exists returns true if a document matches the filter, it stops at the
+// first match unlike Count
+func (dba *MongoOpr) Exists(ctx context.Context, filter map[string]interface{}) (bool, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	n, err := dba.Mcoll.CountDocuments(ctx, f, options.Count().SetLimit(1))
+	if err != nil {
+		return false, mongoErr(err)
+	}
+	return n > 0, nil
+}
+
+// Distinct returns the distinct values of the field among the documents
+// matching the filter, the values of an array field are counted apart
+/*
+	sites, err := db.Distinct(ctx, "site", map[string]interface{}{"vendor": "cisco"})
+*/
+func (dba *MongoOpr) Distinct(ctx context.Context, field string, filter map[string]interface{}) ([]interface{}, error) {
+	if field == "" {
+		return nil, ErrBadInput.Wrap(errors.New("empty distinct field"))
+	}
+	f, err := dba.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	vs, err := dba.Mcoll.Distinct(ctx, field, f)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return vs, nil
+}
+
+// mongoErr converts the mongo driver errors to the sentinel errors
+// no document to ErrNotFound, duplicate key to ErrConflict, deadline to ErrTimeout
+func mongoErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound.Wrap(err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout.Wrap(err)
+	}
+	dup := func(code int) bool { return code == 11000 || code == 11001 || code == 12582 }
+	switch e := err.(type) {
+	case mongo.WriteException:
+		for _, we := range e.WriteErrors {
+			if dup(we.Code) {
+				return ErrConflict.Wrap(err)
+			}
+		}
+	case mongo.BulkWriteException:
+		for _, we := range e.WriteErrors {
+			if dup(we.Code) {
+				return ErrConflict.Wrap(err)
+			}
+		}
+	case mongo.CommandError:
+		if dup(int(e.Code)) {
+			return ErrConflict.Wrap(err)
+		}
+		if e.HasErrorLabel("NetworkError") {
+			return NewErr("MONGO_UNAVAILABLE", CatUnavailable, "mongo unavailable").Wrap(err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/* ****************************************
+API key authentication
+**************************************** */
+
+// APIKeyHeader carries the API key of machine to machine clients
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyInfo is the identity and limits of an API key
+type APIKeyInfo struct {
+	Subject  string    `bson:"subject" json:"subject"`
+	Roles    []string  `bson:"roles,omitempty" json:"roles,omitempty"`
+	Scopes   []string  `bson:"scopes,omitempty" json:"scopes,omitempty"`
+	Rate     float64   `bson:"rate,omitempty" json:"rate,omitempty"` // requests per second, 0 means no limit
+	Burst    int       `bson:"burst,omitempty" json:"burst,omitempty"`
+	Expires  time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
+	Disabled bool      `bson:"disabled,omitempty" json:"disabled,omitempty"`
+}
+
+// claims synthesizes the JWT claims of the key, so the claims based
+// authorization and ClaimsFromContext work the same as with JWT
+func (k *APIKeyInfo) claims() jwt.MapClaims {
+	c := jwt.MapClaims{"sub": k.Subject, "auth": "apikey"}
+	if len(k.Roles) > 0 {
+		c["roles"] = k.Roles
+	}
+	if len(k.Scopes) > 0 {
+		c["scope"] = strings.Join(k.Scopes, " ")
+	}
+	if !k.Expires.IsZero() {
+		c["exp"] = float64(k.Expires.Unix())
+	}
+	return c
+}
+
+// APIKeyStore looks up API keys, nil info and nil error if not found
+type APIKeyStore interface {
+	LookupAPIKey(ctx context.Context, key string) (*APIKeyInfo, error)
+}
+
+// HashAPIKey returns the SHA-256 hex digest of the key, persistent stores
+// keep the digests rather than the keys
+func HashAPIKey(key string) string {
+	s := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(s[:])
+}
+
+// StaticAPIKeys is an APIKeyStore of keys to their info, e.g. loaded from config
+type StaticAPIKeys map[string]APIKeyInfo
+
+// LookupAPIKey returns the info of the key
+func (s StaticAPIKeys) LookupAPIKey(ctx context.Context, key string) (*APIKeyInfo, error) {
+	if k, ok := s[key]; ok {
+		return &k, nil
+	}
+	return nil, nil
+}
+
+// MongoAPIKeys is an APIKeyStore in a collection of the MongoOpr database,
+// documents are APIKeyInfo with the HashAPIKey digest as _id
+type MongoAPIKeys struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// LookupAPIKey finds the info by the key digest
+func (m *MongoAPIKeys) LookupAPIKey(ctx context.Context, key string) (*APIKeyInfo, error) {
+	var k APIKeyInfo
+	err := m.Opr.Mdb.Collection(m.Collection).FindOne(ctx, bson.M{"_id": HashAPIKey(key)}).Decode(&k)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return &k, nil
+}
+
+// AuthAPIKey returns a middleware authenticating by the X-API-Key header
+// against the store, as an alternative to Auth for machine to machine clients
+// the per key rate limit is enforced with 429, the synthesized claims are
+// passed by context and checked against the API policy
+/*
+	keyAuth := svc.API.AuthAPIKey(&util.MongoAPIKeys{Opr: svc.Mongo, Collection: "apikeys"})
+	svc.HandlePublic("/v1/export", keyAuth(export))
+*/
+func (api *API) AuthAPIKey(store APIKeyStore) func(http.HandlerFunc) http.HandlerFunc {
+	var mu sync.Mutex
+	limits := make(map[string]*TokenBucket)
+	allow := func(id string, k *APIKeyInfo) bool {
+		if k.Rate <= 0 {
+			return true
+		}
+		burst := k.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		mu.Lock()
+		// the bucket follows a change of the stored limit
+		tb, ok := limits[id]
+		if !ok || tb.rate != k.Rate || tb.burst != float64(burst) {
+			tb = NewTokenBucket(k.Rate, burst)
+			limits[id] = tb
+		}
+		mu.Unlock()
+		return tb.Allow()
+	}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+			claims := api.authAPIKey(sw, r, next, store, allow)
+			if api.Audit != nil {
+				api.Audit.recordHTTP(r, sw, claims, time.Since(start))
+			}
+		}
+	}
+}
+
+// authAPIKey performs the authentication of AuthAPIKey, returns the claims, nil if denied
+func (api *API) authAPIKey(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, store APIKeyStore, allow func(string, *APIKeyInfo) bool) jwt.MapClaims {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		api.Error(w, http.StatusUnauthorized, "missing API key", "Unauthorized")
+		return nil
+	}
+	k, err := store.LookupAPIKey(r.Context(), key)
+	if err != nil {
+		api.Error(w, 0, fmt.Errorf("API key lookup: %w", err), "API key lookup failed")
+		return nil
+	}
+	switch {
+	case k == nil:
+		api.Error(w, http.StatusUnauthorized, "unknown API key", "Unauthorized")
+		return nil
+	case k.Disabled:
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("API key of %s disabled", k.Subject), "Unauthorized")
+		return nil
+	case !k.Expires.IsZero() && time.Now().After(k.Expires):
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("API key of %s expired", k.Subject), "Unauthorized")
+		return nil
+	}
+	claims := k.claims()
+	if !allow(HashAPIKey(key), k) {
+		w.Header().Set("Retry-After", "1")
+		api.Error(w, http.StatusTooManyRequests, fmt.Sprintf("API key of %s rate limited", k.Subject), "Too many requests")
+		return claims
+	}
+	ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+	w.Header().Set(RequestIDHeader, rid)
+	if err := api.Policy.check(claims, r.Method, r.URL.Path); err != nil {
+		api.Error(w, http.StatusForbidden, err, "Forbidden")
+		return claims
+	}
+	next(w, r.WithContext(ContextWithClaims(ctx, claims)))
+	return claims
+}
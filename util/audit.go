@@ -0,0 +1,306 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+audit logging
+**************************************** */
+
+// audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// AuditRecord is an audited request or RPC
+type AuditRecord struct {
+	Time      time.Time     `json:"time" bson:"time"`
+	RequestID string        `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Subject   string        `json:"subject,omitempty" bson:"subject,omitempty"`
+	Method    string        `json:"method" bson:"method"`     // HTTP method, or RPC
+	Resource  string        `json:"resource" bson:"resource"` // URL path or gRPC full method
+	Outcome   string        `json:"outcome" bson:"outcome"`
+	Status    int           `json:"status" bson:"status"`                 // HTTP status
+	Code      string        `json:"code,omitempty" bson:"code,omitempty"` // gRPC code
+	Latency   time.Duration `json:"latency_ns" bson:"latency_ns"`
+	Remote    string        `json:"remote,omitempty" bson:"remote,omitempty"`
+}
+
+// AuditSink stores audit records
+type AuditSink interface {
+	WriteAudit(ctx context.Context, rec AuditRecord) error
+}
+
+// AuditSinkFunc adapts a function to AuditSink
+type AuditSinkFunc func(ctx context.Context, rec AuditRecord) error
+
+// WriteAudit calls f(ctx, rec)
+func (f AuditSinkFunc) WriteAudit(ctx context.Context, rec AuditRecord) error {
+	return f(ctx, rec)
+}
+
+// AuditMutations is an AuditLogger filter skipping the read only HTTP requests
+func AuditMutations(rec AuditRecord) bool {
+	switch rec.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// AuditLogger delivers the audit records to the sinks in background,
+// records are dropped with a warning if the buffer is full
+/*
+	sink, err := util.NewFileAuditSink("/var/log/app/audit.log")
+	...
+	api.Audit = util.NewAuditLogger(sink)
+	api.Audit.Filter = util.AuditMutations
+	defer api.Audit.Close()
+*/
+type AuditLogger struct {
+	Sinks []AuditSink
+	// Filter selects the records to keep, nil keeps all
+	Filter func(AuditRecord) bool
+	// SubjectClaims are the JWT claims tried in order for the subject
+	SubjectClaims []string
+	Log           *log.Entry
+
+	mu     sync.RWMutex
+	closed bool
+	ch     chan AuditRecord
+	done   chan struct{}
+}
+
+// NewAuditLogger creates an AuditLogger and starts its delivery goroutine
+func NewAuditLogger(sinks ...AuditSink) *AuditLogger {
+	a := &AuditLogger{
+		Sinks:         sinks,
+		SubjectClaims: []string{"sub", "uid", "user"},
+		Log:           logger.WithField("module", "audit"),
+		ch:            make(chan AuditRecord, 1024),
+		done:          make(chan struct{}),
+	}
+	go a.deliver()
+	return a
+}
+
+// Record queues the record for delivery, the time is set if zero
+func (a *AuditLogger) Record(rec AuditRecord) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if a.Filter != nil && !a.Filter(rec) {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	select {
+	case a.ch <- rec:
+	default:
+		a.Log.WithFields(log.Fields{"method": rec.Method, "resource": rec.Resource}).Warn("audit buffer full, record dropped")
+	}
+}
+
+// Close stops accepting records and waits for the queued ones to be delivered
+func (a *AuditLogger) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.ch)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *AuditLogger) deliver() {
+	defer close(a.done)
+	for rec := range a.ch {
+		for _, s := range a.Sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := SafeCall("audit sink", func() error { return s.WriteAudit(ctx, rec) })
+			cancel()
+			if err != nil {
+				a.Log.WithError(err).WithField("request_id", rec.RequestID).Warn("audit record delivery failed")
+			}
+		}
+	}
+}
+
+// subject picks the subject from the JWT claims
+func (a *AuditLogger) subject(claims jwt.MapClaims) string {
+	for _, k := range a.SubjectClaims {
+		if v, ok := claims[k]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+	}
+	return ""
+}
+
+// recordHTTP records a request handled by API.Auth, nil claims or 403 means denied
+func (a *AuditLogger) recordHTTP(r *http.Request, w *statusWriter, claims jwt.MapClaims, latency time.Duration) {
+	rec := AuditRecord{
+		RequestID: w.Header().Get(RequestIDHeader),
+		Method:    r.Method,
+		Resource:  r.URL.Path,
+		Status:    w.code,
+		Latency:   latency,
+		Remote:    r.RemoteAddr,
+	}
+	rec.Subject = a.subject(claims)
+	switch {
+	case claims == nil, w.code == http.StatusForbidden:
+		rec.Outcome = AuditDenied
+	case w.code >= 400:
+		rec.Outcome = AuditFailure
+	default:
+		rec.Outcome = AuditSuccess
+	}
+	a.Record(rec)
+}
+
+// recordRPC records an RPC handled by the API interceptors,
+// Unauthenticated or PermissionDenied means denied
+func (a *AuditLogger) recordRPC(ctx context.Context, method string, claims jwt.MapClaims, err error, latency time.Duration) {
+	code := status.Code(err)
+	if err != nil && code == codes.Unknown {
+		code = GRPCCode(err)
+	}
+	rec := AuditRecord{
+		Method:   "RPC",
+		Resource: method,
+		Code:     code.String(),
+		Status:   grpcToHTTP[code],
+		Latency:  latency,
+		Subject:  a.subject(claims),
+	}
+	if rec.Status == 0 {
+		rec.Status = http.StatusInternalServerError
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(RequestIDHeader); len(v) > 0 {
+			rec.RequestID = v[0]
+		}
+	}
+	switch {
+	case code == codes.Unauthenticated, code == codes.PermissionDenied:
+		rec.Outcome = AuditDenied
+	case err != nil:
+		rec.Outcome = AuditFailure
+	default:
+		rec.Outcome = AuditSuccess
+	}
+	a.Record(rec)
+}
+
+/* ****************************************
+audit sinks
+**************************************** */
+
+// WriterAuditSink writes the records as JSON lines, safe for concurrent use
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterAuditSink creates a sink writing to w
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+// NewFileAuditSink creates a sink appending to the file, the directory is created if missing
+func NewFileAuditSink(fileName string) (*WriterAuditSink, error) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterAuditSink{w: f}, nil
+}
+
+// WriteAudit writes a JSON line
+func (s *WriterAuditSink) WriteAudit(ctx context.Context, rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(b, '\n'))
+	return err
+}
+
+// Close closes the underlying writer if it's an io.Closer
+func (s *WriterAuditSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// MongoAuditSink inserts the records into a collection of the MongoOpr database
+type MongoAuditSink struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// WriteAudit inserts a document
+func (s *MongoAuditSink) WriteAudit(ctx context.Context, rec AuditRecord) error {
+	_, err := s.Opr.Mdb.Collection(s.Collection).InsertOne(ctx, rec)
+	return mongoErr(err)
+}
+
+// HTTPAuditSink posts each record as JSON to the URL
+type HTTPAuditSink struct {
+	URL    string
+	Header http.Header // e.g. Authorization
+	Client *http.Client
+}
+
+// WriteAudit posts the record, non 2xx response is an error
+func (s *HTTPAuditSink) WriteAudit(ctx context.Context, rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c := s.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return httpStatusErr(resp)
+}
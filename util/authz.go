@@ -0,0 +1,335 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+/* ****************************************
+claims based authorization
+**************************************** */
+
+// Identity is the authenticated caller, extracted once from the claims by
+// the auth middlewares
+type Identity struct {
+	Subject  string
+	Roles    []string
+	Scopes   []string
+	Audience []string
+	Expiry   time.Time // zero if the token doesn't expire
+	Method   string    // jwt, apikey or hmac
+	Claims   jwt.MapClaims
+}
+
+// NewIdentity extracts the identity from the claims
+func NewIdentity(claims jwt.MapClaims) *Identity {
+	id := &Identity{
+		Roles:    append(claimStrings(claims, "roles"), claimStrings(claims, "role")...),
+		Scopes:   append(claimStrings(claims, "scope"), claimStrings(claims, "scp")...),
+		Audience: claimStrings(claims, "aud"),
+		Method:   "jwt",
+		Claims:   claims,
+	}
+	id.Subject, _ = claims["sub"].(string)
+	if m, ok := claims["auth"].(string); ok {
+		id.Method = m
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		id.Expiry = time.Unix(int64(exp), 0)
+	}
+	return id
+}
+
+// HasRole returns true if the identity has the role
+func (id *Identity) HasRole(role string) bool {
+	return InStrings(role, id.Roles)
+}
+
+// HasScope returns true if the identity has the scope
+func (id *Identity) HasScope(scope string) bool {
+	return InStrings(scope, id.Scopes)
+}
+
+// ContextWithClaims returns a context carrying the authenticated JWT claims
+// and the Identity extracted from them
+func ContextWithClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+	id := NewIdentity(claims)
+	// report the identity to the outer LogRequests
+	if slot, ok := ctx.Value(ctxKeyIdentitySlot).(**Identity); ok {
+		*slot = id
+	}
+	ctx = context.WithValue(ctx, ctxKeyClaims, claims)
+	return context.WithValue(ctx, ctxKeyIdentity, id)
+}
+
+// contextWithIdentitySlot returns a context letting the inner auth middlewares
+// report the identity to the outer ones through ContextWithClaims
+func contextWithIdentitySlot(ctx context.Context, slot **Identity) context.Context {
+	return context.WithValue(ctx, ctxKeyIdentitySlot, slot)
+}
+
+// ClaimsFromContext returns the JWT claims set by the auth middlewares, false if none
+func ClaimsFromContext(ctx context.Context) (jwt.MapClaims, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	c, ok := ctx.Value(ctxKeyClaims).(jwt.MapClaims)
+	return c, ok && c != nil
+}
+
+// IdentityFromContext returns the caller identity set by the auth middlewares, false if none
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	id, ok := ctx.Value(ctxKeyIdentity).(*Identity)
+	return id, ok && id != nil
+}
+
+// ContextWithToken returns a context carrying the raw bearer token, e.g.
+// to forward it to downstream APIs
+func ContextWithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, ctxKeyToken, token)
+}
+
+// TokenFromContext returns the raw bearer token of the request, false if none
+func TokenFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	t, ok := ctx.Value(ctxKeyToken).(string)
+	return t, ok && t != ""
+}
+
+// noAuthRegexps caches the compiled "re:" patterns of NoAuth
+var noAuthRegexps sync.Map
+
+// NoAuthMatch reports if the route matches one of the auth exemption patterns
+// shared by HTTP and gRPC, a pattern is an optional HTTP method and a space,
+// followed by an exact path or gRPC full method, a glob (path.Match, a
+// trailing * matches any suffix) or a "re:" prefixed regexp, e.g.
+// "/healthz", "POST /login", "/public/*", "/pkg.Svc/*", "re:^/v[0-9]+/status$"
+// patterns with a method never match gRPC calls, whose method is empty
+func NoAuthMatch(patterns []string, method, route string) bool {
+	for _, p := range patterns {
+		if matchPattern(p, method, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern matches a pattern of NoAuthMatch with its optional method
+func matchPattern(p, method, route string) bool {
+	if i := strings.IndexByte(p, ' '); i > 0 {
+		if method == "" || !strings.EqualFold(p[:i], method) {
+			return false
+		}
+		p = strings.TrimSpace(p[i+1:])
+	}
+	return matchRoute(p, route)
+}
+
+// matchRoute matches a route to an exact, glob or regexp pattern
+func matchRoute(p, route string) bool {
+	switch {
+	case strings.HasPrefix(p, "re:"):
+		re, ok := noAuthRegexps.Load(p)
+		if !ok {
+			c, err := regexp.Compile(p[3:])
+			if err != nil {
+				logger.WithError(err).WithField("pattern", p).Warn("invalid NoAuth pattern")
+				return false
+			}
+			re, _ = noAuthRegexps.LoadOrStore(p, c)
+		}
+		return re.(*regexp.Regexp).MatchString(route)
+	case strings.HasSuffix(p, "*") && !strings.ContainsAny(p[:len(p)-1], "*?["):
+		return strings.HasPrefix(route, p[:len(p)-1])
+	case strings.ContainsAny(p, "*?["):
+		ok, _ := path.Match(p, route)
+		return ok
+	}
+	return p == route
+}
+
+// Requirement checks the claims of an authenticated request
+type Requirement interface {
+	Check(claims jwt.MapClaims) error
+}
+
+// RequirementFunc adapts a function to Requirement
+type RequirementFunc func(claims jwt.MapClaims) error
+
+// Check calls f(claims)
+func (f RequirementFunc) Check(claims jwt.MapClaims) error {
+	return f(claims)
+}
+
+// claimStrings reads a claim holding a string list, a JSON array or a
+// space or comma separated string
+func claimStrings(claims jwt.MapClaims, key string) []string {
+	switch v := claims[key].(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		res := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// HasRole requires any of the roles in the "roles" or "role" claim
+func HasRole(roles ...string) Requirement {
+	return RequirementFunc(func(claims jwt.MapClaims) error {
+		have := append(claimStrings(claims, "roles"), claimStrings(claims, "role")...)
+		for _, r := range roles {
+			if InStrings(r, have) {
+				return nil
+			}
+		}
+		return fmt.Errorf("role %s required", strings.Join(roles, " or "))
+	})
+}
+
+// HasScope requires all the scopes in the "scope" or "scp" claim
+func HasScope(scopes ...string) Requirement {
+	return RequirementFunc(func(claims jwt.MapClaims) error {
+		have := append(claimStrings(claims, "scope"), claimStrings(claims, "scp")...)
+		for _, s := range scopes {
+			if !InStrings(s, have) {
+				return fmt.Errorf("scope %s required", s)
+			}
+		}
+		return nil
+	})
+}
+
+// HasAudience requires the audience in the "aud" claim
+func HasAudience(aud string) Requirement {
+	return RequirementFunc(func(claims jwt.MapClaims) error {
+		if InStrings(aud, claimStrings(claims, "aud")) {
+			return nil
+		}
+		return fmt.Errorf("audience %s required", aud)
+	})
+}
+
+// ClaimEquals requires the claim to have the value, compared by text
+func ClaimEquals(key string, val interface{}) Requirement {
+	return RequirementFunc(func(claims jwt.MapClaims) error {
+		if v, ok := claims[key]; ok && fmt.Sprint(v) == fmt.Sprint(val) {
+			return nil
+		}
+		return fmt.Errorf("claim %s=%v required", key, val)
+	})
+}
+
+// checkRequirements returns the first unmet requirement
+func checkRequirements(claims jwt.MapClaims, reqs []Requirement) error {
+	for _, r := range reqs {
+		if err := r.Check(claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Policy maps routes to their requirements, enforced by the auth
+// middlewares after authentication, keys are the patterns of NoAuthMatch,
+// "METHOD /path" or "/path" for HTTP and the full method name for gRPC
+// the exact keys apply first, "METHOD /path" before "/path", then the
+// longest matching pattern, an exact key only covers its own path, the
+// nested resources of a subtree handler need a pattern, e.g.
+// "DELETE /devices/*", and "/pkg.Service/*" covers the methods of the
+// service without own key
+/*
+	api.Policy = util.Policy{
+		"DELETE /devices":                 {util.HasRole("admin")},
+		"DELETE /devices/*":               {util.HasRole("admin")},
+		"/inventory.Inventory/*":          {util.HasScope("inventory")},
+		"/inventory.Inventory/UpdateSite": {util.HasRole("admin", "ops"), util.HasScope("write")},
+	}
+*/
+type Policy map[string][]Requirement
+
+// check applies the requirements of the key of the route, method is ""
+// for gRPC
+func (p Policy) check(claims jwt.MapClaims, method, route string) error {
+	if method != "" {
+		if reqs, ok := p[method+" "+route]; ok {
+			return checkRequirements(claims, reqs)
+		}
+	}
+	if reqs, ok := p[route]; ok {
+		return checkRequirements(claims, reqs)
+	}
+	best := ""
+	for k := range p {
+		longer := len(k) > len(best) || len(k) == len(best) && k < best
+		if longer && matchPattern(k, method, route) {
+			best = k
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return checkRequirements(claims, p[best])
+}
+
+// Require wraps a handler protected by Auth with claim requirements,
+// 403 is returned if one is not met
+/*
+	svc.Handle("/admin", svc.API.Require(util.HasRole("admin"))(adminHandler))
+*/
+func (api *API) Require(reqs ...Requirement) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				api.Error(w, http.StatusUnauthorized, "missing claims, Require must be wrapped by Auth", "Unauthorized")
+				return
+			}
+			if err := checkRequirements(claims, reqs); err != nil {
+				api.Error(w, http.StatusForbidden, err, "Forbidden")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// RequireGrpcUnary returns a unary interceptor enforcing the requirements on
+// all methods, chain it after AuthGrpcUnary
+func (api *API) RequireGrpcUnary(reqs ...Requirement) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, srv *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if NoAuthMatch(api.NoAuth, "", srv.FullMethod) {
+			return handler(ctx, req)
+		}
+		claims, ok := ClaimsFromContext(ctx)
+		if !ok {
+			return nil, api.Errpc(codes.Unauthenticated, "missing claims, RequireGrpcUnary must be chained after AuthGrpcUnary", "Unauthorized")
+		}
+		if err := checkRequirements(claims, reqs); err != nil {
+			return nil, api.Errpc(codes.PermissionDenied, err, "Forbidden")
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,225 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/* ****************************************
+request binding and validation
+**************************************** */
+
+// DefaultMaxBody is the body size limit of Bind if API.MaxBody is zero
+const DefaultMaxBody int64 = 1 << 20
+
+// errors of Bind, responded as 415 and 413 by API.Error
+var (
+	ErrUnsupportedMedia = NewErr("UNSUPPORTED_MEDIA", CatInput, "unsupported media type")
+	ErrBodyTooLarge     = NewErr("BODY_TOO_LARGE", CatInput, "request body too large")
+)
+
+// Validator is implemented by request types with custom validation, run by
+// Bind after the tag validation
+type Validator interface {
+	Validate() error
+}
+
+// FieldError is the validation failure of a field
+type FieldError struct {
+	Field string `json:"field"`
+	Msg   string `json:"msg"`
+}
+
+// ValidationErrors are the field errors of a request, API.Error responds
+// them under "fields"
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	s := make([]string, len(v))
+	for i, e := range v {
+		s[i] = e.Field + ": " + e.Msg
+	}
+	return "validation failed: " + strings.Join(s, "; ")
+}
+
+// Bind decodes the JSON body of the request into out and validates it
+// the Content-Type must be JSON, a missing one is rejected too, the body is limited to API.MaxBody, unknown
+// fields are rejected if API.StrictJSON, the returned errors match
+// ErrBadInput and are meant for api.Error(w, 0, err)
+/*
+	var req struct {
+		Name string `json:"name" validate:"required,max=64"`
+		Port int    `json:"port" validate:"min=1,max=65535"`
+		Mode string `json:"mode" validate:"oneof=access trunk"`
+	}
+	if err := api.Bind(r, &req); err != nil {
+		api.Error(w, 0, err)
+		return
+	}
+*/
+func (api *API) Bind(r *http.Request, out interface{}) error {
+	ct := r.Header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil || (mt != "application/json" && !strings.HasSuffix(mt, "+json")) {
+		return ErrUnsupportedMedia.Wrap(fmt.Errorf("content type %q, expect application/json", ct))
+	}
+	max := api.MaxBody
+	if max <= 0 {
+		max = DefaultMaxBody
+	}
+	if r.Body == nil {
+		return ErrBadInput.Wrap(fmt.Errorf("empty body"))
+	}
+	body := &countingReader{r: io.LimitReader(r.Body, max+1)}
+	d := json.NewDecoder(body)
+	if api.StrictJSON {
+		d.DisallowUnknownFields()
+	}
+	err = d.Decode(out)
+	if body.n > max {
+		return ErrBodyTooLarge.Wrap(fmt.Errorf("body exceeds %d bytes", max))
+	}
+	if err != nil {
+		if err == io.EOF {
+			return ErrBadInput.Wrap(fmt.Errorf("empty body"))
+		}
+		return ErrBadInput.Wrap(fmt.Errorf("decode body: %w", err))
+	}
+	if d.More() {
+		return ErrBadInput.Wrap(fmt.Errorf("trailing data after JSON body"))
+	}
+	return ValidateStruct(out)
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ValidateStruct checks the validate tags of the struct fields, nested
+// structs included, then runs Validate if implemented
+// tags: required, min=n, max=n (value of numbers, length of strings,
+// slices and maps), oneof=a b c
+func ValidateStruct(v interface{}) error {
+	var errs ValidationErrors
+	validateValue(reflect.ValueOf(v), "", &errs)
+	if len(errs) > 0 {
+		return ErrBadInput.Wrap(errs)
+	}
+	if vd, ok := v.(Validator); ok {
+		if err := vd.Validate(); err != nil {
+			var ve ValidationErrors
+			if errors.As(err, &ve) || errors.Is(err, ErrBadInput) {
+				return err
+			}
+			return ErrBadInput.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// validateValue walks the struct fields collecting the failures
+func validateValue(v reflect.Value, prefix string, errs *ValidationErrors) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		name = prefix + name
+		fv := v.Field(i)
+		if tag := sf.Tag.Get("validate"); tag != "" {
+			for _, rule := range strings.Split(tag, ",") {
+				if msg := checkRule(fv, rule); msg != "" {
+					*errs = append(*errs, FieldError{Field: name, Msg: msg})
+					break
+				}
+			}
+		}
+		validateValue(fv, name+".", errs)
+	}
+}
+
+// checkRule returns the failure message of the rule, empty if passed
+func checkRule(v reflect.Value, rule string) string {
+	kv := strings.SplitN(rule, "=", 2)
+	arg := ""
+	if len(kv) == 2 {
+		arg = kv[1]
+	}
+	if kv[0] == "required" {
+		if v.IsZero() {
+			return "required"
+		}
+		return ""
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	// size is the value of numbers, the length of the others
+	var size float64
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = v.Float()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		size = float64(v.Len())
+	}
+	switch kv[0] {
+	case "min", "max":
+		n, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return fmt.Sprintf("invalid rule %q", rule)
+		}
+		if kv[0] == "min" && size < n {
+			return fmt.Sprintf("must be at least %s", arg)
+		}
+		if kv[0] == "max" && size > n {
+			return fmt.Sprintf("must be at most %s", arg)
+		}
+	case "oneof":
+		s := fmt.Sprint(v.Interface())
+		if !InStrings(s, strings.Fields(arg)) {
+			return fmt.Sprintf("must be one of %s", strings.Join(strings.Fields(arg), ", "))
+		}
+	default:
+		return fmt.Sprintf("unknown rule %q", rule)
+	}
+	return ""
+}
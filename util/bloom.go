@@ -0,0 +1,226 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"sync"
+)
+
+/* ****************************************
+Bloom filter - approximate membership
+**************************************** */
+
+// BloomFilter answers "have we seen it" with no false negative
+// and a bounded false positive rate, safe for concurrent use
+type BloomFilter struct {
+	mu   sync.RWMutex
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+	n    uint64 // number of added elements
+	bits []uint64
+}
+
+// bloomMagic marks the serialized form of BloomFilter
+const bloomMagic = "BLM1"
+
+// bounds of the size read by ReadFrom, 512MiB of bits
+const (
+	maxBloomBits   = 1 << 32
+	maxBloomHashes = 256
+)
+
+// NewBloomFilter creates a BloomFilter sized for n elements at the false positive rate fp
+func NewBloomFilter(n uint, fp float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if fp <= 0 || fp >= 1 {
+		fp = 0.01
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return newBloom(uint64(m), uint64(k))
+}
+
+func newBloom(m, k uint64) *BloomFilter {
+	return &BloomFilter{m: m, k: k, bits: make([]uint64, (m+63)/64)}
+}
+
+// bloomHash is the double hash of data, see locations
+type bloomHash struct {
+	h1, h2 uint64
+}
+
+func newBloomHash(data []byte) bloomHash {
+	h := fnv.New64a()
+	h.Write(data)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	h2 ^= 0x9e3779b97f4a7c15
+	h2 = h2*0xbf58476d1ce4e5b9 | 1
+	return bloomHash{h1, h2}
+}
+
+// locations returns the k bit positions of the hash, must hold the lock
+// as ReadFrom replaces the size
+func (bf *BloomFilter) locations(h bloomHash) []uint64 {
+	loc := make([]uint64, bf.k)
+	for i := uint64(0); i < bf.k; i++ {
+		loc[i] = (h.h1 + i*h.h2) % bf.m
+	}
+	return loc
+}
+
+// Add inserts data to the filter
+func (bf *BloomFilter) Add(data []byte) {
+	h := newBloomHash(data)
+	bf.mu.Lock()
+	for _, l := range bf.locations(h) {
+		bf.bits[l/64] |= 1 << (l % 64)
+	}
+	bf.n++
+	bf.mu.Unlock()
+}
+
+// AddString inserts a string to the filter
+func (bf *BloomFilter) AddString(s string) {
+	bf.Add([]byte(s))
+}
+
+// Test returns true if data may have been added, false if definitely not
+func (bf *BloomFilter) Test(data []byte) bool {
+	h := newBloomHash(data)
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	for _, l := range bf.locations(h) {
+		if bf.bits[l/64]&(1<<(l%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// TestString returns true if a string may have been added
+func (bf *BloomFilter) TestString(s string) bool {
+	return bf.Test([]byte(s))
+}
+
+// TestAndAdd returns the Test result before adding data
+func (bf *BloomFilter) TestAndAdd(data []byte) bool {
+	h := newBloomHash(data)
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	present := true
+	for _, l := range bf.locations(h) {
+		if bf.bits[l/64]&(1<<(l%64)) == 0 {
+			present = false
+			bf.bits[l/64] |= 1 << (l % 64)
+		}
+	}
+	bf.n++
+	return present
+}
+
+// Count returns the number of added elements
+func (bf *BloomFilter) Count() uint64 {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return bf.n
+}
+
+// FalsePositiveRate estimates the current false positive rate
+func (bf *BloomFilter) FalsePositiveRate() float64 {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	return math.Pow(1-math.Exp(-float64(bf.k*bf.n)/float64(bf.m)), float64(bf.k))
+}
+
+// Reset clears the filter
+func (bf *BloomFilter) Reset() {
+	bf.mu.Lock()
+	for i := range bf.bits {
+		bf.bits[i] = 0
+	}
+	bf.n = 0
+	bf.mu.Unlock()
+}
+
+// Merge ORs another filter of the same size into this one, merging the
+// filter into itself does nothing
+func (bf *BloomFilter) Merge(o *BloomFilter) error {
+	if o == bf {
+		return nil
+	}
+	// snapshot o so the two locks are never held together
+	o.mu.RLock()
+	m, k, n := o.m, o.k, o.n
+	bits := append([]uint64(nil), o.bits...)
+	o.mu.RUnlock()
+	bf.mu.Lock()
+	defer bf.mu.Unlock()
+	if bf.m != m || bf.k != k {
+		return errors.New("bloom filters of different size")
+	}
+	for i := range bf.bits {
+		bf.bits[i] |= bits[i]
+	}
+	bf.n += n
+	return nil
+}
+
+// WriteTo serializes the filter, format: magic|m|k|n|bits in big endian
+func (bf *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	bf.mu.RLock()
+	defer bf.mu.RUnlock()
+	var buf bytes.Buffer
+	buf.WriteString(bloomMagic)
+	for _, v := range []uint64{bf.m, bf.k, bf.n} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	binary.Write(&buf, binary.BigEndian, bf.bits)
+	return buf.WriteTo(w)
+}
+
+// ReadFrom restores the filter serialized by WriteTo
+func (bf *BloomFilter) ReadFrom(r io.Reader) (int64, error) {
+	head := make([]byte, len(bloomMagic)+24)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, err
+	}
+	if string(head[:len(bloomMagic)]) != bloomMagic {
+		return 0, errors.New("malformed bloom filter")
+	}
+	m := binary.BigEndian.Uint64(head[4:12])
+	k := binary.BigEndian.Uint64(head[12:20])
+	n := binary.BigEndian.Uint64(head[20:28])
+	if m == 0 || k == 0 || m > maxBloomBits || k > maxBloomHashes {
+		return 0, errors.New("malformed bloom filter")
+	}
+	bits := make([]uint64, (m+63)/64)
+	if err := binary.Read(r, binary.BigEndian, bits); err != nil {
+		return 0, err
+	}
+	bf.mu.Lock()
+	bf.m, bf.k, bf.n, bf.bits = m, k, n, bits
+	bf.mu.Unlock()
+	return int64(len(head) + 8*len(bits)), nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (bf *BloomFilter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := bf.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (bf *BloomFilter) UnmarshalBinary(data []byte) error {
+	_, err := bf.ReadFrom(bytes.NewReader(data))
+	return err
+}
@@ -0,0 +1,273 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+response caching
+**************************************** */
+
+// CacheHeader reports HIT or MISS of the cached routes
+const CacheHeader = "X-Cache"
+
+// DefaultCacheMaxBody is the largest response body cached by default
+const DefaultCacheMaxBody = 1 << 20
+
+// CachedResponse is a stored response of a cached route
+type CachedResponse struct {
+	Key     string      `bson:"_id" json:"key"`
+	Path    string      `bson:"path" json:"path"`
+	Status  int         `bson:"status" json:"status"`
+	Header  http.Header `bson:"header" json:"header"`
+	Body    []byte      `bson:"body" json:"body"`
+	Expires time.Time   `bson:"expires" json:"expires"`
+}
+
+// CacheStore keeps the cached responses, GetCache returns nil response and
+// nil error if not found or expired, InvalidateCache removes the responses
+// of the paths starting with the prefix, all of them for an empty prefix
+// other backends, e.g. DynaStore or Redis, plug in by implementing it
+type CacheStore interface {
+	GetCache(ctx context.Context, key string) (*CachedResponse, error)
+	SetCache(ctx context.Context, c *CachedResponse) error
+	InvalidateCache(ctx context.Context, pathPrefix string) error
+}
+
+// MemoryCache is an in-process CacheStore, expired responses are pruned on
+// write, suitable for single instance services and tests
+type MemoryCache struct {
+	mu    sync.Mutex
+	items map[string]CachedResponse
+}
+
+// NewMemoryCache creates an empty MemoryCache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]CachedResponse)}
+}
+
+// GetCache returns the response if not expired
+func (m *MemoryCache) GetCache(ctx context.Context, key string) (*CachedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.items[key]
+	if !ok || time.Now().After(c.Expires) {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// SetCache stores the response
+func (m *MemoryCache) SetCache(ctx context.Context, c *CachedResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, v := range m.items {
+		if now.After(v.Expires) {
+			delete(m.items, k)
+		}
+	}
+	m.items[c.Key] = *c
+	return nil
+}
+
+// InvalidateCache removes the responses of the path prefix
+func (m *MemoryCache) InvalidateCache(ctx context.Context, pathPrefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, v := range m.items {
+		if strings.HasPrefix(v.Path, pathPrefix) {
+			delete(m.items, k)
+		}
+	}
+	return nil
+}
+
+// MongoCache is a CacheStore in a collection of the MongoOpr database,
+// shared by all instances of a service, see EnsureIndex
+type MongoCache struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// EnsureIndex creates the TTL index purging the expired responses
+func (m *MongoCache) EnsureIndex(ctx context.Context) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return mongoErr(err)
+}
+
+// GetCache returns the response if not expired
+// the TTL monitor runs once a minute, so the expiry is checked as well
+func (m *MongoCache) GetCache(ctx context.Context, key string) (*CachedResponse, error) {
+	var c CachedResponse
+	err := m.Opr.Mdb.Collection(m.Collection).FindOne(ctx,
+		bson.M{"_id": key, "expires": bson.M{"$gt": time.Now()}}).Decode(&c)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return &c, nil
+}
+
+// SetCache upserts the response
+func (m *MongoCache) SetCache(ctx context.Context, c *CachedResponse) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).ReplaceOne(ctx, bson.M{"_id": c.Key}, c, options.Replace().SetUpsert(true))
+	return mongoErr(err)
+}
+
+// InvalidateCache removes the responses of the path prefix
+func (m *MongoCache) InvalidateCache(ctx context.Context, pathPrefix string) error {
+	f := bson.M{}
+	if pathPrefix != "" {
+		f["path"] = bson.M{"$regex": "^" + regexp.QuoteMeta(pathPrefix)}
+	}
+	_, err := m.Opr.Mdb.Collection(m.Collection).DeleteMany(ctx, f)
+	return mongoErr(err)
+}
+
+// ResponseCache caches the 200 responses of idempotent GET routes, keyed by
+// path, query, Accept and the caller identity, so users never see the
+// responses of each other nor of another negotiated content type, the
+// middleware must run inside the auth middlewares
+// a request with "Cache-Control: no-cache" bypasses the cached response,
+// a response with Set-Cookie or "Cache-Control: no-store" isn't cached
+/*
+	rc := util.NewResponseCache(util.NewMemoryCache(), 30*time.Second)
+	svc.Handle("/topology", rc.Middleware(0)(topology))
+	// once the devices change
+	rc.Invalidate(ctx, "/topology")
+*/
+type ResponseCache struct {
+	Store CacheStore
+	// TTL is the default validity of the cached responses
+	TTL time.Duration
+	// MaxBody is the largest body cached, zero means DefaultCacheMaxBody
+	MaxBody int
+}
+
+// NewResponseCache creates a ResponseCache with the store and default TTL
+func NewResponseCache(store CacheStore, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{Store: store, TTL: ttl}
+}
+
+// cacheKey hashes the path, sorted query, Accept and subject of the request
+func cacheKey(r *http.Request) string {
+	sub := ""
+	if id, ok := IdentityFromContext(r.Context()); ok {
+		sub = id.Subject
+	}
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	h := sha256.Sum256([]byte(r.URL.Path + "\x00" + r.URL.Query().Encode() + "\x00" + accept + "\x00" + sub))
+	return hex.EncodeToString(h[:])
+}
+
+// Middleware caches the route for ttl, zero means the default TTL
+// store failures are logged and the handler is served uncached
+func (c *ResponseCache) Middleware(ttl time.Duration) Middleware {
+	if ttl <= 0 {
+		ttl = c.TTL
+	}
+	max := c.MaxBody
+	if max <= 0 {
+		max = DefaultCacheMaxBody
+	}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next(w, r)
+				return
+			}
+			key := cacheKey(r)
+			// the body depends on the negotiated content type, see Respond
+			w.Header().Add("Vary", "Accept")
+			lg := LoggerFromContext(r.Context()).WithField("path", r.URL.Path)
+			if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+				hit, err := c.Store.GetCache(r.Context(), key)
+				if err != nil {
+					lg.WithError(err).Warn("response cache read failed")
+				}
+				if hit != nil {
+					for k, v := range hit.Header {
+						w.Header()[k] = append([]string(nil), v...)
+					}
+					w.Header().Set(CacheHeader, "HIT")
+					w.WriteHeader(hit.Status)
+					if r.Method == http.MethodGet {
+						w.Write(hit.Body)
+					}
+					return
+				}
+			}
+			w.Header().Set(CacheHeader, "MISS")
+			cw := &cacheWriter{ResponseWriter: w, code: http.StatusOK, max: max}
+			next(cw, r)
+			if cw.code != http.StatusOK || cw.overflow || r.Method != http.MethodGet ||
+				w.Header().Get("Set-Cookie") != "" || strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+				return
+			}
+			hdr := w.Header().Clone()
+			hdr.Del(RequestIDHeader)
+			hdr.Del(CacheHeader)
+			err := c.Store.SetCache(r.Context(), &CachedResponse{
+				Key:     key,
+				Path:    r.URL.Path,
+				Status:  cw.code,
+				Header:  hdr,
+				Body:    cw.buf.Bytes(),
+				Expires: time.Now().Add(ttl),
+			})
+			if err != nil {
+				lg.WithError(err).Warn("response cache write failed")
+			}
+		}
+	}
+}
+
+// Invalidate removes the cached responses of the paths starting with the
+// prefix, all of them for an empty prefix
+func (c *ResponseCache) Invalidate(ctx context.Context, pathPrefix string) error {
+	return c.Store.InvalidateCache(ctx, pathPrefix)
+}
+
+// cacheWriter copies the response body up to max bytes
+type cacheWriter struct {
+	http.ResponseWriter
+	code     int
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(b) > w.max {
+			w.overflow = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polarbroadband/goto/tbp"
+)
+
+/* ****************************************
+cli capture bundle
+**************************************** */
+
+// Capture is the raw output of a cli command collected from a device
+type Capture struct {
+	Device    string        `json:"device" bson:"device"`
+	Command   string        `json:"command" bson:"command"`
+	Timestamp time.Time     `json:"timestamp" bson:"timestamp"`
+	Duration  time.Duration `json:"duration" bson:"duration"`
+	Output    string        `json:"output" bson:"output"`
+}
+
+// Block returns the output as tbp.Block for parsing
+func (c *Capture) Block() tbp.Block {
+	return tbp.Block(strings.Split(strings.Replace(c.Output, "\r\n", "\n", -1), "\n"))
+}
+
+// captureMagic starts every capture of a bundle
+const captureMagic = "#CAPTURE v1"
+
+// MaxCaptureSize bounds the output length of a capture read from a bundle
+var MaxCaptureSize = 64 << 20
+
+// WriteCapture writes a capture in the bundle format
+/*
+#CAPTURE v1
+device: r1.lab
+command: show mpls lsp
+timestamp: 2021-02-01T10:00:00Z
+duration: 1.2s
+length: 1234
+<blank line>
+<raw output of length bytes>
+<blank line>
+*/
+// the body is length framed, the raw output is kept byte for byte
+func WriteCapture(w io.Writer, c *Capture) error {
+	_, err := fmt.Fprintf(w, "%s\ndevice: %s\ncommand: %s\ntimestamp: %s\nduration: %s\nlength: %d\n\n%s\n",
+		captureMagic,
+		captureHeaderValue(c.Device),
+		captureHeaderValue(c.Command),
+		c.Timestamp.UTC().Format(time.RFC3339Nano),
+		c.Duration,
+		len(c.Output),
+		c.Output)
+	return err
+}
+
+// captureHeaderValue keeps a header value on one line
+func captureHeaderValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// CaptureReader reads the captures of a bundle one by one
+type CaptureReader struct {
+	r *bufio.Reader
+	n int // sequence of the capture being read, for error report
+}
+
+// NewCaptureReader creates a CaptureReader
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next reads the next capture, returns io.EOF at the end of the bundle
+func (cr *CaptureReader) Next() (*Capture, error) {
+	cr.n++
+	ln, err := cr.r.ReadString('\n')
+	// tolerate blank lines between captures
+	for err == nil && strings.TrimSpace(ln) == "" {
+		ln, err = cr.r.ReadString('\n')
+	}
+	if err == io.EOF && strings.TrimSpace(ln) == "" {
+		return nil, io.EOF
+	}
+	if strings.TrimSpace(ln) != captureMagic {
+		return nil, fmt.Errorf("capture %d: missing %q header", cr.n, captureMagic)
+	}
+	c := &Capture{}
+	length := -1
+	for {
+		ln, err = cr.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("capture %d: truncated header: %w", cr.n, err)
+		}
+		ln = strings.TrimRight(ln, "\r\n")
+		if ln == "" {
+			break
+		}
+		kv := strings.SplitN(ln, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("capture %d: malformed header %q", cr.n, ln)
+		}
+		v := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "device":
+			c.Device = v
+		case "command":
+			c.Command = v
+		case "timestamp":
+			if c.Timestamp, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return nil, fmt.Errorf("capture %d: %w", cr.n, err)
+			}
+		case "duration":
+			if c.Duration, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("capture %d: %w", cr.n, err)
+			}
+		case "length":
+			if length, err = strconv.Atoi(v); err != nil || length < 0 {
+				return nil, fmt.Errorf("capture %d: invalid length %q", cr.n, v)
+			}
+		}
+		// unknown headers are ignored for forward compatibility
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("capture %d: missing length header", cr.n)
+	}
+	if length > MaxCaptureSize {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("capture %d: length %d exceeds %d", cr.n, length, MaxCaptureSize))
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, body); err != nil {
+		return nil, fmt.Errorf("capture %d: truncated output: %w", cr.n, err)
+	}
+	c.Output = string(body)
+	return c, nil
+}
+
+// ReadCaptures reads all captures of a bundle
+func ReadCaptures(r io.Reader) ([]*Capture, error) {
+	cr := NewCaptureReader(r)
+	res := []*Capture{}
+	for {
+		c, err := cr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, c)
+	}
+}
+
+// WriteCaptureFile writes the captures to a bundle file
+func WriteCaptureFile(fileName string, cs ...*Capture) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, c := range cs {
+		if err := WriteCapture(w, c); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadCaptureFile reads the captures of a bundle file
+func ReadCaptureFile(fileName string) ([]*Capture, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ReadCaptures(strings.NewReader(string(data)))
+}
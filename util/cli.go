@@ -7,7 +7,6 @@ import (
 	"strings"
 	"syscall"
 
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -21,7 +20,7 @@ func GetInput(prompt string) string {
 	fmt.Print(prompt + ": ")
 	s, err := reader.ReadString('\n')
 	if err != nil {
-		log.WithError(err).Warnf("erroneous input of %s", prompt)
+		logger.WithError(err).Warnf("erroneous input of %s", prompt)
 		return ""
 	}
 	return strings.TrimSpace(s)
@@ -38,7 +37,7 @@ func GetCred() (string, string) {
 	fmt.Print("Password: ")
 	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
 	if err != nil {
-		log.WithError(err).Warn("erroneous input of password")
+		logger.WithError(err).Warn("erroneous input of password")
 		return "", ""
 	}
 	fmt.Println()
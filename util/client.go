@@ -0,0 +1,446 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/* ****************************************
+HTTP client
+**************************************** */
+
+// maxErrBody limits the response body kept by HTTPError
+const maxErrBody = 1 << 16
+
+// errUnavailable is the sentinel of the 429 and 5xx responses, retryable by IsRetryable
+var errUnavailable = NewErr("UNAVAILABLE", CatUnavailable, "unavailable")
+
+// HTTPError is a non 2xx response, errors.Is matches the sentinel error of
+// the status, e.g. errors.Is(err, ErrNotFound) for 404
+type HTTPError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Message    string // "error" of the JSON body if any
+	RequestID  string
+	Body       []byte // up to 64KiB
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Status
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s: %s", e.Status, e.Message)
+	}
+	if e.Method != "" {
+		return fmt.Sprintf("%s %s %s", e.Method, e.URL, msg)
+	}
+	return fmt.Sprintf("%s %s", e.URL, msg)
+}
+
+// Unwrap returns the sentinel error of the status
+func (e *HTTPError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return ErrBadInput
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrTimeout
+	case http.StatusTooManyRequests:
+		return errUnavailable
+	}
+	if e.StatusCode >= 500 {
+		return errUnavailable
+	}
+	return ErrBadInput
+}
+
+// httpStatusErr converts a non 2xx response to *HTTPError carrying the
+// error message of the response body if any
+func httpStatusErr(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	e := &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status, RequestID: resp.Header.Get(RequestIDHeader)}
+	if resp.Request != nil {
+		e.URL = resp.Request.URL.String()
+	}
+	e.Body, _ = ioutil.ReadAll(io.LimitReader(resp.Body, maxErrBody))
+	body := map[string]interface{}{}
+	if json.Unmarshal(e.Body, &body) == nil {
+		if m, ok := body["error"]; ok {
+			e.Message = fmt.Sprint(m)
+		}
+	}
+	return e
+}
+
+// Client calls JSON APIs, the request ID and the trace of the context are
+// propagated, non 2xx responses are returned as *HTTPError
+/*
+	c := util.NewClient("https://inventory:8443/api",
+		util.ClientTimeout(10*time.Second),
+		util.ClientRetry(util.DefaultRetryPolicy),
+		util.ClientToken(ts.Token))
+	var dev Device
+	err := c.Get(ctx, "/devices/r1", &dev)
+	err = c.Post(ctx, "/devices", newDev, &dev, util.WithHeader("X-Dry-Run", "1"))
+*/
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	// Header is sent with every request
+	Header http.Header
+	// Timeout bounds each attempt, zero means no limit
+	Timeout time.Duration
+	// Retry retries the idempotent requests failing with retryable errors, optional
+	Retry *RetryPolicy
+	// Token returns the bearer token of the requests, e.g. TokenSource.Token, optional
+	Token func(context.Context) (string, error)
+}
+
+// ClientOption configures NewClient
+type ClientOption func(*Client)
+
+// ClientTimeout bounds each attempt
+func ClientTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.Timeout = d
+	}
+}
+
+// ClientRetry retries the idempotent requests with the policy
+func ClientRetry(p RetryPolicy) ClientOption {
+	return func(c *Client) {
+		c.Retry = &p
+	}
+}
+
+// ClientTLS sets the TLS config of the transport, see NewClientTLSConfig
+func ClientTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = cfg
+		c.HTTP.Transport = tr
+	}
+}
+
+// ClientTransport sets the transport, e.g. SigningTransport
+func ClientTransport(rt http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.HTTP.Transport = rt
+	}
+}
+
+// ClientHeader adds a header sent with every request
+func ClientHeader(key, value string) ClientOption {
+	return func(c *Client) {
+		c.Header.Add(key, value)
+	}
+}
+
+// ClientToken sets the bearer token source
+func ClientToken(f func(context.Context) (string, error)) ClientOption {
+	return func(c *Client) {
+		c.Token = f
+	}
+}
+
+// NewClient creates a Client of the base URL
+func NewClient(baseURL string, opts ...ClientOption) *Client {
+	c := &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{},
+		Header:  http.Header{},
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// requestConfig is built by the RequestOption of a call
+type requestConfig struct {
+	header     http.Header
+	query      url.Values
+	timeout    time.Duration
+	idempotent bool
+}
+
+// RequestOption configures a single call of Client
+type RequestOption func(*requestConfig)
+
+// WithHeader adds a header to the request
+func WithHeader(key, value string) RequestOption {
+	return func(c *requestConfig) {
+		c.header.Add(key, value)
+	}
+}
+
+// WithQuery adds query parameters to the request
+func WithQuery(q url.Values) RequestOption {
+	return func(c *requestConfig) {
+		for k, vs := range q {
+			for _, v := range vs {
+				c.query.Add(k, v)
+			}
+		}
+	}
+}
+
+// WithTimeout overrides the timeout of the client for the call
+func WithTimeout(d time.Duration) RequestOption {
+	return func(c *requestConfig) {
+		c.timeout = d
+	}
+}
+
+// Idempotent lets a POST or PATCH be retried
+func Idempotent() RequestOption {
+	return func(c *requestConfig) {
+		c.idempotent = true
+	}
+}
+
+// Get calls GET path, the response is decoded into out
+func (c *Client) Get(ctx context.Context, path string, out interface{}, opts ...RequestOption) error {
+	return c.Do(ctx, http.MethodGet, path, nil, out, opts...)
+}
+
+// Post calls POST path with the body in
+func (c *Client) Post(ctx context.Context, path string, in, out interface{}, opts ...RequestOption) error {
+	return c.Do(ctx, http.MethodPost, path, in, out, opts...)
+}
+
+// Put calls PUT path with the body in
+func (c *Client) Put(ctx context.Context, path string, in, out interface{}, opts ...RequestOption) error {
+	return c.Do(ctx, http.MethodPut, path, in, out, opts...)
+}
+
+// Patch calls PATCH path with the body in
+func (c *Client) Patch(ctx context.Context, path string, in, out interface{}, opts ...RequestOption) error {
+	return c.Do(ctx, http.MethodPatch, path, in, out, opts...)
+}
+
+// Delete calls DELETE path, out may be nil
+func (c *Client) Delete(ctx context.Context, path string, out interface{}, opts ...RequestOption) error {
+	return c.Do(ctx, http.MethodDelete, path, nil, out, opts...)
+}
+
+// marshalBody returns the body bytes and content type of in, nil in has no body
+// []byte and string are sent as is, io.Reader is read, others encoded as JSON
+func marshalBody(in interface{}) ([]byte, string, error) {
+	switch v := in.(type) {
+	case nil:
+		return nil, "", nil
+	case []byte:
+		return v, "application/octet-stream", nil
+	case string:
+		return []byte(v), "text/plain; charset=UTF-8", nil
+	case io.Reader:
+		b, err := ioutil.ReadAll(v)
+		return b, "application/octet-stream", err
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, "", ErrBadInput.Wrap(err)
+	}
+	return b, ContentJSON, nil
+}
+
+// decodeBody reads the response into out, nil out discards it, *[]byte and
+// io.Writer receive the raw body, others are decoded from JSON
+func decodeBody(resp *http.Response, out interface{}) error {
+	switch v := out.(type) {
+	case nil:
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		return err
+	case *[]byte:
+		b, err := ioutil.ReadAll(resp.Body)
+		*v = b
+		return err
+	case io.Writer:
+		_, err := io.Copy(v, resp.Body)
+		return err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+		return fmt.Errorf("decode response of %s: %w", resp.Request.URL, err)
+	}
+	return nil
+}
+
+// Do calls the method on the path relative to BaseURL, or an absolute URL,
+// which must have the scheme and host of BaseURL if set, so the Header and
+// Token of the client aren't sent elsewhere,
+// with the body in, see marshalBody, and decodes the response into out,
+// see decodeBody, GET, HEAD, PUT, DELETE and OPTIONS are retried by the
+// Retry policy of the client, POST and PATCH only if Idempotent
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}, opts ...RequestOption) error {
+	rc := &requestConfig{header: http.Header{}, query: url.Values{}, timeout: c.Timeout}
+	for _, o := range opts {
+		o(rc)
+	}
+	target := path
+	if !strings.Contains(path, "://") {
+		target = c.BaseURL + "/" + strings.TrimLeft(path, "/")
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return ErrBadInput.Wrap(err)
+	}
+	if c.BaseURL != "" && target == path {
+		base, err := url.Parse(c.BaseURL)
+		if err != nil {
+			return ErrBadInput.Wrap(err)
+		}
+		if !strings.EqualFold(u.Scheme, base.Scheme) || !strings.EqualFold(u.Host, base.Host) {
+			return ErrBadInput.Wrap(fmt.Errorf("url %s outside the base url %s", u.Redacted(), base.Redacted()))
+		}
+	}
+	if len(rc.query) > 0 {
+		q := u.Query()
+		for k, vs := range rc.query {
+			q[k] = append(q[k], vs...)
+		}
+		u.RawQuery = q.Encode()
+	}
+	body, ctype, err := marshalBody(in)
+	if err != nil {
+		return err
+	}
+	call := func() error {
+		return c.do(ctx, method, u.String(), body, ctype, out, rc)
+	}
+	switch method {
+	case http.MethodPost, http.MethodPatch:
+		if !rc.idempotent {
+			return call()
+		}
+	}
+	if c.Retry == nil {
+		return call()
+	}
+	return Retry(ctx, *c.Retry, call)
+}
+
+// do sends a single attempt of Do
+func (c *Client) do(ctx context.Context, method, target string, body []byte, ctype string, out interface{}, rc *requestConfig) (err error) {
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+	ctx, span := StartChild(ctx, method+" "+target, "client")
+	if span != nil {
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+	}
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := c.newRequest(ctx, method, target, rd, rc.header)
+	if err != nil {
+		return err
+	}
+	if ctype != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+			return ErrTimeout.Wrap(err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if err := httpStatusErr(resp); err != nil {
+		err.(*HTTPError).Method = method
+		return err
+	}
+	return decodeBody(resp, out)
+}
+
+// newRequest builds the request with the client headers, the extra header,
+// the bearer token, the request ID and the trace of the context
+func (c *Client) newRequest(ctx context.Context, method, target string, body io.Reader, extra http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, Permanent(ErrBadInput.Wrap(err))
+	}
+	for k, vs := range c.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	for k, vs := range extra {
+		req.Header[k] = append(req.Header[k], vs...)
+	}
+	if c.Token != nil {
+		tok, err := c.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("client token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+	if id := RequestIDFromContext(ctx); id != "" && req.Header.Get(RequestIDHeader) == "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	InjectHTTP(ctx, req.Header)
+	return req, nil
+}
+
+// forwardClient forwards the Authorization header of the original request,
+// used by the Api helpers
+func forwardClient(r *http.Request) *Client {
+	c := NewClient("")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		c.Header.Set("Authorization", auth)
+	}
+	if RequestIDFromContext(r.Context()) == "" && validRequestID(r.Header.Get(RequestIDHeader)) {
+		c.Header.Set(RequestIDHeader, r.Header.Get(RequestIDHeader))
+	}
+	return c
+}
+
+// ApiPost pass JWT from original request to target api, posting the body,
+// result will be saved to the given address if not nil, see ApiGet
+func ApiPost(r *http.Request, url string, body, rb interface{}) error {
+	return forwardClient(r).Post(r.Context(), url, body, rb)
+}
+
+// ApiPut pass JWT from original request to target api, see ApiPost
+func ApiPut(r *http.Request, url string, body, rb interface{}) error {
+	return forwardClient(r).Put(r.Context(), url, body, rb)
+}
+
+// ApiPatch pass JWT from original request to target api, see ApiPost
+func ApiPatch(r *http.Request, url string, body, rb interface{}) error {
+	return forwardClient(r).Patch(r.Context(), url, body, rb)
+}
+
+// ApiDelete pass JWT from original request to target api, see ApiPost
+func ApiDelete(r *http.Request, url string, rb interface{}) error {
+	return forwardClient(r).Delete(r.Context(), url, rb)
+}
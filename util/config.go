@@ -0,0 +1,343 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* ****************************************
+layered config loading
+**************************************** */
+
+// config sources, in the order of precedence
+const (
+	SrcDefault = "default"
+	SrcFile    = "file"
+	SrcEnv     = "env"
+	SrcFlag    = "flag"
+)
+
+// ConfigLoader populates a config struct from, in increasing precedence,
+// the default tags, a YAML/JSON/env file, environment variables and flags
+/*
+type Config struct {
+	Port    int           `default:"8080" flag:"port"`
+	Timeout time.Duration `default:"30s" yaml:"timeout" env:"SVC_TIMEOUT"`
+	Mongo   struct {
+		URI string `yaml:"uri"` // env MYSVC_MONGO_URI, flag mongo.uri
+	}
+}
+*/
+// field names are matched by the yaml/json tag or case insensitively in the file,
+// env var name defaults to EnvPrefix + upper snake case path, e.g. MONGO_URI
+// flag name defaults to lower case dotted path, e.g. mongo.uri
+// env files use the env var names as the keys
+type ConfigLoader struct {
+	File      string        // .yaml, .yml, .json or dotenv file, optional
+	EnvPrefix string        // prefix of the default env var names
+	Flags     *flag.FlagSet // only the flags explicitly set are applied, optional
+
+	// Sources maps the dotted field path to the source which supplied it
+	Sources map[string]string
+}
+
+// NewConfigLoader creates a ConfigLoader
+func NewConfigLoader(file, envPrefix string, flags *flag.FlagSet) *ConfigLoader {
+	return &ConfigLoader{File: file, EnvPrefix: envPrefix, Flags: flags}
+}
+
+// cfgField is a leaf field of the config struct
+type cfgField struct {
+	path string
+	v    reflect.Value
+	sf   reflect.StructField
+}
+
+// Load populates the struct cfg points to
+func (cl *ConfigLoader) Load(cfg interface{}) error {
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to struct, got %T", cfg)
+	}
+	cl.Sources = make(map[string]string)
+	fields := cfgFields(rv.Elem(), "")
+
+	for _, f := range fields {
+		if d, ok := f.sf.Tag.Lookup("default"); ok {
+			if err := setFromString(f.v, d); err != nil {
+				return fmt.Errorf("default of %s: %w", f.path, err)
+			}
+			cl.Sources[f.path] = SrcDefault
+		}
+	}
+
+	envFile := map[string]string{}
+	if cl.File != "" {
+		switch strings.ToLower(filepath.Ext(cl.File)) {
+		case ".yaml", ".yml", ".json":
+			if err := cl.loadFile(rv.Elem()); err != nil {
+				return err
+			}
+		default:
+			vars, err := ParseEnvFile(cl.File)
+			if err != nil {
+				return err
+			}
+			for _, v := range vars {
+				envFile[v.Key] = v.Val
+			}
+		}
+	}
+
+	for _, f := range fields {
+		name := cl.envName(f)
+		if name == "-" {
+			continue
+		}
+		src := SrcEnv
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			val, ok = envFile[name]
+			src = SrcFile
+		}
+		if !ok {
+			continue
+		}
+		if err := setFromString(f.v, val); err != nil {
+			return fmt.Errorf("%s of %s: %w", src, f.path, err)
+		}
+		cl.Sources[f.path] = src
+	}
+
+	if cl.Flags != nil {
+		set := map[string]*flag.Flag{}
+		cl.Flags.Visit(func(fl *flag.Flag) { set[fl.Name] = fl })
+		for _, f := range fields {
+			name := f.sf.Tag.Get("flag")
+			if name == "" {
+				name = strings.ToLower(f.path)
+			}
+			fl, ok := set[name]
+			if !ok {
+				continue
+			}
+			if err := setFromString(f.v, fl.Value.String()); err != nil {
+				return fmt.Errorf("flag %s: %w", name, err)
+			}
+			cl.Sources[f.path] = SrcFlag
+		}
+	}
+	return nil
+}
+
+// Source returns the source which supplied the field, empty if none
+func (cl *ConfigLoader) Source(path string) string {
+	return cl.Sources[path]
+}
+
+// envName returns the env var name of the field
+func (cl *ConfigLoader) envName(f cfgField) string {
+	if n := f.sf.Tag.Get("env"); n != "" {
+		return n
+	}
+	return cl.EnvPrefix + strings.ToUpper(strings.Replace(snakeCase(f.path), ".", "_", -1))
+}
+
+// loadFile applies a YAML or JSON file to the struct
+func (cl *ConfigLoader) loadFile(v reflect.Value) error {
+	data, err := ioutil.ReadFile(cl.File)
+	if err != nil {
+		return err
+	}
+	m := map[string]interface{}{}
+	if strings.ToLower(filepath.Ext(cl.File)) == ".json" {
+		err = json.Unmarshal(data, &m)
+	} else {
+		err = yaml.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", cl.File, err)
+	}
+	return cl.applyMap(v, m, "")
+}
+
+// applyMap assigns the values of a decoded file to the matching fields
+func (cl *ConfigLoader) applyMap(v reflect.Value, m map[string]interface{}, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		val, ok := cfgLookup(m, sf)
+		if !ok {
+			continue
+		}
+		path := prefix + sf.Name
+		fv := v.Field(i)
+		if isCfgStruct(fv) {
+			sub, ok := normalizeYAML(val).(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("config file %s: %s is not a mapping", cl.File, path)
+			}
+			if err := cl.applyMap(fv, sub, path+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		var err error
+		if s, ok := val.(string); ok {
+			err = setFromString(fv, s)
+		} else {
+			var b []byte
+			if b, err = json.Marshal(normalizeYAML(val)); err == nil {
+				err = json.Unmarshal(b, fv.Addr().Interface())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("config file %s, field %s: %w", cl.File, path, err)
+		}
+		cl.Sources[path] = SrcFile
+	}
+	return nil
+}
+
+// cfgLookup finds the value of a struct field in a decoded file
+func cfgLookup(m map[string]interface{}, sf reflect.StructField) (interface{}, bool) {
+	for _, tag := range []string{"yaml", "json"} {
+		if n := strings.Split(sf.Tag.Get(tag), ",")[0]; n != "" && n != "-" {
+			if v, ok := m[n]; ok {
+				return v, true
+			}
+		}
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, sf.Name) || strings.EqualFold(k, snakeCase(sf.Name)) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// normalizeYAML converts the map[interface{}]interface{} decoded by yaml to map[string]interface{}
+func normalizeYAML(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[fmt.Sprint(k)] = normalizeYAML(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range x {
+			x[i] = normalizeYAML(e)
+		}
+	}
+	return v
+}
+
+// cfgFields lists the leaf fields of a struct, nested structs are flattened
+func cfgFields(v reflect.Value, prefix string) []cfgField {
+	res := []cfgField{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		if isCfgStruct(fv) {
+			res = append(res, cfgFields(fv, prefix+sf.Name+".")...)
+			continue
+		}
+		res = append(res, cfgField{path: prefix + sf.Name, v: fv, sf: sf})
+	}
+	return res
+}
+
+// isCfgStruct tells if the field is a nested config struct rather than a value
+func isCfgStruct(v reflect.Value) bool {
+	return v.Kind() == reflect.Struct && v.Type() != reflect.TypeOf(time.Time{})
+}
+
+var snakeBoundary = regexp.MustCompile(`([a-z0-9])([A-Z])`)
+
+// snakeCase converts CamelCase to Camel_Case
+func snakeCase(s string) string {
+	return snakeBoundary.ReplaceAllString(s, "${1}_${2}")
+}
+
+// setFromString assigns the text representation of a value to v
+// slices are comma separated
+func setFromString(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		parts := []string{}
+		if strings.TrimSpace(s) != "" {
+			parts = strings.Split(s, ",")
+		}
+		sl := reflect.MakeSlice(v.Type(), len(parts), len(parts))
+		for i, p := range parts {
+			if err := setFromString(sl.Index(i), strings.TrimSpace(p)); err != nil {
+				return err
+			}
+		}
+		v.Set(sl)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ****************************************
+CORS
+**************************************** */
+
+// CORSConfig is the cross-origin policy of a route, empty lists use the defaults
+type CORSConfig struct {
+	// AllowOrigins are exact origins, "*" or path.Match patterns, e.g. "https://*.example.com"
+	// with AllowCredentials "*" and the patterns matching any host are ignored
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+	// MaxAge is how long browsers cache the preflight response
+	MaxAge time.Duration
+}
+
+// CORS defaults
+var (
+	CORSDefaultMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	CORSDefaultHeaders = []string{"Authorization", "Content-Type", RequestIDHeader, CSRFHeader}
+	CORSDefaultExpose  = []string{RequestIDHeader}
+)
+
+// allowOrigin returns true if the origin matches the config
+func (c *CORSConfig) allowOrigin(origin string) bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if ok, _ := path.Match(o, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// anyOrigin tells if the origin pattern matches any host, e.g. "*" or "https://*"
+func anyOrigin(o string) bool {
+	if o == "*" {
+		return true
+	}
+	for _, probe := range []string{"https://origin.invalid", "http://origin.invalid"} {
+		if ok, _ := path.Match(o, probe); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS returns a middleware applying the cross-origin policy, wrap each
+// route with its own config, preflight requests are answered directly
+// requests from other origins are served without CORS headers, so
+// browsers block them, preflights of those are rejected with 403
+/*
+	cors := api.CORS(util.CORSConfig{AllowOrigins: []string{"https://netops.example.com"}, AllowCredentials: true})
+	mux.HandleFunc("/devices", cors(api.Auth(listDevices)))
+*/
+func (api *API) CORS(cfg CORSConfig) Middleware {
+	if len(cfg.AllowMethods) == 0 {
+		cfg.AllowMethods = CORSDefaultMethods
+	}
+	if len(cfg.AllowHeaders) == 0 {
+		cfg.AllowHeaders = CORSDefaultHeaders
+	}
+	if len(cfg.ExposeHeaders) == 0 {
+		cfg.ExposeHeaders = CORSDefaultExpose
+	}
+	methods := strings.Join(cfg.AllowMethods, ", ")
+	headers := strings.Join(cfg.AllowHeaders, ", ")
+	expose := strings.Join(cfg.ExposeHeaders, ", ")
+	wildcard := InStrings("*", cfg.AllowOrigins) && !cfg.AllowCredentials
+	if cfg.AllowCredentials {
+		// echoing any origin with credentials lets every site read as the user
+		origins := make([]string, 0, len(cfg.AllowOrigins))
+		for _, o := range cfg.AllowOrigins {
+			if anyOrigin(o) {
+				logger.Warnf("CORS origin %q ignored, it matches any origin and credentials are allowed", o)
+				continue
+			}
+			origins = append(origins, o)
+		}
+		cfg.AllowOrigins = origins
+	}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" {
+				next(w, r)
+				return
+			}
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			if !cfg.allowOrigin(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next(w, r)
+				return
+			}
+			if wildcard {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// credentials require the echoed origin
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				h.Set("Access-Control-Expose-Headers", expose)
+				next(w, r)
+				return
+			}
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if !InStrings(strings.ToUpper(r.Header.Get("Access-Control-Request-Method")), cfg.AllowMethods) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			if cfg.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ****************************************
+gRPC per-RPC credentials
+**************************************** */
+
+// InsecureAuthToken is an AuthToken allowed over plaintext connections,
+// for lab gRPC servers without TLS only
+/*
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithPerRPCCredentials(util.InsecureAuthToken(token)))
+*/
+type InsecureAuthToken string
+
+// GetRequestMetadata injects the token to the request metadata
+func (t InsecureAuthToken) GetRequestMetadata(ctx context.Context, in ...string) (map[string]string, error) {
+	return map[string]string{"authorization": string(t)}, nil
+}
+
+// RequireTransportSecurity returns false to allow plaintext connections
+func (t InsecureAuthToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// TokenFunc fetches a fresh token and its expiry, zero expiry means the
+// token never expires
+type TokenFunc func(ctx context.Context) (token string, expiry time.Time, err error)
+
+// TokenSource is a PerRPCCredentials caching the token of the callback and
+// fetching a new one before the expiry, concurrent calls share the fetch
+/*
+	ts := util.NewTokenSource(util.RefreshTokenFunc(nil, "https://auth:8443/token/refresh", refreshToken))
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds), grpc.WithPerRPCCredentials(ts))
+*/
+type TokenSource struct {
+	Fetch TokenFunc
+	// Margin is the time before the expiry the token is renewed
+	Margin time.Duration
+	// Insecure allows plaintext connections, for lab gRPC servers without TLS only
+	Insecure bool
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// NewTokenSource creates a TokenSource with 30s renewal margin
+func NewTokenSource(fetch TokenFunc) *TokenSource {
+	return &TokenSource{Fetch: fetch, Margin: 30 * time.Second}
+}
+
+// Token returns the cached token or fetches a new one if it is about to expire
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && (s.expiry.IsZero() || time.Until(s.expiry) > s.Margin) {
+		return s.token, nil
+	}
+	tok, exp, err := s.Fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetch token: %w", err)
+	}
+	s.token, s.expiry = tok, exp
+	return tok, nil
+}
+
+// Invalidate drops the cached token, e.g. after the server rejected it
+func (s *TokenSource) Invalidate() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+// GetRequestMetadata injects the bearer token to the request metadata
+func (s *TokenSource) GetRequestMetadata(ctx context.Context, in ...string) (map[string]string, error) {
+	tok, err := s.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"authorization": "Bearer " + tok}, nil
+}
+
+// RequireTransportSecurity mandates TLS unless Insecure is set
+func (s *TokenSource) RequireTransportSecurity() bool {
+	return !s.Insecure
+}
+
+// RefreshTokenFunc returns a TokenFunc exchanging the refresh token for an
+// access token at a RefreshHandler URL, nil client uses http.DefaultClient
+func RefreshTokenFunc(client *http.Client, url, refreshToken string) TokenFunc {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) (string, time.Time, error) {
+		body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		defer resp.Body.Close()
+		if err := httpStatusErr(resp); err != nil {
+			return "", time.Time{}, err
+		}
+		var tr TokenResponse
+		if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+			return "", time.Time{}, fmt.Errorf("decode token response: %w", err)
+		}
+		if tr.AccessToken == "" {
+			return "", time.Time{}, fmt.Errorf("empty access token")
+		}
+		var exp time.Time
+		if tr.ExpiresIn > 0 {
+			exp = start.Add(time.Duration(tr.ExpiresIn) * time.Second)
+		}
+		return strings.TrimSpace(tr.AccessToken), exp, nil
+	}
+}
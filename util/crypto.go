@@ -4,10 +4,12 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"io"
-
-	log "github.com/sirupsen/logrus"
+	"math/big"
+	"strings"
 )
 
 // Written in 2015 by George Tankersley <george.tankersley@gmail.com>
@@ -33,18 +35,18 @@ func NewEncryptionKey() *[32]byte {
 func Encrypt(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
-		log.WithError(err).Warn("erroneous cipher block")
+		logger.WithError(err).Warn("erroneous cipher block")
 		return nil, err
 	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		log.WithError(err).Warn("erroneous GCM")
+		logger.WithError(err).Warn("erroneous GCM")
 		return nil, err
 	}
 	nonce := make([]byte, gcm.NonceSize())
 	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
-		log.WithError(err).Warn("erroneous random reader")
+		logger.WithError(err).Warn("erroneous random reader")
 		return nil, err
 	}
 	return gcm.Seal(nonce, nonce, plaintext, nil), nil
@@ -56,17 +58,17 @@ func Encrypt(plaintext []byte, key *[32]byte) (ciphertext []byte, err error) {
 func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
-		log.WithError(err).Warn("erroneous cipher block")
+		logger.WithError(err).Warn("erroneous cipher block")
 		return nil, err
 	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		log.WithError(err).Warn("erroneous GCM")
+		logger.WithError(err).Warn("erroneous GCM")
 		return nil, err
 	}
 
 	if len(ciphertext) < gcm.NonceSize() {
-		log.Warn("malformed ciphertext")
+		logger.Warn("malformed ciphertext")
 		return nil, errors.New("malformed ciphertext")
 	}
 
@@ -76,3 +78,115 @@ func Decrypt(ciphertext []byte, key *[32]byte) (plaintext []byte, err error) {
 		nil,
 	)
 }
+
+/* ****************************************
+Secure random string - crypto/rand backed
+for session IDs, tokens, keys and passwords
+use RandString family only for non-security purposes
+**************************************** */
+
+// SecureStringWithCharset generates cryptographically secure random string
+// on a given length and character set, characters are uniformly distributed
+// ErrBadInput if the charset is empty or the length negative
+func SecureStringWithCharset(length int, charset string) (string, error) {
+	if charset == "" {
+		return "", ErrBadInput.Wrap(errors.New("empty charset"))
+	}
+	if length < 0 {
+		return "", ErrBadInput.Wrap(errors.New("negative length"))
+	}
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// SecureRandString generates cryptographically secure random numeric and alphabetic string
+// It panics if the source of randomness fails.
+func SecureRandString(n int) string {
+	s, err := SecureStringWithCharset(n, charset)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// SecureToken returns nBytes of cryptographically secure random data
+// encoded in unpadded base64url, suitable for session IDs and API tokens.
+// It panics if the source of randomness fails.
+func SecureToken(nBytes int) string {
+	b := make([]byte, nBytes)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SecureCompare compares two secrets in constant time
+func SecureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// symbolset is the symbol characters accepted by common vendor CLIs without quoting
+const symbolset = "!@#%^&*-_=+?."
+
+// secureIntn returns a uniform random int in [0, n) from crypto/rand.
+// It panics if the source of randomness fails.
+func secureIntn(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(v.Int64())
+}
+
+// RandPassphrase generates a human readable passphrase of random words
+// from the embedded word list joined by sep, e.g. "lamp-tide-rock-wolf"
+// every word adds about 8.7 bits of entropy
+func RandPassphrase(words int, sep string) string {
+	w := make([]string, words)
+	for i := range w {
+		w[i] = passWords[secureIntn(len(passWords))]
+	}
+	return strings.Join(w, sep)
+}
+
+// RandStringWithClasses generates a cryptographically secure random password
+// of lowercase letters plus the required classes, each required class
+// appears at least once to satisfy vendor complexity rules
+func RandStringWithClasses(length int, requireUpper, requireDigit, requireSymbol bool) string {
+	classes := []string{"abcdefghijklmnopqrstuvwxyz"}
+	if requireUpper {
+		classes = append(classes, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	}
+	if requireDigit {
+		classes = append(classes, "0123456789")
+	}
+	if requireSymbol {
+		classes = append(classes, symbolset)
+	}
+	if length < len(classes) {
+		length = len(classes)
+	}
+	pool := strings.Join(classes, "")
+	b := make([]byte, length)
+	for i := range b {
+		if i < len(classes) {
+			b[i] = classes[i][secureIntn(len(classes[i]))]
+		} else {
+			b[i] = pool[secureIntn(len(pool))]
+		}
+	}
+	// Fisher-Yates, so the mandatory characters are not always in front
+	for i := len(b) - 1; i > 0; i-- {
+		j := secureIntn(i + 1)
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
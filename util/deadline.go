@@ -0,0 +1,82 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+/* ****************************************
+context aware sleep and deadlines
+**************************************** */
+
+// SleepCtx pauses for d or until ctx is done, returns ctx.Err() if interrupted
+// use it in place of time.Sleep in loops which should abort on shutdown
+func SleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// SleepUntil pauses until t or until ctx is done, see SleepCtx
+func SleepUntil(ctx context.Context, t time.Time) error {
+	return SleepCtx(ctx, time.Until(t))
+}
+
+// TimeLeft returns the time until the ctx deadline, false if it has none
+func TimeLeft(ctx context.Context) (time.Duration, bool) {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(dl), true
+}
+
+// WithDeadlineMargin derives a context expiring margin before the ctx deadline,
+// leaving time for clean up or reporting, a ctx without deadline is kept as is
+func WithDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, dl.Add(-margin))
+}
+
+// WithTimeoutRetry retries f by the policy, each attempt with its own timeout
+// an attempt timing out is retried while ctx is alive, see Retry
+/*
+	err := util.WithTimeoutRetry(ctx, 10*time.Second, util.DefaultRetryPolicy, func(ctx context.Context) error {
+		return collect(ctx, dev)
+	})
+*/
+func WithTimeoutRetry(ctx context.Context, timeout time.Duration, p RetryPolicy, f func(context.Context) error) error {
+	return Retry(ctx, p, func() error {
+		if err := ctx.Err(); err != nil {
+			return Permanent(err)
+		}
+		actx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return f(actx)
+	})
+}
+
+// PollUntil calls cond every interval until it returns true or an error,
+// or ctx is done, the first call is immediate
+func PollUntil(ctx context.Context, interval time.Duration, cond func(context.Context) (bool, error)) error {
+	for {
+		done, err := cond(ctx)
+		if err != nil || done {
+			return err
+		}
+		if err := SleepCtx(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ****************************************
+env file parsing
+**************************************** */
+
+// EnvVar is a key/value pair parsed from an env file
+type EnvVar struct {
+	Key  string
+	Val  string
+	Line int // line number where the definition starts
+	end  int // line number where the definition ends
+}
+
+// envKey matches the start of a definition, optional export prefix
+var envKey = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][\w\.-]*)\s*=\s*`)
+
+// envComment matches the inline comment of an unquoted value
+var envComment = regexp.MustCompile(`(^|\s)#`)
+
+// EnvParseError collects the malformed lines of an env file
+type EnvParseError struct {
+	File  string
+	Lines map[int]string // line number to the reason
+}
+
+func (e *EnvParseError) Error() string {
+	ln := []string{}
+	for n, r := range e.Lines {
+		ln = append(ln, fmt.Sprintf("line %d: %s", n, r))
+	}
+	NatureOrder().Sort(ln)
+	return fmt.Sprintf("malformed env file %s, %s", e.File, strings.Join(ln, "; "))
+}
+
+// ParseEnv parses the content of a dotenv style file
+/*
+# comment line
+export KEY=value          # export prefix and inline comment
+SPACED = a value with spaces
+SINGLE='literal $HOME \n'
+DOUBLE="escaped \"quote\"\nsecond line"
+MULTI="first line
+second line"
+URL=http://${HOST:-localhost}:$PORT/  # expanded from earlier keys or process env
+PRICE="\$5"                           # escaped literal $
+*/
+// $VAR, ${VAR} and ${VAR:-default} are expanded in unquoted and double quoted
+// values, from the keys defined earlier in the file, then the process environment
+// malformed lines are skipped and reported by *EnvParseError,
+// the well formed definitions are always returned in original sequence
+func ParseEnv(data string) ([]EnvVar, error) {
+	res := []EnvVar{}
+	perr := &EnvParseError{Lines: map[int]string{}}
+	defined := make(map[string]string)
+	lookup := func(k string) (string, bool) {
+		if v, ok := defined[k]; ok {
+			return v, true
+		}
+		return os.LookupEnv(k)
+	}
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		ln := lines[i]
+		tl := strings.TrimSpace(ln)
+		if tl == "" || strings.HasPrefix(tl, "#") {
+			continue
+		}
+		m := envKey.FindStringSubmatchIndex(ln)
+		if m == nil {
+			perr.Lines[i+1] = "not a KEY=VALUE definition"
+			continue
+		}
+		v := EnvVar{Key: ln[m[2]:m[3]], Line: i + 1, end: i + 1}
+		rest := ln[m[1]:]
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			// unquoted, inline comment must be preceded by white space
+			if c := envComment.FindStringIndex(rest); c != nil {
+				rest = rest[:c[0]]
+			}
+			v.Val = envDecode(strings.TrimSpace(rest), 0, lookup)
+			defined[v.Key] = v.Val
+			res = append(res, v)
+			continue
+		}
+		// quoted value may span lines until the closing quote
+		q := rest[0]
+		body := rest[1:]
+		start := i
+		raw, tail, ok := envUnquote(body, q)
+		for !ok && i+1 < len(lines) {
+			i++
+			body += "\n" + lines[i]
+			raw, tail, ok = envUnquote(body, q)
+		}
+		if !ok {
+			perr.Lines[start+1] = "unterminated quoted value"
+			continue
+		}
+		if t := strings.TrimSpace(tail); t != "" && !strings.HasPrefix(t, "#") {
+			perr.Lines[i+1] = "unexpected characters after quoted value"
+			continue
+		}
+		v.Val = envDecode(raw, q, lookup)
+		v.end = i + 1
+		defined[v.Key] = v.Val
+		res = append(res, v)
+	}
+	if len(perr.Lines) > 0 {
+		return res, perr
+	}
+	return res, nil
+}
+
+// envUnquote reads a quoted value up to the closing quote q
+// backslash escaped quote doesn't close a double quoted value
+// returns the raw value, the remaining text after the closing quote and
+// false if the closing quote is not found
+func envUnquote(s string, q byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && q == '"' {
+			i++
+			continue
+		}
+		if s[i] == q {
+			return s[:i], s[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// envVarName matches the variable name following $
+var envVarName = regexp.MustCompile(`^[A-Za-z_]\w*`)
+
+// envDecode processes the escapes and expands the variables of a raw value
+// q is the quote of the value, 0 for unquoted
+// single quoted value is literal, unquoted value only honors \$ escape
+func envDecode(s string, q byte, lookup func(string) (string, bool)) string {
+	if q == '\'' {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			n := s[i+1]
+			switch {
+			case n == '$':
+				b.WriteByte('$')
+			case q == '"' && n == 'n':
+				b.WriteByte('\n')
+			case q == '"' && n == 'r':
+				b.WriteByte('\r')
+			case q == '"' && n == 't':
+				b.WriteByte('\t')
+			case q == '"' && (n == '"' || n == '\\'):
+				b.WriteByte(n)
+			default:
+				b.WriteByte(c)
+				b.WriteByte(n)
+			}
+			i++
+			continue
+		}
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		if s[i+1] == '{' {
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				b.WriteByte(c)
+				continue
+			}
+			expr := s[i+2 : i+end]
+			name, def := expr, ""
+			if d := strings.Index(expr, ":-"); d >= 0 {
+				name, def = expr[:d], expr[d+2:]
+			}
+			if v, ok := lookup(name); ok && v != "" {
+				b.WriteString(v)
+			} else {
+				b.WriteString(def)
+			}
+			i += end
+			continue
+		}
+		if name := envVarName.FindString(s[i+1:]); name != "" {
+			v, _ := lookup(name)
+			b.WriteString(v)
+			i += len(name)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// ParseEnvFile reads and parses a dotenv style file, see ParseEnv
+func ParseEnvFile(fileName string) ([]EnvVar, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ParseEnv(string(data))
+	if perr, ok := err.(*EnvParseError); ok {
+		perr.File = fileName
+	}
+	return res, err
+}
+
+// LoadEnvToProcess sets the variables of a dotenv style file to the process environment
+// variables already present in the environment are not overridden
+func LoadEnvToProcess(fileName string) error {
+	vars, err := ParseEnvFile(fileName)
+	if vars == nil {
+		return err
+	}
+	for _, v := range vars {
+		if _, exist := os.LookupEnv(v.Key); exist {
+			continue
+		}
+		if e := os.Setenv(v.Key, v.Val); e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+/* ****************************************
+env file writing
+**************************************** */
+
+// envSafe matches the values written without quotes
+var envSafe = regexp.MustCompile(`^[\w@%+=:,./-]*$`)
+
+// envQuote formats a value to be read back by ParseEnv as is
+func envQuote(v string) string {
+	if envSafe.MatchString(v) {
+		return v
+	}
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		`$`, `\$`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+	).Replace(v) + `"`
+}
+
+// WriteEnvFile writes the key/value pairs to a dotenv style file, keys absent from kv are dropped
+// with preserveOrder, comments, blank lines and key order of the existing file are kept,
+// changed values are replaced in place and new keys are appended in sorted order
+// otherwise the file is rewritten with the keys sorted
+// the file is replaced atomically, keeping the permission of the existing one
+func WriteEnvFile(fileName string, kv map[string]string, preserveOrder bool) error {
+	unset := []string{}
+	if preserveOrder {
+		if vars, err := ParseEnvFile(fileName); err == nil || vars != nil {
+			for _, v := range vars {
+				if _, ok := kv[v.Key]; !ok {
+					unset = append(unset, v.Key)
+				}
+			}
+		}
+		return UpdateEnvFile(fileName, kv, unset...)
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, envQuote(kv[k]))
+	}
+	return writeFileAtomic(fileName, []byte(b.String()), 0600)
+}
+
+// UpdateEnvFile sets and removes keys of a dotenv style file in place,
+// everything else, including comments and order, is kept
+// new keys are appended in sorted order, missing file is created
+func UpdateEnvFile(fileName string, set map[string]string, unset ...string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content := strings.Replace(string(data), "\r\n", "\n", -1)
+	vars, err := ParseEnv(content)
+	if err != nil && vars == nil {
+		return err
+	}
+	lines := strings.Split(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	drop := map[string]bool{}
+	for _, k := range unset {
+		drop[k] = true
+	}
+	// replacement of the definition lines, indexed by start line
+	repl := map[int][]string{}
+	done := map[string]bool{}
+	for _, v := range vars {
+		nv, ok := set[v.Key]
+		switch {
+		case drop[v.Key]:
+			repl[v.Line] = []string{}
+		case ok && !done[v.Key]:
+			repl[v.Line] = []string{envReplaceValue(lines[v.Line-1:v.end], nv)}
+			done[v.Key] = true
+		case ok:
+			// duplicated definition, keep the first one only
+			repl[v.Line] = []string{}
+		default:
+			continue
+		}
+		for n := v.Line + 1; n <= v.end; n++ {
+			repl[n] = []string{}
+		}
+	}
+	out := []string{}
+	for i, ln := range lines {
+		if r, ok := repl[i+1]; ok {
+			out = append(out, r...)
+			continue
+		}
+		out = append(out, ln)
+	}
+	keys := []string{}
+	for k := range set {
+		if !done[k] && !drop[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out = append(out, k+"="+envQuote(set[k]))
+	}
+	return writeFileAtomic(fileName, []byte(strings.Join(out, "\n")+"\n"), 0600)
+}
+
+// envReplaceValue rewrites a definition with a new value,
+// keeping its export prefix, spacing and inline comment
+func envReplaceValue(def []string, val string) string {
+	first := def[0]
+	m := envKey.FindStringIndex(first)
+	prefix, rest := first[:m[1]], first[m[1]:]
+	comment := ""
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		body := strings.Join(append([]string{rest[1:]}, def[1:]...), "\n")
+		if _, tail, ok := envUnquote(body, rest[0]); ok {
+			comment = tail
+		}
+	} else if c := envComment.FindStringIndex(rest); c != nil {
+		comment = rest[c[0]:]
+	}
+	return prefix + envQuote(val) + comment
+}
+
+// writeFileAtomic writes to a temporary file in the same directory and renames it over fileName
+// the permission of the existing file is kept, mode applies to a new file
+func writeFileAtomic(fileName string, data []byte, mode os.FileMode) error {
+	if fi, err := os.Stat(fileName); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+/* ****************************************
+encrypted env file
+**************************************** */
+
+// encEnvHeader is the first line of an encrypted env file
+const encEnvHeader = "#GOTO-ENCRYPTED-ENV v1"
+
+// EncryptEnvFile encrypts a dotenv style file with AES-GCM, see Encrypt
+// the output is a header line followed by the base64 encoded ciphertext
+// the source is parsed first so a malformed file is not sealed unnoticed
+func EncryptEnvFile(src, dst string, key *[32]byte) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseEnv(string(data)); err != nil {
+		if perr, ok := err.(*EnvParseError); ok {
+			perr.File = src
+		}
+		return err
+	}
+	ct, err := Encrypt(data, key)
+	if err != nil {
+		return err
+	}
+	out := encEnvHeader + "\n" + base64.StdEncoding.EncodeToString(ct) + "\n"
+	return writeFileAtomic(dst, []byte(out), 0600)
+}
+
+// DecryptEnvFile returns the plaintext content of an encrypted env file
+func DecryptEnvFile(fileName string, key *[32]byte) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(data)), "\n", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) != encEnvHeader {
+		return "", fmt.Errorf("%s is not an encrypted env file", fileName)
+	}
+	ct, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(parts[1]), ""))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted env file %s: %w", fileName, err)
+	}
+	pt, err := Decrypt(ct, key)
+	if err != nil {
+		return "", fmt.Errorf("decrypt env file %s: %w", fileName, err)
+	}
+	return string(pt), nil
+}
+
+// LoadEncryptedEnv reads an encrypted env file produced by EncryptEnvFile
+// and returns its key/value pairs, see GetEnvHashFrFile
+func LoadEncryptedEnv(fileName string, key *[32]byte) (map[string]string, error) {
+	data, err := DecryptEnvFile(fileName, key)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := ParseEnv(data)
+	if perr, ok := err.(*EnvParseError); ok {
+		perr.File = fileName
+	}
+	res := make(map[string]string)
+	for _, v := range vars {
+		res[v.Key] = v.Val
+	}
+	return res, err
+}
+
+// ParseEncryptionKey decodes a 256-bit key given in hex or base64,
+// e.g. read from an env var or a key file
+func ParseEncryptionKey(s string) (*[32]byte, error) {
+	s = strings.TrimSpace(s)
+	var b []byte
+	var err error
+	if len(s) == 64 {
+		b, err = hex.DecodeString(s)
+	} else {
+		b, err = base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed encryption key: %w", err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(b))
+	}
+	key := [32]byte{}
+	copy(key[:], b)
+	return &key, nil
+}
+
+/* ****************************************
+typed env var access
+**************************************** */
+
+// EnvString returns the env var, or the optional default if unset or empty
+func EnvString(key string, def ...string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	if len(def) > 0 {
+		return def[0]
+	}
+	return ""
+}
+
+// EnvInt returns the env var as int, or the optional default if unset or invalid
+func EnvInt(key string, def ...int) int {
+	d := 0
+	if len(def) > 0 {
+		d = def[0]
+	}
+	v := os.Getenv(key)
+	if v == "" {
+		return d
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		logger.WithField("key", key).Warnf("invalid int env var %q, use default %d", v, d)
+		return d
+	}
+	return n
+}
+
+// EnvBool returns the env var as bool, or the optional default if unset or invalid
+// accepts 1, t, true, yes, on and 0, f, false, no, off in any case
+func EnvBool(key string, def ...bool) bool {
+	d := false
+	if len(def) > 0 {
+		d = def[0]
+	}
+	v := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	switch v {
+	case "":
+		return d
+	case "yes", "on":
+		return true
+	case "no", "off":
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.WithField("key", key).Warnf("invalid bool env var %q, use default %v", v, d)
+		return d
+	}
+	return b
+}
+
+// EnvDuration returns the env var as duration, or the optional default if unset or invalid
+// accepts Go duration (1m30s) or HH:MM:SS
+func EnvDuration(key string, def ...time.Duration) time.Duration {
+	var d time.Duration
+	if len(def) > 0 {
+		d = def[0]
+	}
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return d
+	}
+	if r, err := time.ParseDuration(v); err == nil {
+		return r
+	}
+	if r, err := HMSToDuration(v); err == nil {
+		return r
+	}
+	logger.WithField("key", key).Warnf("invalid duration env var %q, use default %s", v, d)
+	return d
+}
+
+// MustEnv returns the env var, logs and exits if it's unset or empty
+func MustEnv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		logger.WithField("key", key).Fatal("required env var is missing")
+	}
+	return v
+}
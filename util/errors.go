@@ -0,0 +1,235 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+/* ****************************************
+structured error
+**************************************** */
+
+// error categories, for status mapping and handling policy
+const (
+	CatInput       = "input"
+	CatAuth        = "auth"
+	CatNotFound    = "not_found"
+	CatConflict    = "conflict"
+	CatTimeout     = "timeout"
+	CatUnavailable = "unavailable"
+	CatInternal    = "internal"
+)
+
+// ErrCaptureStack enables stack capture by Wrap and NewErr
+var ErrCaptureStack = false
+
+// Err is a structured error carrying a code, a category, the wrapped cause,
+// optional stack trace and key/value context
+// errors.Is matches another *Err by code, errors.Is/As see through to the cause
+type Err struct {
+	Code     string // machine readable, e.g. DEVICE_UNREACHABLE
+	Category string // one of the Cat constants
+	Msg      string
+	Cause    error
+	Fields   map[string]interface{}
+	stack    []uintptr
+}
+
+// NewErr creates an Err
+func NewErr(code, category, msg string) *Err {
+	e := &Err{Code: code, Category: category, Msg: msg}
+	if ErrCaptureStack {
+		e.stack = callers()
+	}
+	return e
+}
+
+// Errorf creates an Err with a formatted message, %w is not interpreted, use Wrap
+func Errorf(code, category, format string, a ...interface{}) *Err {
+	e := &Err{Code: code, Category: category, Msg: fmt.Sprintf(format, a...)}
+	if ErrCaptureStack {
+		e.stack = callers()
+	}
+	return e
+}
+
+// Wrap annotates err with a message, nil err returns nil
+// the code and category are inherited from the wrapped *Err if any
+func Wrap(err error, msg string) error {
+	if err == nil {
+		return nil
+	}
+	e := &Err{Msg: msg, Cause: err}
+	var inner *Err
+	if errors.As(err, &inner) {
+		e.Code, e.Category = inner.Code, inner.Category
+	}
+	if ErrCaptureStack {
+		e.stack = callers()
+	}
+	return e
+}
+
+// WithField attaches a key/value context to err, nil err returns nil
+// an *Err is copied with the field added, other errors are wrapped
+func WithField(err error, key string, val interface{}) error {
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*Err)
+	if !ok {
+		return (&Err{Cause: err}).With(key, val)
+	}
+	return e.With(key, val)
+}
+
+// With returns a copy of the error with the key/value context added
+func (e *Err) With(key string, val interface{}) *Err {
+	c := *e
+	c.Fields = make(map[string]interface{}, len(e.Fields)+1)
+	for k, v := range e.Fields {
+		c.Fields[k] = v
+	}
+	c.Fields[key] = val
+	return &c
+}
+
+// Wrap returns a copy of the error with the cause set
+func (e *Err) Wrap(cause error) *Err {
+	c := *e
+	c.Cause = cause
+	return &c
+}
+
+// WithStack returns a copy of the error with the stack of the caller captured
+func (e *Err) WithStack() *Err {
+	c := *e
+	c.stack = callers()
+	return &c
+}
+
+func (e *Err) Error() string {
+	msg := e.Msg
+	if e.Code != "" && (e.Cause == nil || ErrCode(e.Cause) != e.Code) {
+		msg = strings.TrimSpace(fmt.Sprintf("[%s] %s", e.Code, msg))
+	}
+	if len(e.Fields) > 0 {
+		keys := make([]string, 0, len(e.Fields))
+		for k := range e.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kv := make([]string, len(keys))
+		for i, k := range keys {
+			kv[i] = fmt.Sprintf("%s=%v", k, e.Fields[k])
+		}
+		msg = strings.TrimSpace(msg + " (" + strings.Join(kv, " ") + ")")
+	}
+	if e.Cause == nil {
+		return msg
+	}
+	if msg == "" {
+		return e.Cause.Error()
+	}
+	return msg + ": " + e.Cause.Error()
+}
+
+// Unwrap returns the cause for errors.Is/As
+func (e *Err) Unwrap() error {
+	return e.Cause
+}
+
+// Is matches a target *Err having the same code
+func (e *Err) Is(target error) bool {
+	t, ok := target.(*Err)
+	return ok && t.Code != "" && t.Code == e.Code
+}
+
+// Stack returns the captured stack trace, empty if not captured
+func (e *Err) Stack() string {
+	if len(e.stack) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	frames := runtime.CallersFrames(e.stack)
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// callers captures the stack of the caller of the calling function
+func callers() []uintptr {
+	pc := make([]uintptr, 32)
+	return pc[:runtime.Callers(3, pc)]
+}
+
+// ErrCode returns the code of the outermost *Err in the chain, empty if none
+func ErrCode(err error) string {
+	var e *Err
+	for err != nil {
+		if errors.As(err, &e) {
+			if e.Code != "" {
+				return e.Code
+			}
+			err = e.Cause
+			continue
+		}
+		break
+	}
+	return ""
+}
+
+// ErrCategory returns the category of the outermost *Err in the chain, empty if none
+func ErrCategory(err error) string {
+	var e *Err
+	for err != nil {
+		if errors.As(err, &e) {
+			if e.Category != "" {
+				return e.Category
+			}
+			err = e.Cause
+			continue
+		}
+		break
+	}
+	return ""
+}
+
+// ErrFields collects the key/value context along the chain, outer values win
+// suitable for log.WithFields
+func ErrFields(err error) map[string]interface{} {
+	res := map[string]interface{}{}
+	var e *Err
+	for err != nil && errors.As(err, &e) {
+		for k, v := range e.Fields {
+			if _, ok := res[k]; !ok {
+				res[k] = v
+			}
+		}
+		err = e.Cause
+	}
+	return res
+}
+
+/* ****************************************
+sentinel errors, match with errors.Is
+**************************************** */
+
+// sentinel errors returned by the package APIs, the returned errors carry
+// the cause and context, errors.Is matches them by code
+// see also ErrLimitExceeded, ErrQueueFull and ErrExecutorClosed
+var (
+	ErrNotFound     = NewErr("NOT_FOUND", CatNotFound, "not found")
+	ErrUnauthorized = NewErr("UNAUTHORIZED", CatAuth, "unauthorized")
+	ErrTimeout      = NewErr("TIMEOUT", CatTimeout, "timeout")
+	ErrConflict     = NewErr("CONFLICT", CatConflict, "conflict")
+	ErrBadInput     = NewErr("BAD_INPUT", CatInput, "bad input")
+)
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+error to HTTP/gRPC status mapping
+**************************************** */
+
+// ErrStatus is the HTTP status and gRPC code an error maps to
+type ErrStatus struct {
+	HTTP int
+	GRPC codes.Code
+}
+
+var (
+	errStatusMu sync.RWMutex
+	// errStatusByCode maps the *Err codes, takes precedence over category
+	errStatusByCode = map[string]ErrStatus{
+		"UNSUPPORTED_MEDIA": {http.StatusUnsupportedMediaType, codes.InvalidArgument},
+		"BODY_TOO_LARGE":    {http.StatusRequestEntityTooLarge, codes.InvalidArgument},
+	}
+	// errStatusByCat maps the *Err categories
+	errStatusByCat = map[string]ErrStatus{
+		CatInput:       {http.StatusBadRequest, codes.InvalidArgument},
+		CatAuth:        {http.StatusUnauthorized, codes.Unauthenticated},
+		CatNotFound:    {http.StatusNotFound, codes.NotFound},
+		CatConflict:    {http.StatusConflict, codes.AlreadyExists},
+		CatTimeout:     {http.StatusGatewayTimeout, codes.DeadlineExceeded},
+		CatUnavailable: {http.StatusServiceUnavailable, codes.Unavailable},
+		CatInternal:    {http.StatusInternalServerError, codes.Internal},
+	}
+	// grpcToHTTP maps the gRPC status of errors from gRPC calls
+	grpcToHTTP = map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusPreconditionFailed,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	}
+)
+
+// RegisterErrCode maps an *Err code to the HTTP status and gRPC code
+func RegisterErrCode(code string, httpStatus int, grpcCode codes.Code) {
+	errStatusMu.Lock()
+	errStatusByCode[code] = ErrStatus{httpStatus, grpcCode}
+	errStatusMu.Unlock()
+}
+
+// RegisterErrCategory maps an *Err category to the HTTP status and gRPC code
+func RegisterErrCategory(category string, httpStatus int, grpcCode codes.Code) {
+	errStatusMu.Lock()
+	errStatusByCat[category] = ErrStatus{httpStatus, grpcCode}
+	errStatusMu.Unlock()
+}
+
+// StatusOf resolves the status of an error, in the order of
+// registered code, registered category, context errors, gRPC status,
+// ErrLimitExceeded, falls back to 500/Internal
+func StatusOf(err error) ErrStatus {
+	if err == nil {
+		return ErrStatus{http.StatusOK, codes.OK}
+	}
+	errStatusMu.RLock()
+	defer errStatusMu.RUnlock()
+	var e *Err
+	for c := err; c != nil && errors.As(c, &e); c = e.Cause {
+		if s, ok := errStatusByCode[e.Code]; ok && e.Code != "" {
+			return s
+		}
+		if s, ok := errStatusByCat[e.Category]; ok && e.Category != "" {
+			return s
+		}
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrStatus{http.StatusGatewayTimeout, codes.DeadlineExceeded}
+	case errors.Is(err, context.Canceled):
+		return ErrStatus{499, codes.Canceled}
+	case errors.Is(err, ErrLimitExceeded):
+		return ErrStatus{http.StatusTooManyRequests, codes.ResourceExhausted}
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		if h, ok := grpcToHTTP[st.Code()]; ok {
+			return ErrStatus{h, st.Code()}
+		}
+		return ErrStatus{http.StatusInternalServerError, st.Code()}
+	}
+	return ErrStatus{http.StatusInternalServerError, codes.Internal}
+}
+
+// HTTPStatus returns the HTTP status code of an error, see StatusOf
+func HTTPStatus(err error) int {
+	return StatusOf(err).HTTP
+}
+
+// GRPCCode returns the gRPC code of an error, see StatusOf
+func GRPCCode(err error) codes.Code {
+	return StatusOf(err).GRPC
+}
+
+// errArgs splits the arguments of API.Error/Errpc into the messages and
+// the first error, string and error are accepted, others are formatted by %v
+func errArgs(args []interface{}) ([]string, error) {
+	if len(args) == 0 {
+		args = []interface{}{"server error"}
+	}
+	var first error
+	msgs := make([]string, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case string:
+			msgs[i] = v
+		case error:
+			if first == nil {
+				first = v
+			}
+			msgs[i] = v.Error()
+		default:
+			msgs[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return msgs, first
+}
@@ -0,0 +1,288 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+/* ****************************************
+debounce, throttle and coalescing of events
+**************************************** */
+
+// Debounce returns a wrapped fn which runs d after the last of a burst of calls
+// safe for concurrent use, fn runs in its own goroutine, see Debouncer
+func Debounce(fn func(), d time.Duration) func() {
+	return NewDebouncer(fn, d).Call
+}
+
+// Throttle returns a wrapped fn which runs at most once per interval
+// the first call runs immediately, calls made during the interval are
+// collapsed into one trailing run at the end of it
+// safe for concurrent use, fn runs in its own goroutine, see Throttler
+func Throttle(fn func(), interval time.Duration) func() {
+	return NewThrottler(fn, interval).Call
+}
+
+// Debouncer runs fn d after the last of a burst of calls
+// the pending run can be flushed or cancelled, e.g. on shutdown
+type Debouncer struct {
+	fn      func()
+	d       time.Duration
+	mu      sync.Mutex
+	timer   *time.Timer
+	gen     uint64 // of the armed timer, a fire of another one is stale
+	stopped bool
+}
+
+// NewDebouncer creates a Debouncer of fn
+func NewDebouncer(fn func(), d time.Duration) *Debouncer {
+	return &Debouncer{fn: fn, d: d}
+}
+
+// Call (re)starts the quiet period, no-op once stopped
+func (db *Debouncer) Call() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.stopped {
+		return
+	}
+	if db.timer != nil {
+		db.timer.Stop()
+	}
+	db.gen++
+	gen := db.gen
+	db.timer = time.AfterFunc(db.d, func() { db.fire(gen) })
+}
+
+// fire runs fn unless the timer of gen was stopped, replaced or flushed
+// while the fire was already on its way
+func (db *Debouncer) fire(gen uint64) {
+	db.mu.Lock()
+	if db.stopped || gen != db.gen {
+		db.mu.Unlock()
+		return
+	}
+	db.timer = nil
+	db.mu.Unlock()
+	db.fn()
+}
+
+// Flush runs the pending call now in the calling goroutine, returns false if none
+func (db *Debouncer) Flush() bool {
+	db.mu.Lock()
+	// a fire on its way is made stale, the run is taken over here
+	pending := db.timer != nil
+	if pending {
+		db.timer.Stop()
+	}
+	db.timer = nil
+	db.gen++
+	db.mu.Unlock()
+	if pending {
+		db.fn()
+	}
+	return pending
+}
+
+// Stop cancels the pending call and ignores later calls
+func (db *Debouncer) Stop() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.stopped = true
+	db.gen++
+	if db.timer != nil {
+		db.timer.Stop()
+		db.timer = nil
+	}
+}
+
+// Throttler runs fn at most once per interval with a trailing run, see Throttle
+// the runs never overlap, a call during a run longer than the interval is
+// collapsed into the trailing run after it
+type Throttler struct {
+	fn       func()
+	interval time.Duration
+	mu       sync.Mutex
+	last     time.Time
+	timer    *time.Timer // pending trailing run
+	running  bool
+	pending  bool // a call arrived during the run
+	stopped  bool
+}
+
+// NewThrottler creates a Throttler of fn
+func NewThrottler(fn func(), interval time.Duration) *Throttler {
+	return &Throttler{fn: fn, interval: interval}
+}
+
+// Call runs fn now if the interval passed, otherwise schedules the trailing run
+func (th *Throttler) Call() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.stopped || th.timer != nil {
+		return
+	}
+	if th.running {
+		th.pending = true
+		return
+	}
+	wait := th.interval - time.Since(th.last)
+	if wait <= 0 {
+		th.running, th.last = true, time.Now()
+		go th.run()
+		return
+	}
+	th.timer = time.AfterFunc(wait, th.fire)
+}
+
+func (th *Throttler) fire() {
+	th.mu.Lock()
+	if th.stopped {
+		th.mu.Unlock()
+		return
+	}
+	th.timer = nil
+	if th.running {
+		th.pending = true
+		th.mu.Unlock()
+		return
+	}
+	th.running, th.last = true, time.Now()
+	th.mu.Unlock()
+	th.run()
+}
+
+// run runs fn, then the trailing run of the calls made meanwhile
+func (th *Throttler) run() {
+	for {
+		th.fn()
+		th.mu.Lock()
+		th.running = false
+		if !th.pending || th.stopped {
+			th.mu.Unlock()
+			return
+		}
+		th.pending = false
+		if wait := th.interval - time.Since(th.last); wait > 0 {
+			th.timer = time.AfterFunc(wait, th.fire)
+			th.mu.Unlock()
+			return
+		}
+		th.running, th.last = true, time.Now()
+		th.mu.Unlock()
+	}
+}
+
+// Stop cancels the trailing run and ignores later calls
+func (th *Throttler) Stop() {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.stopped = true
+	if th.timer != nil {
+		th.timer.Stop()
+		th.timer = nil
+	}
+}
+
+// Coalescer batches rapid-fire events and hands them to the processing function
+// a batch is released once no event arrived for Wait, the first event of
+// the batch is older than MaxDelay, or the batch reaches MaxBatch events
+// batches are processed sequentially in arrival order
+type Coalescer struct {
+	wait     time.Duration
+	maxDelay time.Duration
+	maxBatch int
+	process  func([]interface{})
+
+	in    chan interface{}
+	flush chan chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewCoalescer creates and starts a Coalescer, zero maxDelay or maxBatch means no limit
+func NewCoalescer(wait, maxDelay time.Duration, maxBatch int, process func([]interface{})) *Coalescer {
+	c := &Coalescer{
+		wait:     wait,
+		maxDelay: maxDelay,
+		maxBatch: maxBatch,
+		process:  process,
+		in:       make(chan interface{}),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *Coalescer) run() {
+	var batch []interface{}
+	var quiet, deadline <-chan time.Time
+	var quietT, deadlineT *time.Timer
+	release := func() {
+		if quietT != nil {
+			quietT.Stop()
+		}
+		if deadlineT != nil {
+			deadlineT.Stop()
+		}
+		quiet, deadline, quietT, deadlineT = nil, nil, nil, nil
+		if len(batch) > 0 {
+			b := batch
+			batch = nil
+			c.process(b)
+		}
+	}
+	for {
+		select {
+		case v, ok := <-c.in:
+			if !ok {
+				release()
+				close(c.done)
+				return
+			}
+			batch = append(batch, v)
+			if len(batch) == 1 && c.maxDelay > 0 {
+				deadlineT = time.NewTimer(c.maxDelay)
+				deadline = deadlineT.C
+			}
+			if c.maxBatch > 0 && len(batch) >= c.maxBatch {
+				release()
+				continue
+			}
+			if quietT != nil {
+				quietT.Stop()
+			}
+			quietT = time.NewTimer(c.wait)
+			quiet = quietT.C
+		case <-quiet:
+			release()
+		case <-deadline:
+			release()
+		case ack := <-c.flush:
+			release()
+			close(ack)
+		}
+	}
+}
+
+// Add queues an event, it must not be called after Close
+func (c *Coalescer) Add(v interface{}) {
+	c.in <- v
+}
+
+// Flush processes the pending batch immediately and waits for it
+func (c *Coalescer) Flush() {
+	ack := make(chan struct{})
+	select {
+	case c.flush <- ack:
+		<-ack
+	case <-c.done:
+	}
+}
+
+// Close processes the pending batch and stops the Coalescer
+func (c *Coalescer) Close() {
+	c.once.Do(func() { close(c.in) })
+	<-c.done
+}
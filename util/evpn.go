@@ -0,0 +1,326 @@
+package util
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/polarbroadband/goto/tbp"
+)
+
+/* ****************************************
+EVPN/VXLAN overlay state
+**************************************** */
+
+// EVPNInstance holds the configuration of an EVPN instance (MAC-VRF or IP-VRF)
+type EVPNInstance struct {
+	Name     string
+	VNI      int
+	RD       string
+	ImportRT []string
+	ExportRT []string
+}
+
+// EVPNRoute holds a EVPN route of type 2 (MAC/IP), 3 (IMET) or 5 (IP prefix)
+type EVPNRoute struct {
+	Type    int // 2, 3 or 5
+	RD      string
+	VNI     int
+	MAC     string // type 2
+	IP      string // type 2 host address or type 5 prefix
+	NextHop string // originating VTEP
+	Local   bool   // learned locally instead of via BGP
+}
+
+// VTEPPeer holds a remote VXLAN tunnel end point seen by a device
+type VTEPPeer struct {
+	Address string
+	VNI     []int
+	State   string // Up/Down
+}
+
+// EVPNDevice is a per-device snapshot of the overlay state
+type EVPNDevice struct {
+	Name      string
+	VTEP      string // local VTEP source address
+	Instances []EVPNInstance
+	Routes    []EVPNRoute
+	Peers     []VTEPPeer
+}
+
+// AuditFinding records a single failed consistency check
+type AuditFinding struct {
+	Check    string
+	Device   string
+	VNI      int
+	Object   string
+	Detail   string
+	Severity string // Critical/Major/Minor
+}
+
+// vnis returns the VNI to instance index of the device
+func (d *EVPNDevice) vnis() map[int]EVPNInstance {
+	m := make(map[int]EVPNInstance)
+	for _, i := range d.Instances {
+		m[i.VNI] = i
+	}
+	return m
+}
+
+// peerHasVNI returns true if the device sees the remote VTEP for the given VNI
+// a peer without VNI details is considered to carry all VNIs
+func (d *EVPNDevice) peerHasVNI(addr string, vni int) bool {
+	for _, p := range d.Peers {
+		if p.Address != addr {
+			continue
+		}
+		if len(p.VNI) == 0 {
+			return true
+		}
+		for _, v := range p.VNI {
+			if v == vni {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuditEVPN runs cross device consistency checks of the overlay
+// missing VTEPs: a device sharing a VNI is not seen as remote VTEP by the other
+// duplicate MACs: the same MAC in a VNI is learned locally on more than one device
+// asymmetric RTs: route targets exported for a VNI are not imported by the other
+func AuditEVPN(devs []EVPNDevice) []AuditFinding {
+	r := []AuditFinding{}
+	for _, a := range devs {
+		av := a.vnis()
+		for _, b := range devs {
+			if a.Name == b.Name {
+				continue
+			}
+			bv := b.vnis()
+			for vni, ai := range av {
+				bi, ok := bv[vni]
+				if !ok {
+					continue
+				}
+				if b.VTEP != "" && !a.peerHasVNI(b.VTEP, vni) {
+					r = append(r, AuditFinding{
+						Check:    "Missing VTEP",
+						Device:   a.Name,
+						VNI:      vni,
+						Object:   b.VTEP,
+						Detail:   "remote VTEP of " + b.Name + " not found",
+						Severity: "Critical",
+					})
+				}
+				for _, rt := range ai.ExportRT {
+					if !InStrings(rt, bi.ImportRT) {
+						r = append(r, AuditFinding{
+							Check:    "Asymmetric RT",
+							Device:   b.Name,
+							VNI:      vni,
+							Object:   rt,
+							Detail:   "export RT of " + a.Name + " not imported",
+							Severity: "Major",
+						})
+					}
+				}
+			}
+		}
+	}
+	// duplicate MACs
+	owner := make(map[string][]string)
+	for _, d := range devs {
+		seen := make(map[string]struct{})
+		for _, rt := range d.Routes {
+			if rt.Type != 2 || !rt.Local || rt.MAC == "" {
+				continue
+			}
+			k := strconv.Itoa(rt.VNI) + "/" + strings.ToLower(rt.MAC)
+			if _, ok := seen[k]; ok {
+				continue
+			}
+			seen[k] = struct{}{}
+			owner[k] = append(owner[k], d.Name)
+		}
+	}
+	for k, o := range owner {
+		if len(o) < 2 {
+			continue
+		}
+		ks := strings.SplitN(k, "/", 2)
+		vni, _ := strconv.Atoi(ks[0])
+		sort.Strings(o)
+		for _, d := range o {
+			r = append(r, AuditFinding{
+				Check:    "Duplicate MAC",
+				Device:   d,
+				VNI:      vni,
+				Object:   ks[1],
+				Detail:   "learned locally on " + strings.Join(o, ", "),
+				Severity: "Critical",
+			})
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].Check != r[j].Check {
+			return r[i].Check < r[j].Check
+		}
+		if r[i].Device != r[j].Device {
+			return r[i].Device < r[j].Device
+		}
+		if r[i].VNI != r[j].VNI {
+			return r[i].VNI < r[j].VNI
+		}
+		return r[i].Object < r[j].Object
+	})
+	return r
+}
+
+// AuditTable renders audit findings to a html table, critical findings are highlighted
+func AuditTable(f []AuditFinding) string {
+	tb := TableBuilder{
+		FullBorder: true,
+		RowHLs:     map[string][]interface{}{"Severity": {"Critical"}},
+		ColHLs:     []string{"Check"},
+	}
+	for _, e := range f {
+		tb.Data = append(tb.Data, e)
+	}
+	tb.SetHeaders([]string{"Check", "Device", "VNI", "Object", "Detail", "Severity"})
+	return tb.Build()
+}
+
+// ParseJunosEVPNDatabase parses JUNOS "show evpn database" output to type 2 routes
+/*
+Instance: default-switch
+VLAN  DomainId  MAC address        Active source                  Timestamp        IP address
+     10010      00:50:56:aa:00:01  xe-0/0/1.0                     Jan 12 10:11:12  10.1.1.11
+     10010      00:50:56:aa:00:02  10.255.0.2                     Jan 12 10:11:15
+*/
+func ParseJunosEVPNDatabase(s string) []EVPNRoute {
+	r := []EVPNRoute{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	re := regexp.MustCompile(`^\s*(\d+)\s+((?:[0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2})\s+(\S+)\s+\w{3}\s+\d+\s+\d\d:\d\d:\d\d\s*(\S*)\s*$`)
+	reIP := regexp.MustCompile(`^\d+\.\d+\.\d+\.\d+$`)
+	if m, mv := b.MatchInBlock(re); m {
+		for _, v := range mv {
+			rt := EVPNRoute{Type: 2, MAC: v[1], IP: v[3]}
+			rt.VNI, _ = strconv.Atoi(v[0])
+			if reIP.MatchString(v[2]) {
+				rt.NextHop = v[2]
+			} else {
+				rt.Local = true
+			}
+			r = append(r, rt)
+		}
+	}
+	return r
+}
+
+// ParseJunosVTEPPeers parses JUNOS "show ethernet-switching vxlan-tunnel-end-point remote" output
+/*
+Logical System Name       Id  SVTEP-IP         IFL   L3-Idx    SVTEP-Mode    ELP-SVTEP-IP
+<default>                 0   10.255.0.1       lo0.0    0
+ RVTEP-IP         IFL-Idx   Interface    NH-Id   RVTEP-Mode  ELP-IP        Flags
+ 10.255.0.2       586       vtep.32769   1752    RNVE
+    VNID          MC-Group-IP
+    10010         0.0.0.0
+*/
+func ParseJunosVTEPPeers(s string) []VTEPPeer {
+	r := []VTEPPeer{}
+	reRemote := regexp.MustCompile(`^\s(\d+\.\d+\.\d+\.\d+)\s+\d+\s+vtep\.\d+`)
+	reVNI := regexp.MustCompile(`^\s+(\d+)\s+\d+\.\d+\.\d+\.\d+\s*$`)
+	var p *VTEPPeer
+	for _, ln := range strings.Split(s, "\n") {
+		if m := reRemote.FindStringSubmatch(ln); m != nil {
+			if p != nil {
+				r = append(r, *p)
+			}
+			p = &VTEPPeer{Address: m[1], State: "Up"}
+			continue
+		}
+		if m := reVNI.FindStringSubmatch(ln); m != nil && p != nil {
+			vni, _ := strconv.Atoi(m[1])
+			p.VNI = append(p.VNI, vni)
+		}
+	}
+	if p != nil {
+		r = append(r, *p)
+	}
+	return r
+}
+
+// ParseJunosEVPNRoutes parses JUNOS "show route table bgp.evpn.0 detail"
+// output to type 3 and 5 routes, the routes of the local device are Local
+// the VNI of a type 5 route is its ethernet tag, or the route label if the
+// tag is 0, its next hop the protocol next hop
+/*
+bgp.evpn.0: 3 destinations, 3 routes (3 active, 0 holddown, 0 hidden)
+3:10.255.0.2:1::10010::10.255.0.2/248 IM (1 entry, 1 announced)
+        *BGP    Preference: 170/-101
+                Route Distinguisher: 10.255.0.2:1
+                Protocol next hop: 10.255.0.2
+5:10.255.0.2:100::0::10.1.1.0::24/248 (1 entry, 1 announced)
+        *BGP    Preference: 170/-101
+                Route Distinguisher: 10.255.0.2:100
+                Protocol next hop: 10.255.0.2
+                Route Label: 10100
+5:10.255.0.1:100::0::10.1.2.0::24/248 (1 entry, 1 announced)
+        *EVPN   Preference: 170
+                Route Distinguisher: 10.255.0.1:100
+                Route Label: 10100
+*/
+func ParseJunosEVPNRoutes(s string) []EVPNRoute {
+	r := []EVPNRoute{}
+	reIMET := regexp.MustCompile(`^3:(\S+?)::(\d+)::([0-9a-fA-F.:]+)/\d+`)
+	rePrefix := regexp.MustCompile(`^5:(\S+?)::(\d+)::([0-9a-fA-F.:]+)::(\d+)/\d+`)
+	reOther := regexp.MustCompile(`^\d:\S+/\d+`)
+	reProto := regexp.MustCompile(`^\s+\*\[?(BGP|EVPN)\b`)
+	reNextHop := regexp.MustCompile(`^\s+Protocol next hop:\s+(\S+)`)
+	reLabel := regexp.MustCompile(`^\s+Route Label:\s+(\d+)`)
+	var rt *EVPNRoute
+	for _, ln := range strings.Split(s, "\n") {
+		ln = strings.TrimRight(ln, "\r")
+		if m := reIMET.FindStringSubmatch(ln); m != nil {
+			if rt != nil {
+				r = append(r, *rt)
+			}
+			rt = &EVPNRoute{Type: 3, RD: m[1], NextHop: m[3]}
+			rt.VNI, _ = strconv.Atoi(m[2])
+			continue
+		}
+		if m := rePrefix.FindStringSubmatch(ln); m != nil {
+			if rt != nil {
+				r = append(r, *rt)
+			}
+			rt = &EVPNRoute{Type: 5, RD: m[1], IP: m[3] + "/" + m[4]}
+			rt.VNI, _ = strconv.Atoi(m[2])
+			continue
+		}
+		if reOther.MatchString(ln) {
+			// a route of another type ends the current one
+			if rt != nil {
+				r = append(r, *rt)
+			}
+			rt = nil
+			continue
+		}
+		if rt == nil {
+			continue
+		}
+		if m := reProto.FindStringSubmatch(ln); m != nil {
+			rt.Local = m[1] == "EVPN"
+		} else if m := reNextHop.FindStringSubmatch(ln); m != nil && rt.Type == 5 {
+			rt.NextHop = m[1]
+		} else if m := reLabel.FindStringSubmatch(ln); m != nil && rt.Type == 5 && rt.VNI == 0 {
+			rt.VNI, _ = strconv.Atoi(m[1])
+		}
+	}
+	if rt != nil {
+		r = append(r, *rt)
+	}
+	return r
+}
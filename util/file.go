@@ -0,0 +1,107 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/* ****************************************
+file check and hashing
+**************************************** */
+
+// supported hash algorithms
+const (
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+	HashSHA256 = "sha256"
+)
+
+// normHashAlgo normalizes the algorithm name, e.g. SHA-256 to sha256
+func normHashAlgo(algo string) string {
+	return strings.ToLower(strings.Replace(algo, "-", "", -1))
+}
+
+// newHash returns the hasher of the algorithm
+func newHash(algo string) (hash.Hash, error) {
+	switch normHashAlgo(algo) {
+	case HashMD5:
+		return md5.New(), nil
+	case HashSHA1:
+		return sha1.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+}
+
+// FileReport is the result of FileExist
+type FileReport struct {
+	Path    string
+	Exist   bool
+	Size    int64
+	ModTime time.Time
+	Algo    string // hash algorithm, empty if not hashed
+	Sum     string // hex encoded checksum
+}
+
+// FileExist checks a regular file and reports its size and mtime,
+// the checksum is computed too if a hash algorithm (md5, sha1, sha256) is given
+// the file is streamed through the hasher, suitable for multi-GB images
+// a missing file is reported by Exist false without error
+func FileExist(path string, algo ...string) (FileReport, error) {
+	r := FileReport{Path: path}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	if fi.IsDir() {
+		return r, fmt.Errorf("%s is a directory", path)
+	}
+	r.Exist, r.Size, r.ModTime = true, fi.Size(), fi.ModTime()
+	if len(algo) == 0 || algo[0] == "" {
+		return r, nil
+	}
+	r.Sum, err = FileHash(path, algo[0])
+	if err != nil {
+		return r, err
+	}
+	r.Algo = normHashAlgo(algo[0])
+	return r, nil
+}
+
+// FileHash returns the hex encoded checksum of a file, streaming its content
+func FileHash(path, algo string) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyFile tells if the file exists and matches the expected hex checksum
+func VerifyFile(path, algo, sum string) (bool, error) {
+	r, err := FileExist(path, algo)
+	if err != nil || !r.Exist {
+		return false, err
+	}
+	return strings.EqualFold(r.Sum, strings.TrimSpace(sum)), nil
+}
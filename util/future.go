@@ -0,0 +1,144 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/* ****************************************
+future of async call results
+**************************************** */
+
+// Future is the pending result of an Async call
+type Future struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// Async runs f in its own goroutine and returns its Future
+// a panic of f is converted to the error of the Future
+/*
+	fa := util.Async(func() (interface{}, error) { return getLSP(ctx, "r1") })
+	fb := util.Async(func() (interface{}, error) { return getLSP(ctx, "r2") })
+	res, err := util.All(ctx, fa, fb)
+*/
+func Async(f func() (interface{}, error)) *Future {
+	fu := &Future{done: make(chan struct{})}
+	go func() {
+		defer close(fu.done)
+		fu.err = SafeCall("async", func() (err error) {
+			fu.val, err = f()
+			return
+		})
+	}()
+	return fu
+}
+
+// Resolved returns a completed Future
+func Resolved(v interface{}, err error) *Future {
+	fu := &Future{done: make(chan struct{}), val: v, err: err}
+	close(fu.done)
+	return fu
+}
+
+// Done returns the channel closed once the result is available
+func (fu *Future) Done() <-chan struct{} {
+	return fu.done
+}
+
+// Get waits for the result or until ctx is done, the call keeps running
+// in the latter case and can be awaited again
+func (fu *Future) Get(ctx context.Context) (interface{}, error) {
+	select {
+	case <-fu.done:
+		return fu.val, fu.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ready returns true if the result is available, Get won't block
+func (fu *Future) Ready() bool {
+	select {
+	case <-fu.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// All waits for all futures and returns their values in order,
+// it returns early with the first error or once ctx is done
+func All(ctx context.Context, fs ...*Future) ([]interface{}, error) {
+	res := make([]interface{}, len(fs))
+	pending := make(map[int]*Future, len(fs))
+	for i, f := range fs {
+		pending[i] = f
+	}
+	for len(pending) > 0 {
+		i, v, err := first(ctx, pending)
+		if err != nil {
+			if i < 0 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("future %d: %w", i, err)
+		}
+		res[i] = v
+		delete(pending, i)
+	}
+	return res, nil
+}
+
+// ErrAllFailed is returned by Any when every future failed
+var ErrAllFailed = errors.New("all futures failed")
+
+// Any returns the first successful value, or ErrAllFailed wrapping the
+// last error if all failed
+func Any(ctx context.Context, fs ...*Future) (interface{}, error) {
+	pending := make(map[int]*Future, len(fs))
+	for i, f := range fs {
+		pending[i] = f
+	}
+	var last error
+	for len(pending) > 0 {
+		i, v, err := first(ctx, pending)
+		if i < 0 {
+			return nil, err
+		}
+		if err == nil {
+			return v, nil
+		}
+		last = err
+		delete(pending, i)
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAllFailed, last)
+}
+
+// first waits for the first completed future of the set, index -1 if ctx is done
+func first(ctx context.Context, fs map[int]*Future) (int, interface{}, error) {
+	for i, f := range fs {
+		if f.Ready() {
+			return i, f.val, f.err
+		}
+	}
+	done := make(chan int, len(fs))
+	stop := make(chan struct{})
+	defer close(stop)
+	for i, f := range fs {
+		go func(i int, f *Future) {
+			select {
+			case <-f.done:
+				done <- i
+			case <-stop:
+			}
+		}(i, f)
+	}
+	select {
+	case i := <-done:
+		return i, fs[i].val, fs[i].err
+	case <-ctx.Done():
+		return -1, nil, ctx.Err()
+	}
+}
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+gRPC client interceptors
+**************************************** */
+
+// GrpcClientOptions returns the dial options chaining the client
+// interceptors, the counterpart of AuthGrpcUnary/AuthGrpcStream: request
+// ID and trace propagation, logging, retry of the unavailable backend and
+// per attempt timeout, nil retry disables the retries, zero timeout keeps
+// the deadline of the caller
+/*
+	p := util.DefaultRetryPolicy
+	opts := append(util.GrpcClientOptions(5*time.Second, &p), grpc.WithTransportCredentials(creds))
+	conn, err := grpc.Dial(addr, opts...)
+*/
+func GrpcClientOptions(timeout time.Duration, retry *RetryPolicy) []grpc.DialOption {
+	unary := []grpc.UnaryClientInterceptor{RequestIDClientUnary(), GrpcClientUnary(), GrpcLogUnary(nil)}
+	stream := []grpc.StreamClientInterceptor{RequestIDClientStream(), GrpcClientStream(), GrpcLogStream(nil)}
+	if retry != nil {
+		unary = append(unary, GrpcRetryUnary(*retry))
+		stream = append(stream, GrpcRetryStream(*retry))
+	}
+	if timeout > 0 {
+		unary = append(unary, GrpcTimeoutUnary(timeout))
+	}
+	return []grpc.DialOption{grpc.WithChainUnaryInterceptor(unary...), grpc.WithChainStreamInterceptor(stream...)}
+}
+
+// GrpcTimeoutUnary returns the gRPC unary client interceptor bounding each
+// call to the timeout, a shorter deadline of the caller is kept
+// chained after GrpcRetryUnary the timeout applies to each attempt
+func GrpcTimeoutUnary(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// grpcRetryable retries the unavailable backend and the attempts timed out
+// while the caller's context is still alive
+func grpcRetryable(ctx context.Context) func(error) bool {
+	return func(err error) bool {
+		switch status.Code(err) {
+		case codes.Unavailable:
+			return true
+		case codes.DeadlineExceeded:
+			return ctx.Err() == nil
+		}
+		return false
+	}
+}
+
+// GrpcRetryUnary returns the gRPC unary client interceptor retrying the
+// calls failing with Unavailable or DeadlineExceeded with the waits of the
+// policy, p.IsRetryable overrides the classification
+// the error of the last attempt is returned, so the status code is kept
+// a call may be retried after the server processed it, use it for
+// idempotent methods only or pass grpc.WaitForReady(true) to wait for the
+// connection instead
+func GrpcRetryUnary(p RetryPolicy) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		var last error
+		err := Retry(ctx, grpcRetryPolicy(ctx, p, method), func() error {
+			last = invoker(ctx, method, req, reply, cc, opts...)
+			return last
+		})
+		if err != nil && last != nil {
+			return last
+		}
+		return err
+	}
+}
+
+// GrpcRetryStream returns the gRPC stream client interceptor retrying the
+// creation of the stream, see GrpcRetryUnary, the messages of an
+// established stream are never retried
+func GrpcRetryStream(p RetryPolicy) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		var cs grpc.ClientStream
+		var last error
+		err := Retry(ctx, grpcRetryPolicy(ctx, p, method), func() error {
+			cs, last = streamer(ctx, desc, cc, method, opts...)
+			return last
+		})
+		if err != nil && last != nil {
+			return nil, last
+		}
+		return cs, err
+	}
+}
+
+// grpcRetryPolicy completes the policy of a call with the gRPC
+// classification and the retry log
+func grpcRetryPolicy(ctx context.Context, p RetryPolicy, method string) RetryPolicy {
+	if p.IsRetryable == nil {
+		p.IsRetryable = grpcRetryable(ctx)
+	}
+	onRetry := p.OnRetry
+	p.OnRetry = func(attempt int, err error, wait time.Duration) {
+		LoggerFromContext(ctx).WithError(err).WithField("method", method).Debugf("grpc attempt %d failed, retry in %s", attempt, wait)
+		if onRetry != nil {
+			onRetry(attempt, err, wait)
+		}
+	}
+	return p
+}
+
+// logRPC logs the outcome of a call, the failures as warning
+func logRPC(lg *log.Entry, cc *grpc.ClientConn, method string, start time.Time, err error) {
+	lg = lg.WithFields(log.Fields{
+		"method":  method,
+		"target":  cc.Target(),
+		"code":    status.Code(err).String(),
+		"latency": time.Since(start).String(),
+	})
+	if err != nil {
+		lg.WithError(err).Warn("grpc call")
+		return
+	}
+	lg.Debug("grpc call")
+}
+
+// GrpcLogUnary returns the gRPC unary client interceptor logging the method,
+// target, status code and latency of each call, nil lg uses the logger of
+// the context
+func GrpcLogUnary(lg *log.Entry) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		l := lg
+		if l == nil {
+			l = LoggerFromContext(ctx)
+		}
+		logRPC(l, cc, method, start, err)
+		return err
+	}
+}
+
+// GrpcLogStream returns the gRPC stream client interceptor, see
+// GrpcLogUnary, the stream is logged once it ends
+func GrpcLogStream(lg *log.Entry) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		l := lg
+		if l == nil {
+			l = LoggerFromContext(ctx)
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			logRPC(l, cc, method, start, err)
+			return nil, err
+		}
+		return &endClientStream{ClientStream: cs, end: func(err error) { logRPC(l, cc, method, start, err) }}, nil
+	}
+}
+
+// endClientStream calls end once the stream ends, on the first receive
+// error, io.EOF being the normal end
+type endClientStream struct {
+	grpc.ClientStream
+	once sync.Once
+	end  func(error)
+}
+
+func (s *endClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		s.once.Do(func() {
+			if err == io.EOF {
+				s.end(nil)
+				return
+			}
+			s.end(err)
+		})
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+/* ****************************************
+REST to gRPC gateway
+**************************************** */
+
+// GrpcRoute maps a REST route to a unary gRPC method
+// Path segments "{field}" set the request field, dotted paths reach the
+// nested messages, the query parameters set the other fields, repeated
+// fields by repeating the parameter
+// Body is the request field set by the JSON body, "*" for the whole
+// request, "" if the route has no body
+type GrpcRoute struct {
+	Method      string // HTTP method
+	Path        string // e.g. /v1/devices/{name}
+	RPC         string // full gRPC method, e.g. /inventory.Inventory/GetDevice
+	Body        string
+	NewRequest  func() proto.Message
+	NewResponse func() proto.Message
+	// Status of the success response, zero means 200
+	Status int
+}
+
+// grpcRouteSeg is a literal segment or a field capture of a route path
+type grpcRouteSeg struct {
+	lit   string
+	field string
+}
+
+type grpcGatewayRoute struct {
+	GrpcRoute
+	segs []grpcRouteSeg
+}
+
+// GrpcGateway serves JSON/REST routes by calling the gRPC methods on Conn,
+// the messages in the protobuf JSON mapping, the response in the data of
+// the Envelope, the gRPC errors are responded with the HTTP status of
+// their code, see StatusOf
+// the token authenticated by Auth, or the Authorization header otherwise,
+// the request ID and the trace are forwarded in the metadata
+/*
+	gw := util.NewGrpcGateway(api, conn)
+	gw.Handle(util.GrpcRoute{
+		Method:      http.MethodGet,
+		Path:        "/v1/devices/{name}",
+		RPC:         "/inventory.Inventory/GetDevice",
+		NewRequest:  func() proto.Message { return &pb.GetDeviceRequest{} },
+		NewResponse: func() proto.Message { return &pb.Device{} },
+	})
+	gw.Handle(util.GrpcRoute{Method: http.MethodPost, Path: "/v1/devices", RPC: "/inventory.Inventory/CreateDevice",
+		Body: "device", Status: http.StatusCreated, NewRequest: ..., NewResponse: ...})
+	mux.HandleFunc("/v1/", api.Auth(gw.ServeHTTP))
+*/
+type GrpcGateway struct {
+	API  *API
+	Conn *grpc.ClientConn
+	// Marshal encodes the responses
+	Marshal protojson.MarshalOptions
+
+	routes []grpcGatewayRoute
+}
+
+// NewGrpcGateway creates a gateway calling conn, the responses use the
+// proto field names
+func NewGrpcGateway(api *API, conn *grpc.ClientConn) *GrpcGateway {
+	return &GrpcGateway{API: api, Conn: conn, Marshal: protojson.MarshalOptions{UseProtoNames: true}}
+}
+
+// Handle adds the route, the routes are matched in order, panics if the
+// path is invalid like http.ServeMux
+func (g *GrpcGateway) Handle(rt GrpcRoute) {
+	if !strings.HasPrefix(rt.Path, "/") || rt.NewRequest == nil || rt.NewResponse == nil {
+		panic("grpc gateway: invalid route " + rt.Method + " " + rt.Path)
+	}
+	var segs []grpcRouteSeg
+	for _, s := range strings.Split(strings.Trim(rt.Path, "/"), "/") {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			segs = append(segs, grpcRouteSeg{field: s[1 : len(s)-1]})
+			continue
+		}
+		segs = append(segs, grpcRouteSeg{lit: s})
+	}
+	g.routes = append(g.routes, grpcGatewayRoute{rt, segs})
+}
+
+// match returns the route of the request and its path fields, the path
+// matched by another method only sets methodMismatch
+func (g *GrpcGateway) match(r *http.Request) (rt *grpcGatewayRoute, fields map[string]string, methodMismatch bool) {
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i := range g.routes {
+		c := &g.routes[i]
+		if len(c.segs) != len(parts) {
+			continue
+		}
+		f := make(map[string]string)
+		ok := true
+		for j, s := range c.segs {
+			if s.field == "" {
+				ok = s.lit == parts[j]
+			} else {
+				// an escaped slash stays in the field
+				v, err := url.PathUnescape(parts[j])
+				ok = err == nil && v != ""
+				f[s.field] = v
+			}
+			if !ok {
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		if c.Method != r.Method {
+			methodMismatch = true
+			continue
+		}
+		return c, f, false
+	}
+	return nil, nil, methodMismatch
+}
+
+// ServeHTTP transcodes the request to the gRPC call of the matching route
+func (g *GrpcGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt, fields, mismatch := g.match(r)
+	if rt == nil {
+		if mismatch {
+			g.API.Error(w, http.StatusMethodNotAllowed, r.Method+" "+r.URL.Path+" not allowed")
+			return
+		}
+		g.API.Error(w, http.StatusNotFound, r.URL.Path+" not found")
+		return
+	}
+	req := rt.NewRequest()
+	if err := g.decode(r, rt, fields, req); err != nil {
+		g.API.Error(w, 0, err)
+		return
+	}
+	ctx := r.Context()
+	if tok, ok := TokenFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tok)
+	} else if h := r.Header.Get("Authorization"); h != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", h)
+	}
+	res := rt.NewResponse()
+	if err := g.Conn.Invoke(InjectGRPC(InjectRequestID(ctx)), rt.RPC, req, res); err != nil {
+		g.API.Error(w, 0, err, status.Convert(err).Message())
+		return
+	}
+	js, err := g.Marshal.Marshal(res)
+	if err != nil {
+		g.API.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	code := rt.Status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	g.API.Respond(w, code, Envelope{Data: json.RawMessage(js)})
+}
+
+// decode builds the request from the body, the query and the path, in
+// increasing precedence
+func (g *GrpcGateway) decode(r *http.Request, rt *grpcGatewayRoute, fields map[string]string, req proto.Message) error {
+	m := req.ProtoReflect()
+	if rt.Body != "" && r.Body != nil {
+		max := g.API.MaxBody
+		if max <= 0 {
+			max = DefaultMaxBody
+		}
+		b, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, max))
+		if err != nil {
+			return ErrBadInput.Wrap(err)
+		}
+		if len(b) > 0 {
+			target := req
+			if rt.Body != "*" {
+				fd, parent, err := protoField(m, rt.Body)
+				if err != nil {
+					return err
+				}
+				if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+					return ErrBadInput.Wrap(fmt.Errorf("body field %s is not a message", rt.Body))
+				}
+				target = parent.Mutable(fd).Message().Interface()
+			}
+			if err := protojson.Unmarshal(b, target); err != nil {
+				return ErrBadInput.Wrap(err)
+			}
+		}
+	}
+	for k, vs := range r.URL.Query() {
+		if err := setProtoField(m, k, vs); err != nil {
+			return err
+		}
+	}
+	for k, v := range fields {
+		if err := setProtoField(m, k, []string{v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protoField resolves the dotted field path, by proto or JSON name, and
+// returns the last field and the message holding it
+func protoField(m protoreflect.Message, path string) (protoreflect.FieldDescriptor, protoreflect.Message, error) {
+	names := strings.Split(path, ".")
+	for i, n := range names {
+		fds := m.Descriptor().Fields()
+		fd := fds.ByName(protoreflect.Name(n))
+		if fd == nil {
+			fd = fds.ByJSONName(n)
+		}
+		if fd == nil {
+			return nil, nil, ErrBadInput.Wrap(fmt.Errorf("unknown field %s", path))
+		}
+		if i == len(names)-1 {
+			return fd, m, nil
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return nil, nil, ErrBadInput.Wrap(fmt.Errorf("field %s is not a message", n))
+		}
+		m = m.Mutable(fd).Message()
+	}
+	return nil, nil, ErrBadInput.Wrap(fmt.Errorf("empty field path"))
+}
+
+// setProtoField sets the scalar field of the path from the parameter
+// values, a repeated field gets all values, a single one the last
+func setProtoField(m protoreflect.Message, path string, vals []string) error {
+	fd, parent, err := protoField(m, path)
+	if err != nil {
+		return err
+	}
+	if fd.IsMap() {
+		return ErrBadInput.Wrap(fmt.Errorf("map field %s not supported in parameters", path))
+	}
+	if fd.IsList() {
+		l := parent.Mutable(fd).List()
+		for _, s := range vals {
+			v, err := protoScalar(fd, s)
+			if err != nil {
+				return err
+			}
+			l.Append(v)
+		}
+		return nil
+	}
+	v, err := protoScalar(fd, vals[len(vals)-1])
+	if err != nil {
+		return err
+	}
+	parent.Set(fd, v)
+	return nil
+}
+
+// protoScalar parses the parameter as the value of the scalar field
+func protoScalar(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	var v protoreflect.Value
+	var err error
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(s)
+	case protoreflect.BoolKind:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfInt32(int32(n))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		v = protoreflect.ValueOfInt64(n)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 32)
+		v = protoreflect.ValueOfUint32(uint32(n))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 64)
+		v = protoreflect.ValueOfUint64(n)
+	case protoreflect.FloatKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		v = protoreflect.ValueOfFloat32(float32(f))
+	case protoreflect.DoubleKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		v = protoreflect.ValueOfFloat64(f)
+	case protoreflect.BytesKind:
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+			b, err = base64.URLEncoding.DecodeString(s)
+		}
+		v = protoreflect.ValueOfBytes(b)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			v = protoreflect.ValueOfEnum(ev.Number())
+			break
+		}
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfEnum(protoreflect.EnumNumber(n))
+	default:
+		return v, ErrBadInput.Wrap(fmt.Errorf("field %s of kind %s not supported in parameters", fd.Name(), fd.Kind()))
+	}
+	if err != nil {
+		return v, ErrBadInput.Wrap(fmt.Errorf("field %s: %w", fd.Name(), err))
+	}
+	return v, nil
+}
@@ -0,0 +1,360 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+gRPC client connection pool
+**************************************** */
+
+// ErrGrpcPoolClosed is returned by Get of a closed GrpcPool
+var ErrGrpcPoolClosed = errors.New("grpc pool closed")
+
+// grpcPoolConn is a pooled connection and its last health check
+type grpcPoolConn struct {
+	cc      *grpc.ClientConn
+	healthy int32 // atomic, 1 until a check fails
+}
+
+// grpcTarget is the connections of a target
+type grpcTarget struct {
+	conns    []*grpcPoolConn
+	next     uint32
+	lastUsed int64 // atomic, unix nano
+}
+
+// GrpcPool shares the connections to the targets across the callers, Size
+// connections per target dialed on first use, the calls are spread round
+// robin over the healthy ones and, inside each connection, over the
+// addresses the target resolves to
+// a lost connection is reconnected by gRPC with the waits of Backoff, the
+// health loop checks the standard health service of every connection
+// each HealthInterval and closes the targets unused for IdleTimeout
+// the zero GrpcPool is a pool of single connections without health loop,
+// see NewGrpcPool for the defaults
+/*
+	pool := util.NewGrpcPool(2)
+	pool.TLS = tlsCfg
+	pool.Creds = util.NewTokenSource(util.RefreshTokenFunc(nil, refreshURL, refreshToken))
+	defer pool.Close()
+	conn, err := pool.Get(ctx, "dns:///inventory.eu-west:9443")
+	if err != nil {
+		return err
+	}
+	res, err := pb.NewInventoryClient(conn).Get(ctx, req)
+*/
+type GrpcPool struct {
+	// Size is the number of connections per target
+	Size int
+	// TLS of the connections, nil dials plaintext
+	TLS *tls.Config
+	// Creds authenticates the calls, e.g. AuthToken, InsecureAuthToken or *TokenSource
+	Creds credentials.PerRPCCredentials
+	// DialOptions are appended to the options of the pool
+	DialOptions []grpc.DialOption
+	// Backoff paces the reconnects, only the waits are used
+	Backoff RetryPolicy
+	// HealthInterval between the checks, zero disables the health loop
+	HealthInterval time.Duration
+	// HealthService is the checked service, "" checks the whole server
+	HealthService string
+	// IdleTimeout closes the targets not used for that long, zero keeps them
+	IdleTimeout time.Duration
+	Log         *log.Entry
+
+	mu      sync.Mutex
+	targets map[string]*grpcTarget
+	closed  bool
+	loop    sync.Once
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewGrpcPool creates a pool of size connections per target, reconnecting
+// with the waits of DefaultRetryPolicy and checked every 30s
+func NewGrpcPool(size int) *GrpcPool {
+	if size < 1 {
+		size = 1
+	}
+	return &GrpcPool{
+		Size:           size,
+		Backoff:        DefaultRetryPolicy,
+		HealthInterval: 30 * time.Second,
+		Log:            logger.WithField("module", "grpcpool"),
+		targets:        make(map[string]*grpcTarget),
+		stop:           make(chan struct{}),
+	}
+}
+
+// dialOptions returns the options of a pool connection
+func (p *GrpcPool) dialOptions() []grpc.DialOption {
+	bc := backoff.DefaultConfig
+	if p.Backoff.Initial > 0 {
+		bc.BaseDelay = p.Backoff.Initial
+	}
+	if p.Backoff.Multiplier >= 1 {
+		bc.Multiplier = p.Backoff.Multiplier
+	}
+	if p.Backoff.Max > 0 {
+		bc.MaxDelay = p.Backoff.Max
+	}
+	bc.Jitter = p.Backoff.Jitter
+	opts := append(GrpcClientOptions(0, nil),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: bc, MinConnectTimeout: 20 * time.Second}),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`),
+	)
+	if p.TLS != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(p.TLS.Clone())))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if p.Creds != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(p.Creds))
+	}
+	return append(opts, p.DialOptions...)
+}
+
+// init makes the zero GrpcPool usable, must hold the lock
+func (p *GrpcPool) init() {
+	if p.targets == nil {
+		p.targets = make(map[string]*grpcTarget)
+	}
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+	}
+	if p.Log == nil {
+		p.Log = logger.WithField("module", "grpcpool")
+	}
+}
+
+// dial connects the Size connections of the target without blocking
+func (p *GrpcPool) dial(target string) (*grpcTarget, error) {
+	t := &grpcTarget{lastUsed: time.Now().UnixNano()}
+	opts := p.dialOptions()
+	size := p.Size
+	if size < 1 {
+		size = 1
+	}
+	for i := 0; i < size; i++ {
+		cc, err := grpc.Dial(target, opts...)
+		if err != nil {
+			for _, c := range t.conns {
+				c.cc.Close()
+			}
+			return nil, ErrBadInput.Wrap(fmt.Errorf("dial %s: %w", target, err))
+		}
+		t.conns = append(t.conns, &grpcPoolConn{cc: cc, healthy: 1})
+	}
+	p.Log.WithField("target", target).Debugf("%d connections dialed", size)
+	return t, nil
+}
+
+// Get returns a connection to the target, dialing the target on first use,
+// the connection is shared, the caller must not close it
+// while no connection is healthy one is returned anyway, its calls fail
+// with Unavailable until reconnected
+func (p *GrpcPool) Get(ctx context.Context, target string) (*grpc.ClientConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrGrpcPoolClosed
+	}
+	p.init()
+	t, ok := p.targets[target]
+	if !ok {
+		var err error
+		if t, err = p.dial(target); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.targets[target] = t
+		if p.HealthInterval > 0 {
+			p.loop.Do(func() {
+				p.wg.Add(1)
+				go p.healthLoop()
+			})
+		}
+	}
+	// stored under the lock, so evictIdle can't close the target between
+	atomic.StoreInt64(&t.lastUsed, time.Now().UnixNano())
+	p.mu.Unlock()
+	n := uint32(len(t.conns))
+	start := atomic.AddUint32(&t.next, 1)
+	for i := uint32(0); i < n; i++ {
+		c := t.conns[(start+i)%n]
+		if atomic.LoadInt32(&c.healthy) == 1 && c.cc.GetState() != connectivity.TransientFailure {
+			return c.cc, nil
+		}
+	}
+	return t.conns[start%n].cc, nil
+}
+
+// Remove closes the connections of the target, the calls in flight fail
+func (p *GrpcPool) Remove(target string) {
+	p.mu.Lock()
+	t := p.targets[target]
+	delete(p.targets, target)
+	p.mu.Unlock()
+	if t != nil {
+		t.close()
+	}
+}
+
+// close closes the connections of the target
+func (t *grpcTarget) close() {
+	for _, c := range t.conns {
+		c.cc.Close()
+	}
+}
+
+// Targets returns the dialed targets in order
+func (p *GrpcPool) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ts := make([]string, 0, len(p.targets))
+	for t := range p.targets {
+		ts = append(ts, t)
+	}
+	sort.Strings(ts)
+	return ts
+}
+
+// Check is a readiness check failing while a target has no healthy connection
+/*
+	api.Health().AddReadiness("backends", pool.Check, 0)
+*/
+func (p *GrpcPool) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var down []string
+	for name, t := range p.targets {
+		up := false
+		for _, c := range t.conns {
+			if atomic.LoadInt32(&c.healthy) == 1 && c.cc.GetState() != connectivity.TransientFailure {
+				up = true
+				break
+			}
+		}
+		if !up {
+			down = append(down, name)
+		}
+	}
+	if len(down) > 0 {
+		sort.Strings(down)
+		return fmt.Errorf("no healthy connection to %v", down)
+	}
+	return nil
+}
+
+// healthLoop checks the connections and evicts the idle targets until Close
+func (p *GrpcPool) healthLoop() {
+	defer p.wg.Done()
+	defer Recover(p.Log)
+	tk := time.NewTicker(p.HealthInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-tk.C:
+			p.evictIdle()
+			p.checkAll()
+		}
+	}
+}
+
+// evictIdle closes the targets unused for IdleTimeout
+func (p *GrpcPool) evictIdle() {
+	if p.IdleTimeout <= 0 {
+		return
+	}
+	p.mu.Lock()
+	var idle []*grpcTarget
+	for name, t := range p.targets {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&t.lastUsed))) > p.IdleTimeout {
+			idle = append(idle, t)
+			delete(p.targets, name)
+			p.Log.WithField("target", name).Debug("idle target closed")
+		}
+	}
+	p.mu.Unlock()
+	for _, t := range idle {
+		t.close()
+	}
+}
+
+// checkAll checks every connection concurrently, a backend without the
+// health service is healthy as long as the connection is
+func (p *GrpcPool) checkAll() {
+	p.mu.Lock()
+	conns := make(map[*grpcPoolConn]string)
+	for name, t := range p.targets {
+		for _, c := range t.conns {
+			conns[c] = name
+		}
+	}
+	p.mu.Unlock()
+	var wg sync.WaitGroup
+	for c, name := range conns {
+		wg.Add(1)
+		go func(c *grpcPoolConn, name string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultCheckTimeout)
+			defer cancel()
+			err := GRPCServing(c.cc, p.HealthService)(ctx)
+			if status.Code(err) == codes.Unimplemented {
+				err = nil
+			}
+			if err != nil {
+				if atomic.SwapInt32(&c.healthy, 0) == 1 {
+					p.Log.WithError(err).WithField("target", name).Warn("grpc connection unhealthy")
+				}
+				// skip the pending reconnect wait
+				c.cc.ResetConnectBackoff()
+				return
+			}
+			if atomic.SwapInt32(&c.healthy, 1) == 0 {
+				p.Log.WithField("target", name).Info("grpc connection healthy")
+			}
+		}(c, name)
+	}
+	wg.Wait()
+}
+
+// Close stops the health loop and closes all connections
+func (p *GrpcPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.init()
+	p.closed = true
+	targets := p.targets
+	p.targets = make(map[string]*grpcTarget)
+	close(p.stop)
+	p.mu.Unlock()
+	p.wg.Wait()
+	for _, t := range targets {
+		t.close()
+	}
+}
@@ -0,0 +1,205 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+gRPC server builder
+**************************************** */
+
+// gRPC keepalive defaults, the server pings an idle connection every
+// GrpcKeepaliveTime and drops it if unanswered within GrpcKeepaliveTimeout,
+// clients pinging more often than GrpcMinPingInterval are disconnected
+var (
+	GrpcKeepaliveTime    = 30 * time.Second
+	GrpcKeepaliveTimeout = 10 * time.Second
+	GrpcMinPingInterval  = 10 * time.Second
+)
+
+// GrpcServerOptions configures NewGrpcServer
+type GrpcServerOptions struct {
+	TLS *tls.Config
+	// Metrics and Tracer instrument the calls, optional
+	Metrics *Metrics
+	Tracer  *Tracer
+	// Unary and Stream run after the auth interceptors, e.g. RequireGrpcUnary
+	Unary  []grpc.UnaryServerInterceptor
+	Stream []grpc.StreamServerInterceptor
+	// NoAuth skips the auth interceptors, for internal services only
+	NoAuth bool
+	// MaxConnectionAge recycles the connections, so the clients rebalance
+	// over new backends, zero keeps them
+	MaxConnectionAge time.Duration
+	// Reflection registers the reflection service, e.g. for grpcurl
+	Reflection bool
+	// ServerOptions are appended, e.g. grpc.MaxRecvMsgSize
+	ServerOptions []grpc.ServerOption
+}
+
+// NewGrpcServer creates a gRPC server chaining, in order, the request ID
+// and logging, the recovery, the tracer, the metrics, the auth and the
+// extra interceptors, with keepalive enforcement
+/*
+	srv := api.NewGrpcServer(util.GrpcServerOptions{
+		TLS:        tlsCfg,
+		Metrics:    metrics,
+		Unary:      []grpc.UnaryServerInterceptor{api.RequireGrpcUnary(util.HasRole("admin"))},
+		Reflection: true,
+	})
+	pb.RegisterInventoryServer(srv, &inventory{})
+	err := api.ServeGRPC(ctx, ":50051", nil, util.ServeGRPCServer(srv))
+*/
+func (api *API) NewGrpcServer(o GrpcServerOptions) *grpc.Server {
+	unary := []grpc.UnaryServerInterceptor{api.LogGrpcUnary, api.RecoverGrpcUnary}
+	stream := []grpc.StreamServerInterceptor{api.LogGrpcStream, api.RecoverGrpcStream}
+	if o.Tracer != nil {
+		unary = append(unary, o.Tracer.GrpcUnary())
+		stream = append(stream, o.Tracer.GrpcStream())
+	}
+	if o.Metrics != nil {
+		unary = append(unary, o.Metrics.GrpcUnary())
+		stream = append(stream, o.Metrics.GrpcStream())
+	}
+	if !o.NoAuth {
+		unary = append(unary, api.AuthGrpcUnary)
+		stream = append(stream, api.AuthGrpcStream)
+	}
+	sopts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(append(unary, o.Unary...)...),
+		grpc.ChainStreamInterceptor(append(stream, o.Stream...)...),
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:             GrpcKeepaliveTime,
+			Timeout:          GrpcKeepaliveTimeout,
+			MaxConnectionAge: o.MaxConnectionAge,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             GrpcMinPingInterval,
+			PermitWithoutStream: true,
+		}),
+	}
+	if o.TLS != nil {
+		sopts = append(sopts, grpc.Creds(credentials.NewTLS(o.TLS)))
+	}
+	srv := grpc.NewServer(append(sopts, o.ServerOptions...)...)
+	if o.Reflection {
+		reflection.Register(srv)
+	}
+	return srv
+}
+
+// grpcPanic logs the panic of a call and returns it as Internal
+func (api *API) grpcPanic(ctx context.Context, method string, rec interface{}) error {
+	lg := api.Log
+	if RequestIDFromContext(ctx) != "" || lg == nil {
+		lg = LoggerFromContext(ctx)
+	}
+	reportPanic(lg.WithField("method", method), method, rec)
+	return status.Error(codes.Internal, "Internal server error")
+}
+
+// RecoverGrpcUnary converts a panic of the handler to Internal, logged with
+// the stack trace and passed to PanicReporter, see Recoverer
+func (api *API) RecoverGrpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			res, err = nil, api.grpcPanic(ctx, info.FullMethod, rec)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// RecoverGrpcStream is the stream interceptor of RecoverGrpcUnary
+func (api *API) RecoverGrpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = api.grpcPanic(ss.Context(), info.FullMethod, rec)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// grpcClientErr are the codes caused by the caller, logged as warning
+var grpcClientErr = map[codes.Code]bool{
+	codes.Canceled:           true,
+	codes.InvalidArgument:    true,
+	codes.NotFound:           true,
+	codes.AlreadyExists:      true,
+	codes.PermissionDenied:   true,
+	codes.ResourceExhausted:  true,
+	codes.FailedPrecondition: true,
+	codes.Aborted:            true,
+	codes.OutOfRange:         true,
+	codes.Unauthenticated:    true,
+}
+
+// logCall assigns the request ID of the call and returns the context
+// reporting the identity and the function logging the outcome
+func (api *API) logCall(ctx context.Context, method string) (context.Context, func(error)) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = api.grpcRequestID(ctx, md)
+	var id *Identity
+	ctx = contextWithIdentitySlot(ctx, &id)
+	return ctx, func(err error) {
+		code := status.Code(err)
+		lg := LoggerFromContext(ctx).WithFields(log.Fields{
+			"method":  method,
+			"code":    code.String(),
+			"latency": time.Since(start).String(),
+		})
+		if p, ok := peer.FromContext(ctx); ok {
+			lg = lg.WithField("remote", p.Addr.String())
+		}
+		if id != nil {
+			lg = lg.WithField("subject", id.Subject)
+		}
+		switch {
+		case err == nil:
+			lg.Info("rpc")
+		case grpcClientErr[code]:
+			lg.WithError(err).Warn("rpc")
+		default:
+			lg.WithError(err).Error("rpc")
+		}
+	}
+}
+
+// LogGrpcUnary logs the method, status code, latency, peer and the identity
+// authenticated by the inner interceptors of each call, the request ID is
+// assigned here so all log lines share it, see LogRequests
+func (api *API) LogGrpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done := api.logCall(ctx, info.FullMethod)
+	res, err := handler(ctx, req)
+	done(err)
+	return res, err
+}
+
+// LogGrpcStream is the stream interceptor of LogGrpcUnary, logged once the stream ends
+func (api *API) LogGrpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, done := api.logCall(ss.Context(), info.FullMethod)
+	err := handler(srv, &ctxStream{ss, ctx})
+	done(err)
+	return err
+}
+
+// ServeGRPCServer serves the server of NewGrpcServer in ServeGRPC instead
+// of the default one, the register function and the other gRPC options of
+// ServeGRPC are ignored
+func ServeGRPCServer(srv *grpc.Server) ServeOption {
+	return func(c *serveConfig) {
+		c.grpcServer = srv
+	}
+}
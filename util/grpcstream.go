@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+gRPC server stream flow control
+**************************************** */
+
+// throttledStream paces the sends of the stream
+type throttledStream struct {
+	grpc.ServerStream
+	tb *TokenBucket
+}
+
+// SendMsg waits for the pace of the stream, the stream context ends the wait
+func (s *throttledStream) SendMsg(m interface{}) error {
+	if err := s.tb.Wait(s.Context()); err != nil {
+		return streamCtxErr(err)
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// ThrottleStream returns the stream sending at most perSec messages per second,
+// without bursts, the wait ends when the client cancels
+/*
+	func (s *telemetry) Subscribe(req *pb.SubscribeRequest, stream pb.Telemetry_SubscribeServer) error {
+		updates := make(chan interface{}, 256)
+		go s.collect(stream.Context(), req.Device, updates) // closes updates
+		return util.SendLoop(util.ThrottleStream(stream, 50), updates)
+	}
+*/
+func ThrottleStream(ss grpc.ServerStream, perSec float64) grpc.ServerStream {
+	return &throttledStream{ServerStream: ss, tb: NewTokenBucket(perSec, 1)}
+}
+
+// streamCtxErr converts the context error of the stream to its status
+func streamCtxErr(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, "client cancelled the stream")
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, "stream deadline exceeded")
+	}
+	return err
+}
+
+// SendLoop sends the messages of in until it's closed, which returns nil,
+// the client cancels or the deadline passes, which returns Canceled or
+// DeadlineExceeded, or a send fails
+// the producer of in must stop on the stream context, a send blocked by
+// a slow client holds back the loop, not the producer, if in is buffered
+func SendLoop(ss grpc.ServerStream, in <-chan interface{}) error {
+	ctx := ss.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return streamCtxErr(ctx.Err())
+		case m, ok := <-in:
+			if !ok {
+				return nil
+			}
+			if err := ss.SendMsg(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// BatchLoop collects the messages of in and flushes them once max are
+// collected or interval passed since the first one, so a fast producer is
+// sent fewer, larger messages, the rest is flushed when in is closed
+// it returns like SendLoop, with the context of ctx
+/*
+	err := util.BatchLoop(stream.Context(), updates, 100, 200*time.Millisecond, func(batch []interface{}) error {
+		res := &pb.Updates{}
+		for _, u := range batch {
+			res.Items = append(res.Items, u.(*pb.Update))
+		}
+		return stream.Send(res)
+	})
+*/
+func BatchLoop(ctx context.Context, in <-chan interface{}, max int, interval time.Duration, flush func(batch []interface{}) error) error {
+	if max < 1 {
+		max = 1
+	}
+	batch := make([]interface{}, 0, max)
+	t := time.NewTimer(interval)
+	t.Stop()
+	defer t.Stop()
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := flush(batch)
+		batch = make([]interface{}, 0, max)
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return streamCtxErr(ctx.Err())
+		case <-t.C:
+			if err := send(); err != nil {
+				return err
+			}
+		case m, ok := <-in:
+			if !ok {
+				return send()
+			}
+			batch = append(batch, m)
+			if len(batch) == 1 {
+				t.Reset(interval)
+			}
+			if len(batch) >= max {
+				if !t.Stop() {
+					// drain the fired timer so the next batch waits its interval
+					select {
+					case <-t.C:
+					default:
+					}
+				}
+				if err := send(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
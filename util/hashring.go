@@ -0,0 +1,148 @@
+package util
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/* ****************************************
+consistent hashing ring
+**************************************** */
+
+// HashRing distributes keys to members by consistent hashing
+// each member takes VNodes*weight virtual nodes on the ring, so adding or
+// removing a member only moves the keys owned by it, safe for concurrent use
+type HashRing struct {
+	mu      sync.RWMutex
+	vnodes  int
+	members map[string]int // member to weight
+	points  []uint64       // sorted virtual node hashes
+	owner   map[uint64]string
+}
+
+// NewHashRing creates an empty HashRing, vnodes is the virtual node count per weight unit
+func NewHashRing(vnodes int) *HashRing {
+	if vnodes < 1 {
+		vnodes = 100
+	}
+	return &HashRing{vnodes: vnodes, members: make(map[string]int), owner: make(map[uint64]string)}
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv of short similar strings is poorly mixed, apply a finalizer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// rebuild recalculates the ring, must hold the lock
+func (hr *HashRing) rebuild() {
+	hr.points = hr.points[:0]
+	hr.owner = make(map[uint64]string)
+	names := make([]string, 0, len(hr.members))
+	for m := range hr.members {
+		names = append(names, m)
+	}
+	// deterministic owner on hash collision regardless of insertion order
+	sort.Strings(names)
+	for _, m := range names {
+		for i := 0; i < hr.vnodes*hr.members[m]; i++ {
+			p := ringHash(m + "#" + strconv.Itoa(i))
+			if _, ok := hr.owner[p]; ok {
+				continue
+			}
+			hr.owner[p] = m
+			hr.points = append(hr.points, p)
+		}
+	}
+	sort.Slice(hr.points, func(i, j int) bool { return hr.points[i] < hr.points[j] })
+}
+
+// Add puts a member to the ring or updates its weight, weight less than 1 is taken as 1
+func (hr *HashRing) Add(member string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.members[member] = weight
+	hr.rebuild()
+}
+
+// Remove takes a member off the ring
+func (hr *HashRing) Remove(member string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	if _, ok := hr.members[member]; !ok {
+		return
+	}
+	delete(hr.members, member)
+	hr.rebuild()
+}
+
+// Members returns the sorted member list
+func (hr *HashRing) Members() []string {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	r := []string{}
+	for m := range hr.members {
+		r = append(r, m)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Get returns the member owning the key, empty string if the ring is empty
+func (hr *HashRing) Get(key string) string {
+	r := hr.GetN(key, 1)
+	if len(r) == 0 {
+		return ""
+	}
+	return r[0]
+}
+
+// GetN returns up to n distinct members for the key in ring order
+// the first is the owner, the rest can serve as replicas or fallbacks
+func (hr *HashRing) GetN(key string, n int) []string {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	r := []string{}
+	if len(hr.points) == 0 || n < 1 {
+		return r
+	}
+	if n > len(hr.members) {
+		n = len(hr.members)
+	}
+	h := ringHash(key)
+	i := sort.Search(len(hr.points), func(i int) bool { return hr.points[i] >= h })
+	for j := 0; len(r) < n && j < len(hr.points); j++ {
+		m := hr.owner[hr.points[(i+j)%len(hr.points)]]
+		if !InStrings(m, r) {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// Owns returns true if the member owns the key, handy for a replica
+// to filter its share of the inventory
+func (hr *HashRing) Owns(member, key string) bool {
+	return hr.Get(key) == member
+}
+
+// Distribute assigns the keys to their owners
+func (hr *HashRing) Distribute(keys []string) map[string][]string {
+	r := make(map[string][]string)
+	for _, k := range keys {
+		if m := hr.Get(k); m != "" {
+			r[m] = append(r[m], k)
+		}
+	}
+	return r
+}
@@ -0,0 +1,196 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+/* ****************************************
+health and readiness
+**************************************** */
+
+// DefaultCheckTimeout applies to the checks registered without timeout
+var DefaultCheckTimeout = 5 * time.Second
+
+// healthCheck is a registered checker
+type healthCheck struct {
+	name    string
+	f       func(context.Context) error
+	timeout time.Duration
+}
+
+// CheckResult is the outcome of a check in the health response
+type CheckResult struct {
+	Status   string `json:"status"` // ok or fail
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthReport is the JSON body of /healthz and /readyz
+type HealthReport struct {
+	Service string                 `json:"service,omitempty"`
+	Status  string                 `json:"status"`
+	Checks  map[string]CheckResult `json:"checks"`
+}
+
+// Health serves the liveness (/healthz) and readiness (/readyz) probes,
+// the checks run concurrently, each within its timeout, a failing or
+// panicking check responds 503
+// liveness checks should only detect a broken process, the dependencies
+// (database, backends) belong to readiness
+type Health struct {
+	Name string
+
+	mu    sync.Mutex
+	live  []healthCheck
+	ready []healthCheck
+}
+
+// healthMu guards the lazy creation of API.health
+var healthMu sync.Mutex
+
+// Health returns the health probes of the API, created on first use
+/*
+	h := api.Health()
+	h.AddReadiness("mongo", util.MongoPing(client), 2*time.Second)
+	h.AddReadiness("inventory", util.GRPCServing(conn, ""), 0)
+	h.Register(mux)
+*/
+func (api *API) Health() *Health {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if api.health == nil {
+		api.health = &Health{}
+	}
+	return api.health
+}
+
+// AddLiveness registers a liveness check, zero timeout uses DefaultCheckTimeout
+func (h *Health) AddLiveness(name string, f func(context.Context) error, timeout time.Duration) {
+	h.mu.Lock()
+	h.live = append(h.live, healthCheck{name, f, timeout})
+	h.mu.Unlock()
+}
+
+// AddReadiness registers a readiness check, zero timeout uses DefaultCheckTimeout
+func (h *Health) AddReadiness(name string, f func(context.Context) error, timeout time.Duration) {
+	h.mu.Lock()
+	h.ready = append(h.ready, healthCheck{name, f, timeout})
+	h.mu.Unlock()
+}
+
+// run runs the checks concurrently and reports them
+func (h *Health) run(ctx context.Context, checks []healthCheck) HealthReport {
+	rep := HealthReport{Service: h.Name, Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			timeout := c.timeout
+			if timeout <= 0 {
+				timeout = DefaultCheckTimeout
+			}
+			cctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			errc := make(chan error, 1)
+			go func() { errc <- SafeCall(c.name, func() error { return c.f(cctx) }) }()
+			var err error
+			select {
+			case err = <-errc:
+			case <-cctx.Done():
+				// the check ignores its context
+				err = fmt.Errorf("timeout after %s", timeout)
+			}
+			res := CheckResult{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status, res.Error = "fail", err.Error()
+			}
+			mu.Lock()
+			rep.Checks[c.name] = res
+			if err != nil {
+				rep.Status = "fail"
+			}
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return rep
+}
+
+// serve runs the checks and responds the report
+func (h *Health) serve(w http.ResponseWriter, r *http.Request, checks []healthCheck) {
+	rep := h.run(r.Context(), checks)
+	code := http.StatusOK
+	if rep.Status != "ok" {
+		code = http.StatusServiceUnavailable
+		failed := make([]string, 0, len(rep.Checks))
+		for n, c := range rep.Checks {
+			if c.Status != "ok" {
+				failed = append(failed, n)
+			}
+		}
+		sort.Strings(failed)
+		logger.WithField("checks", failed).Warn(r.URL.Path + " failed")
+	}
+	w.Header().Set("Content-Type", ContentJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
+
+// Healthz serves the liveness probe
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	checks := append([]healthCheck{}, h.live...)
+	h.mu.Unlock()
+	h.serve(w, r, checks)
+}
+
+// Readyz serves the readiness probe, the liveness checks are included
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	checks := append(append([]healthCheck{}, h.live...), h.ready...)
+	h.mu.Unlock()
+	h.serve(w, r, checks)
+}
+
+// Register serves /healthz and /readyz on the mux
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.Healthz)
+	mux.HandleFunc("/readyz", h.Readyz)
+}
+
+// MongoPing returns a check pinging the mongo deployment
+func MongoPing(client *mongo.Client) func(context.Context) error {
+	return func(ctx context.Context) error {
+		return client.Ping(ctx, nil)
+	}
+}
+
+// GRPCServing returns a check calling the standard gRPC health service of
+// the backend, the service must report SERVING, "" checks the whole server
+func GRPCServing(conn *grpc.ClientConn, service string) func(context.Context) error {
+	client := grpc_health_v1.NewHealthClient(conn)
+	return func(ctx context.Context) error {
+		res, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+		if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+			return fmt.Errorf("%s %s", conn.Target(), res.Status)
+		}
+		return nil
+	}
+}
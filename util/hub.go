@@ -0,0 +1,214 @@
+package util
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* ****************************************
+in-process publish/subscribe hub
+**************************************** */
+
+// SlowPolicy decides what Hub.Publish does when a subscriber buffer is full
+type SlowPolicy int
+
+const (
+	// DropNewest discards the message being published for the subscriber
+	DropNewest SlowPolicy = iota
+	// DropOldest discards the oldest buffered message to make room
+	DropOldest
+	// Disconnect unsubscribes the subscriber, its channel is closed
+	Disconnect
+)
+
+// HubAllTopics subscribes to every topic
+const HubAllTopics = "*"
+
+// Message is a published value
+type Message struct {
+	Topic string
+	Value interface{}
+	Time  time.Time
+}
+
+// Subscription receives the messages of its topics on C, which is
+// closed once unsubscribed or the hub is closed
+type Subscription struct {
+	C <-chan Message
+
+	hub     *Hub
+	topics  []string
+	ch      chan Message
+	mu      sync.Mutex // serializes the sends of concurrent publishers
+	dropped uint64
+}
+
+// Unsubscribe removes the subscription from the hub
+func (s *Subscription) Unsubscribe() {
+	s.hub.Unsubscribe(s)
+}
+
+// Dropped returns the number of messages lost by the slow policy
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// deliver sends the message without blocking by the policy,
+// returns false if the subscriber should be disconnected
+func (s *Subscription) deliver(m Message, p SlowPolicy) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.ch <- m:
+		return true
+	default:
+	}
+	switch p {
+	case DropOldest:
+		select {
+		case <-s.ch:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+		select {
+		case s.ch <- m:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+		return true
+	case Disconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return true
+}
+
+// Hub fans out the published messages to the subscribers of the topic,
+// publishing never blocks, slow subscribers are handled by the policy
+/*
+	hub := util.NewHub(64, util.DropOldest)
+	sub := hub.Subscribe("lsp")
+	defer sub.Unsubscribe()
+	go func() {
+		for m := range sub.C {
+			...
+		}
+	}()
+	hub.Publish("lsp", change)
+*/
+type Hub struct {
+	Buffer int
+	Policy SlowPolicy
+
+	mu     sync.RWMutex
+	subs   map[string]map[*Subscription]struct{}
+	closed bool
+}
+
+// NewHub creates a Hub with the subscriber buffer size and slow consumer policy
+func NewHub(buffer int, policy SlowPolicy) *Hub {
+	return &Hub{Buffer: buffer, Policy: policy, subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe creates a subscription to the topics, HubAllTopics for all
+// a subscription to a closed hub gets a closed channel
+func (h *Hub) Subscribe(topics ...string) *Subscription {
+	ch := make(chan Message, h.Buffer)
+	s := &Subscription{C: ch, hub: h, topics: topics, ch: ch}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return s
+	}
+	for _, t := range topics {
+		if h.subs[t] == nil {
+			h.subs[t] = make(map[*Subscription]struct{})
+		}
+		h.subs[t][s] = struct{}{}
+	}
+	return s
+}
+
+// Unsubscribe removes the subscription and closes its channel
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove unregisters s, the caller holds the lock
+func (h *Hub) remove(s *Subscription) {
+	found := false
+	for _, t := range s.topics {
+		if set, ok := h.subs[t]; ok {
+			if _, ok := set[s]; ok {
+				found = true
+				delete(set, s)
+			}
+			if len(set) == 0 {
+				delete(h.subs, t)
+			}
+		}
+	}
+	if found {
+		close(s.ch)
+	}
+}
+
+// Publish delivers the value to the subscribers of the topic and of all
+// topics, returns the number of subscribers it was delivered to
+func (h *Hub) Publish(topic string, v interface{}) int {
+	m := Message{Topic: topic, Value: v, Time: time.Now()}
+	n := 0
+	var slow []*Subscription
+	h.mu.RLock()
+	seen := make(map[*Subscription]bool)
+	for _, t := range []string{topic, HubAllTopics} {
+		for s := range h.subs[t] {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			if s.deliver(m, h.Policy) {
+				n++
+			} else {
+				slow = append(slow, s)
+			}
+		}
+	}
+	h.mu.RUnlock()
+	if len(slow) > 0 {
+		h.mu.Lock()
+		for _, s := range slow {
+			h.remove(s)
+		}
+		h.mu.Unlock()
+	}
+	return n
+}
+
+// Topics returns the number of subscribers per topic
+func (h *Hub) Topics() map[string]int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	res := make(map[string]int, len(h.subs))
+	for t, set := range h.subs {
+		res[t] = len(set)
+	}
+	return res
+}
+
+// Close removes all subscriptions, later subscriptions get closed channels
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, set := range h.subs {
+		for s := range set {
+			h.remove(s)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* ****************************************
+IPv6 readiness audit
+**************************************** */
+
+// InterfaceFacts holds the addressing and filter facts of a logical interface
+type InterfaceFacts struct {
+	Name       string
+	IPv4       []string
+	IPv6       []string
+	RA         bool              // router advertisement configured
+	Filter4    map[string]string // direction (input/output) to IPv4 filter name
+	Filter6    map[string]string // direction (input/output) to IPv6 filter name
+	Disabled   bool
+	Unnumbered bool
+}
+
+// DeviceFacts holds the facts of a device required by the audits
+type DeviceFacts struct {
+	Name       string
+	Interfaces []InterfaceFacts
+}
+
+// IPv6AuditOption tunes the IPv6 readiness audit
+type IPv6AuditOption struct {
+	Exclude   *regexp.Regexp // interfaces not subject to the audit, e.g. management
+	RARequire *regexp.Regexp // interfaces require router advertisement, nil for all dual-stack
+}
+
+// globalV6 returns true if the address list has at least one non link-local address
+func globalV6(addrs []string) bool {
+	for _, a := range addrs {
+		if !strings.HasPrefix(strings.ToLower(a), "fe80:") {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditIPv6 reports the IPv6 gaps of the devices
+// missing IPv6 address: interface with IPv4 address but no global IPv6 address
+// missing RA: dual-stack interface without router advertisement
+// v4-only ACL: IPv4 filter applied without the IPv6 counterpart in the same direction
+func AuditIPv6(devs []DeviceFacts, opt IPv6AuditOption) []AuditFinding {
+	r := []AuditFinding{}
+	for _, d := range devs {
+		for _, i := range d.Interfaces {
+			if i.Disabled || (opt.Exclude != nil && opt.Exclude.MatchString(i.Name)) {
+				continue
+			}
+			dual := len(i.IPv4) > 0 && globalV6(i.IPv6)
+			if len(i.IPv4) > 0 && !globalV6(i.IPv6) && !i.Unnumbered {
+				r = append(r, AuditFinding{
+					Check:    "Missing IPv6 address",
+					Device:   d.Name,
+					Object:   i.Name,
+					Detail:   "IPv4 " + strings.Join(i.IPv4, " ") + " without IPv6 counterpart",
+					Severity: "Major",
+				})
+			}
+			if dual && !i.RA && (opt.RARequire == nil || opt.RARequire.MatchString(i.Name)) {
+				r = append(r, AuditFinding{
+					Check:    "Missing RA",
+					Device:   d.Name,
+					Object:   i.Name,
+					Detail:   "router advertisement not configured",
+					Severity: "Minor",
+				})
+			}
+			for _, dir := range []string{"input", "output"} {
+				f4, ok := i.Filter4[dir]
+				if !ok {
+					continue
+				}
+				if _, ok := i.Filter6[dir]; !ok && globalV6(i.IPv6) {
+					r = append(r, AuditFinding{
+						Check:    "v4-only ACL",
+						Device:   d.Name,
+						Object:   i.Name,
+						Detail:   fmt.Sprintf("%s filter %s has no IPv6 counterpart", dir, f4),
+						Severity: "Critical",
+					})
+				}
+			}
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].Device != r[j].Device {
+			return r[i].Device < r[j].Device
+		}
+		return r[i].Object < r[j].Object
+	})
+	return r
+}
+
+// IPv6Report renders the IPv6 readiness audit as a html compliance report
+// a per device summary followed by the list of findings
+func IPv6Report(devs []DeviceFacts, f []AuditFinding) string {
+	cnt := make(map[string]int)
+	for _, e := range f {
+		cnt[e.Device]++
+	}
+	sum := [][]string{{"Device", "Interfaces", "Findings", "Compliant"}}
+	for _, d := range devs {
+		mark := MarkPass
+		if cnt[d.Name] > 0 {
+			mark = MarkFail
+		}
+		sum = append(sum, []string{d.Name, fmt.Sprint(len(d.Interfaces)), fmt.Sprint(cnt[d.Name]), mark})
+	}
+	tb := TableBuilder{
+		FullBorder: true,
+		RowHLs:     map[string][]interface{}{"Severity": {"Critical"}},
+	}
+	for _, e := range f {
+		tb.Data = append(tb.Data, e)
+	}
+	tb.SetHeaders([]string{"Device", "Object", "Check", "Detail", "Severity"}, []string{"Device", "Interface", "Check", "Detail", "Severity"})
+	return `<h3>IPv6 Readiness Summary</h3>` + MakeHtmlTable(sum) + `<h3>IPv6 Readiness Findings</h3>` + tb.Build()
+}
+
+// ParseJunosFacts collects interface facts from JUNOS "show configuration | display set" output
+func ParseJunosFacts(name, cfg string) DeviceFacts {
+	reAddr := regexp.MustCompile(`^set interfaces (\S+) unit (\d+) family (inet6?) address (\S+)`)
+	reFilter := regexp.MustCompile(`^set interfaces (\S+) unit (\d+) family (inet6?) filter (input|output) (\S+)`)
+	reUnnum := regexp.MustCompile(`^set interfaces (\S+) unit (\d+) family inet unnumbered-address`)
+	reDisable := regexp.MustCompile(`^set interfaces (\S+)(?: unit (\d+))? disable$`)
+	reRA := regexp.MustCompile(`^set protocols router-advertisement interface (\S+)`)
+	ifs := make(map[string]*InterfaceFacts)
+	order := []string{}
+	get := func(n string) *InterfaceFacts {
+		i, ok := ifs[n]
+		if !ok {
+			i = &InterfaceFacts{Name: n, Filter4: map[string]string{}, Filter6: map[string]string{}}
+			ifs[n] = i
+			order = append(order, n)
+		}
+		return i
+	}
+	disabled := []string{}
+	for _, ln := range strings.Split(cfg, "\n") {
+		ln = strings.TrimSpace(ln)
+		if m := reAddr.FindStringSubmatch(ln); m != nil {
+			i := get(m[1] + "." + m[2])
+			if m[3] == "inet" {
+				i.IPv4 = append(i.IPv4, m[4])
+			} else {
+				i.IPv6 = append(i.IPv6, m[4])
+			}
+		} else if m := reFilter.FindStringSubmatch(ln); m != nil {
+			i := get(m[1] + "." + m[2])
+			if m[3] == "inet" {
+				i.Filter4[m[4]] = m[5]
+			} else {
+				i.Filter6[m[4]] = m[5]
+			}
+		} else if m := reUnnum.FindStringSubmatch(ln); m != nil {
+			get(m[1] + "." + m[2]).Unnumbered = true
+		} else if m := reRA.FindStringSubmatch(ln); m != nil {
+			get(m[1]).RA = true
+		} else if m := reDisable.FindStringSubmatch(ln); m != nil {
+			if m[2] != "" {
+				disabled = append(disabled, m[1]+"."+m[2])
+			} else {
+				disabled = append(disabled, m[1]+".")
+			}
+		}
+	}
+	// keep the order of the configuration
+	d := DeviceFacts{Name: name}
+	for _, n := range order {
+		i := ifs[n]
+		for _, ds := range disabled {
+			if n == ds || (strings.HasSuffix(ds, ".") && strings.HasPrefix(n, ds)) {
+				i.Disabled = true
+			}
+		}
+		d.Interfaces = append(d.Interfaces, *i)
+	}
+	return d
+}
@@ -0,0 +1,310 @@
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+JWT verification keys
+**************************************** */
+
+// KeySource provides the verification key of a token, e.g. by its "kid" header
+// the key must suit the token algorithm, see checkAlg
+type KeySource interface {
+	Key(token *jwt.Token) (interface{}, error)
+}
+
+// checkAlg verifies the token algorithm matches the key type, which
+// prevents e.g. a HMAC token signed with a public key as secret
+func checkAlg(token *jwt.Token, key interface{}) (interface{}, error) {
+	ok := false
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+		if !ok {
+			_, ok = token.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+	return key, nil
+}
+
+// StaticKeys maps key IDs to keys, *rsa.PublicKey, *ecdsa.PublicKey or
+// []byte HMAC secret, the "" entry is used for tokens without "kid"
+type StaticKeys map[string]interface{}
+
+// Key returns the key of the token kid
+func (k StaticKeys) Key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := k[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return checkAlg(token, key)
+}
+
+// LoadPublicKey reads a PEM encoded RSA or ECDSA public key or certificate
+func LoadPublicKey(fileName string) (interface{}, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if k, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return k, nil
+	}
+	if k, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: no RSA or ECDSA public key found", fileName)
+}
+
+// JWKS is a KeySource fetching the keys from a JSON Web Key Set URL, e.g. of
+// an OIDC provider, the keys are cached and refreshed periodically or when
+// a token refers to an unknown key id, which follows the provider key rotation
+// the tokens must be of Issuer and for Audience, the provider signs the
+// tokens of all its clients with the same keys
+/*
+	api.Keys = util.NewJWKS("https://sso.example.com/.well-known/jwks.json", "https://sso.example.com", "inventory", time.Hour)
+*/
+type JWKS struct {
+	URL    string
+	Client *http.Client
+	// Issuer and Audience are the required iss and aud of the tokens
+	Issuer, Audience string
+	// Refresh is the max age of the cached keys
+	Refresh time.Duration
+	// MinInterval throttles the fetches triggered by unknown key ids
+	MinInterval time.Duration
+	Log         *log.Entry
+
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	fetched  time.Time
+	fetching chan struct{} // closed when the fetch in progress is done
+	fetchErr error         // of the last fetch
+}
+
+// NewJWKS creates a JWKS key source of the tokens of issuer for audience,
+// the keys are fetched on first use
+func NewJWKS(url, issuer, audience string, refresh time.Duration) *JWKS {
+	return &JWKS{
+		URL:         url,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Issuer:      issuer,
+		Audience:    audience,
+		Refresh:     refresh,
+		MinInterval: 30 * time.Second,
+		Log:         logger.WithField("module", "jwks"),
+	}
+}
+
+// checkClaims verifies the issuer and audience of the token
+func (j *JWKS) checkClaims(token *jwt.Token) error {
+	if j.Issuer == "" || j.Audience == "" {
+		return fmt.Errorf("JWKS issuer and audience not configured")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return fmt.Errorf("invalid token claims")
+	}
+	if iss, _ := claims["iss"].(string); iss != j.Issuer {
+		return fmt.Errorf("token issuer %q not accepted", iss)
+	}
+	if !InStrings(j.Audience, claimStrings(claims, "aud")) {
+		return fmt.Errorf("token audience not accepted")
+	}
+	return nil
+}
+
+// Key returns the key of the token kid, fetching the key set if needed
+// the fetch is done once for the concurrent callers, those with a cached
+// key don't wait for it
+func (j *JWKS) Key(token *jwt.Token) (interface{}, error) {
+	if err := j.checkClaims(token); err != nil {
+		return nil, err
+	}
+	kid, _ := token.Header["kid"].(string)
+	j.mu.Lock()
+	key, ok := j.keys[kid]
+	stale := j.Refresh > 0 && time.Since(j.fetched) > j.Refresh
+	var wait chan struct{}
+	switch {
+	case j.fetching != nil:
+		wait = j.fetching
+	case (!ok || stale) && time.Since(j.fetched) > j.MinInterval:
+		wait = j.startFetch()
+	}
+	j.mu.Unlock()
+	if wait != nil && !ok {
+		<-wait
+		j.mu.Lock()
+		key, ok = j.keys[kid]
+		err := j.fetchErr
+		j.mu.Unlock()
+		if !ok && err != nil {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return checkAlg(token, key)
+}
+
+// startFetch reloads the key set in the background, must hold the lock
+func (j *JWKS) startFetch() chan struct{} {
+	done := make(chan struct{})
+	j.fetching, j.fetched = done, time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		keys, err := j.fetch(ctx)
+		if err != nil {
+			// keep using the cached keys while the provider is unreachable
+			j.Log.WithError(err).Warn("JWKS refresh failed")
+		}
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+		}
+		j.fetchErr, j.fetching = err, nil
+		j.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// Fetch reloads the key set
+func (j *JWKS) Fetch(ctx context.Context) error {
+	keys, err := j.fetch(ctx)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.fetched = time.Now()
+	if err != nil {
+		return err
+	}
+	j.keys = keys
+	return nil
+}
+
+// jwk is a JSON Web Key, RSA and EC public keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch reads the key set, without the lock
+func (j *JWKS) fetch(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := j.Client
+	if c == nil {
+		c = http.DefaultClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := httpStatusErr(resp); err != nil {
+		return nil, fmt.Errorf("fetch JWKS: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			j.Log.WithError(err).WithField("kid", k.Kid).Warn("JWKS key skipped")
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS %s has no usable key", j.URL)
+	}
+	return keys, nil
+}
+
+// publicKey converts the JWK to *rsa.PublicKey or *ecdsa.PublicKey
+func (k jwk) publicKey() (interface{}, error) {
+	b64 := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("RSA modulus: %w", err)
+		}
+		e, err := b64(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("RSA exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("EC x: %w", err)
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("EC y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC point not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
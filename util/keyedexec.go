@@ -0,0 +1,171 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* ****************************************
+per key serialized executor
+**************************************** */
+
+var (
+	// ErrQueueFull is returned when the queue of a key reaches its depth limit
+	ErrQueueFull = errors.New("queue is full")
+	// ErrExecutorClosed is returned when submitting to a closed executor
+	ErrExecutorClosed = errors.New("executor is closed")
+)
+
+// keyedTask is a queued task of KeyedExecutor
+type keyedTask struct {
+	ctx      context.Context
+	f        func(context.Context) error
+	res      chan error
+	enqueued time.Time
+}
+
+// ExecutorStats is a snapshot of the KeyedExecutor metrics
+type ExecutorStats struct {
+	Submitted  uint64
+	Completed  uint64
+	Failed     uint64
+	Rejected   uint64
+	ActiveKeys int           // keys with a running task
+	Queued     int           // tasks waiting, running ones excluded
+	MaxWait    time.Duration // longest queue wait observed
+}
+
+// KeyedExecutor runs the tasks of the same key (e.g. device name) sequentially
+// in submission order, while tasks of different keys run concurrently
+type KeyedExecutor struct {
+	// MaxDepth limits the number of waiting tasks per key, 0 means no limit
+	MaxDepth int
+
+	mu     sync.Mutex
+	queues map[string][]*keyedTask
+	wg     sync.WaitGroup
+	closed bool
+	stats  ExecutorStats
+}
+
+// NewKeyedExecutor creates a KeyedExecutor with the per key depth limit
+func NewKeyedExecutor(maxDepth int) *KeyedExecutor {
+	return &KeyedExecutor{MaxDepth: maxDepth, queues: make(map[string][]*keyedTask)}
+}
+
+// Submit queues a task for the key and returns the channel delivering its result
+// the task is skipped with ctx.Err() if ctx is done before it starts
+func (ke *KeyedExecutor) Submit(ctx context.Context, key string, f func(context.Context) error) (<-chan error, error) {
+	t := &keyedTask{ctx: ctx, f: f, res: make(chan error, 1), enqueued: time.Now()}
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	if ke.closed {
+		ke.stats.Rejected++
+		return nil, ErrExecutorClosed
+	}
+	q, running := ke.queues[key]
+	// the head of the queue is the running task
+	if ke.MaxDepth > 0 && len(q) > ke.MaxDepth {
+		ke.stats.Rejected++
+		return nil, fmt.Errorf("key %s: %w", key, ErrQueueFull)
+	}
+	ke.stats.Submitted++
+	ke.queues[key] = append(q, t)
+	if !running {
+		ke.wg.Add(1)
+		go ke.worker(key)
+	}
+	return t.res, nil
+}
+
+// Do submits a task and waits for its result
+func (ke *KeyedExecutor) Do(ctx context.Context, key string, f func(context.Context) error) error {
+	res, err := ke.Submit(ctx, key, f)
+	if err != nil {
+		return err
+	}
+	return <-res
+}
+
+// worker drains the queue of a key, it exits once the queue is empty
+func (ke *KeyedExecutor) worker(key string) {
+	defer ke.wg.Done()
+	for {
+		ke.mu.Lock()
+		q := ke.queues[key]
+		if len(q) == 0 {
+			delete(ke.queues, key)
+			ke.mu.Unlock()
+			return
+		}
+		t := q[0]
+		if w := time.Since(t.enqueued); w > ke.stats.MaxWait {
+			ke.stats.MaxWait = w
+		}
+		ke.mu.Unlock()
+
+		err := t.ctx.Err()
+		if err == nil {
+			err = ke.run(t)
+		}
+		t.res <- err
+
+		ke.mu.Lock()
+		ke.queues[key] = ke.queues[key][1:]
+		ke.stats.Completed++
+		if err != nil {
+			ke.stats.Failed++
+		}
+		ke.mu.Unlock()
+	}
+}
+
+// run executes a task, panic is converted to error
+func (ke *KeyedExecutor) run(t *keyedTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("task panic: %v", r)
+		}
+	}()
+	return t.f(t.ctx)
+}
+
+// Depth returns the number of tasks of the key, including the running one
+func (ke *KeyedExecutor) Depth(key string) int {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	return len(ke.queues[key])
+}
+
+// Stats returns a snapshot of the executor metrics
+func (ke *KeyedExecutor) Stats() ExecutorStats {
+	ke.mu.Lock()
+	defer ke.mu.Unlock()
+	s := ke.stats
+	s.ActiveKeys = len(ke.queues)
+	for _, q := range ke.queues {
+		s.Queued += len(q) - 1
+	}
+	return s
+}
+
+// Close stops accepting tasks and waits for the queued ones to finish or ctx is done
+func (ke *KeyedExecutor) Close(ctx context.Context) error {
+	ke.mu.Lock()
+	ke.closed = true
+	ke.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		ke.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
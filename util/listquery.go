@@ -0,0 +1,425 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+list query parameters
+**************************************** */
+
+// page size of ParseListQuery, and the bound of its offset, deeper
+// pages are read with the cursor
+var (
+	DefaultPerPage = 20
+	MaxPerPage     = 200
+	MaxOffset      = 1000000
+)
+
+// listReserved are the query parameters not taken as filters
+var listReserved = map[string]bool{"page": true, "per_page": true, "limit": true, "offset": true, "cursor": true, "sort": true}
+
+// filter operators of the list query, "field[op]=value", plain "field=value" is eq
+var filterOps = map[string]string{
+	"eq": "$eq", "ne": "$ne", "gt": "$gt", "gte": "$gte", "lt": "$lt", "lte": "$lte",
+	"in": "$in", "nin": "$nin", "like": "$regex", "exists": "$exists",
+}
+
+// SortField is a sort key, descending if prefixed by "-" in the query
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Filter is a field condition of the list query
+type Filter struct {
+	Field string
+	Op    string // eq, ne, gt, gte, lt, lte, in, nin, like or exists
+	Value string // comma separated for in and nin
+}
+
+// ListQuery is the pagination, sorting and filtering of a list endpoint
+/*
+	GET /devices?page=2&per_page=50&sort=-uptime,name&vendor=juniper&mtu[gte]=9000
+	GET /devices?limit=50&offset=100
+	GET /devices?limit=50&cursor=eyJ...
+*/
+type ListQuery struct {
+	Page    int // 1 based
+	PerPage int
+	Offset  int    // (Page-1)*PerPage, or the offset parameter
+	Cursor  string // the next page token of MongoPage
+	Sort    []SortField
+	Filters []Filter
+
+	types map[string]reflect.Kind
+}
+
+// ParseListQuery parses the list query parameters of the request, invalid
+// page sizes are clamped to DefaultPerPage and MaxPerPage, unknown filter
+// operators are ignored, see Allow to restrict the fields
+// returns ErrBadInput if the page or offset is past MaxOffset
+/*
+	q, err := util.ParseListQuery(r)
+	if err != nil {
+		api.Error(w, 0, err, "invalid list query")
+		return
+	}
+*/
+func ParseListQuery(r *http.Request) (ListQuery, error) {
+	v := r.URL.Query()
+	q := ListQuery{Page: 1, PerPage: DefaultPerPage, Cursor: v.Get("cursor")}
+	atoi := func(k string) int {
+		n, err := strconv.Atoi(v.Get(k))
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	if n := atoi("per_page"); n > 0 {
+		q.PerPage = n
+	}
+	if n := atoi("limit"); n > 0 {
+		q.PerPage = n
+	}
+	if q.PerPage > MaxPerPage {
+		q.PerPage = MaxPerPage
+	}
+	if n := atoi("page"); n > 1 {
+		// checked before multiplying, a huge page overflows the offset
+		if n-1 > MaxOffset/q.PerPage {
+			return q, ErrBadInput.Wrap(fmt.Errorf("page %d past the offset limit %d", n, MaxOffset))
+		}
+		q.Page = n
+	}
+	q.Offset = (q.Page - 1) * q.PerPage
+	if n := atoi("offset"); n > 0 {
+		if n > MaxOffset {
+			return q, ErrBadInput.Wrap(fmt.Errorf("offset %d past the limit %d", n, MaxOffset))
+		}
+		q.Offset = n
+		q.Page = n/q.PerPage + 1
+	}
+	for _, s := range strings.Split(v.Get("sort"), ",") {
+		if s = strings.TrimSpace(s); s == "" || s == "-" || s == "+" {
+			continue
+		}
+		q.Sort = append(q.Sort, SortField{Field: strings.TrimLeft(s, "+-"), Desc: s[0] == '-'})
+	}
+	for k, vals := range v {
+		if listReserved[k] || len(vals) == 0 {
+			continue
+		}
+		f := Filter{Field: k, Op: "eq", Value: vals[0]}
+		if i := strings.IndexByte(k, '['); i > 0 && strings.HasSuffix(k, "]") {
+			f.Field, f.Op = k[:i], k[i+1:len(k)-1]
+		}
+		if _, ok := filterOps[f.Op]; ok && f.Field != "" {
+			q.Filters = append(q.Filters, f)
+		}
+	}
+	return q, nil
+}
+
+// Allow returns ErrBadInput if a sort or filter field isn't listed, so
+// clients can't query on internal fields
+func (q ListQuery) Allow(fields ...string) error {
+	for _, s := range q.Sort {
+		if !InStrings(s.Field, fields) {
+			return ErrBadInput.Wrap(fmt.Errorf("sort on field %q not allowed", s.Field))
+		}
+	}
+	for _, f := range q.Filters {
+		if !InStrings(f.Field, fields) {
+			return ErrBadInput.Wrap(fmt.Errorf("filter on field %q not allowed", f.Field))
+		}
+	}
+	return nil
+}
+
+// Meta returns the pagination meta of the page out of total items
+func (q ListQuery) Meta(total int64) *Page {
+	return NewPage(q.Page, q.PerPage, total)
+}
+
+// filterValue converts the query value to the kind of the field,
+// reflect.Invalid is a string
+func filterValue(s string, k reflect.Kind) (interface{}, error) {
+	switch k {
+	case reflect.Invalid, reflect.String:
+		return s, nil
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(s, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	}
+	return nil, fmt.Errorf("unsupported filter kind %s", k)
+}
+
+// filterValues converts the value of the filter, a list for in and nin
+func (q ListQuery) filterValues(f Filter) (interface{}, error) {
+	k := q.types[f.Field]
+	if f.Op != "in" && f.Op != "nin" {
+		return filterValue(f.Value, k)
+	}
+	vs := []interface{}{}
+	for _, s := range strings.Split(f.Value, ",") {
+		v, err := filterValue(s, k)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// Typed sets the kinds of the filter fields, reflect.Bool, Int64,
+// Float64 or String, for MongoFilter, the values of the other fields are
+// strings, returns ErrBadInput if a value doesn't parse as its kind
+/*
+	q, err := util.ParseListQuery(r)
+	if err := q.Typed(map[string]reflect.Kind{"mtu": reflect.Int64, "up": reflect.Bool}); err != nil {
+		api.Error(w, 0, err, "invalid filter")
+		return
+	}
+*/
+func (q *ListQuery) Typed(types map[string]reflect.Kind) error {
+	q.types = types
+	for _, f := range q.Filters {
+		if f.Op == "like" || f.Op == "exists" {
+			continue
+		}
+		if _, err := q.filterValues(f); err != nil {
+			return ErrBadInput.Wrap(fmt.Errorf("filter on field %q: %w", f.Field, err))
+		}
+	}
+	return nil
+}
+
+// MongoFilter converts the filters to a mongo query, like is a case
+// insensitive substring match, the values are strings unless typed, see Typed
+func (q ListQuery) MongoFilter() bson.M {
+	m := bson.M{}
+	for _, f := range q.Filters {
+		var v interface{}
+		switch f.Op {
+		case "like":
+			v = bson.M{"$regex": regexp.QuoteMeta(f.Value), "$options": "i"}
+		case "exists":
+			v = f.Value != "false"
+		default:
+			var err error
+			if v, err = q.filterValues(f); err != nil {
+				// not validated by Typed
+				v = f.Value
+			}
+		}
+		cond, ok := m[f.Field].(bson.M)
+		if !ok {
+			cond = bson.M{}
+			m[f.Field] = cond
+		}
+		if f.Op == "like" {
+			for k, rv := range v.(bson.M) {
+				cond[k] = rv
+			}
+			continue
+		}
+		cond[filterOps[f.Op]] = v
+	}
+	return m
+}
+
+// MongoSort returns the sort document of the sort fields
+func (q ListQuery) MongoSort() bson.D {
+	d := bson.D{}
+	for _, s := range q.Sort {
+		dir := 1
+		if s.Desc {
+			dir = -1
+		}
+		d = append(d, bson.E{Key: s.Field, Value: dir})
+	}
+	return d
+}
+
+// FindOptions returns the sort, skip and limit of the page
+/*
+	q, err := util.ParseListQuery(r)
+	cur, err := coll.Find(ctx, q.MongoFilter(), q.FindOptions())
+	total, err := coll.CountDocuments(ctx, q.MongoFilter())
+	api.Paginated(w, devices, q.Meta(total))
+*/
+func (q ListQuery) FindOptions() *options.FindOptions {
+	o := options.Find().SetLimit(int64(q.PerPage))
+	if q.Offset > 0 {
+		o.SetSkip(int64(q.Offset))
+	}
+	if len(q.Sort) > 0 {
+		o.SetSort(q.MongoSort())
+	}
+	return o
+}
+
+// MongoPage reads the page after Cursor into res, a pointer to a slice,
+// with GetPage sorted by the single sort field, and returns its meta
+// carrying the token of the next page, the total isn't counted
+/*
+	q, err := util.ParseListQuery(r)
+	var devs []Device
+	meta, err := q.MongoPage(ctx, devices, &devs, nil)
+	if err != nil {
+		api.Error(w, 0, err, "list devices failed")
+		return
+	}
+	api.Paginated(w, devs, meta)
+*/
+func (q ListQuery) MongoPage(ctx context.Context, dba *MongoOpr, res interface{}, projection map[string]interface{}) (*Page, error) {
+	if len(q.Sort) > 1 {
+		return nil, ErrBadInput.Wrap(errors.New("cursor paging sorts on one field"))
+	}
+	sort := ""
+	if len(q.Sort) == 1 {
+		sort = q.Sort[0].Field
+		if q.Sort[0].Desc {
+			sort = "-" + sort
+		}
+	}
+	next, err := dba.GetPage(ctx, res, q.MongoFilter(), projection, sort, int64(q.PerPage), q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{PerPage: q.PerPage, Next: next}, nil
+}
+
+// mapValue returns the sortable string of a map value as SortMapByField does
+func mapValue(v interface{}) (string, bool) {
+	switch uv := v.(type) {
+	case string:
+		return uv, true
+	case int:
+		return strconv.Itoa(uv), true
+	case int64:
+		return strconv.FormatInt(uv, 10), true
+	}
+	return "", false
+}
+
+// sortSeq returns the natural order of the field values, reversed if desc
+func sortSeq(m []map[string]interface{}, s SortField) []string {
+	seen := map[string]struct{}{}
+	seq := []string{}
+	for _, em := range m {
+		if v, ok := mapValue(em[s.Field]); ok {
+			if _, dup := seen[v]; !dup {
+				seen[v] = struct{}{}
+				seq = append(seq, v)
+			}
+		}
+	}
+	NatureOrder().Sort(seq)
+	if s.Desc {
+		seq = RevStringsOrder(seq)
+	}
+	return seq
+}
+
+// matchMap returns true if the map satisfies the filter
+func matchMap(em map[string]interface{}, f Filter) bool {
+	v, exist := em[f.Field]
+	if f.Op == "exists" {
+		return exist == (f.Value != "false")
+	}
+	sv := fmt.Sprint(v)
+	switch f.Op {
+	case "eq":
+		return exist && sv == f.Value
+	case "ne":
+		return !exist || sv != f.Value
+	case "in":
+		return exist && InStrings(sv, strings.Split(f.Value, ","))
+	case "nin":
+		return !exist || !InStrings(sv, strings.Split(f.Value, ","))
+	case "like":
+		return exist && strings.Contains(strings.ToLower(sv), strings.ToLower(f.Value))
+	}
+	if !exist {
+		return false
+	}
+	a, aerr := strconv.ParseFloat(sv, 64)
+	b, berr := strconv.ParseFloat(f.Value, 64)
+	c := strings.Compare(sv, f.Value)
+	if aerr == nil && berr == nil {
+		c = 0
+		if a < b {
+			c = -1
+		} else if a > b {
+			c = 1
+		}
+	}
+	switch f.Op {
+	case "gt":
+		return c > 0
+	case "gte":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "lte":
+		return c <= 0
+	}
+	return false
+}
+
+// ApplyMaps filters, sorts and pages in-memory data, sorted by the first two
+// sort fields with SortMapByField and SortMapByTwoFields, returns the page
+// and its meta
+/*
+	q, err := util.ParseListQuery(r)
+	page, meta := q.ApplyMaps(interfaces)
+	api.Paginated(w, page, meta)
+*/
+func (q ListQuery) ApplyMaps(m []map[string]interface{}) ([]map[string]interface{}, *Page) {
+	res := []map[string]interface{}{}
+	for _, em := range m {
+		ok := true
+		for _, f := range q.Filters {
+			if ok = matchMap(em, f); !ok {
+				break
+			}
+		}
+		if ok {
+			res = append(res, em)
+		}
+	}
+	switch {
+	case len(q.Sort) == 1:
+		res = SortMapByField(res, q.Sort[0].Field, sortSeq(res, q.Sort[0]))
+	case len(q.Sort) > 1:
+		res = SortMapByTwoFields(res, q.Sort[0].Field, sortSeq(res, q.Sort[0]), q.Sort[1].Field, sortSeq(res, q.Sort[1]))
+	}
+	meta := q.Meta(int64(len(res)))
+	off := q.Offset
+	if off < 0 {
+		off = 0
+	}
+	if off >= len(res) {
+		return []map[string]interface{}{}, meta
+	}
+	end := len(res)
+	if q.PerPage > 0 && q.PerPage < end-off {
+		end = off + q.PerPage
+	}
+	return res[off:end], meta
+}
@@ -0,0 +1,327 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+package logger
+**************************************** */
+
+// LogOptions configures the package logger
+// empty fields keep the current setting
+type LogOptions struct {
+	Level        string    // trace, debug, info, warn, error, fatal, panic
+	Format       string    // json or text
+	Output       io.Writer // e.g. os.Stderr, ignored if File is set
+	ReportCaller bool
+
+	// File enables output to a rotating log file, see RotatingWriter
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// logger is the package logger, the global logrus logger is left untouched
+// default JSON to stdout, level, format and log file
+// from GOTO_LOG_LEVEL, GOTO_LOG_FORMAT and GOTO_LOG_FILE
+var logger = newPkgLogger()
+
+func newPkgLogger() *log.Logger {
+	l := log.New()
+	l.SetOutput(os.Stdout)
+	l.SetFormatter(&log.JSONFormatter{})
+	l.SetLevel(log.InfoLevel)
+	err := configureLogger(l, LogOptions{
+		Level:      os.Getenv("GOTO_LOG_LEVEL"),
+		Format:     os.Getenv("GOTO_LOG_FORMAT"),
+		File:       os.Getenv("GOTO_LOG_FILE"),
+		MaxSizeMB:  100,
+		MaxBackups: 10,
+	})
+	if err != nil {
+		l.WithError(err).Warn("invalid log settings in env, use defaults")
+	}
+	return l
+}
+
+// Logger returns the package logger
+func Logger() *log.Logger {
+	return logger
+}
+
+// SetLogger replaces the package logger, e.g. by the application logger
+// call it at startup, loggers already handed out (e.g. Scheduler.Log) are not updated
+func SetLogger(l *log.Logger) {
+	if l != nil {
+		logger = l
+	}
+}
+
+// Configure applies the options to the package logger
+func Configure(opts LogOptions) error {
+	return configureLogger(logger, opts)
+}
+
+func configureLogger(l *log.Logger, opts LogOptions) error {
+	if opts.Level != "" {
+		lv, err := log.ParseLevel(opts.Level)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(lv)
+	}
+	switch strings.ToLower(opts.Format) {
+	case "":
+	case "json":
+		l.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		l.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	switch {
+	case opts.File != "":
+		w, err := NewRotatingWriter(opts.File, opts.MaxSizeMB, opts.MaxBackups, opts.MaxAgeDays)
+		if err != nil {
+			return err
+		}
+		if rw, ok := l.Out.(*RotatingWriter); ok {
+			defer rw.Close()
+		}
+		l.SetOutput(w)
+	case opts.Output != nil:
+		l.SetOutput(opts.Output)
+	}
+	l.SetReportCaller(opts.ReportCaller)
+	return nil
+}
+
+/* ****************************************
+rotating log file
+**************************************** */
+
+// RotatingWriter is an io.WriteCloser appending to a file which is rotated
+// once it exceeds the size limit, rotated files are named path.<timestamp>
+// and pruned by count and age, safe for concurrent use
+type RotatingWriter struct {
+	path       string
+	maxSize    int64 // bytes, 0 means no rotation
+	maxBackups int   // 0 means keep all
+	maxAge     time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingWriter opens or creates the log file, the directory is created if missing
+func NewRotatingWriter(path string, maxSizeMB, maxBackups, maxAgeDays int) (*RotatingWriter, error) {
+	w := &RotatingWriter{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		maxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the log file for appending
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, fi.Size()
+	return nil
+}
+
+// Write appends p, rotating the file first if p doesn't fit
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate closes the current file, renames it with a timestamp and starts a new one
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rotate()
+}
+
+// rotateLayout is the timestamp suffix of the backups
+const rotateLayout = "20060102T150405.000"
+
+func (w *RotatingWriter) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		w.file = nil
+	}
+	backup := w.path + "." + time.Now().UTC().Format(rotateLayout)
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.prune()
+	return nil
+}
+
+// prune removes the backups beyond the count limit or older than the age limit
+func (w *RotatingWriter) prune() {
+	matches, err := filepath.Glob(w.path + ".*")
+	if err != nil {
+		return
+	}
+	// only the backups, not the other files of the same prefix, e.g. app.log.conf
+	var backups []string
+	for _, m := range matches {
+		if _, err := time.Parse(rotateLayout, strings.TrimPrefix(m, w.path+".")); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// timestamp suffix sorts chronologically, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, b := range backups {
+		remove := w.maxBackups > 0 && i >= w.maxBackups
+		if !remove && w.maxAge > 0 {
+			if fi, err := os.Stat(b); err == nil && time.Since(fi.ModTime()) > w.maxAge {
+				remove = true
+			}
+		}
+		if remove {
+			os.Remove(b)
+		}
+	}
+}
+
+// Close closes the current file
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// NewRotatingLogger creates a JSON logger writing to a rotating file, see RotatingWriter
+// zero maxSizeMB disables rotation, zero maxBackups or maxAgeDays disables the limit
+func NewRotatingLogger(path string, maxSizeMB, maxBackups, maxAgeDays int) (*log.Logger, error) {
+	w, err := NewRotatingWriter(path, maxSizeMB, maxBackups, maxAgeDays)
+	if err != nil {
+		return nil, err
+	}
+	l := log.New()
+	l.SetOutput(w)
+	l.SetFormatter(&log.JSONFormatter{})
+	l.SetLevel(logger.GetLevel())
+	return l, nil
+}
+
+/* ****************************************
+context logging
+**************************************** */
+
+// ctxKey is the type of the context keys of the package
+type ctxKey int
+
+const (
+	ctxKeyLogger ctxKey = iota
+	ctxKeyRequestID
+	ctxKeyClaims
+	ctxKeyIdentity
+	ctxKeyToken
+	ctxKeyIdentitySlot
+)
+
+// RequestIDHeader carries the request correlation ID in HTTP headers and gRPC metadata
+const RequestIDHeader = "X-Request-ID"
+
+// ContextWithLogger returns a context carrying the log entry
+func ContextWithLogger(ctx context.Context, lg *log.Entry) context.Context {
+	return context.WithValue(ctx, ctxKeyLogger, lg)
+}
+
+// LoggerFromContext returns the log entry of the context, or the package logger
+func LoggerFromContext(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if lg, ok := ctx.Value(ctxKeyLogger).(*log.Entry); ok && lg != nil {
+			return lg
+		}
+	}
+	return log.NewEntry(logger)
+}
+
+// ContextWithRequestID returns a context carrying the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestID, id)
+}
+
+// RequestIDFromContext returns the request ID of the context, empty if none
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(ctxKeyRequestID).(string)
+	return id
+}
+
+// NewRequestID generates a random request ID
+func NewRequestID() string {
+	return SecureRandString(20)
+}
+
+// withRequestID attaches the request ID and a log entry carrying it to the context
+// an empty or invalid id is taken from the context, e.g. set by LogRequests, or generated
+func withRequestID(ctx context.Context, lg *log.Entry, id string) (context.Context, string) {
+	if !validRequestID(id) {
+		id = RequestIDFromContext(ctx)
+	}
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+	if lg == nil {
+		lg = log.NewEntry(logger)
+	}
+	ctx = ContextWithRequestID(ctx, id)
+	return ContextWithLogger(ctx, lg.WithField("request_id", id)), id
+}
@@ -0,0 +1,194 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/* ****************************************
+login and logout
+**************************************** */
+
+// LoginFailDelay slows down password guessing, applied to failed logins
+var LoginFailDelay = time.Second
+
+// CredentialVerifier checks a username and password, returns the claims of
+// the token to issue, an error matching ErrUnauthorized if rejected
+type CredentialVerifier interface {
+	VerifyCredential(ctx context.Context, username, password string) (jwt.MapClaims, error)
+}
+
+// CredentialFunc is a CredentialVerifier callback, e.g. binding to LDAP
+type CredentialFunc func(ctx context.Context, username, password string) (jwt.MapClaims, error)
+
+// VerifyCredential calls the callback
+func (f CredentialFunc) VerifyCredential(ctx context.Context, username, password string) (jwt.MapClaims, error) {
+	return f(ctx, username, password)
+}
+
+// HashPassword returns the bcrypt hash of the password, as stored by MongoCredentials
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// dummyHash is compared for the unknown users, so they take as long as
+// a wrong password and can't be told apart by the timing
+var dummyHash struct {
+	once sync.Once
+	hash []byte
+}
+
+// compareDummy spends the time of a bcrypt comparison
+func compareDummy(password string) {
+	dummyHash.once.Do(func() {
+		dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(password))
+}
+
+// MongoCredentials is a CredentialVerifier of the user documents in a
+// collection of the MongoOpr database, {_id: username, password: HashPassword, roles, disabled}
+type MongoCredentials struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// VerifyCredential checks the password against the stored bcrypt hash
+func (m *MongoCredentials) VerifyCredential(ctx context.Context, username, password string) (jwt.MapClaims, error) {
+	var u struct {
+		Password string   `bson:"password"`
+		Roles    []string `bson:"roles"`
+		Disabled bool     `bson:"disabled"`
+	}
+	err := m.Opr.Mdb.Collection(m.Collection).FindOne(ctx, bson.M{"_id": username}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		compareDummy(password)
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("unknown user %s", username))
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("wrong password of %s", username))
+	}
+	if u.Disabled {
+		return nil, ErrUnauthorized.Wrap(fmt.Errorf("user %s disabled", username))
+	}
+	return jwt.MapClaims{"sub": username, "roles": u.Roles}, nil
+}
+
+// LoginRequest is the JSON body of LoginHandler
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginHandler verifies the JSON LoginRequest and responds the issued
+// TokenResponse, the token is valid for api.TokenTTL
+/*
+	svc.HandlePublic("/login", svc.API.LoginHandler(&util.MongoCredentials{Opr: svc.Mongo, Collection: "users"}))
+	svc.Handle("/logout", svc.API.LogoutHandler)
+*/
+func (api *API) LoginHandler(verifier CredentialVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			api.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var req LoginRequest
+		if err := api.Bind(r, &req); err != nil {
+			api.Error(w, 0, err)
+			return
+		}
+		if req.Username == "" {
+			api.Error(w, http.StatusBadRequest, "malformed login request")
+			return
+		}
+		claims, err := verifier.VerifyCredential(r.Context(), req.Username, req.Password)
+		if err != nil {
+			SleepCtx(r.Context(), LoginFailDelay)
+			api.Error(w, 0, fmt.Errorf("login: %w", err), "Login failed")
+			return
+		}
+		if claims == nil {
+			claims = jwt.MapClaims{}
+		}
+		if _, ok := claims["sub"]; !ok {
+			claims["sub"] = req.Username
+		}
+		ttl := api.TokenTTL
+		if ttl == 0 {
+			ttl = time.Hour
+		}
+		tok, err := api.IssueToken(claims, ttl)
+		if err != nil {
+			api.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+		api.Log.WithField("user", req.Username).Info("login")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: tok, TokenType: "Bearer", ExpiresIn: int64(ttl / time.Second)})
+	}
+}
+
+// LogoutHandler revokes the token of the request, register it behind Auth
+// requires api.Revoker, tokens issued without jti can't be revoked
+func (api *API) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		api.Error(w, http.StatusUnauthorized, "logout without authentication", "Unauthorized")
+		return
+	}
+	if err := api.RevokeClaims(claims); err != nil {
+		api.Error(w, 0, fmt.Errorf("logout: %w", err), "Logout failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Login posts the credential to a LoginHandler URL, nil client uses http.DefaultClient
+func Login(ctx context.Context, client *http.Client, url, username, password string) (*TokenResponse, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := httpStatusErr(resp); err != nil {
+		return nil, err
+	}
+	var tr TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("decode token response: %w", err)
+	}
+	return &tr, nil
+}
+
+// LoginPrompt prompts for the credential with GetCred and logs in, for CLI clients
+func LoginPrompt(ctx context.Context, client *http.Client, url string) (*TokenResponse, error) {
+	uid, pwd := GetCred()
+	if uid == "" {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("no username entered"))
+	}
+	return Login(ctx, client, url, uid, pwd)
+}
@@ -0,0 +1,227 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+Prometheus metrics
+**************************************** */
+
+// DefaultBuckets are the latency histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram is a cumulative Prometheus histogram
+type histogram struct {
+	counts []uint64 // per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// Metrics collects the request counts, latencies, in-flight requests and
+// auth failures of the HTTP routes and gRPC methods, exported in the
+// Prometheus text format by Handler
+/*
+	m := util.NewMetrics()
+	mux.HandleFunc("/devices", m.Middleware("/devices")(api.Auth(listDevices)))
+	mux.HandleFunc("/metrics", m.Handler)
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(m.GrpcUnary(), api.AuthGrpcUnary))
+*/
+type Metrics struct {
+	Buckets []float64
+
+	mu       sync.Mutex
+	requests map[string]uint64 // labels to count
+	failures map[string]uint64 // labels to auth failure count
+	latency  map[string]*histogram
+	inflight map[string]int64
+	gauges   map[string]func() float64
+}
+
+// NewMetrics creates a Metrics with the DefaultBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Buckets:  DefaultBuckets,
+		requests: make(map[string]uint64),
+		failures: make(map[string]uint64),
+		latency:  make(map[string]*histogram),
+		inflight: make(map[string]int64),
+		gauges:   make(map[string]func() float64),
+	}
+}
+
+// Gauge registers a gauge read at export, e.g. the connected clients
+func (m *Metrics) Gauge(name string, f func() float64) {
+	m.mu.Lock()
+	m.gauges[name] = f
+	m.mu.Unlock()
+}
+
+// labels formats the label pairs, values escaped
+func labels(kv ...string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	s := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		s = append(s, fmt.Sprintf(`%s="%s"`, kv[i], r.Replace(kv[i+1])))
+	}
+	return strings.Join(s, ",")
+}
+
+// begin counts an in-flight request
+func (m *Metrics) begin(key string) {
+	m.mu.Lock()
+	m.inflight[key]++
+	m.mu.Unlock()
+}
+
+// observe records a finished request
+func (m *Metrics) observe(inflight, req, lat string, authFailed bool, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight[inflight]--
+	m.requests[req]++
+	if authFailed {
+		m.failures[req]++
+	}
+	h, ok := m.latency[lat]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.Buckets))}
+		m.latency[lat] = h
+	}
+	sec := d.Seconds()
+	for i, b := range m.Buckets {
+		if sec <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += sec
+	h.count++
+}
+
+// Middleware instruments the HTTP handler of the route, 401 and 403
+// responses are counted as auth failures
+func (m *Metrics) Middleware(route string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			inflight := labels("route", route)
+			m.begin(inflight)
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+			defer func() {
+				m.observe(inflight,
+					labels("route", route, "method", r.Method, "code", strconv.Itoa(sw.code)),
+					labels("route", route, "method", r.Method),
+					sw.code == http.StatusUnauthorized || sw.code == http.StatusForbidden,
+					time.Since(start))
+			}()
+			next(sw, r)
+		}
+	}
+}
+
+// observeRPC records a finished RPC
+func (m *Metrics) observeRPC(method string, err error, d time.Duration) {
+	code := status.Code(err)
+	m.observe(labels("route", method),
+		labels("route", method, "method", "grpc", "code", code.String()),
+		labels("route", method, "method", "grpc"),
+		code == codes.Unauthenticated || code == codes.PermissionDenied, d)
+}
+
+// GrpcUnary returns the gRPC unary interceptor of the metrics, the gRPC
+// methods are reported as routes with method "grpc"
+func (m *Metrics) GrpcUnary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		m.begin(labels("route", info.FullMethod))
+		start := time.Now()
+		res, err := handler(ctx, req)
+		m.observeRPC(info.FullMethod, err, time.Since(start))
+		return res, err
+	}
+}
+
+// GrpcStream returns the gRPC stream interceptor of the metrics
+func (m *Metrics) GrpcStream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		m.begin(labels("route", info.FullMethod))
+		start := time.Now()
+		err := handler(srv, ss)
+		m.observeRPC(info.FullMethod, err, time.Since(start))
+		return err
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	sorted := func(mp map[string]uint64) []string {
+		keys := make([]string, 0, len(mp))
+		for k := range mp {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	m.mu.Lock()
+	b.WriteString("# TYPE http_requests_total counter\n")
+	for _, k := range sorted(m.requests) {
+		fmt.Fprintf(&b, "http_requests_total{%s} %d\n", k, m.requests[k])
+	}
+	b.WriteString("# TYPE auth_failures_total counter\n")
+	for _, k := range sorted(m.failures) {
+		fmt.Fprintf(&b, "auth_failures_total{%s} %d\n", k, m.failures[k])
+	}
+	b.WriteString("# TYPE http_requests_in_flight gauge\n")
+	keys := make([]string, 0, len(m.inflight))
+	for k := range m.inflight {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "http_requests_in_flight{%s} %d\n", k, m.inflight[k])
+	}
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	keys = keys[:0]
+	for k := range m.latency {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := m.latency[k]
+		var cum uint64
+		for i, le := range m.Buckets {
+			cum += h.counts[i]
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", k, le, cum)
+		}
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", k, h.count)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %g\n", k, h.sum)
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", k, h.count)
+	}
+	gauges := make(map[string]func() float64, len(m.gauges))
+	for k, f := range m.gauges {
+		gauges[k] = f
+	}
+	m.mu.Unlock()
+	keys = keys[:0]
+	for k := range gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %g\n", k, k, gauges[k]())
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+HTTP middlewares
+**************************************** */
+
+// Middleware wraps a handler, e.g. API.Auth
+type Middleware func(http.HandlerFunc) http.HandlerFunc
+
+// Chain composes the middlewares, the first is the outermost
+/*
+	mw := api.Chain(api.LogRequests, api.Recoverer, api.Auth)
+	mux.HandleFunc("/devices", mw(listDevices))
+*/
+func (api *API) Chain(mws ...Middleware) Middleware {
+	return func(h http.HandlerFunc) http.HandlerFunc {
+		for i := len(mws) - 1; i >= 0; i-- {
+			h = mws[i](h)
+		}
+		return h
+	}
+}
+
+// Recoverer converts a panic of the handler to 500, logged with the stack
+// trace and passed to PanicReporter, http.ErrAbortHandler is passed through
+func (api *API) Recoverer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			lg := api.Log
+			if RequestIDFromContext(r.Context()) != "" || lg == nil {
+				lg = LoggerFromContext(r.Context())
+			}
+			reportPanic(lg.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}), r.URL.Path, rec)
+			if !sw.wrote {
+				api.Error(sw, http.StatusInternalServerError, fmt.Sprintf("%s %s panic: %v", r.Method, r.URL.Path, rec), "Internal server error")
+			}
+		}()
+		next(sw, r)
+	}
+}
+
+// LogRequests logs the method, path, status, latency and the identity
+// authenticated by the inner middlewares of each request, 5xx as error and
+// 4xx as warning, the request ID is assigned here so all log lines share it
+func (api *API) LogRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, rid)
+		var id *Identity
+		ctx = contextWithIdentitySlot(ctx, &id)
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		next(sw, r.WithContext(ctx))
+
+		lg := LoggerFromContext(ctx).WithFields(log.Fields{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"status":  sw.code,
+			"latency": time.Since(start).String(),
+			"remote":  r.RemoteAddr,
+		})
+		if id != nil {
+			lg = lg.WithField("subject", id.Subject)
+		}
+		switch {
+		case sw.code >= 500:
+			lg.Error("request")
+		case sw.code >= 400:
+			lg.Warn("request")
+		default:
+			lg.Info("request")
+		}
+	}
+}
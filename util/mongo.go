@@ -0,0 +1,260 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo write operations
+**************************************** */
+
+// marshalFilter encodes a map filter, nil matches all documents
+func marshalFilter(filter map[string]interface{}) (bson.Raw, error) {
+	f, err := bson.Marshal(filter)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	return f, nil
+}
+
+// updateDoc builds the update document, the fields of a map without
+// operators are set by $set, a map of operators, e.g. $inc, is used as is
+func updateDoc(update map[string]interface{}) (bson.Raw, error) {
+	if len(update) == 0 {
+		return nil, ErrBadInput.Wrap(errors.New("empty update"))
+	}
+	ops := 0
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			ops++
+		}
+	}
+	var doc interface{} = update
+	switch {
+	case ops == 0:
+		doc = bson.M{"$set": update}
+	case ops != len(update):
+		return nil, ErrBadInput.Wrap(errors.New("update mixes operators and fields"))
+	}
+	u, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	return u, nil
+}
+
+// InsertOne inserts the document and returns its _id
+func (dba *MongoOpr) InsertOne(ctx context.Context, doc interface{}) (interface{}, error) {
+	doc, err := dba.auditDoc(ctx, doc, true)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.InsertOne(ctx, doc)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return res.InsertedID, nil
+}
+
+// InsertMany inserts the documents in order and returns their _id, the
+// documents before a failed one are inserted
+func (dba *MongoOpr) InsertMany(ctx context.Context, docs []interface{}) ([]interface{}, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	if dba.Audit {
+		stamped := make([]interface{}, len(docs))
+		for i, d := range docs {
+			var err error
+			if stamped[i], err = dba.auditDoc(ctx, d, true); err != nil {
+				return nil, err
+			}
+		}
+		docs = stamped
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.InsertMany(ctx, docs)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return res.InsertedIDs, nil
+}
+
+// UpdateByID updates the document of the mongo _id, see UpdateMany for the
+// update, return false if no found
+/*
+	ok, err := db.UpdateByID(ctx, id, map[string]interface{}{"status": "up"})
+	ok, err := db.UpdateByID(ctx, id, map[string]interface{}{"$inc": bson.M{"flaps": 1}})
+*/
+func (dba *MongoOpr) UpdateByID(ctx context.Context, id primitive.ObjectID, update map[string]interface{}) (bool, error) {
+	f, err := dba.filter(map[string]interface{}{"_id": id})
+	if err != nil {
+		return false, err
+	}
+	u, err := dba.auditUpdate(ctx, update)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.UpdateOne(ctx, f, u)
+	if err != nil {
+		return false, mongoErr(err)
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// UpdateMany updates the documents matching the filter and returns the
+// number matched, the update fields are set by $set unless the map holds
+// update operators, e.g. $inc or $unset
+func (dba *MongoOpr) UpdateMany(ctx context.Context, filter, update map[string]interface{}) (int64, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return 0, err
+	}
+	u, err := dba.auditUpdate(ctx, update)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.UpdateMany(ctx, f, u)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	return res.MatchedCount, nil
+}
+
+// Upsert updates the first document matching the filter or inserts one
+// built from the filter and the update, returns the _id of the inserted
+// document, nil if updated
+func (dba *MongoOpr) Upsert(ctx context.Context, filter, update map[string]interface{}) (interface{}, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	u, err := dba.auditUpdate(ctx, update)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.UpdateOne(ctx, f, u, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return res.UpsertedID, nil
+}
+
+// ReplaceOne replaces the first document matching the filter, inserting it
+// if upsert, return false if no found and not inserted
+func (dba *MongoOpr) ReplaceOne(ctx context.Context, filter map[string]interface{}, doc interface{}, upsert bool) (bool, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return false, err
+	}
+	doc, err = dba.auditDoc(ctx, doc, false)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	res, err := dba.Mcoll.ReplaceOne(ctx, f, doc, options.Replace().SetUpsert(upsert))
+	if err != nil {
+		return false, mongoErr(err)
+	}
+	return res.MatchedCount > 0 || res.UpsertedCount > 0, nil
+}
+
+// DeleteByID deletes the document of the mongo _id, return false if no found
+// with SoftDelete it is marked deleted instead
+func (dba *MongoOpr) DeleteByID(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	n, err := dba.delete(ctx, map[string]interface{}{"_id": id}, false)
+	return n > 0, err
+}
+
+// DeleteMany deletes the documents matching the filter and returns their
+// number, an empty filter is rejected, use a filter matching all explicitly
+// with SoftDelete they are marked deleted instead
+func (dba *MongoOpr) DeleteMany(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	if len(filter) == 0 {
+		return 0, ErrBadInput.Wrap(errors.New("empty delete filter"))
+	}
+	return dba.delete(ctx, filter, true)
+}
+
+// delete deletes or marks deleted the first or all documents matching the filter
+func (dba *MongoOpr) delete(ctx context.Context, filter map[string]interface{}, many bool) (int64, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return 0, err
+	}
+	if dba.SoftDelete {
+		u, err := dba.softDeleteDoc(ctx)
+		if err != nil {
+			return 0, err
+		}
+		ctx, cancel := dba.opCtx(ctx)
+		defer cancel()
+		var res *mongo.UpdateResult
+		if many {
+			res, err = dba.Mcoll.UpdateMany(ctx, f, u)
+		} else {
+			res, err = dba.Mcoll.UpdateOne(ctx, f, u)
+		}
+		if err != nil {
+			return 0, mongoErr(err)
+		}
+		return res.MatchedCount, nil
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	var res *mongo.DeleteResult
+	if many {
+		res, err = dba.Mcoll.DeleteMany(ctx, f)
+	} else {
+		res, err = dba.Mcoll.DeleteOne(ctx, f)
+	}
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	return res.DeletedCount, nil
+}
+
+// FindOneAndUpdate updates the first document matching the filter, see
+// UpdateMany for the update, and decodes the updated document into res,
+// inserting it if upsert, return false if no found and not inserted
+/*
+	var job Job
+	ok, err := db.FindOneAndUpdate(ctx, &job, map[string]interface{}{"state": "queued"}, map[string]interface{}{"state": "running"}, false)
+*/
+func (dba *MongoOpr) FindOneAndUpdate(ctx context.Context, res interface{}, filter, update map[string]interface{}, upsert bool) (bool, error) {
+	f, err := dba.filter(filter)
+	if err != nil {
+		return false, err
+	}
+	u, err := dba.auditUpdate(ctx, update)
+	if err != nil {
+		return false, err
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(upsert)
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	if err := dba.Mcoll.FindOneAndUpdate(ctx, f, u, opts).Decode(res); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		return false, mongoErr(err)
+	}
+	return true, nil
+}
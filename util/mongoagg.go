@@ -0,0 +1,124 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* ****************************************
+mongo aggregation
+**************************************** */
+
+// Aggregate runs the pipeline on the collection and decodes all results
+// into res, a pointer to a slice
+// with SoftDelete the pipeline starts by skipping the deleted documents,
+// use WithDeleted for the stages which must come first, e.g. $geoNear
+/*
+	var rows []struct {
+		Vendor string `bson:"_id"`
+		Count  int    `bson:"count"`
+	}
+	err := db.Aggregate(ctx, &rows, []map[string]interface{}{
+		util.MatchStage(map[string]interface{}{"site": site}),
+		util.GroupStage("$vendor", map[string]interface{}{"count": util.Sum(1)}),
+		util.SortStage("-count", "_id"),
+	})
+*/
+func (dba *MongoOpr) Aggregate(ctx context.Context, res interface{}, pipeline []map[string]interface{}) error {
+	if len(pipeline) == 0 {
+		return ErrBadInput.Wrap(errors.New("empty pipeline"))
+	}
+	p := make(bson.A, 0, len(pipeline)+1)
+	if dba.SoftDelete && !dba.withDeleted {
+		p = append(p, MatchStage(dba.liveFilter(nil)))
+	}
+	for _, st := range pipeline {
+		if len(st) != 1 {
+			return ErrBadInput.Wrap(errors.New("a pipeline stage must have a single operator"))
+		}
+		p = append(p, st)
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	cursor, err := dba.Mcoll.Aggregate(ctx, p)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if err := cursor.All(ctx, res); err != nil {
+		return mongoErr(err)
+	}
+	return nil
+}
+
+// MatchStage is the $match stage of the filter
+func MatchStage(filter map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"$match": filter}
+}
+
+// GroupStage is the $group stage by id, e.g. "$vendor" or a map of
+// fields, with the accumulators, e.g. {"count": Sum(1)}
+func GroupStage(id interface{}, acc map[string]interface{}) map[string]interface{} {
+	g := map[string]interface{}{"_id": id}
+	for k, v := range acc {
+		g[k] = v
+	}
+	return map[string]interface{}{"$group": g}
+}
+
+// Sum is the $sum accumulator of the value, e.g. 1 or "$bytes"
+func Sum(v interface{}) map[string]interface{} {
+	return map[string]interface{}{"$sum": v}
+}
+
+// SortStage is the $sort stage of the fields in order, "-" prefixed
+// fields are descending, as the sort parameter of ListQuery
+func SortStage(fields ...string) map[string]interface{} {
+	d := bson.D{}
+	for _, f := range fields {
+		dir := 1
+		if strings.HasPrefix(f, "-") {
+			f, dir = f[1:], -1
+		}
+		d = append(d, bson.E{Key: f, Value: dir})
+	}
+	return map[string]interface{}{"$sort": d}
+}
+
+// ProjectStage is the $project stage of the fields, e.g. {"name": 1,
+// "mb": {"$divide": []interface{}{"$bytes", 1 << 20}}}
+func ProjectStage(fields map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"$project": fields}
+}
+
+// LookupStage is the $lookup stage joining the documents of the from
+// collection whose foreignField equals localField into the array as
+func LookupStage(from, localField, foreignField, as string) map[string]interface{} {
+	return map[string]interface{}{"$lookup": map[string]interface{}{
+		"from":         from,
+		"localField":   localField,
+		"foreignField": foreignField,
+		"as":           as,
+	}}
+}
+
+// UnwindStage is the $unwind stage of the array path, e.g. "$ports",
+// keeping the documents without element if preserveEmpty
+func UnwindStage(path string, preserveEmpty bool) map[string]interface{} {
+	return map[string]interface{}{"$unwind": map[string]interface{}{
+		"path":                       path,
+		"preserveNullAndEmptyArrays": preserveEmpty,
+	}}
+}
+
+// LimitStage is the $limit stage
+func LimitStage(n int64) map[string]interface{} {
+	return map[string]interface{}{"$limit": n}
+}
+
+// SkipStage is the $skip stage
+func SkipStage(n int64) map[string]interface{} {
+	return map[string]interface{}{"$skip": n}
+}
@@ -0,0 +1,188 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/* ****************************************
+mongo audit fields and soft delete
+**************************************** */
+
+// the fields stamped by MongoOpr.Audit and MongoOpr.SoftDelete
+const (
+	AuditCreatedAt = "createdAt"
+	AuditUpdatedAt = "updatedAt"
+	AuditUpdatedBy = "updatedBy"
+	SoftDeletedAt  = "deletedAt"
+)
+
+// WithDeleted returns a copy of dba whose operations include the soft
+// deleted documents, see SoftDelete
+func (dba *MongoOpr) WithDeleted() *MongoOpr {
+	c := *dba
+	c.withDeleted = true
+	return &c
+}
+
+// liveFilter adds the soft delete condition to the filter unless it
+// already has a condition on deletedAt
+func (dba *MongoOpr) liveFilter(filter map[string]interface{}) map[string]interface{} {
+	if !dba.SoftDelete || dba.withDeleted {
+		return filter
+	}
+	if _, ok := filter[SoftDeletedAt]; ok {
+		return filter
+	}
+	f := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	// matches the missing field as well
+	f[SoftDeletedAt] = nil
+	return f
+}
+
+// filter encodes the filter of an operation, see liveFilter
+func (dba *MongoOpr) filter(filter map[string]interface{}) (bson.Raw, error) {
+	return marshalFilter(dba.liveFilter(filter))
+}
+
+// auditFields are the fields set by a write of the caller of ctx,
+// updatedBy is null without identity
+func auditFields(ctx context.Context, now time.Time) bson.D {
+	var by interface{}
+	if id, ok := IdentityFromContext(ctx); ok {
+		by = id.Subject
+	}
+	return bson.D{{Key: AuditUpdatedAt, Value: now}, {Key: AuditUpdatedBy, Value: by}}
+}
+
+// setFields replaces or appends the fields of d
+func setFields(d bson.D, fields bson.D) bson.D {
+	out := make(bson.D, 0, len(d)+len(fields))
+	for _, e := range d {
+		if _, ok := lookupD(fields, e.Key); !ok {
+			out = append(out, e)
+		}
+	}
+	return append(out, fields...)
+}
+
+// lookupD returns the value of the key of d
+func lookupD(d bson.D, key string) (interface{}, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// auditDoc returns the document to insert, or the replacement if not
+// insert, stamped with the audit fields if Audit
+func (dba *MongoOpr) auditDoc(ctx context.Context, doc interface{}, insert bool) (interface{}, error) {
+	if !dba.Audit {
+		return doc, nil
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	now := time.Now()
+	fields := auditFields(ctx, now)
+	// a replacement keeps its createdAt, there is no way to read the
+	// replaced one in the same operation
+	if insert {
+		fields = append(bson.D{{Key: AuditCreatedAt, Value: now}}, fields...)
+	}
+	return setFields(d, fields), nil
+}
+
+// auditUpdate builds the update document as updateDoc, adding the audit
+// fields to $set and createdAt to $setOnInsert if Audit
+func (dba *MongoOpr) auditUpdate(ctx context.Context, update map[string]interface{}) (bson.Raw, error) {
+	u, err := updateDoc(update)
+	if err != nil || !dba.Audit {
+		return u, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(u, &d); err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	return dba.auditSet(ctx, d, nil)
+}
+
+// auditSet adds the fields, and the audit fields if Audit, to the $set of
+// the update document d
+func (dba *MongoOpr) auditSet(ctx context.Context, d bson.D, fields bson.D) (bson.Raw, error) {
+	now := time.Now()
+	if dba.Audit {
+		fields = append(fields, auditFields(ctx, now)...)
+	}
+	set, _ := lookupD(d, "$set")
+	setD, _ := set.(bson.D)
+	setD = setFields(setD, fields)
+	d = setFields(d, bson.D{{Key: "$set", Value: setD}})
+	if _, ok := lookupD(setD, AuditCreatedAt); dba.Audit && !ok {
+		ins, _ := lookupD(d, "$setOnInsert")
+		insD, _ := ins.(bson.D)
+		insD = setFields(insD, bson.D{{Key: AuditCreatedAt, Value: now}})
+		d = setFields(d, bson.D{{Key: "$setOnInsert", Value: insD}})
+	}
+	return bson.Marshal(d)
+}
+
+// softDeleteDoc is the update marking the documents deleted
+func (dba *MongoOpr) softDeleteDoc(ctx context.Context) (bson.Raw, error) {
+	return dba.auditSet(ctx, nil, bson.D{{Key: SoftDeletedAt, Value: time.Now()}})
+}
+
+// deletedFilter copies the filter adding the condition matching the soft
+// deleted documents, unless it already has a condition on deletedAt
+func deletedFilter(filter map[string]interface{}) map[string]interface{} {
+	f := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		f[k] = v
+	}
+	if _, ok := f[SoftDeletedAt]; !ok {
+		f[SoftDeletedAt] = map[string]interface{}{"$ne": nil}
+	}
+	return f
+}
+
+// Purge deletes for good the soft deleted documents matching the filter,
+// e.g. {"deletedAt": {"$lt": cutoff}} past the retention, and returns
+// their number, an empty filter is rejected
+/*
+	records := svc.Mongo.Collection("records")
+	records.Audit, records.SoftDelete = true, true
+	...
+	n, err := records.Purge(ctx, map[string]interface{}{
+		"deletedAt": map[string]interface{}{"$lt": time.Now().AddDate(0, 0, -90)}})
+*/
+func (dba *MongoOpr) Purge(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	if len(filter) == 0 {
+		return 0, ErrBadInput.Wrap(errors.New("empty purge filter"))
+	}
+	hard := *dba
+	hard.SoftDelete = false
+	return hard.delete(ctx, deletedFilter(filter), true)
+}
+
+// Restore undeletes the soft deleted documents matching the filter, e.g.
+// {"deletedAt": {"$gte": since}}, and returns their number, an empty
+// filter is rejected
+func (dba *MongoOpr) Restore(ctx context.Context, filter map[string]interface{}) (int64, error) {
+	if len(filter) == 0 {
+		return 0, ErrBadInput.Wrap(errors.New("empty restore filter"))
+	}
+	return dba.WithDeleted().UpdateMany(ctx, deletedFilter(filter), map[string]interface{}{"$unset": map[string]interface{}{SoftDeletedAt: ""}})
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo bulk write
+**************************************** */
+
+// BulkOp kinds
+const (
+	BulkInsert  = "insert"
+	BulkUpdate  = "update"
+	BulkReplace = "replace"
+	BulkDelete  = "delete"
+)
+
+// BulkOp is an operation of BulkWrite, Filter and Update are map-style as
+// for UpdateMany, Doc is the document of insert and replace, Many applies
+// update and delete to all matching documents instead of the first
+/*
+	ops := make([]util.BulkOp, 0, len(records))
+	for _, r := range records {
+		ops = append(ops, util.BulkOp{Kind: util.BulkUpdate, Upsert: true,
+			Filter: map[string]interface{}{"_id": r.Key},
+			Update: map[string]interface{}{"name": r.Name, "seen": now}})
+	}
+	res, err := db.BulkWrite(ctx, ops, false)
+*/
+type BulkOp struct {
+	Kind   string
+	Filter map[string]interface{}
+	Update map[string]interface{}
+	Doc    interface{}
+	Upsert bool
+	Many   bool
+}
+
+// model builds the driver model of the op on dba, see Audit and SoftDelete
+func (op BulkOp) model(ctx context.Context, dba *MongoOpr) (mongo.WriteModel, error) {
+	switch op.Kind {
+	case BulkInsert:
+		if op.Doc == nil {
+			return nil, errors.New("insert without document")
+		}
+		doc, err := dba.auditDoc(ctx, op.Doc, true)
+		if err != nil {
+			return nil, err
+		}
+		return mongo.NewInsertOneModel().SetDocument(doc), nil
+	case BulkUpdate:
+		f, err := dba.filter(op.Filter)
+		if err != nil {
+			return nil, err
+		}
+		u, err := dba.auditUpdate(ctx, op.Update)
+		if err != nil {
+			return nil, err
+		}
+		if op.Many {
+			return mongo.NewUpdateManyModel().SetFilter(f).SetUpdate(u).SetUpsert(op.Upsert), nil
+		}
+		return mongo.NewUpdateOneModel().SetFilter(f).SetUpdate(u).SetUpsert(op.Upsert), nil
+	case BulkReplace:
+		f, err := dba.filter(op.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if op.Doc == nil {
+			return nil, errors.New("replace without document")
+		}
+		doc, err := dba.auditDoc(ctx, op.Doc, false)
+		if err != nil {
+			return nil, err
+		}
+		return mongo.NewReplaceOneModel().SetFilter(f).SetReplacement(doc).SetUpsert(op.Upsert), nil
+	case BulkDelete:
+		if len(op.Filter) == 0 {
+			return nil, errors.New("empty delete filter")
+		}
+		f, err := dba.filter(op.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if dba.SoftDelete {
+			u, err := dba.softDeleteDoc(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if op.Many {
+				return mongo.NewUpdateManyModel().SetFilter(f).SetUpdate(u), nil
+			}
+			return mongo.NewUpdateOneModel().SetFilter(f).SetUpdate(u), nil
+		}
+		if op.Many {
+			return mongo.NewDeleteManyModel().SetFilter(f), nil
+		}
+		return mongo.NewDeleteOneModel().SetFilter(f), nil
+	}
+	return nil, fmt.Errorf("unknown bulk op %q", op.Kind)
+}
+
+// BulkOpError is the failure of the op at Index of the BulkWrite ops, -1
+// for the write concern error
+type BulkOpError struct {
+	Index   int    `json:"index"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// BulkResult is the outcome of BulkWrite, Upserted maps the index of the
+// upserting ops to the _id of the inserted document
+type BulkResult struct {
+	Inserted int64               `json:"inserted"`
+	Matched  int64               `json:"matched"`
+	Modified int64               `json:"modified"`
+	Deleted  int64               `json:"deleted"`
+	Upserted map[int]interface{} `json:"upserted,omitempty"`
+	Errors   []BulkOpError       `json:"errors,omitempty"`
+}
+
+// BulkWrite sends the ops in as few round trips as possible, ordered stops
+// at the first failed op, otherwise all ops are attempted
+// with SoftDelete the deletes are counted as Matched
+// on partial failure the result holds the counts of the applied ops and
+// the error of each failed one, and the error is returned as well
+func (dba *MongoOpr) BulkWrite(ctx context.Context, ops []BulkOp, ordered bool) (*BulkResult, error) {
+	res := &BulkResult{}
+	if len(ops) == 0 {
+		return res, nil
+	}
+	models := make([]mongo.WriteModel, len(ops))
+	for i, op := range ops {
+		m, err := op.model(ctx, dba)
+		if err != nil {
+			return res, ErrBadInput.Wrap(fmt.Errorf("bulk op %d: %w", i, err))
+		}
+		models[i] = m
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	r, err := dba.Mcoll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(ordered))
+	if r != nil {
+		res.Inserted, res.Matched, res.Modified, res.Deleted = r.InsertedCount, r.MatchedCount, r.ModifiedCount, r.DeletedCount
+		if len(r.UpsertedIDs) > 0 {
+			res.Upserted = make(map[int]interface{}, len(r.UpsertedIDs))
+			for i, id := range r.UpsertedIDs {
+				res.Upserted[int(i)] = id
+			}
+		}
+	}
+	var be mongo.BulkWriteException
+	if errors.As(err, &be) {
+		for _, we := range be.WriteErrors {
+			res.Errors = append(res.Errors, BulkOpError{Index: we.Index, Code: we.Code, Message: we.Message})
+		}
+		if be.WriteConcernError != nil {
+			res.Errors = append(res.Errors, BulkOpError{Index: -1, Code: be.WriteConcernError.Code, Message: be.WriteConcernError.Message})
+		}
+	}
+	return res, mongoErr(err)
+}
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+)
+
+/* ****************************************
+mongo connection
+**************************************** */
+
+// DefaultMongoConnectTimeout bounds ConnectMongo unless ctx has a deadline
+var DefaultMongoConnectTimeout = 10 * time.Second
+
+// MongoOptions configures ConnectMongo, the zero values keep the settings
+// of the URI, then the driver defaults
+type MongoOptions struct {
+	// Database defaults to the database of the URI
+	Database string
+	// AppName is reported to the server logs and profiler
+	AppName string
+	// MinPool and MaxPool bound the connections per server
+	MinPool, MaxPool uint64
+	// MaxConnIdle closes the pooled connections idle longer
+	MaxConnIdle time.Duration
+	// ConnectTimeout bounds the dial of a connection, ServerSelection the
+	// wait for a suitable server, Socket a read or write on a connection
+	ConnectTimeout, ServerSelection, Socket time.Duration
+	// Timeout is the MongoOpr Timeout, default DefaultMongoTimeout
+	Timeout time.Duration
+	// NoRetryWrites disables the retryable writes, required by the
+	// deployments without sessions, e.g. a standalone mongod
+	NoRetryWrites bool
+	// TLS enables TLS with the config, see NewClientTLSConfig
+	TLS *tls.Config
+	// Tracer traces the mongo commands if set
+	Tracer *Tracer
+}
+
+// ConnectMongo connects the deployment of the URI and returns the
+// MongoOpr of the database once the primary answers a ping, use
+// Collection for the collections, Ping for the readiness and Close on
+// shutdown
+/*
+	db, err := util.ConnectMongo(ctx, cfg.MongoURI, &util.MongoOptions{MaxPool: 50, AppName: "inventory"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	api.Health().AddReadiness("mongo", db.Ping, 2*time.Second)
+	devices := db.Collection("devices")
+*/
+func ConnectMongo(ctx context.Context, uri string, opts *MongoOptions) (*MongoOpr, error) {
+	if opts == nil {
+		opts = &MongoOptions{}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cs, err := connstring.Parse(uri)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("mongo uri: %w", err))
+	}
+	db := opts.Database
+	if db == "" {
+		db = cs.Database
+	}
+	if db == "" {
+		return nil, ErrBadInput.Wrap(errors.New("mongo database neither configured nor in the uri"))
+	}
+	co := options.Client().ApplyURI(uri)
+	if opts.AppName != "" {
+		co.SetAppName(opts.AppName)
+	}
+	if opts.MinPool > 0 {
+		co.SetMinPoolSize(opts.MinPool)
+	}
+	if opts.MaxPool > 0 {
+		co.SetMaxPoolSize(opts.MaxPool)
+	}
+	if opts.MaxConnIdle > 0 {
+		co.SetMaxConnIdleTime(opts.MaxConnIdle)
+	}
+	if opts.ConnectTimeout > 0 {
+		co.SetConnectTimeout(opts.ConnectTimeout)
+	}
+	if opts.ServerSelection > 0 {
+		co.SetServerSelectionTimeout(opts.ServerSelection)
+	}
+	if opts.Socket > 0 {
+		co.SetSocketTimeout(opts.Socket)
+	}
+	if opts.NoRetryWrites {
+		co.SetRetryWrites(false)
+	}
+	if opts.TLS != nil {
+		co.SetTLSConfig(opts.TLS)
+	}
+	if opts.Tracer != nil {
+		co.SetMonitor(opts.Tracer.MongoMonitor())
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultMongoConnectTimeout)
+		defer cancel()
+	}
+	client, err := mongo.Connect(ctx, co)
+	if err != nil {
+		return nil, fmt.Errorf("mongo connect: %w", mongoErr(err))
+	}
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("mongo ping: %w", mongoErr(err))
+	}
+	return &MongoOpr{Mdb: client.Database(db), Timeout: opts.Timeout}, nil
+}
+
+// Ping checks the primary answers within Timeout unless ctx has a
+// deadline, a readiness check, see Health.AddReadiness
+func (dba *MongoOpr) Ping(ctx context.Context) error {
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	return mongoErr(dba.Mdb.Client().Ping(ctx, readpref.Primary()))
+}
+
+// Close disconnects the client of the MongoOpr, shared by all its
+// collections, waiting for the operations in progress until ctx is done
+func (dba *MongoOpr) Close(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return dba.Mdb.Client().Disconnect(ctx)
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo GridFS file storage
+**************************************** */
+
+// GridFile is a file stored by PutFile, Meta is the metadata given to
+// PutFile, Sum the hex encoded sha256 checksum of the content
+type GridFile struct {
+	ID       primitive.ObjectID     `json:"id"`
+	Name     string                 `json:"name"`
+	Size     int64                  `json:"size"`
+	Uploaded time.Time              `json:"uploaded"`
+	Sum      string                 `json:"sha256"`
+	Meta     map[string]interface{} `json:"meta,omitempty"`
+}
+
+// gridSumField is the metadata field of the checksum
+const gridSumField = HashSHA256
+
+// bucket returns the GridFS bucket named after the collection, e.g.
+// configs.files and configs.chunks of Collection("configs"), with the
+// deadline of ctx
+func (dba *MongoOpr) bucket(ctx context.Context) (*gridfs.Bucket, time.Time, error) {
+	b, err := gridfs.NewBucket(dba.Mdb, options.GridFSBucket().SetName(dba.Mcoll.Name()))
+	if err != nil {
+		return nil, time.Time{}, mongoErr(err)
+	}
+	dl, _ := ctx.Deadline()
+	b.SetWriteDeadline(dl)
+	b.SetReadDeadline(dl)
+	return b, dl, nil
+}
+
+// ctxReader fails the reads once ctx is done, GridFS only knows deadlines
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// PutFile streams r into GridFS as a new revision of the file name, with
+// the metadata and the sha256 checksum of the content
+// the operation isn't bounded by Timeout, ctx must be
+/*
+	f, err := svc.Mongo.Collection("configs").PutFile(ctx, dev.Name+".cfg", cfg,
+		map[string]interface{}{"device": dev.ID, "captured": time.Now()})
+*/
+func (dba *MongoOpr) PutFile(ctx context.Context, name string, r io.Reader, meta map[string]interface{}) (*GridFile, error) {
+	if name == "" {
+		return nil, ErrBadInput.Wrap(errors.New("empty file name"))
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	h, _ := newHash(HashSHA256)
+	b, dl, err := dba.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := primitive.NewObjectID()
+	o := options.GridFSUpload()
+	if meta != nil {
+		o.SetMetadata(meta)
+	}
+	us, err := b.OpenUploadStreamWithID(id, name, o)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	us.SetWriteDeadline(dl)
+	n, err := io.Copy(us, io.TeeReader(ctxReader{ctx, r}, h))
+	if err != nil {
+		us.Abort()
+		return nil, mongoErr(err)
+	}
+	if err := us.Close(); err != nil {
+		return nil, mongoErr(err)
+	}
+	// the checksum is only known once streamed
+	sum := hex.EncodeToString(h.Sum(nil))
+	if _, err := b.GetFilesCollection().UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$set": bson.M{"metadata." + gridSumField: sum}}); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &GridFile{ID: id, Name: name, Size: n, Uploaded: time.Now(), Sum: sum, Meta: meta}, nil
+}
+
+// GetFile streams the latest revision of the file name into w, ErrNotFound
+// if there is none, and verifies its checksum, ErrChecksum if it doesn't
+// match, in which case w has received the corrupted content
+// the operation isn't bounded by Timeout, ctx must be
+/*
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := svc.Mongo.Collection("configs").GetFile(r.Context(), name, w); err != nil {
+		...
+	}
+*/
+func (dba *MongoOpr) GetFile(ctx context.Context, name string, w io.Writer) (*GridFile, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	b, dl, err := dba.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := b.OpenDownloadStreamByName(name)
+	if err == gridfs.ErrFileNotFound {
+		return nil, ErrNotFound.Wrap(fmt.Errorf("file %s", name))
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	defer ds.Close()
+	ds.SetReadDeadline(dl)
+	f := ds.GetFile()
+	gf := &GridFile{Name: name, Size: f.Length, Uploaded: f.UploadDate}
+	gf.ID, _ = f.ID.(primitive.ObjectID)
+	if len(f.Metadata) > 0 {
+		if err := bson.Unmarshal(f.Metadata, &gf.Meta); err != nil {
+			return nil, err
+		}
+		gf.Sum, _ = gf.Meta[gridSumField].(string)
+		delete(gf.Meta, gridSumField)
+	}
+	h, _ := newHash(HashSHA256)
+	if _, err := io.Copy(io.MultiWriter(w, h), ctxReader{ctx, ds}); err != nil {
+		return nil, mongoErr(err)
+	}
+	// files stored by other tools have no checksum
+	if sum := hex.EncodeToString(h.Sum(nil)); gf.Sum != "" && sum != gf.Sum {
+		return gf, ErrChecksum.Wrap(fmt.Errorf("file %s sha256 %s doesn't match %s", name, sum, gf.Sum))
+	}
+	return gf, nil
+}
@@ -0,0 +1,202 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo index management
+**************************************** */
+
+// IndexSpec declares an index of the collection, Keys are the fields in
+// order, "-" prefixed fields are descending, as SortStage
+// Name defaults to the name the server gives, e.g. "site_1_updated_-1",
+// TTL expires the documents after the date of the single key, Partial
+// limits the index to the documents matching the filter
+// a TTL under a second expires the documents at the date itself
+type IndexSpec struct {
+	Name    string
+	Keys    []string
+	Unique  bool
+	TTL     time.Duration
+	Partial map[string]interface{}
+}
+
+// keys returns the key document and the default name of the spec
+func (s IndexSpec) keys() (bson.D, string) {
+	d := make(bson.D, 0, len(s.Keys))
+	names := make([]string, 0, len(s.Keys))
+	for _, k := range s.Keys {
+		dir := 1
+		if strings.HasPrefix(k, "-") {
+			k, dir = k[1:], -1
+		}
+		d = append(d, bson.E{Key: k, Value: dir})
+		names = append(names, fmt.Sprintf("%s_%d", k, dir))
+	}
+	return d, strings.Join(names, "_")
+}
+
+// IndexDrift is an index of the collection which differs from its spec,
+// or isn't declared if Reason is "undeclared"
+type IndexDrift struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// existingIndex is an entry of the index listing
+type existingIndex struct {
+	Name    string      `bson:"name"`
+	Key     bson.D      `bson:"key"`
+	Unique  bool        `bson:"unique"`
+	TTL     interface{} `bson:"expireAfterSeconds"`
+	Partial bson.M      `bson:"partialFilterExpression"`
+}
+
+// EnsureIndexes creates the missing indexes of the specs and reports the
+// existing ones which differ from their spec or aren't declared
+// the drifted indexes are left as they are, dropping or rebuilding an
+// index of a large collection is a decision for the operator, so it is
+// safe to call on every start
+/*
+	drift, err := db.EnsureIndexes(ctx, []util.IndexSpec{
+		{Keys: []string{"site", "-updated"}},
+		{Keys: []string{"serial"}, Unique: true},
+		{Keys: []string{"expires"}, TTL: time.Nanosecond},
+		{Keys: []string{"email"}, Unique: true, Partial: map[string]interface{}{"deletedAt": nil}},
+	})
+	for _, d := range drift {
+		log.Warnf("index %s: %s", d.Name, d.Reason)
+	}
+*/
+func (dba *MongoOpr) EnsureIndexes(ctx context.Context, specs []IndexSpec) ([]IndexDrift, error) {
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	cursor, err := dba.Mcoll.Indexes().List(ctx)
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	var existing []existingIndex
+	if err := cursor.All(ctx, &existing); err != nil {
+		return nil, mongoErr(err)
+	}
+	byName := make(map[string]existingIndex, len(existing))
+	for _, ix := range existing {
+		byName[ix.Name] = ix
+	}
+	var drift []IndexDrift
+	var models []mongo.IndexModel
+	declared := map[string]bool{"_id_": true}
+	for _, s := range specs {
+		if len(s.Keys) == 0 {
+			return nil, ErrBadInput.Wrap(errors.New("index without keys"))
+		}
+		keys, name := s.keys()
+		if s.Name != "" {
+			name = s.Name
+		}
+		declared[name] = true
+		ix, ok := byName[name]
+		if !ok {
+			o := options.Index().SetName(name)
+			if s.Unique {
+				o.SetUnique(true)
+			}
+			if s.TTL > 0 {
+				o.SetExpireAfterSeconds(int32(s.TTL / time.Second))
+			}
+			if s.Partial != nil {
+				p, err := marshalFilter(s.Partial)
+				if err != nil {
+					return nil, err
+				}
+				o.SetPartialFilterExpression(p)
+			}
+			models = append(models, mongo.IndexModel{Keys: keys, Options: o})
+			continue
+		}
+		if r := ix.diff(s, keys); r != "" {
+			drift = append(drift, IndexDrift{Name: name, Reason: r})
+		}
+	}
+	for _, ix := range existing {
+		if !declared[ix.Name] {
+			drift = append(drift, IndexDrift{Name: ix.Name, Reason: "undeclared"})
+		}
+	}
+	if len(models) > 0 {
+		if _, err := dba.Mcoll.Indexes().CreateMany(ctx, models); err != nil {
+			return drift, mongoErr(err)
+		}
+	}
+	return drift, nil
+}
+
+// diff describes how the index differs from the spec, "" if it doesn't
+func (ix existingIndex) diff(s IndexSpec, keys bson.D) string {
+	var r []string
+	if !sameKeys(ix.Key, keys) {
+		r = append(r, "keys differ")
+	}
+	if ix.Unique != s.Unique {
+		r = append(r, fmt.Sprintf("unique is %t", ix.Unique))
+	}
+	ttl, want := int64(-1), int64(-1)
+	if ix.TTL != nil {
+		ttl = toInt64(ix.TTL)
+	}
+	if s.TTL > 0 {
+		want = int64(s.TTL / time.Second)
+	}
+	if ttl != want && ttl < 0 {
+		r = append(r, "no TTL")
+	} else if ttl != want {
+		r = append(r, fmt.Sprintf("expireAfterSeconds is %d", ttl))
+	}
+	var partial bson.M
+	if s.Partial != nil {
+		if b, err := bson.Marshal(s.Partial); err == nil {
+			bson.Unmarshal(b, &partial)
+		}
+	}
+	if len(ix.Partial) != len(partial) || len(partial) > 0 && !reflect.DeepEqual(ix.Partial, partial) {
+		r = append(r, "partial filter differs")
+	}
+	return strings.Join(r, ", ")
+}
+
+// sameKeys compares the key documents, the numbers of the listing may be
+// of any type
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// toInt64 converts the numbers of a listing
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return -1
+}
@@ -0,0 +1,215 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo cursor pagination and streaming
+**************************************** */
+
+// pageCursor is the position after the last document of a page, Value is
+// null if the document has no sort field
+type pageCursor struct {
+	Value bson.RawValue `bson:"v"`
+	ID    bson.RawValue `bson:"id"`
+}
+
+// encodeCursor returns the opaque token of the position of doc
+func encodeCursor(doc bson.Raw, field string) (string, error) {
+	id, err := doc.LookupErr("_id")
+	if err != nil {
+		return "", ErrBadInput.Wrap(errors.New("the projection must keep _id"))
+	}
+	c := bson.D{{Key: "id", Value: id}}
+	if field != "_id" {
+		// a missing field sorts as null
+		var v interface{}
+		if rv, err := doc.LookupErr(strings.Split(field, ".")...); err == nil {
+			v = rv
+		}
+		c = append(c, bson.E{Key: "v", Value: v})
+	}
+	b, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor parses the token of encodeCursor, the cursor is given by
+// the client, so its values must be plain values, a document or an array
+// would be read as query operators
+func decodeCursor(token string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("invalid cursor: %w", err))
+	}
+	var c pageCursor
+	if err := bson.Unmarshal(b, &c); err != nil {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("invalid cursor: %w", err))
+	}
+	if c.ID.Type == 0 {
+		return nil, ErrBadInput.Wrap(errors.New("invalid cursor: no _id"))
+	}
+	for _, v := range []bson.RawValue{c.ID, c.Value} {
+		switch v.Type {
+		case bsontype.EmbeddedDocument, bsontype.Array, bsontype.JavaScript, bsontype.CodeWithScope:
+			return nil, ErrBadInput.Wrap(fmt.Errorf("invalid cursor: %s value", v.Type))
+		}
+	}
+	return &c, nil
+}
+
+// after is the filter of the documents after the cursor in the order of
+// the field, null and missing values sort before any other
+func (c *pageCursor) after(field string, desc bool) bson.M {
+	cmp := "$gt"
+	if desc {
+		cmp = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{cmp: c.ID}}
+	}
+	null := c.Value.Type == 0 || c.Value.Type == bsontype.Null
+	var v interface{}
+	if !null {
+		v = c.Value
+	}
+	same := bson.M{field: v, "_id": bson.M{cmp: c.ID}}
+	switch {
+	case null && desc:
+		return same
+	case null:
+		// comparing with null matches nothing, any value is after null
+		return bson.M{"$or": bson.A{bson.M{field: bson.M{"$ne": nil}}, same}}
+	case desc:
+		return bson.M{"$or": bson.A{bson.M{field: bson.M{cmp: v}}, same, bson.M{field: nil}}}
+	}
+	return bson.M{"$or": bson.A{bson.M{field: bson.M{cmp: v}}, same}}
+}
+
+// GetPage returns up to limit documents into res, a pointer to a slice,
+// in the order of the sort field, "-" prefixed for descending, "" means
+// _id, starting after the cursor, "" for the first page
+// the returned cursor is the token of the next page, "" after the last one
+// unlike skip, the position is kept by the sort value and _id, so the
+// pages stay fast and stable on large collections while documents are
+// added, the sort field and _id must be kept by the projection
+/*
+	var devs []Device
+	next, err := db.GetPage(ctx, &devs, map[string]interface{}{"site": site}, nil, "-updated", 100, r.URL.Query().Get("cursor"))
+*/
+func (dba *MongoOpr) GetPage(ctx context.Context, res interface{}, filter, projection map[string]interface{}, sort string, limit int64, after string) (string, error) {
+	rv := reflect.ValueOf(res)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return "", ErrBadInput.Wrap(errors.New("res must be a pointer to a slice"))
+	}
+	if limit <= 0 {
+		limit = int64(DefaultPerPage)
+	}
+	field, dir, desc := strings.TrimPrefix(sort, "-"), 1, strings.HasPrefix(sort, "-")
+	if field == "" {
+		field = "_id"
+	}
+	if desc {
+		dir = -1
+	}
+	f := bson.M{}
+	for k, v := range dba.liveFilter(filter) {
+		f[k] = v
+	}
+	if after != "" {
+		c, err := decodeCursor(after)
+		if err != nil {
+			return "", err
+		}
+		pos := c.after(field, desc)
+		if len(f) > 0 {
+			f = bson.M{"$and": bson.A{f, pos}}
+		} else {
+			f = pos
+		}
+	}
+	order := bson.D{{Key: field, Value: dir}}
+	if field != "_id" {
+		order = append(order, bson.E{Key: "_id", Value: dir})
+	}
+	p, err := bson.Marshal(projection)
+	if err != nil {
+		return "", ErrBadInput.Wrap(err)
+	}
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	// one more to know if there is a next page
+	cursor, err := dba.Mcoll.Find(ctx, f, options.Find().SetSort(order).SetProjection(p).SetLimit(limit+1))
+	if err != nil {
+		return "", mongoErr(err)
+	}
+	defer cursor.Close(ctx)
+	var docs []bson.Raw
+	for cursor.Next(ctx) {
+		docs = append(docs, append(bson.Raw(nil), cursor.Current...))
+	}
+	if err := cursor.Err(); err != nil {
+		return "", mongoErr(err)
+	}
+	next := ""
+	if int64(len(docs)) > limit {
+		docs = docs[:limit]
+		if next, err = encodeCursor(docs[len(docs)-1], field); err != nil {
+			return "", err
+		}
+	}
+	out := reflect.MakeSlice(rv.Elem().Type(), len(docs), len(docs))
+	for i, d := range docs {
+		if err := bson.Unmarshal(d, out.Index(i).Addr().Interface()); err != nil {
+			return "", ErrBadInput.Wrap(err)
+		}
+	}
+	rv.Elem().Set(out)
+	return next, nil
+}
+
+// Stream calls fn for each document matching the filter as the cursor
+// reads them, so the collection is never held in memory, until fn returns
+// an error, which is returned, or ctx is done
+// the operation isn't bounded by Timeout, ctx must be
+/*
+	err := db.Stream(ctx, map[string]interface{}{"kind": "syslog"}, func(doc bson.M) error {
+		return enc.Encode(doc)
+	})
+*/
+func (dba *MongoOpr) Stream(ctx context.Context, filter map[string]interface{}, fn func(doc bson.M) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	f, err := dba.filter(filter)
+	if err != nil {
+		return err
+	}
+	cursor, err := dba.Mcoll.Find(ctx, f)
+	if err != nil {
+		return mongoErr(err)
+	}
+	defer cursor.Close(context.Background())
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		if err := fn(doc); err != nil {
+			return err
+		}
+	}
+	return mongoErr(cursor.Err())
+}
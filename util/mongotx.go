@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+/* ****************************************
+mongo sessions and transactions
+**************************************** */
+
+// WithTransaction runs fn in a transaction committed if fn succeeds and
+// aborted otherwise, the MongoOpr operations of every collection given
+// sessCtx join the transaction, e.g. dba.Collection("audit").InsertOne
+// fn is retried on transient errors, so it must not have other side
+// effects, the whole transaction is bounded by Timeout unless ctx has a
+// deadline, the transactions require a replica set
+/*
+	jobs, audit := svc.Mongo.Collection("jobs"), svc.Mongo.Collection("audit")
+	err := jobs.WithTransaction(ctx, func(sc mongo.SessionContext) error {
+		if _, err := jobs.UpdateByID(sc, job.ID, map[string]interface{}{"state": "done"}); err != nil {
+			return err
+		}
+		_, err := audit.InsertOne(sc, entry)
+		return err
+	})
+*/
+func (dba *MongoOpr) WithTransaction(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	ctx, cancel := dba.opCtx(ctx)
+	defer cancel()
+	sess, err := dba.Mdb.Client().StartSession()
+	if err != nil {
+		return mongoErr(err)
+	}
+	defer sess.EndSession(context.Background())
+	opts := options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	}, opts)
+	return mongoErr(err)
+}
+
+// WithSession runs fn in a causally consistent session without
+// transaction, the operations given sessCtx read their own writes even
+// from the secondaries
+// unlike WithTransaction, the session is not bounded by Timeout, each
+// operation is
+func (dba *MongoOpr) WithSession(ctx context.Context, fn func(sessCtx mongo.SessionContext) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return mongoErr(dba.Mdb.Client().UseSessionWithOptions(ctx, options.Session().SetCausalConsistency(true), fn))
+}
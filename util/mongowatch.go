@@ -0,0 +1,208 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+mongo change streams
+**************************************** */
+
+// ChangeEvent is a change stream event, FullDocument is the document after
+// an insert, replace or update, nil after a delete
+type ChangeEvent struct {
+	ResumeToken       bson.Raw                  `bson:"_id"`
+	OperationType     string                    `bson:"operationType"`
+	FullDocument      bson.M                    `bson:"fullDocument,omitempty"`
+	DocumentKey       bson.M                    `bson:"documentKey,omitempty"`
+	UpdateDescription *UpdateDescription        `bson:"updateDescription,omitempty"`
+	Ns                struct{ DB, Coll string } `bson:"ns"`
+	ClusterTime       primitive.Timestamp       `bson:"clusterTime"`
+}
+
+// UpdateDescription is the delta of an update event
+type UpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// ResumeTokenStore persists the position of a change stream, so a
+// restarted service continues where it stopped
+type ResumeTokenStore interface {
+	// LoadResumeToken returns nil if there is no token of the key
+	LoadResumeToken(ctx context.Context, key string) (bson.Raw, error)
+	SaveResumeToken(ctx context.Context, key string, token bson.Raw) error
+}
+
+// MemoryResumeTokens is a ResumeTokenStore of a single process, it only
+// survives the reconnects of Watch
+type MemoryResumeTokens struct {
+	mu     sync.Mutex
+	tokens map[string]bson.Raw
+}
+
+// NewMemoryResumeTokens creates an empty MemoryResumeTokens
+func NewMemoryResumeTokens() *MemoryResumeTokens {
+	return &MemoryResumeTokens{tokens: make(map[string]bson.Raw)}
+}
+
+// LoadResumeToken returns the token of the key
+func (m *MemoryResumeTokens) LoadResumeToken(ctx context.Context, key string) (bson.Raw, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tokens[key], nil
+}
+
+// SaveResumeToken stores the token of the key
+func (m *MemoryResumeTokens) SaveResumeToken(ctx context.Context, key string, token bson.Raw) error {
+	m.mu.Lock()
+	m.tokens[key] = token
+	m.mu.Unlock()
+	return nil
+}
+
+// MongoResumeTokens is a ResumeTokenStore in a collection of the MongoOpr
+// database, {_id: key, token, updated}
+type MongoResumeTokens struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// LoadResumeToken returns the token of the key
+func (m *MongoResumeTokens) LoadResumeToken(ctx context.Context, key string) (bson.Raw, error) {
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := m.Opr.Mdb.Collection(m.Collection).FindOne(ctx, bson.M{"_id": key}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	return doc.Token, nil
+}
+
+// SaveResumeToken upserts the token of the key
+func (m *MongoResumeTokens) SaveResumeToken(ctx context.Context, key string, token bson.Raw) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).UpdateOne(ctx, bson.M{"_id": key},
+		bson.M{"$set": bson.M{"token": token, "updated": time.Now()}}, options.Update().SetUpsert(true))
+	return mongoErr(err)
+}
+
+// watchConfig is built by the WatchOption of Watch
+type watchConfig struct {
+	store   ResumeTokenStore
+	key     string
+	backoff RetryPolicy
+}
+
+// WatchOption configures Watch
+type WatchOption func(*watchConfig)
+
+// WatchResume persists the resume token under the key after each handled
+// event and resumes after the stored one on start
+func WatchResume(store ResumeTokenStore, key string) WatchOption {
+	return func(c *watchConfig) {
+		c.store, c.key = store, key
+	}
+}
+
+// WatchBackoff paces the reopening of the stream after an error, only the
+// waits are used, default DefaultRetryPolicy
+func WatchBackoff(p RetryPolicy) WatchOption {
+	return func(c *watchConfig) {
+		c.backoff = p
+	}
+}
+
+// Watch calls fn for each change of the collection matching the pipeline,
+// e.g. []map[string]interface{}{util.MatchStage(...)}, until ctx is done or
+// fn returns an error, which is returned
+// the stream is reopened after the last handled event when it fails, the
+// change streams require a replica set
+/*
+	err := db.Watch(ctx, nil, func(ev util.ChangeEvent) error {
+		hub.Publish("devices", ev.FullDocument)
+		return nil
+	}, util.WatchResume(&util.MongoResumeTokens{Opr: svc.Mongo, Collection: "resume_tokens"}, "devices-hub"))
+*/
+func (dba *MongoOpr) Watch(ctx context.Context, pipeline []map[string]interface{}, fn func(ChangeEvent) error, opts ...WatchOption) error {
+	c := &watchConfig{backoff: DefaultRetryPolicy}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.store == nil {
+		c.store, c.key = NewMemoryResumeTokens(), "watch"
+	}
+	p := bson.A{}
+	for _, st := range pipeline {
+		p = append(p, st)
+	}
+	lg := LoggerFromContext(ctx).WithField("collection", dba.Mcoll.Name())
+	failures := 0
+	for {
+		n, err := dba.watch(ctx, p, fn, c)
+		if h, ok := err.(*watchHandlerErr); ok {
+			return h.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if n > 0 {
+			failures = 0
+		}
+		failures++
+		wait := jitter(c.backoff.Backoff(failures), c.backoff.Jitter)
+		lg.WithError(err).Warnf("change stream closed, reopen in %s", wait)
+		if e := SleepCtx(ctx, wait); e != nil {
+			return e
+		}
+	}
+}
+
+// watchHandlerErr is the error of the event handler, which ends Watch
+type watchHandlerErr struct {
+	err error
+}
+
+func (e *watchHandlerErr) Error() string { return e.err.Error() }
+
+// watch runs a change stream until it fails, returns the number of handled events
+func (dba *MongoOpr) watch(ctx context.Context, pipeline bson.A, fn func(ChangeEvent) error, c *watchConfig) (int, error) {
+	o := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	token, err := c.store.LoadResumeToken(ctx, c.key)
+	if err != nil {
+		return 0, err
+	}
+	if token != nil {
+		o.SetStartAfter(token)
+	}
+	cs, err := dba.Mcoll.Watch(ctx, pipeline, o)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	defer cs.Close(context.Background())
+	n := 0
+	for cs.Next(ctx) {
+		var ev ChangeEvent
+		if err := cs.Decode(&ev); err != nil {
+			return n, err
+		}
+		if err := fn(ev); err != nil {
+			return n, &watchHandlerErr{err}
+		}
+		n++
+		if err := c.store.SaveResumeToken(ctx, c.key, cs.ResumeToken()); err != nil {
+			return n, err
+		}
+	}
+	return n, mongoErr(cs.Err())
+}
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+differences only state monitor
+**************************************** */
+
+// Collector gathers a keyed snapshot of a device state, e.g. LSPs indexed by name
+// values are structs compared field by field, or plain values compared as a whole
+type Collector func(ctx context.Context, device string) (map[string]interface{}, error)
+
+// Drift is the set of state changes of a device detected by a monitor check
+type Drift struct {
+	Check   string
+	Device  string
+	Time    time.Time
+	Changes []StateChange
+}
+
+// Notifier receives the detected drifts
+type Notifier interface {
+	Notify(ctx context.Context, d Drift) error
+}
+
+// NotifierFunc adapts a function to Notifier
+type NotifierFunc func(ctx context.Context, d Drift) error
+
+// Notify calls f(ctx, d)
+func (f NotifierFunc) Notify(ctx context.Context, d Drift) error {
+	return f(ctx, d)
+}
+
+// monitorCheck is a check registered to the Monitor
+type monitorCheck struct {
+	name    string
+	devices []string
+	collect Collector
+}
+
+// Monitor periodically collects device state, compares it with the previous
+// snapshot and notifies only the changes, the first collection of a device
+// is the baseline and is not notified
+// a failed collection keeps the previous snapshot
+type Monitor struct {
+	Log       *log.Entry
+	Sched     *Scheduler
+	notifiers []Notifier
+
+	mu     sync.Mutex
+	checks map[string]*monitorCheck
+	snaps  map[string]map[string]interface{} // check/device to the last snapshot
+}
+
+// NewMonitor creates a Monitor running on its own Scheduler
+func NewMonitor(notifiers ...Notifier) *Monitor {
+	return &Monitor{
+		Log:       logger.WithField("module", "monitor"),
+		Sched:     NewScheduler(),
+		notifiers: notifiers,
+		checks:    make(map[string]*monitorCheck),
+		snaps:     make(map[string]map[string]interface{}),
+	}
+}
+
+// AddNotifier registers an additional notifier
+func (m *Monitor) AddNotifier(n Notifier) {
+	m.mu.Lock()
+	m.notifiers = append(m.notifiers, n)
+	m.mu.Unlock()
+}
+
+// Watch registers a named check collecting the devices on the cron schedule
+func (m *Monitor) Watch(name, cronExpr string, devices []string, c Collector) error {
+	m.mu.Lock()
+	if _, exist := m.checks[name]; exist {
+		m.mu.Unlock()
+		return fmt.Errorf("monitor check %s already exists", name)
+	}
+	m.checks[name] = &monitorCheck{name: name, devices: devices, collect: c}
+	m.mu.Unlock()
+	if err := m.Sched.Add(name, cronExpr, func(ctx context.Context) { m.Poll(ctx, name) }); err != nil {
+		m.mu.Lock()
+		delete(m.checks, name)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unwatch removes the named check and its snapshots
+func (m *Monitor) Unwatch(name string) {
+	m.Sched.Remove(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.checks[name]; ok {
+		for _, d := range c.devices {
+			delete(m.snaps, name+"/"+d)
+		}
+		delete(m.checks, name)
+	}
+}
+
+// Poll runs the named check immediately on all its devices concurrently
+// and returns the drifts found, which are notified as well
+func (m *Monitor) Poll(ctx context.Context, name string) []Drift {
+	m.mu.Lock()
+	c, ok := m.checks[name]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var wg sync.WaitGroup
+	var rmu sync.Mutex
+	res := []Drift{}
+	for _, dev := range c.devices {
+		wg.Add(1)
+		go func(dev string) {
+			defer wg.Done()
+			if d, ok := m.pollDevice(ctx, c, dev); ok {
+				rmu.Lock()
+				res = append(res, d)
+				rmu.Unlock()
+			}
+		}(dev)
+	}
+	wg.Wait()
+	return res
+}
+
+// pollDevice collects and diffs a device, returns false if there is no change
+func (m *Monitor) pollDevice(ctx context.Context, c *monitorCheck, dev string) (Drift, bool) {
+	lg := m.Log.WithFields(log.Fields{"check": c.name, "device": dev})
+	var snap map[string]interface{}
+	err := SafeCall(c.name, func() (e error) {
+		snap, e = c.collect(ctx, dev)
+		return
+	})
+	if err != nil {
+		lg.WithError(err).Warn("state collection failed")
+		return Drift{}, false
+	}
+	key := c.name + "/" + dev
+	m.mu.Lock()
+	pre, seen := m.snaps[key]
+	m.snaps[key] = snap
+	notifiers := append([]Notifier{}, m.notifiers...)
+	m.mu.Unlock()
+	if !seen {
+		lg.Debug("baseline snapshot taken")
+		return Drift{}, false
+	}
+	changes := diffKeyed(pre, snap)
+	if len(changes) == 0 {
+		return Drift{}, false
+	}
+	d := Drift{Check: c.name, Device: dev, Time: time.Now(), Changes: changes}
+	lg.WithField("changes", len(changes)).Info("state drift detected")
+	for _, n := range notifiers {
+		if err := n.Notify(ctx, d); err != nil {
+			lg.WithError(err).Warn("drift notification failed")
+		}
+	}
+	return d, true
+}
+
+// Run blocks running the scheduled checks until ctx is done
+func (m *Monitor) Run(ctx context.Context) {
+	m.Sched.Run(ctx)
+}
@@ -0,0 +1,291 @@
+package util
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/structs"
+	"github.com/polarbroadband/goto/tbp"
+)
+
+/* ****************************************
+MPLS LSP and segment routing state
+**************************************** */
+
+// LSP holds the state of a RSVP-TE LSP or SR-TE policy
+type LSP struct {
+	Name           string
+	From           string
+	To             string
+	State          string   // Up/Down
+	ActivePath     string   // name of the active (primary/secondary) path
+	Path           []string // hop list taken from the recorded route
+	Bandwidth      string   // reserved bandwidth as displayed, e.g. 100Mbps
+	LastTransition string   // timestamp of the last state transition
+	SR             bool     // false - RSVP-TE LSP, true - SR policy
+	Color          int      // SR policy color
+	Preference     int      // SR policy candidate path preference
+}
+
+// Key returns the snapshot key of the LSP
+func (l *LSP) Key() string {
+	if l.SR {
+		return fmt.Sprintf("%s-%d", l.To, l.Color)
+	}
+	return l.Name
+}
+
+// Up returns true if the LSP is operationally up
+func (l *LSP) Up() bool {
+	return strings.EqualFold(l.State, "up")
+}
+
+// StateChange records a single difference between pre and post snapshots
+type StateChange struct {
+	Key    string // object key, e.g. LSP name
+	Field  string // changed field name, empty for added/removed object
+	Change string // Added/Removed/Modified
+	Pre    interface{}
+	Post   interface{}
+}
+
+// diffStructFields returns the names of the exported fields which differ between two structs
+func diffStructFields(s1, s2 interface{}) (f []string) {
+	m2 := structs.Map(s2)
+	for k, v1 := range structs.Map(s1) {
+		if !reflect.DeepEqual(v1, m2[k]) {
+			f = append(f, k)
+		}
+	}
+	sort.Strings(f)
+	return
+}
+
+// diffKeyed compares two snapshots of struct values indexed by the same key
+// result is ordered by key on the natural order, then by field
+func diffKeyed(pre, post map[string]interface{}) (r []StateChange) {
+	keys := []string{}
+	for k := range pre {
+		keys = append(keys, k)
+	}
+	for k := range post {
+		if _, ok := pre[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	NatureOrder().Sort(keys)
+	for _, k := range keys {
+		v1, inPre := pre[k]
+		v2, inPost := post[k]
+		switch {
+		case !inPre:
+			r = append(r, StateChange{Key: k, Change: "Added", Post: v2})
+		case !inPost:
+			r = append(r, StateChange{Key: k, Change: "Removed", Pre: v1})
+		case !structs.IsStruct(v1) || !structs.IsStruct(v2):
+			// plain values are compared as a whole
+			if !reflect.DeepEqual(v1, v2) {
+				r = append(r, StateChange{Key: k, Change: "Modified", Pre: v1, Post: v2})
+			}
+		default:
+			m1, m2 := structs.Map(v1), structs.Map(v2)
+			for _, f := range diffStructFields(v1, v2) {
+				r = append(r, StateChange{Key: k, Field: f, Change: "Modified", Pre: m1[f], Post: m2[f]})
+			}
+		}
+	}
+	return
+}
+
+// DiffLSP compares pre and post LSP snapshots and returns the changes
+// LastTransition is ignored unless the LSP state changed as well
+func DiffLSP(pre, post []LSP) []StateChange {
+	m1 := make(map[string]interface{})
+	m2 := make(map[string]interface{})
+	for _, l := range pre {
+		m1[l.Key()] = l
+	}
+	for _, l := range post {
+		m2[l.Key()] = l
+	}
+	r := []StateChange{}
+	for _, c := range diffKeyed(m1, m2) {
+		if c.Field == "LastTransition" && m1[c.Key].(LSP).State == m2[c.Key].(LSP).State {
+			continue
+		}
+		r = append(r, c)
+	}
+	return r
+}
+
+// StateChangeTable renders a list of StateChange to a html table
+func StateChangeTable(c []StateChange) string {
+	tb := TableBuilder{FullBorder: true}
+	for _, e := range c {
+		tb.Data = append(tb.Data, e)
+	}
+	tb.SetHeaders([]string{"Key", "Change", "Field", "Pre", "Post"})
+	return tb.Build()
+}
+
+// ParseJunosLSP parses JUNOS "show mpls lsp ingress" brief output
+/*
+Ingress LSP: 2 sessions
+To              From            State Rt P     ActivePath       LSPname
+10.255.0.2      10.255.0.1      Up     0 *     primary          to-r2
+10.255.0.3      10.255.0.1      Dn     0       -                to-r3
+Total 2 displayed, Up 1, Down 1
+*/
+func ParseJunosLSP(s string) []LSP {
+	r := []LSP{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	re := regexp.MustCompile(`^\s*(\S+)\s+(\S+)\s+(Up|Dn|Down)\s+\d+\s+\*?\s+(\S+)\s+(\S+)\s*$`)
+	if m, mv := b.MatchInBlock(re); m {
+		for _, v := range mv {
+			l := LSP{To: v[0], From: v[1], State: "Up", ActivePath: v[3], Name: v[4]}
+			if v[2] != "Up" {
+				l.State = "Down"
+			}
+			if l.ActivePath == "-" {
+				l.ActivePath = ""
+			}
+			r = append(r, l)
+		}
+	}
+	return r
+}
+
+// ParseJunosLSPDetail parses JUNOS "show mpls lsp ingress extensive" output
+// bandwidth, recorded route and last transition are collected per LSP
+func ParseJunosLSPDetail(s string) []LSP {
+	r := []LSP{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	blocks, title := b.Cut(regexp.MustCompile(`^(\d+\.\d+\.\d+\.\d+|[0-9a-fA-F:]+:[0-9a-fA-F:]*)\s*$`))
+	reHead := regexp.MustCompile(`From:\s*([^,\s]+),\s*State:\s*(\w+),.*LSPname:\s*(\S+)`)
+	reActive := regexp.MustCompile(`^\s*ActivePath:\s*(\S+)`)
+	reBW := regexp.MustCompile(`^\s*Bandwidth:\s*(\S+)`)
+	reRRO := regexp.MustCompile(`^\s*Received RRO`)
+	reHop := regexp.MustCompile(`^\s+((?:\d+\.\d+\.\d+\.\d+\S*\s*)+)$`)
+	reTrans := regexp.MustCompile(`^\s*\d+\s+(\w{3}\s+\d+\s+\d\d:\d\d:\d\d(?:\.\d+)?)\s+(?:Up|Down|Selected as active path|Deselected as active)`)
+	for i, blk := range blocks {
+		l := LSP{To: title[i][0]}
+		inRRO := false
+		for _, ln := range *blk {
+			if m := reHead.FindStringSubmatch(ln); m != nil {
+				l.From, l.State, l.Name = m[1], m[2], m[3]
+				if l.State == "Dn" {
+					l.State = "Down"
+				}
+				continue
+			}
+			if m := reActive.FindStringSubmatch(ln); m != nil && l.ActivePath == "" {
+				l.ActivePath = m[1]
+				continue
+			}
+			if m := reBW.FindStringSubmatch(ln); m != nil && l.Bandwidth == "" {
+				l.Bandwidth = m[1]
+				continue
+			}
+			if reRRO.MatchString(ln) {
+				inRRO = true
+				l.Path = nil
+				continue
+			}
+			if inRRO {
+				if m := reHop.FindStringSubmatch(ln); m != nil {
+					for _, h := range strings.Fields(m[1]) {
+						l.Path = append(l.Path, strings.TrimRight(h, "()SLN"))
+					}
+					continue
+				}
+				inRRO = false
+			}
+			// history is listed in chronological order, keep the last one
+			if m := reTrans.FindStringSubmatch(ln); m != nil {
+				l.LastTransition = m[1]
+			}
+		}
+		if l.Name != "" {
+			r = append(r, l)
+		}
+	}
+	return r
+}
+
+// ParseJunosSRPolicy parses JUNOS "show spring-traffic-engineering lsp" output
+/*
+To                        State        LSPname
+10.255.0.2-100<c>         Up           sr-pol-r2
+10.255.0.3-200<c>         Dn           sr-pol-r3
+*/
+func ParseJunosSRPolicy(s string) []LSP {
+	r := []LSP{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	re := regexp.MustCompile(`^\s*(\S+?)-(\d+)<c(?:6)?>\S*\s+(Up|Dn|Down)\s+(\S+)\s*$`)
+	if m, mv := b.MatchInBlock(re); m {
+		for _, v := range mv {
+			l := LSP{To: v[0], State: "Up", Name: v[3], SR: true}
+			l.Color, _ = strconv.Atoi(v[1])
+			if v[2] != "Up" {
+				l.State = "Down"
+			}
+			r = append(r, l)
+		}
+	}
+	return r
+}
+
+// ParseSrosLSP parses SROS "show router mpls lsp" output
+// each LSP takes two lines, name/admin/oper state followed by the destination
+/*
+LSP Name                                            Tun     Fastfail  Adm  Opr
+  To                                                Id      Config
+-------------------------------------------------------------------------------
+to-PE2                                              1       No        Up   Up
+  10.20.1.2
+*/
+func ParseSrosLSP(s string) []LSP {
+	r := []LSP{}
+	reName := regexp.MustCompile(`^(\S+)\s+\d+\s+(?:Yes|No)\s+(Up|Dn|Down)\s+(Up|Dn|Down)\s*$`)
+	reTo := regexp.MustCompile(`^\s+(\d+\.\d+\.\d+\.\d+|[0-9a-fA-F:]+:[0-9a-fA-F:]*)\s*$`)
+	var l *LSP
+	for _, ln := range strings.Split(s, "\n") {
+		if m := reName.FindStringSubmatch(strings.TrimRight(ln, " \r")); m != nil {
+			if l != nil {
+				r = append(r, *l)
+			}
+			l = &LSP{Name: m[1], State: "Up"}
+			if m[3] != "Up" {
+				l.State = "Down"
+			}
+			continue
+		}
+		if m := reTo.FindStringSubmatch(ln); m != nil && l != nil && l.To == "" {
+			l.To = m[1]
+		}
+	}
+	if l != nil {
+		r = append(r, *l)
+	}
+	return r
+}
+
+// LSPUptime converts the LastTransition of a LSP to the time elapsed since then
+// return 0 if the timestamp is not valid, year is assumed to be the current one
+func LSPUptime(l *LSP, now time.Time) time.Duration {
+	ts := strings.Join(strings.Fields(strings.Split(l.LastTransition, ".")[0]), " ")
+	t, err := time.ParseInLocation("Jan 2 15:04:05", ts, now.Location())
+	if err != nil {
+		return time.Duration(0)
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return now.Sub(t)
+}
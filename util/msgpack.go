@@ -0,0 +1,112 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+/* ****************************************
+MessagePack encoding
+**************************************** */
+
+// MarshalMsgpack encodes the value as MessagePack, the value is converted
+// through its JSON form first, so the json struct tags apply
+// integers are encoded as int, other numbers as float64, map keys are sorted
+func MarshalMsgpack(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.UseNumber()
+	var g interface{}
+	if err := d.Decode(&g); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := msgpackEncode(&b, g); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// msgpackHead writes the header of a length prefixed type, fix is the fix
+// format base or 0 if none, fixMax its max length, c8 the 8 bit format or 0
+func msgpackHead(b *bytes.Buffer, n int, fix byte, fixMax int, c8, c16, c32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		b.WriteByte(fix | byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		b.WriteByte(c8)
+		b.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		b.WriteByte(c16)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(c32)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+}
+
+// msgpackEncode encodes the generic JSON value
+func msgpackEncode(b *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			switch {
+			case i >= 0 && i <= 0x7f:
+				b.WriteByte(byte(i))
+			case i < 0 && i >= -32:
+				b.WriteByte(byte(int8(i)))
+			default:
+				b.WriteByte(0xd3)
+				binary.Write(b, binary.BigEndian, i)
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		b.WriteByte(0xcb)
+		binary.Write(b, binary.BigEndian, math.Float64bits(f))
+	case string:
+		msgpackHead(b, len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		b.WriteString(v)
+	case []interface{}:
+		msgpackHead(b, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackEncode(b, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		msgpackHead(b, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msgpackEncode(b, k)
+			if err := msgpackEncode(b, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package util
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/polarbroadband/goto/tbp"
+)
+
+/* ****************************************
+multicast IGMP/PIM state
+**************************************** */
+
+// IGMPGroup holds a IGMP membership learned on an interface
+type IGMPGroup struct {
+	Interface    string
+	Group        string
+	Source       string // 0.0.0.0 for (*,G) membership
+	LastReporter string
+	Type         string // Dynamic/Static
+}
+
+// MRoute holds a multicast forwarding entry
+type MRoute struct {
+	Group      string
+	Source     string
+	Upstream   string   // incoming interface
+	Downstream []string // outgoing interface list
+}
+
+// PIMNeighbor holds a PIM adjacency
+type PIMNeighbor struct {
+	Interface string
+	Address   string
+	Version   string
+	Uptime    string
+}
+
+// RPMapping holds a rendezvous point and the group ranges it serves
+type RPMapping struct {
+	RP     string
+	Type   string // static/bootstrap/auto-rp/embedded
+	Groups []string
+}
+
+// MulticastExpect defines a group/source expected to be present on an interface
+// empty Source matches any source, Interface is either a IGMP receiver
+// interface or a downstream interface of the multicast route
+type MulticastExpect struct {
+	Group     string
+	Source    string
+	Interface string
+}
+
+// MulticastCheck is the result of a MulticastExpect
+type MulticastCheck struct {
+	Group     string
+	Source    string
+	Interface string
+	Pass      bool
+	Detail    string
+}
+
+// CheckMulticast validates the expected groups/sources are present on the expected interfaces
+func CheckMulticast(expect []MulticastExpect, groups []IGMPGroup, routes []MRoute) []MulticastCheck {
+	r := []MulticastCheck{}
+	srcMatch := func(want, got string) bool {
+		return want == "" || want == got || strings.Split(got, "/")[0] == want
+	}
+	for _, e := range expect {
+		c := MulticastCheck{Group: e.Group, Source: e.Source, Interface: e.Interface}
+		for _, g := range groups {
+			if g.Group == e.Group && g.Interface == e.Interface && (srcMatch(e.Source, g.Source) || g.Source == "0.0.0.0") {
+				c.Pass, c.Detail = true, "IGMP member"
+				break
+			}
+		}
+		if !c.Pass {
+			for _, m := range routes {
+				if m.Group == e.Group && srcMatch(e.Source, m.Source) && InStrings(e.Interface, m.Downstream) {
+					c.Pass, c.Detail = true, "downstream of "+m.Upstream
+					break
+				}
+			}
+		}
+		if !c.Pass {
+			c.Detail = "not found"
+			for _, m := range routes {
+				if m.Group == e.Group && srcMatch(e.Source, m.Source) {
+					c.Detail = "interface missing in downstream list " + strings.Join(m.Downstream, " ")
+					break
+				}
+			}
+		}
+		r = append(r, c)
+	}
+	return r
+}
+
+// MulticastCheckTable renders the check results to a html table, failed checks are highlighted
+func MulticastCheckTable(c []MulticastCheck) string {
+	tb := TableBuilder{
+		FullBorder: true,
+		RowHLs:     map[string][]interface{}{"Pass": {false}},
+	}
+	for _, e := range c {
+		tb.Data = append(tb.Data, e)
+	}
+	tb.SetHeaders([]string{"Group", "Source", "Interface", "Pass", "Detail"})
+	return tb.Build()
+}
+
+// ParseJunosIGMPGroup parses JUNOS "show igmp group" output
+/*
+Interface: ge-0/0/1.0, Groups: 1
+    Group: 239.1.1.1
+        Source: 0.0.0.0
+        Last reported by: 10.1.1.2
+        Timeout:     210 Type: Dynamic
+*/
+func ParseJunosIGMPGroup(s string) []IGMPGroup {
+	r := []IGMPGroup{}
+	reIf := regexp.MustCompile(`^Interface:\s*([^,\s]+)`)
+	reGrp := regexp.MustCompile(`^\s+Group:\s*(\S+)`)
+	reSrc := regexp.MustCompile(`^\s+Source:\s*(\S+)`)
+	reRpt := regexp.MustCompile(`^\s+Last reported by:\s*(\S+)`)
+	reType := regexp.MustCompile(`Type:\s*(\w+)`)
+	ifName := ""
+	var g *IGMPGroup
+	for _, ln := range strings.Split(s, "\n") {
+		if m := reIf.FindStringSubmatch(ln); m != nil {
+			ifName = m[1]
+			continue
+		}
+		if m := reGrp.FindStringSubmatch(ln); m != nil {
+			if g != nil {
+				r = append(r, *g)
+			}
+			g = &IGMPGroup{Interface: ifName, Group: m[1]}
+			continue
+		}
+		if g == nil {
+			continue
+		}
+		if m := reSrc.FindStringSubmatch(ln); m != nil {
+			if g.Source != "" {
+				// another source of the same group
+				r = append(r, *g)
+				g = &IGMPGroup{Interface: g.Interface, Group: g.Group}
+			}
+			g.Source = m[1]
+		} else if m := reRpt.FindStringSubmatch(ln); m != nil {
+			g.LastReporter = m[1]
+		} else if m := reType.FindStringSubmatch(ln); m != nil {
+			g.Type = m[1]
+		}
+	}
+	if g != nil {
+		r = append(r, *g)
+	}
+	return r
+}
+
+// ParseJunosMRoute parses JUNOS "show multicast route detail" output
+/*
+Group: 239.1.1.1
+    Source: 10.1.1.10/32
+    Upstream interface: ge-0/0/0.0
+    Downstream interface list:
+        ge-0/0/1.0 ge-0/0/2.0
+    Session description: Administratively Scoped
+*/
+func ParseJunosMRoute(s string) []MRoute {
+	r := []MRoute{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	blocks, title := b.Cut(regexp.MustCompile(`^Group:\s*(\S+)`))
+	reSrc := regexp.MustCompile(`^\s+Source:\s*(\S+)`)
+	reUp := regexp.MustCompile(`^\s+Upstream interface:\s*(\S+)`)
+	reDown := regexp.MustCompile(`^\s+Downstream interface list:`)
+	reAttr := regexp.MustCompile(`^\s+[A-Z][\w ]*:`)
+	for i, blk := range blocks {
+		m := MRoute{Group: title[i][0]}
+		inDown := false
+		for _, ln := range *blk {
+			if inDown {
+				if reAttr.MatchString(ln) {
+					inDown = false
+				} else {
+					m.Downstream = append(m.Downstream, strings.Fields(ln)...)
+					continue
+				}
+			}
+			if v := reSrc.FindStringSubmatch(ln); v != nil {
+				m.Source = v[1]
+			} else if v := reUp.FindStringSubmatch(ln); v != nil {
+				m.Upstream = v[1]
+			} else if reDown.MatchString(ln) {
+				inDown = true
+			}
+		}
+		r = append(r, m)
+	}
+	return r
+}
+
+// ParseJunosPIMNeighbor parses JUNOS "show pim neighbors" output
+/*
+Interface           IP V Mode        Option       Uptime Neighbor addr
+ge-0/0/0.0           4 2             HPLGT      1d 02:03:04 10.0.12.2
+*/
+func ParseJunosPIMNeighbor(s string) []PIMNeighbor {
+	r := []PIMNeighbor{}
+	b := tbp.Block(strings.Split(s, "\n"))
+	re := regexp.MustCompile(`^(\S+)\s+[46]\s+(\d)\s+(?:[a-z-]+\s+)?[A-Z]+\s+(.+?)\s+(\S+)\s*$`)
+	if m, mv := b.MatchInBlock(re); m {
+		for _, v := range mv {
+			r = append(r, PIMNeighbor{Interface: v[0], Version: v[1], Uptime: v[2], Address: v[3]})
+		}
+	}
+	return r
+}
+
+// ParseJunosPIMRP parses JUNOS "show pim rps" output
+/*
+RP address      Type        Mode   Holdtime Timeout Groups Group prefixes
+10.255.0.1      static      sparse        0    None      2 224.0.0.0/4
+                                                           239.0.0.0/8
+*/
+func ParseJunosPIMRP(s string) []RPMapping {
+	r := []RPMapping{}
+	reRP := regexp.MustCompile(`^(\d+\.\d+\.\d+\.\d+|[0-9a-fA-F:]+:[0-9a-fA-F:]*)\s+(\S+)\s+\S+\s+\d+\s+\S+\s+\d+\s+(\S+)\s*$`)
+	rePfx := regexp.MustCompile(`^\s+(\S+/\d+)\s*$`)
+	for _, ln := range strings.Split(s, "\n") {
+		if m := reRP.FindStringSubmatch(ln); m != nil {
+			r = append(r, RPMapping{RP: m[1], Type: m[2], Groups: []string{m[3]}})
+			continue
+		}
+		if m := rePfx.FindStringSubmatch(ln); m != nil && len(r) > 0 {
+			r[len(r)-1].Groups = append(r[len(r)-1].Groups, m[1])
+		}
+	}
+	return r
+}
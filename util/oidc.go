@@ -0,0 +1,257 @@
+package util
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+/* ****************************************
+OIDC authorization code flow
+**************************************** */
+
+// oidcCookie keeps the state, PKCE verifier and nonce between login and callback
+const oidcCookie = "goto_oidc"
+
+// NewPKCE generates a PKCE code verifier and its S256 challenge
+func NewPKCE() (verifier, challenge string) {
+	verifier = SecureRandString(64)
+	s := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(s[:])
+}
+
+// OIDC implements the authorization code flow with PKCE against an OpenID
+// provider, the ID token is verified and exchanged for an internal JWT
+/*
+	o := util.NewOIDC(svc.API, "https://sso.example.com", "netops", secret, "https://netops.example.com/auth/callback")
+	if err := o.Discover(ctx); err != nil {
+		...
+	}
+	svc.HandlePublic("/auth/login", o.LoginHandler)
+	svc.HandlePublic("/auth/callback", o.CallbackHandler)
+*/
+type OIDC struct {
+	API          *API
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// endpoints, set by Discover or manually
+	AuthURL  string
+	TokenURL string
+	Keys     KeySource
+	// TokenTTL is the validity of the internal JWT
+	TokenTTL time.Duration
+	// Claims maps the verified ID token claims to the internal JWT claims,
+	// nil keeps sub, name, email, preferred_username, roles and groups
+	Claims func(id jwt.MapClaims) (jwt.MapClaims, error)
+	// OnToken delivers the internal JWT, nil responds TokenResponse JSON
+	OnToken func(w http.ResponseWriter, r *http.Request, token string)
+	Client  *http.Client
+}
+
+// NewOIDC creates the flow of the API with the default scopes and 1h token TTL
+func NewOIDC(api *API, issuer, clientID, clientSecret, redirectURL string) *OIDC {
+	return &OIDC{
+		API:          api,
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		TokenTTL:     time.Hour,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Discover reads the endpoints from the provider configuration
+func (o *OIDC) Discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := httpStatusErr(resp); err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	var conf struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&conf); err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if conf.Issuer != o.Issuer {
+		return fmt.Errorf("OIDC discovery: issuer mismatch %q", conf.Issuer)
+	}
+	o.AuthURL, o.TokenURL = conf.AuthURL, conf.TokenURL
+	o.Keys = NewJWKS(conf.JWKSURL, o.Issuer, o.ClientID, time.Hour)
+	return nil
+}
+
+// LoginHandler redirects to the provider with a new state, nonce and PKCE challenge
+func (o *OIDC) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state, nonce := SecureRandString(32), SecureRandString(32)
+	verifier, challenge := NewPKCE()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join([]string{state, verifier, nonce}, "."),
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(o.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.ClientID},
+		"redirect_uri":          {o.RedirectURL},
+		"scope":                 {strings.Join(o.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, o.AuthURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// CallbackHandler checks the state, exchanges the code, verifies the ID
+// token and issues the internal JWT via API.IssueToken
+func (o *OIDC) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	api := o.API
+	if e := r.URL.Query().Get("error"); e != "" {
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("OIDC login: %s %s", e, r.URL.Query().Get("error_description")), "Login failed")
+		return
+	}
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		api.Error(w, http.StatusBadRequest, "OIDC callback without login state", "Login expired")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/", MaxAge: -1})
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 3 || !SecureCompare(parts[0], r.URL.Query().Get("state")) {
+		api.Error(w, http.StatusBadRequest, "OIDC state mismatch", "Login failed")
+		return
+	}
+	idToken, err := o.exchange(r.Context(), r.URL.Query().Get("code"), parts[1])
+	if err != nil {
+		api.Error(w, http.StatusUnauthorized, err, "Login failed")
+		return
+	}
+	id, err := o.verifyIDToken(idToken, parts[2])
+	if err != nil {
+		api.Error(w, http.StatusUnauthorized, err, "Login failed")
+		return
+	}
+	claims, err := o.mapClaims(id)
+	if err != nil {
+		api.Error(w, http.StatusForbidden, err, "Forbidden")
+		return
+	}
+	tok, err := api.IssueToken(claims, o.TokenTTL)
+	if err != nil {
+		api.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	if o.OnToken != nil {
+		o.OnToken(w, r, tok)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(TokenResponse{AccessToken: tok, TokenType: "Bearer", ExpiresIn: int64(o.TokenTTL / time.Second)})
+}
+
+// exchange redeems the authorization code and returns the ID token
+func (o *OIDC) exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.RedirectURL},
+		"client_id":     {o.ClientID},
+		"code_verifier": {verifier},
+	}
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OIDC code exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := httpStatusErr(resp); err != nil {
+		return "", fmt.Errorf("OIDC code exchange: %w", err)
+	}
+	var tr struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("OIDC code exchange: %w", err)
+	}
+	if tr.IDToken == "" {
+		return "", fmt.Errorf("OIDC code exchange: no id_token")
+	}
+	return tr.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce
+func (o *OIDC) verifyIDToken(raw, nonce string) (jwt.MapClaims, error) {
+	if o.Keys == nil {
+		return nil, fmt.Errorf("OIDC keys not configured")
+	}
+	token, err := jwt.Parse(raw, o.Keys.Key)
+	if err != nil {
+		return nil, fmt.Errorf("ID token: %w", err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("ID token: invalid claims")
+	}
+	switch {
+	case !claims.VerifyIssuer(o.Issuer, true):
+		return nil, fmt.Errorf("ID token: issuer mismatch")
+	case !InStrings(o.ClientID, claimStrings(claims, "aud")):
+		return nil, fmt.Errorf("ID token: audience mismatch")
+	case !claims.VerifyExpiresAt(time.Now().Unix(), true):
+		return nil, fmt.Errorf("ID token: expired")
+	}
+	if n, _ := claims["nonce"].(string); !SecureCompare(n, nonce) {
+		return nil, fmt.Errorf("ID token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// mapClaims converts the ID token claims to the internal JWT claims
+func (o *OIDC) mapClaims(id jwt.MapClaims) (jwt.MapClaims, error) {
+	if o.Claims != nil {
+		return o.Claims(id)
+	}
+	c := jwt.MapClaims{"iss_oidc": o.Issuer}
+	for _, k := range []string{"sub", "name", "email", "preferred_username", "roles", "groups"} {
+		if v, ok := id[k]; ok {
+			c[k] = v
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,232 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+parse, transform and report pipeline
+**************************************** */
+
+// StageFunc processes an item of a pipeline stage
+// a nil output drops the item, Items fans out to several items
+type StageFunc func(ctx context.Context, in interface{}) (interface{}, error)
+
+// Items returned by a StageFunc are passed downstream one by one
+type Items []interface{}
+
+// StageStats are the metrics of a pipeline stage
+type StageStats struct {
+	Name    string
+	Workers int
+	In      uint64
+	Out     uint64
+	Errors  uint64
+	Busy    time.Duration // total processing time of all workers
+}
+
+// pipeStage is a stage of the Pipeline
+type pipeStage struct {
+	name    string
+	workers int
+	f       StageFunc
+	in      uint64
+	out     uint64
+	errs    uint64
+	busy    int64
+}
+
+// Pipeline chains stages connected by channels, each stage runs its
+// workers concurrently (fan-out) feeding a shared output channel (fan-in)
+// with more than one worker the item order is not kept
+/*
+	p := util.NewPipeline().
+		Stage("collect", 10, collectStage).
+		Stage("parse", 4, util.ParseStage(reg, "junos-evpn")).
+		Stage("check", 1, checkStage)
+	res, err := p.Run(ctx, util.StringItems(devices)...)
+	...
+	tb := util.TableBuilder{Data: res}
+	log.Print(p.Stats())
+*/
+type Pipeline struct {
+	Log *log.Entry
+	// ContinueOnError drops the failed items and keeps going, the errors are
+	// returned joined by Run, by default the first error stops the pipeline
+	ContinueOnError bool
+	// Buffer is the capacity of the channels between stages
+	Buffer int
+
+	stages []*pipeStage
+}
+
+// NewPipeline creates an empty Pipeline
+func NewPipeline() *Pipeline {
+	return &Pipeline{Log: logger.WithField("module", "pipeline")}
+}
+
+// Stage appends a stage with the number of concurrent workers, minimum 1
+func (p *Pipeline) Stage(name string, workers int, f StageFunc) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p.stages = append(p.stages, &pipeStage{name: name, workers: workers, f: f})
+	return p
+}
+
+// Stats returns the metrics of the stages, valid during and after Run
+func (p *Pipeline) Stats() []StageStats {
+	res := make([]StageStats, len(p.stages))
+	for i, s := range p.stages {
+		res[i] = StageStats{
+			Name:    s.name,
+			Workers: s.workers,
+			In:      atomic.LoadUint64(&s.in),
+			Out:     atomic.LoadUint64(&s.out),
+			Errors:  atomic.LoadUint64(&s.errs),
+			Busy:    time.Duration(atomic.LoadInt64(&s.busy)),
+		}
+	}
+	return res
+}
+
+// Run feeds the items through the stages and collects the outputs of the last one
+// stage panics are converted to errors, errors are prefixed by the stage name
+func (p *Pipeline) Run(ctx context.Context, items ...interface{}) ([]interface{}, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var emu sync.Mutex
+	var errs []string
+	var first error
+	fail := func(s *pipeStage, err error) {
+		atomic.AddUint64(&s.errs, 1)
+		err = fmt.Errorf("stage %s: %w", s.name, err)
+		p.Log.WithError(err).Debug("pipeline item failed")
+		emu.Lock()
+		defer emu.Unlock()
+		if first == nil {
+			first = err
+		}
+		errs = append(errs, err.Error())
+		if !p.ContinueOnError {
+			cancel()
+		}
+	}
+
+	src := make(chan interface{}, p.Buffer)
+	go func() {
+		defer close(src)
+		for _, it := range items {
+			select {
+			case src <- it:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var in <-chan interface{} = src
+	for _, s := range p.stages {
+		in = p.runStage(ctx, s, in, fail)
+	}
+	res := []interface{}{}
+	for v := range in {
+		res = append(res, v)
+	}
+
+	switch {
+	case first == nil:
+		return res, ctx.Err()
+	case p.ContinueOnError && len(errs) > 1:
+		return res, fmt.Errorf("%d items failed, first %w", len(errs), first)
+	}
+	return res, first
+}
+
+// runStage starts the workers of a stage and returns its output channel
+func (p *Pipeline) runStage(ctx context.Context, s *pipeStage, in <-chan interface{}, fail func(*pipeStage, error)) <-chan interface{} {
+	out := make(chan interface{}, p.Buffer)
+	emit := func(v interface{}) bool {
+		select {
+		case out <- v:
+			atomic.AddUint64(&s.out, 1)
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < s.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := range in {
+				if ctx.Err() != nil {
+					// drain the upstream so it can exit
+					continue
+				}
+				atomic.AddUint64(&s.in, 1)
+				start := time.Now()
+				var res interface{}
+				err := SafeCall(s.name, func() (e error) {
+					res, e = s.f(ctx, v)
+					return
+				})
+				atomic.AddInt64(&s.busy, int64(time.Since(start)))
+				if err != nil {
+					fail(s, err)
+					continue
+				}
+				switch r := res.(type) {
+				case nil:
+				case Items:
+					for _, e := range r {
+						if !emit(e) {
+							break
+						}
+					}
+				default:
+					emit(r)
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// StringItems converts strings, e.g. device names, to pipeline items
+func StringItems(ss []string) []interface{} {
+	res := make([]interface{}, len(ss))
+	for i, s := range ss {
+		res[i] = s
+	}
+	return res
+}
+
+// ParseStage runs the named parser of the registry on a string or *Capture item
+func ParseStage(reg *ParserRegistry, parser string) StageFunc {
+	return func(ctx context.Context, in interface{}) (interface{}, error) {
+		switch v := in.(type) {
+		case string:
+			return reg.Parse(parser, v)
+		case *Capture:
+			res, err := reg.Parse(parser, v.Output)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", v.Device, v.Command, err)
+			}
+			return res, nil
+		}
+		return nil, fmt.Errorf("parse stage: unsupported item %T", in)
+	}
+}
@@ -0,0 +1,221 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* ****************************************
+bounded worker pool
+**************************************** */
+
+// Job is a unit of work of the WorkerPool
+type Job func(ctx context.Context) (interface{}, error)
+
+// JobResult is the outcome of a Job, Index is its submission order
+type JobResult struct {
+	Index    int
+	Value    interface{}
+	Err      error
+	Duration time.Duration
+}
+
+// WorkerPool runs the submitted jobs with bounded concurrency, jobs not
+// started when the pool context is done get the context error
+/*
+	p := util.NewWorkerPool(ctx, 10)
+	for _, dev := range devices {
+		dev := dev
+		p.Submit(func(ctx context.Context) (interface{}, error) { return collect(ctx, dev) })
+	}
+	for _, r := range p.Wait() {
+		...
+	}
+*/
+type WorkerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	closed  bool
+	results []JobResult
+	stream  chan JobResult
+}
+
+// NewWorkerPool creates a pool running at most concurrency jobs at a time
+func NewWorkerPool(ctx context.Context, concurrency int) *WorkerPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	p := &WorkerPool{sem: make(chan struct{}, concurrency)}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p
+}
+
+// Stream returns the channel delivering the results as completed, it's
+// closed once the pool is closed and all jobs are done
+// call it before submitting, the channel must be drained or the workers block
+func (p *WorkerPool) Stream() <-chan JobResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream == nil {
+		p.stream = make(chan JobResult)
+	}
+	return p.stream
+}
+
+// Submit queues a job without blocking and returns its index
+func (p *WorkerPool) Submit(job Job) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, ErrExecutorClosed
+	}
+	i := len(p.results)
+	p.results = append(p.results, JobResult{Index: i})
+	p.wg.Add(1)
+	go p.run(i, job)
+	return i, nil
+}
+
+// run waits for a slot and executes the job, panic is converted to error
+func (p *WorkerPool) run(i int, job Job) {
+	defer p.wg.Done()
+	r := JobResult{Index: i}
+	select {
+	case p.sem <- struct{}{}:
+		start := time.Now()
+		if r.Err = p.ctx.Err(); r.Err == nil {
+			r.Err = SafeCall(fmt.Sprintf("job %d", i), func() (err error) {
+				r.Value, err = job(p.ctx)
+				return
+			})
+		}
+		r.Duration = time.Since(start)
+		<-p.sem
+	case <-p.ctx.Done():
+		r.Err = p.ctx.Err()
+	}
+	p.mu.Lock()
+	p.results[i] = r
+	stream := p.stream
+	p.mu.Unlock()
+	if stream != nil {
+		stream <- r
+	}
+}
+
+// Close stops accepting jobs, the running and queued ones continue
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	if p.stream != nil {
+		go func(stream chan JobResult) {
+			p.wg.Wait()
+			close(stream)
+		}(p.stream)
+	}
+}
+
+// Cancel cancels the pool context, queued jobs are skipped with the context error
+func (p *WorkerPool) Cancel() {
+	p.cancel()
+}
+
+// Wait closes the pool, waits for all jobs and returns the results in submission order
+func (p *WorkerPool) Wait() []JobResult {
+	p.Close()
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]JobResult{}, p.results...)
+}
+
+// RunJobs runs the jobs with bounded concurrency and returns the results in order
+func RunJobs(ctx context.Context, concurrency int, jobs ...Job) []JobResult {
+	p := NewWorkerPool(ctx, concurrency)
+	defer p.Cancel()
+	for _, j := range jobs {
+		p.Submit(j)
+	}
+	return p.Wait()
+}
+
+// item status of ItemResult
+const (
+	ItemOK      = "OK"
+	ItemFailed  = "Failed"
+	ItemTimeout = "Timeout"
+	ItemSkipped = "Skipped"
+)
+
+// ItemResult is the outcome of an item of ForEachConcurrent, ready for TableBuilder
+type ItemResult struct {
+	Item     string
+	Status   string
+	Error    string
+	Duration time.Duration
+	Err      error `structs:"-" json:"-"`
+}
+
+// ForEachConcurrent runs f on each item with at most limit running at a time,
+// each call gets its own timeout if positive, results are in the item order
+// items not started when ctx is done are Skipped
+func ForEachConcurrent(ctx context.Context, items []string, limit int, timeout time.Duration, f func(ctx context.Context, item string) error) []ItemResult {
+	p := NewWorkerPool(ctx, limit)
+	defer p.Cancel()
+	// set by the workers, the results of Wait are ordered after them
+	started := make([]bool, len(items))
+	for i, item := range items {
+		i, item := i, item
+		p.Submit(func(ctx context.Context) (interface{}, error) {
+			started[i] = true
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return nil, f(ctx, item)
+		})
+	}
+	res := make([]ItemResult, len(items))
+	for i, r := range p.Wait() {
+		ir := ItemResult{Item: items[i], Status: ItemOK, Duration: r.Duration, Err: r.Err}
+		switch {
+		case r.Err == nil:
+		case !started[i]:
+			ir.Status = ItemSkipped
+		case errors.Is(r.Err, context.DeadlineExceeded):
+			ir.Status = ItemTimeout
+		default:
+			ir.Status = ItemFailed
+		}
+		if r.Err != nil {
+			ir.Error = r.Err.Error()
+		}
+		res[i] = ir
+	}
+	return res
+}
+
+// ItemTable renders the item results to a html table, failed items are highlighted
+func ItemTable(rs []ItemResult) string {
+	tb := TableBuilder{
+		FullBorder: true,
+		RowHLs:     map[string][]interface{}{"Status": {ItemFailed, ItemTimeout}},
+	}
+	for _, r := range rs {
+		tb.Data = append(tb.Data, r)
+	}
+	tb.SetHeaders([]string{"Item", "Status", "Error", "Duration"})
+	return tb.Build()
+}
@@ -0,0 +1,204 @@
+package util
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+/* ****************************************
+priority and delay queues
+**************************************** */
+
+// pqItem is an element of the heap, seq keeps FIFO order among equal keys
+type pqItem struct {
+	value    interface{}
+	priority int
+	at       time.Time
+	seq      uint64
+}
+
+// pqHeap orders by priority descending, or by time ascending if byTime
+type pqHeap struct {
+	items  []*pqItem
+	byTime bool
+}
+
+func (h *pqHeap) Len() int { return len(h.items) }
+
+func (h *pqHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.byTime {
+		if !a.at.Equal(b.at) {
+			return a.at.Before(b.at)
+		}
+	} else if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	return a.seq < b.seq
+}
+
+func (h *pqHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *pqHeap) Push(x interface{}) { h.items = append(h.items, x.(*pqItem)) }
+
+func (h *pqHeap) Pop() interface{} {
+	n := len(h.items)
+	it := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return it
+}
+
+// PriorityQueue is a lock protected heap, higher priority pops first
+// values of the same priority pop in insertion order
+type PriorityQueue struct {
+	mu     sync.Mutex
+	h      pqHeap
+	seq    uint64
+	notify chan struct{} // closed and renewed on every Push to wake up all waiters
+}
+
+// NewPriorityQueue creates an empty PriorityQueue
+func NewPriorityQueue() *PriorityQueue {
+	return &PriorityQueue{notify: make(chan struct{})}
+}
+
+// Push adds a value with the priority
+func (pq *PriorityQueue) Push(v interface{}, priority int) {
+	pq.mu.Lock()
+	pq.seq++
+	heap.Push(&pq.h, &pqItem{value: v, priority: priority, seq: pq.seq})
+	close(pq.notify)
+	pq.notify = make(chan struct{})
+	pq.mu.Unlock()
+}
+
+// Pop removes and returns the highest priority value, false if empty
+func (pq *PriorityQueue) Pop() (interface{}, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.h.Len() == 0 {
+		return nil, false
+	}
+	return heap.Pop(&pq.h).(*pqItem).value, true
+}
+
+// Peek returns the highest priority value and its priority without removing it
+func (pq *PriorityQueue) Peek() (interface{}, int, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	if pq.h.Len() == 0 {
+		return nil, 0, false
+	}
+	return pq.h.items[0].value, pq.h.items[0].priority, true
+}
+
+// Take blocks until a value is available or ctx is done
+func (pq *PriorityQueue) Take(ctx context.Context) (interface{}, error) {
+	for {
+		pq.mu.Lock()
+		if pq.h.Len() > 0 {
+			v := heap.Pop(&pq.h).(*pqItem).value
+			pq.mu.Unlock()
+			return v, nil
+		}
+		notify := pq.notify
+		pq.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// Len returns the number of queued values
+func (pq *PriorityQueue) Len() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	return pq.h.Len()
+}
+
+// DelayQueue is a lock protected heap releasing values not before their due time
+type DelayQueue struct {
+	mu     sync.Mutex
+	h      pqHeap
+	seq    uint64
+	notify chan struct{} // closed and renewed on every Push to wake up all waiters
+}
+
+// NewDelayQueue creates an empty DelayQueue
+func NewDelayQueue() *DelayQueue {
+	return &DelayQueue{h: pqHeap{byTime: true}, notify: make(chan struct{})}
+}
+
+// Push adds a value due at the given time
+func (dq *DelayQueue) Push(v interface{}, at time.Time) {
+	dq.mu.Lock()
+	dq.seq++
+	heap.Push(&dq.h, &pqItem{value: v, at: at, seq: dq.seq})
+	close(dq.notify)
+	dq.notify = make(chan struct{})
+	dq.mu.Unlock()
+}
+
+// PushAfter adds a value due after the delay
+func (dq *DelayQueue) PushAfter(v interface{}, d time.Duration) {
+	dq.Push(v, time.Now().Add(d))
+}
+
+// next pops the earliest value if due, otherwise returns the wait time, -1 if empty
+// and the channel to be notified on the next Push
+func (dq *DelayQueue) next() (interface{}, bool, time.Duration, chan struct{}) {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	if dq.h.Len() == 0 {
+		return nil, false, -1, dq.notify
+	}
+	if d := time.Until(dq.h.items[0].at); d > 0 {
+		return nil, false, d, dq.notify
+	}
+	return heap.Pop(&dq.h).(*pqItem).value, true, 0, nil
+}
+
+// Poll returns the earliest value if it's due, false otherwise
+func (dq *DelayQueue) Poll() (interface{}, bool) {
+	v, ok, _, _ := dq.next()
+	return v, ok
+}
+
+// Take blocks until the earliest value is due or ctx is done
+func (dq *DelayQueue) Take(ctx context.Context) (interface{}, error) {
+	for {
+		v, ok, d, notify := dq.next()
+		if ok {
+			return v, nil
+		}
+		var timer *time.Timer
+		var due <-chan time.Time
+		if d > 0 {
+			timer = time.NewTimer(d)
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-notify:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Len returns the number of queued values, due or not
+func (dq *DelayQueue) Len() int {
+	dq.mu.Lock()
+	defer dq.mu.Unlock()
+	return dq.h.Len()
+}
@@ -0,0 +1,521 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+/* ****************************************
+rate limiting primitives
+**************************************** */
+
+// ErrLimitExceeded is returned when the wait queue of a limiter is full
+var ErrLimitExceeded = errors.New("rate limit exceeded")
+
+// Limiter is implemented by all rate limiting primitives
+// Allow reports whether an event may happen now and consumes it if so
+// Wait blocks until an event is permitted or ctx is done
+type Limiter interface {
+	Allow() bool
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket refills Rate tokens per second up to Burst
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full TokenBucket, rate is the number of events per second
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill adds the tokens accumulated since the last call, must hold the lock
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// Allow consumes a token if available
+func (tb *TokenBucket) Allow() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true
+	}
+	return false
+}
+
+// Delay returns the time until a token is available, without consuming it
+// a zero rate bucket returns -1 once empty, as Reserve
+func (tb *TokenBucket) Delay() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens >= 1 {
+		return 0
+	}
+	if tb.rate <= 0 {
+		return -1
+	}
+	return time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// Reserve consumes a token in advance and returns the delay until it's available
+// a zero rate bucket returns -1 once empty, the token is not consumed then
+func (tb *TokenBucket) Reserve() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < 1 && tb.rate <= 0 {
+		return -1
+	}
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// cancel returns a reserved token
+func (tb *TokenBucket) cancel() {
+	tb.mu.Lock()
+	tb.tokens++
+	tb.mu.Unlock()
+}
+
+// Wait blocks until a token is available, the reserved token is returned if ctx is done first
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	d := tb.Reserve()
+	if d < 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if err := SleepCtx(ctx, d); err != nil {
+		tb.cancel()
+		return err
+	}
+	return nil
+}
+
+// LeakyBucket lets events out at a fixed interval with a bounded queue of waiters
+type LeakyBucket struct {
+	mu       sync.Mutex
+	interval time.Duration // negative if nothing leaks
+	capacity int
+	next     time.Time // earliest time of the next event
+}
+
+// NewLeakyBucket creates a LeakyBucket of rate events per second
+// at most capacity events can queue up in Wait, a zero rate lets nothing
+// out, as a zero rate TokenBucket once empty
+func NewLeakyBucket(rate float64, capacity int) *LeakyBucket {
+	if rate <= 0 {
+		return &LeakyBucket{interval: -1, capacity: capacity}
+	}
+	return &LeakyBucket{interval: time.Duration(float64(time.Second) / rate), capacity: capacity}
+}
+
+// Allow returns true if an event can leak out immediately
+func (lb *LeakyBucket) Allow() bool {
+	if lb.interval < 0 {
+		return false
+	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	now := time.Now()
+	if lb.next.After(now) {
+		return false
+	}
+	lb.next = now.Add(lb.interval)
+	return true
+}
+
+// Wait blocks until the event's slot, returns ErrLimitExceeded if the queue is full
+func (lb *LeakyBucket) Wait(ctx context.Context) error {
+	if lb.interval < 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	lb.mu.Lock()
+	now := time.Now()
+	slot := lb.next
+	if slot.Before(now) {
+		slot = now
+	}
+	if lb.capacity > 0 && slot.Sub(now) > time.Duration(lb.capacity)*lb.interval {
+		lb.mu.Unlock()
+		return ErrLimitExceeded
+	}
+	lb.next = slot.Add(lb.interval)
+	lb.mu.Unlock()
+	return SleepCtx(ctx, time.Until(slot))
+}
+
+// SlidingWindow permits at most Limit events in any Window period
+// using the weighted counts of the current and previous fixed windows
+type SlidingWindow struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time // start of the current fixed window
+	cur    int
+	prev   int
+}
+
+// NewSlidingWindow creates a SlidingWindow of limit events per window, a
+// window under a millisecond is a millisecond, a zero limit permits nothing
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	return &SlidingWindow{limit: limit, window: window, start: time.Now().Truncate(window)}
+}
+
+// try consumes an event if permitted, otherwise returns the suggested delay,
+// -1 if the limit permits nothing
+func (sw *SlidingWindow) try() (bool, time.Duration) {
+	if sw.limit <= 0 {
+		return false, -1
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	now := time.Now()
+	switch elapsed := now.Sub(sw.start); {
+	case elapsed >= 2*sw.window:
+		sw.prev, sw.cur = 0, 0
+		sw.start = now.Truncate(sw.window)
+	case elapsed >= sw.window:
+		sw.prev, sw.cur = sw.cur, 0
+		sw.start = sw.start.Add(sw.window)
+	}
+	weight := 1 - float64(now.Sub(sw.start))/float64(sw.window)
+	if float64(sw.prev)*weight+float64(sw.cur) < float64(sw.limit) {
+		sw.cur++
+		return true, 0
+	}
+	if sw.cur >= sw.limit {
+		return false, sw.start.Add(sw.window).Sub(now)
+	}
+	// wait until enough of the previous window slides out
+	return false, sw.window / time.Duration(sw.limit+1)
+}
+
+// Allow consumes an event if the window permits
+func (sw *SlidingWindow) Allow() bool {
+	ok, _ := sw.try()
+	return ok
+}
+
+// Wait blocks until the window permits the event
+func (sw *SlidingWindow) Wait(ctx context.Context) error {
+	for {
+		ok, d := sw.try()
+		if ok {
+			return nil
+		}
+		if d < 0 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		if err := SleepCtx(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// KeyedLimiter holds an independent Limiter per key, e.g. per device
+// the Limiter of a key unused for Idle is dropped, so Idle must exceed the
+// time the Limiter takes to recover, e.g. Burst/Rate of a TokenBucket
+type KeyedLimiter struct {
+	// Idle is how long the Limiter of an inactive key is kept, default 10m
+	Idle   time.Duration
+	mu     sync.Mutex
+	new    func() Limiter
+	lim    map[string]*keyedEntry
+	pruned time.Time
+}
+
+type keyedEntry struct {
+	l    Limiter
+	seen time.Time
+}
+
+// NewKeyedLimiter creates a KeyedLimiter, f creates the Limiter of a new key
+func NewKeyedLimiter(f func() Limiter) *KeyedLimiter {
+	return &KeyedLimiter{new: f, lim: make(map[string]*keyedEntry), pruned: time.Now()}
+}
+
+// Get returns the Limiter of the key
+func (kl *KeyedLimiter) Get(key string) Limiter {
+	now := time.Now()
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	idle := kl.Idle
+	if idle <= 0 {
+		idle = 10 * time.Minute
+	}
+	if now.Sub(kl.pruned) > idle {
+		for k, e := range kl.lim {
+			if now.Sub(e.seen) > idle {
+				delete(kl.lim, k)
+			}
+		}
+		kl.pruned = now
+	}
+	e, ok := kl.lim[key]
+	if !ok {
+		e = &keyedEntry{l: kl.new()}
+		kl.lim[key] = e
+	}
+	e.seen = now
+	return e.l
+}
+
+// Remove drops the Limiter of the key
+func (kl *KeyedLimiter) Remove(key string) {
+	kl.mu.Lock()
+	delete(kl.lim, key)
+	kl.mu.Unlock()
+}
+
+// Allow consumes an event of the key
+func (kl *KeyedLimiter) Allow(key string) bool {
+	return kl.Get(key).Allow()
+}
+
+// Wait blocks until an event of the key is permitted
+func (kl *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	return kl.Get(key).Wait(ctx)
+}
+
+// MultiLimiter combines limiters, e.g. a per-device and a global ceiling
+type MultiLimiter []Limiter
+
+// Allow returns true only if all limiters allow the event
+// limiters are checked in order, an event consumed by an earlier one
+// is not returned when a later one refuses
+func (ml MultiLimiter) Allow() bool {
+	for _, l := range ml {
+		if !l.Allow() {
+			return false
+		}
+	}
+	return true
+}
+
+// Wait blocks until all limiters permit the event
+func (ml MultiLimiter) Wait(ctx context.Context) error {
+	for _, l := range ml {
+		if err := l.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ****************************************
+rate limiting middleware
+**************************************** */
+
+// client keys of the rate limiting middleware
+const (
+	RateBySubject = "subject" // JWT subject, the client IP if unauthenticated
+	RateByAPIKey  = "apikey"  // authenticated API key subject, the client IP if none
+	RateByIP      = "ip"
+)
+
+// RateLimitConfig is the per client limit of API.RateLimit and RateLimitGrpcUnary
+type RateLimitConfig struct {
+	Rate  float64 // requests per second
+	Burst int
+	By    string // one of the RateBy constants, default RateBySubject
+	// TrustProxy takes the client IP from X-Forwarded-For, only behind a trusted proxy
+	TrustProxy bool
+	// ProxyHops is the number of trusted proxies appending to
+	// X-Forwarded-For, the client IP is the entry the outermost one
+	// appended, default 1, the rightmost, the entries left of it are
+	// set by the client
+	ProxyHops int
+	// Idle is how long the limiter of an inactive client is kept, default 10m
+	Idle time.Duration
+}
+
+// clientLimiter holds the token buckets of the clients, idle ones are pruned
+type clientLimiter struct {
+	cfg    RateLimitConfig
+	mu     sync.Mutex
+	bucket map[string]*clientBucket
+	pruned time.Time
+}
+
+type clientBucket struct {
+	tb   *TokenBucket
+	seen time.Time
+}
+
+func newClientLimiter(cfg RateLimitConfig) *clientLimiter {
+	if cfg.By == "" {
+		cfg.By = RateBySubject
+	}
+	if cfg.Idle <= 0 {
+		cfg.Idle = 10 * time.Minute
+	}
+	if cfg.ProxyHops <= 0 {
+		cfg.ProxyHops = 1
+	}
+	return &clientLimiter{cfg: cfg, bucket: make(map[string]*clientBucket), pruned: time.Now()}
+}
+
+// allow consumes a request of the client, returns the retry delay if
+// limited, -1 if the client is never permitted again
+func (cl *clientLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	cl.mu.Lock()
+	if now.Sub(cl.pruned) > cl.cfg.Idle {
+		for k, b := range cl.bucket {
+			if now.Sub(b.seen) > cl.cfg.Idle {
+				delete(cl.bucket, k)
+			}
+		}
+		cl.pruned = now
+	}
+	b, ok := cl.bucket[key]
+	if !ok {
+		b = &clientBucket{tb: NewTokenBucket(cl.cfg.Rate, cl.cfg.Burst)}
+		cl.bucket[key] = b
+	}
+	b.seen = now
+	cl.mu.Unlock()
+	if b.tb.Allow() {
+		return true, 0
+	}
+	return false, b.tb.Delay()
+}
+
+// key returns the client key of the identity or IP
+// only the authenticated identities are keys, the header of an unchecked
+// API key would give each made up key a bucket of its own
+func (cl *clientLimiter) key(ctx context.Context, ip string) string {
+	id, ok := IdentityFromContext(ctx)
+	switch {
+	case !ok || id.Subject == "":
+	case cl.cfg.By == RateBySubject:
+		return "sub:" + id.Subject
+	case cl.cfg.By == RateByAPIKey && id.Method == "apikey":
+		return "key:" + id.Subject
+	}
+	return "ip:" + ip
+}
+
+// forwardedIP returns the X-Forwarded-For entry appended by the outermost
+// of the hops trusted proxies, "" if there are fewer entries
+func forwardedIP(xff []string, hops int) string {
+	var entries []string
+	for _, v := range xff {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if hops < 1 || len(entries) < hops {
+		return ""
+	}
+	return entries[len(entries)-hops]
+}
+
+// clientIP returns the IP of the request, see RateLimitConfig.TrustProxy
+func (cl *clientLimiter) clientIP(r *http.Request) string {
+	if cl.cfg.TrustProxy {
+		if ip := forwardedIP(r.Header.Values("X-Forwarded-For"), cl.cfg.ProxyHops); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retrySeconds rounds the delay up to whole seconds for Retry-After
+func retrySeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+// RateLimit returns a middleware limiting the requests per client with 429
+// and Retry-After, place it inside Auth or AuthAPIKey to limit by subject
+// or API key
+/*
+	limit := api.RateLimit(util.RateLimitConfig{Rate: 5, Burst: 20})
+	mux.HandleFunc("/devices/exec", api.Auth(limit(execCmd)))
+*/
+func (api *API) RateLimit(cfg RateLimitConfig) Middleware {
+	cl := newClientLimiter(cfg)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := cl.key(r.Context(), cl.clientIP(r))
+			if ok, delay := cl.allow(key); !ok {
+				if delay >= 0 {
+					w.Header().Set("Retry-After", retrySeconds(delay))
+				}
+				api.Error(w, http.StatusTooManyRequests, fmt.Sprintf("rate limited %s %s", key, r.URL.Path), "Too many requests")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// RateLimitGrpcUnary returns the gRPC unary interceptor of RateLimit, the
+// limited calls fail with ResourceExhausted and retry-after in the trailer
+// chain it after AuthGrpcUnary to limit by subject
+func (api *API) RateLimitGrpcUnary(cfg RateLimitConfig) grpc.UnaryServerInterceptor {
+	cl := newClientLimiter(cfg)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ip := ""
+		if md, ok := metadata.FromIncomingContext(ctx); ok && cl.cfg.TrustProxy {
+			ip = forwardedIP(md.Get("x-forwarded-for"), cl.cfg.ProxyHops)
+		}
+		if p, ok := peer.FromContext(ctx); ok && ip == "" {
+			ip = p.Addr.String()
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+		}
+		key := cl.key(ctx, ip)
+		if ok, delay := cl.allow(key); !ok {
+			if delay >= 0 {
+				grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retrySeconds(delay)))
+			}
+			return nil, api.Errpc(codes.ResourceExhausted, fmt.Sprintf("rate limited %s %s", key, info.FullMethod), "Too many requests")
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+redaction of sensitive values
+**************************************** */
+
+// RedactMask replaces the sensitive values
+const RedactMask = "******"
+
+var (
+	redactMu sync.RWMutex
+	// redactKeys match the keys of sensitive values, case insensitive
+	redactKeys = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)passw(or)?d|^pass$`),
+		regexp.MustCompile(`(?i)secret`),
+		regexp.MustCompile(`(?i)community`),
+		regexp.MustCompile(`(?i)token`),
+		regexp.MustCompile(`(?i)api[-_]?key`),
+		regexp.MustCompile(`(?i)private[-_]?key`),
+		regexp.MustCompile(`(?i)authorization`),
+	}
+)
+
+// RegisterRedactKey adds a regexp pattern matching the keys of sensitive values
+// the match is case insensitive
+func RegisterRedactKey(pattern string) error {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return err
+	}
+	redactMu.Lock()
+	redactKeys = append(redactKeys, re)
+	redactMu.Unlock()
+	return nil
+}
+
+// IsSensitiveKey returns true if the key matches a registered pattern
+func IsSensitiveKey(key string) bool {
+	redactMu.RLock()
+	defer redactMu.RUnlock()
+	for _, re := range redactKeys {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactURI returns the request URI of u with the values of the sensitive
+// query parameters masked, e.g. access_token
+func redactURI(u *url.URL) string {
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.Path
+	}
+	masked := false
+	for k := range q {
+		if IsSensitiveKey(k) {
+			q[k], masked = []string{RedactMask}, true
+		}
+	}
+	if !masked {
+		return u.RequestURI()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.RequestURI()
+}
+
+// Redact returns a copy of v with the values of sensitive keys masked,
+// nested maps, slices and structs are walked, structs by their JSON form
+// v itself is not modified
+func Redact(v interface{}) interface{} {
+	return redactValue(v)
+}
+
+// redactField masks the value if the key is sensitive, otherwise walks it
+func redactField(key string, v interface{}) interface{} {
+	if IsSensitiveKey(key) {
+		if v == nil || v == "" {
+			return v
+		}
+		return RedactMask
+	}
+	return redactValue(v)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, string, bool, int, int64, float64, time.Time:
+		return v
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			res[k] = redactField(k, e)
+		}
+		return res
+	case log.Fields:
+		res := make(log.Fields, len(x))
+		for k, e := range x {
+			res[k] = redactField(k, e)
+		}
+		return res
+	case map[string]string:
+		res := make(map[string]string, len(x))
+		for k, e := range x {
+			if IsSensitiveKey(k) && e != "" {
+				e = RedactMask
+			}
+			res[k] = e
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(x))
+		for i, e := range x {
+			res[i] = redactValue(e)
+		}
+		return res
+	}
+	// the structs are walked even if they are errors or Stringers, their
+	// text may well print the sensitive fields
+	switch reflect.Indirect(reflect.ValueOf(v)).Kind() {
+	case reflect.Map, reflect.Struct, reflect.Slice, reflect.Array:
+		// walk the generic JSON form, unmarshalable values are dropped
+		// rather than risking a leak
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("<%T: %v>", v, err)
+		}
+		var g interface{}
+		if err := json.Unmarshal(b, &g); err != nil {
+			return fmt.Sprintf("<%T: %v>", v, err)
+		}
+		// without exported field, e.g. errors.New, an error is its message
+		if m, ok := g.(map[string]interface{}); ok && len(m) == 0 {
+			if e, ok := v.(error); ok {
+				return e.Error()
+			}
+		}
+		return redactValue(g)
+	}
+	return v
+}
+
+// DebugOutput is the destination of Debug
+var DebugOutput io.Writer = os.Stderr
+
+// Debug pretty prints the redacted v as indented JSON to DebugOutput
+// if the package logger is at debug level or above
+/*
+	util.Debug("device", dev)	// dev.Password is printed as ******
+*/
+func Debug(title string, v interface{}) {
+	if !logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	fmt.Fprintf(DebugOutput, "%s:\n%s\n", title, DebugString(v))
+}
+
+// DebugString returns the redacted v as indented JSON
+func DebugString(v interface{}) string {
+	b, err := json.MarshalIndent(redactValue(v), "", "    ")
+	if err != nil {
+		return fmt.Sprintf("<%T: %v>", v, err)
+	}
+	return string(b)
+}
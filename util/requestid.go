@@ -0,0 +1,89 @@
+package util
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+/* ****************************************
+request ID propagation
+**************************************** */
+
+// maxRequestIDLen bounds the length of an accepted incoming request ID
+const maxRequestIDLen = 128
+
+// validRequestID accepts printable ASCII without spaces up to maxRequestIDLen,
+// other incoming IDs are replaced so they can't forge log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID http middleware assigns the request ID, taken from the
+// X-Request-ID header or generated, to the context and the log entry of it,
+// and echoes it in the response header, see RequestIDFromContext
+/*
+	mw := api.Chain(api.RequestID, api.Recoverer)
+	mux.HandleFunc("/version", mw(version))
+*/
+func (api *API) RequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+		w.Header().Set(RequestIDHeader, rid)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequestIDGrpcUnary gRPC unary interceptor assigning the request ID of the
+// call metadata, or a new one, for servers not using AuthGrpcUnary
+func (api *API) RequestIDGrpcUnary(ctx context.Context, req interface{}, srv *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return handler(api.grpcRequestID(ctx, md), req)
+}
+
+// RequestIDGrpcStream gRPC stream interceptor, see RequestIDGrpcUnary
+func (api *API) RequestIDGrpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	md, _ := metadata.FromIncomingContext(ss.Context())
+	return handler(srv, &ctxStream{ss, api.grpcRequestID(ss.Context(), md)})
+}
+
+// InjectRequestID returns the context with the request ID of the context in
+// the outgoing metadata, unchanged if there is none or it's already set
+func InjectRequestID(ctx context.Context) context.Context {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return ctx
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok && len(md.Get(RequestIDHeader)) > 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, RequestIDHeader, id)
+}
+
+// RequestIDClientUnary returns the gRPC unary client interceptor forwarding
+// the request ID of the context to the called service
+/*
+	conn, err := grpc.Dial(addr, grpc.WithChainUnaryInterceptor(util.RequestIDClientUnary(), util.GrpcClientUnary()))
+*/
+func RequestIDClientUnary() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(InjectRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// RequestIDClientStream returns the gRPC stream client interceptor, see RequestIDClientUnary
+func RequestIDClientStream() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(InjectRequestID(ctx), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+/* ****************************************
+response envelope
+**************************************** */
+
+// content types of the response envelope
+const (
+	ContentJSON    = "application/json; charset=UTF-8"
+	ContentMsgpack = "application/msgpack"
+)
+
+// Envelope is the consistent response body of the API helpers
+type Envelope struct {
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Meta      *Page       `json:"meta,omitempty"`
+	RequestID string      `json:"requestID,omitempty"`
+}
+
+// Page is the pagination meta of Paginated
+type Page struct {
+	Page    int   `json:"page"`
+	PerPage int   `json:"perPage"`
+	Total   int64 `json:"total"`
+	Pages   int64 `json:"pages"`
+	// Next is the cursor of the next page of ListQuery.MongoPage
+	Next string `json:"next,omitempty"`
+}
+
+// NewPage calculates the page count of the total
+func NewPage(page, perPage int, total int64) *Page {
+	p := &Page{Page: page, PerPage: perPage, Total: total}
+	if perPage > 0 {
+		p.Pages = (total + int64(perPage) - 1) / int64(perPage)
+	}
+	return p
+}
+
+// Negotiate is a middleware selecting the envelope encoding by the Accept
+// header, MessagePack if accepted, JSON otherwise
+// the choice is passed to the helpers by the preset Content-Type header
+func (api *API) Negotiate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept")
+		if strings.Contains(accept, "application/msgpack") || strings.Contains(accept, "application/x-msgpack") {
+			w.Header().Set("Content-Type", ContentMsgpack)
+		}
+		w.Header().Add("Vary", "Accept")
+		next(w, r)
+	}
+}
+
+// Respond writes the envelope with the status code, the request ID is
+// taken from the response header set by the middlewares
+func (api *API) Respond(w http.ResponseWriter, code int, env Envelope) {
+	if env.RequestID == "" {
+		env.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	if w.Header().Get("Content-Type") == ContentMsgpack {
+		b, err := MarshalMsgpack(env)
+		if err == nil {
+			w.WriteHeader(code)
+			w.Write(b)
+			return
+		}
+		api.Log.WithError(err).Warn("msgpack encoding failed, fall back to JSON")
+	}
+	w.Header().Set("Content-Type", ContentJSON)
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(env); err != nil {
+		api.Log.WithError(err).Error("response encoding failed")
+	}
+}
+
+// OK responds 200 with the data
+func (api *API) OK(w http.ResponseWriter, data interface{}) {
+	api.Respond(w, http.StatusOK, Envelope{Data: data})
+}
+
+// Created responds 201 with the created resource
+func (api *API) Created(w http.ResponseWriter, data interface{}) {
+	api.Respond(w, http.StatusCreated, Envelope{Data: data})
+}
+
+// Paginated responds 200 with a page of the data and the pagination meta
+/*
+	api.Paginated(w, devices, util.NewPage(page, 50, total))
+*/
+func (api *API) Paginated(w http.ResponseWriter, data interface{}, page *Page) {
+	api.Respond(w, http.StatusOK, Envelope{Data: data, Meta: page})
+}
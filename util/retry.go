@@ -0,0 +1,153 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+/* ****************************************
+retry with backoff
+**************************************** */
+
+// RetryPolicy defines how Retry backs off between attempts
+// zero MaxAttempts and MaxElapsed mean no limit, at least one should be set
+type RetryPolicy struct {
+	MaxAttempts int
+	MaxElapsed  time.Duration // total time budget, the last wait is cut short to fit
+	Initial     time.Duration // first wait
+	Max         time.Duration // cap of a single wait, zero means no cap
+	Multiplier  float64       // growth of the wait, below 1 means 2
+	Jitter      float64       // randomize each wait by +/- the fraction, 0 to 1
+	// IsRetryable classifies the errors, nil uses the package IsRetryable
+	IsRetryable func(error) bool
+	// OnRetry is called before each wait, optional
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+// DefaultRetryPolicy is 5 attempts, waits from 200ms doubling up to 5s with 20% jitter
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Initial:     200 * time.Millisecond,
+	Max:         5 * time.Second,
+	Multiplier:  2,
+	Jitter:      0.2,
+}
+
+// permanentErr stops Retry immediately
+type permanentErr struct {
+	err error
+}
+
+func (e *permanentErr) Error() string { return e.err.Error() }
+func (e *permanentErr) Unwrap() error { return e.err }
+
+// Permanent marks err as not retryable whatever the policy, nil err returns nil
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentErr{err}
+}
+
+// IsRetryable is the default error classification
+// context cancellation, Permanent errors and *Err of category input, auth,
+// not found and conflict are not retryable, everything else is
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var p *permanentErr
+	if errors.As(err, &p) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch ErrCategory(err) {
+	case CatInput, CatAuth, CatNotFound, CatConflict:
+		return false
+	case CatTimeout, CatUnavailable:
+		return true
+	}
+	return true
+}
+
+// Backoff returns the wait before the given retry attempt (1 based), jitter excluded
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	m := p.Multiplier
+	if m < 1 {
+		m = 2
+	}
+	d := float64(p.Initial) * math.Pow(m, float64(attempt-1))
+	if p.Max > 0 && d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+	if d > math.MaxInt64 {
+		d = math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// jitter randomizes d by +/- the fraction j
+func jitter(d time.Duration, j float64) time.Duration {
+	if j <= 0 || d <= 0 {
+		return d
+	}
+	if j > 1 {
+		j = 1
+	}
+	randMu.Lock()
+	r := seededRand.Float64()
+	randMu.Unlock()
+	return time.Duration(float64(d) * (1 + j*(2*r-1)))
+}
+
+// Retry calls f until it succeeds, returns a non retryable error,
+// the attempts or the time budget are exhausted, or ctx is done
+// the last error of f is returned, wrapped with the attempt count when giving up
+// when ctx is done the error of ctx is returned wrapped, so errors.Is
+// context.Canceled or DeadlineExceeded holds, with the last error of f in the message
+func Retry(ctx context.Context, p RetryPolicy, f func() error) error {
+	retryable := p.IsRetryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		var perm *permanentErr
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+		if !retryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		wait := jitter(p.Backoff(attempt), p.Jitter)
+		if p.MaxElapsed > 0 {
+			left := p.MaxElapsed - time.Since(start)
+			if left <= 0 {
+				return fmt.Errorf("gave up after %d attempts in %s: %w", attempt, time.Since(start).Round(time.Millisecond), err)
+			}
+			if wait > left {
+				wait = left
+			}
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(attempt, err, wait)
+		} else {
+			logger.WithError(err).WithField("attempt", attempt).Debugf("retry in %s", wait)
+		}
+		if e := SleepCtx(ctx, wait); e != nil {
+			return fmt.Errorf("%w, last error: %v", e, err)
+		}
+	}
+}
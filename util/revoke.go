@@ -0,0 +1,135 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+token revocation
+**************************************** */
+
+// TokenRevoker is a deny-list of token IDs (the "jti" claim)
+// entries are kept until the token would have expired anyway
+type TokenRevoker interface {
+	Revoke(ctx context.Context, jti string, until time.Time) error
+	IsRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// Revoke adds the token ID to the deny-list of the API until the given time
+func (api *API) Revoke(jti string, until time.Time) error {
+	if api.Revoker == nil {
+		return fmt.Errorf("token revoker not configured")
+	}
+	if jti == "" {
+		return ErrBadInput.Wrap(fmt.Errorf("empty token id"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return api.Revoker.Revoke(ctx, jti, until)
+}
+
+// RevokeClaims revokes the token of the claims until its expiry, e.g. on logout
+// tokens without expiry are revoked for a year
+func (api *API) RevokeClaims(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	until := time.Now().AddDate(1, 0, 0)
+	if exp, ok := claims["exp"].(float64); ok {
+		until = time.Unix(int64(exp), 0)
+	}
+	return api.Revoke(jti, until)
+}
+
+// checkRevoked rejects a revoked token, the check fails closed if the
+// revoker is unavailable, tokens without jti can't be revoked
+func (api *API) checkRevoked(ctx context.Context, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if api.Revoker == nil || jti == "" {
+		return nil
+	}
+	revoked, err := api.Revoker.IsRevoked(ctx, jti)
+	if err != nil {
+		return fmt.Errorf("revocation check: %w", err)
+	}
+	if revoked {
+		return fmt.Errorf("token revoked")
+	}
+	return nil
+}
+
+// MemoryRevoker is an in-process TokenRevoker, expired entries are pruned
+// on write, suitable for single instance services and tests
+type MemoryRevoker struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevoker creates an empty MemoryRevoker
+func NewMemoryRevoker() *MemoryRevoker {
+	return &MemoryRevoker{revoked: make(map[string]time.Time)}
+}
+
+// Revoke adds the token ID until the given time
+func (m *MemoryRevoker) Revoke(ctx context.Context, jti string, until time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, t := range m.revoked {
+		if now.After(t) {
+			delete(m.revoked, k)
+		}
+	}
+	m.revoked[jti] = until
+	return nil
+}
+
+// IsRevoked returns true if the token ID is revoked and not expired
+func (m *MemoryRevoker) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.revoked[jti]
+	return ok && time.Now().Before(t), nil
+}
+
+// MongoRevoker stores the deny-list in a collection of the MongoOpr database,
+// shared by all instances of a service, see EnsureIndex
+type MongoRevoker struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// EnsureIndex creates the TTL index purging the expired entries
+func (m *MongoRevoker) EnsureIndex(ctx context.Context) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "until", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return mongoErr(err)
+}
+
+// Revoke upserts the token ID until the given time
+func (m *MongoRevoker) Revoke(ctx context.Context, jti string, until time.Time) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).UpdateOne(ctx,
+		bson.M{"_id": jti},
+		bson.M{"$set": bson.M{"until": until}},
+		options.Update().SetUpsert(true))
+	return mongoErr(err)
+}
+
+// IsRevoked returns true if the token ID is revoked and not expired
+// the TTL monitor runs once a minute, so the expiry is checked as well
+func (m *MongoRevoker) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := m.Opr.Mdb.Collection(m.Collection).CountDocuments(ctx,
+		bson.M{"_id": jti, "until": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return false, mongoErr(err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,229 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+/* ****************************************
+graceful shutdown coordinator
+**************************************** */
+
+// Component is a long-running part of a service, Run blocks until ctx is
+// done and returns once the component is stopped
+type Component interface {
+	Run(ctx context.Context) error
+}
+
+// ComponentFunc adapts a function to Component
+type ComponentFunc func(ctx context.Context) error
+
+// Run calls f(ctx)
+func (f ComponentFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+// runnerComp is a named component of the Runner
+type runnerComp struct {
+	name string
+	c    Component
+}
+
+// Runner runs the registered components sharing a context, which is
+// cancelled on SIGINT/SIGTERM or once a component fails, then waits for
+// the components to stop within DrainTimeout and calls the shutdown hooks
+/*
+	r := util.NewRunner(15 * time.Second)
+	r.AddHTTPServer("api", &http.Server{Addr: ":8080", Handler: mux})
+	r.AddGRPCServer("grpc", gs, lis)
+	r.AddFunc("collector", collector.Run)
+	r.OnShutdown(func(ctx context.Context) error { return client.Disconnect(ctx) })
+	r.Main()
+*/
+type Runner struct {
+	Log          *log.Entry
+	DrainTimeout time.Duration
+
+	comps []runnerComp
+	hooks []func(context.Context) error
+}
+
+// NewRunner creates a Runner with the drain timeout
+func NewRunner(drain time.Duration) *Runner {
+	return &Runner{Log: logger.WithField("module", "runner"), DrainTimeout: drain}
+}
+
+// Add registers a named component
+func (r *Runner) Add(name string, c Component) *Runner {
+	r.comps = append(r.comps, runnerComp{name, c})
+	return r
+}
+
+// AddFunc registers a named component function
+func (r *Runner) AddFunc(name string, f func(context.Context) error) *Runner {
+	return r.Add(name, ComponentFunc(f))
+}
+
+// AddHTTPServer registers a HTTP server, it's shut down gracefully within the drain timeout
+// TLS is served if the server TLSConfig provides a certificate, see NewServerTLSConfig
+func (r *Runner) AddHTTPServer(name string, srv *http.Server) *Runner {
+	return r.AddFunc(name, func(ctx context.Context) error {
+		return serveHTTP(ctx, srv, nil, r.DrainTimeout)
+	})
+}
+
+// listenAndServe serves TLS if the server TLSConfig provides a certificate
+func listenAndServe(srv *http.Server) error {
+	if c := srv.TLSConfig; c != nil && (len(c.Certificates) > 0 || c.GetCertificate != nil) {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// serveHTTP serves on the listener, or the server address if nil, until
+// ctx is done, then shuts the server down within the drain timeout
+func serveHTTP(ctx context.Context, srv *http.Server, lis net.Listener, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		switch {
+		case lis == nil:
+			errc <- listenAndServe(srv)
+		case srv.TLSConfig != nil:
+			errc <- srv.ServeTLS(lis, "", "")
+		default:
+			errc <- srv.Serve(lis)
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shut, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	return srv.Shutdown(shut)
+}
+
+// AddGRPCServer registers a gRPC server serving on the listener, it's stopped
+// gracefully, or forcibly if the drain timeout is exceeded
+// create the server with GRPCServerTLS for TLS
+func (r *Runner) AddGRPCServer(name string, srv *grpc.Server, lis net.Listener) *Runner {
+	return r.AddFunc(name, func(ctx context.Context) error {
+		return serveGRPC(ctx, name, srv, lis, r.DrainTimeout)
+	})
+}
+
+// serveGRPC serves on the listener until ctx is done, then stops the
+// server gracefully, or forcibly if the drain timeout is exceeded
+func serveGRPC(ctx context.Context, name string, srv *grpc.Server, lis net.Listener, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(lis)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(drain):
+		srv.Stop()
+		return fmt.Errorf("grpc server %s stopped forcibly after %s", name, drain)
+	}
+}
+
+// OnShutdown registers a hook called after the components stopped, in
+// reverse order of registration, e.g. to close database connections
+func (r *Runner) OnShutdown(f func(context.Context) error) *Runner {
+	r.hooks = append(r.hooks, f)
+	return r
+}
+
+// Run starts the components and blocks until ctx is done, a signal is
+// received or a component fails, returns the first failure
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	var emu sync.Mutex
+	var first error
+	var wg sync.WaitGroup
+	for _, c := range r.comps {
+		wg.Add(1)
+		go func(c runnerComp) {
+			defer wg.Done()
+			lg := r.Log.WithField("component", c.name)
+			lg.Debug("component started")
+			err := SafeCall(c.name, func() error { return c.c.Run(ctx) })
+			if err == nil || (ctx.Err() != nil && err == ctx.Err()) {
+				lg.Debug("component stopped")
+				return
+			}
+			lg.WithError(err).Error("component failed")
+			emu.Lock()
+			if first == nil {
+				first = fmt.Errorf("%s: %w", c.name, err)
+			}
+			emu.Unlock()
+			cancel()
+		}(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case s := <-sig:
+		r.Log.WithField("signal", s.String()).Info("shutting down")
+		cancel()
+	case <-ctx.Done():
+		r.Log.Info("shutting down")
+	case <-done:
+	}
+	drain, dcancel := context.WithTimeout(context.Background(), r.DrainTimeout)
+	defer dcancel()
+	select {
+	case <-done:
+	case <-drain.Done():
+		r.Log.WithField("timeout", r.DrainTimeout).Warn("components didn't stop before drain timeout")
+	case s := <-sig:
+		r.Log.WithField("signal", s.String()).Warn("forced shutdown")
+	}
+	for i := len(r.hooks) - 1; i >= 0; i-- {
+		if err := SafeCall("shutdown hook", func() error { return r.hooks[i](drain) }); err != nil {
+			r.Log.WithError(err).Warn("shutdown hook failed")
+		}
+	}
+	emu.Lock()
+	defer emu.Unlock()
+	return first
+}
+
+// Main runs until SIGINT or SIGTERM, exits on failure
+func (r *Runner) Main() {
+	if err := r.Run(context.Background()); err != nil {
+		r.Log.WithError(err).Fatal("service failed")
+	}
+}
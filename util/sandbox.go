@@ -0,0 +1,204 @@
+package util
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+sandboxed parser and rule invocation
+**************************************** */
+
+// PanicError is a panic converted to error, with the input line being processed
+type PanicError struct {
+	Func  string      // name of the parser or rule
+	Line  int         // line number of the input, 0 if unknown
+	Input string      // offending input line, or truncated input if line unknown
+	Value interface{} // recovered panic value
+	Stack string
+}
+
+func (e *PanicError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s panic at line %d %q: %v", e.Func, e.Line, e.Input, e.Value)
+	}
+	return fmt.Sprintf("%s panic: %v", e.Func, e.Value)
+}
+
+// PanicReporter is called with every panic caught by Recover and SafeGo,
+// e.g. to forward it to an alerting system, optional
+var PanicReporter func(*PanicError)
+
+// Recover catches a panic and logs it with the stack trace, to be deferred directly
+/*
+defer util.Recover(lg)
+*/
+// nil lg uses the package logger
+func Recover(lg *log.Entry) {
+	if r := recover(); r != nil {
+		reportPanic(lg, "", r)
+	}
+}
+
+// reportPanic logs a recovered panic and passes it to PanicReporter
+func reportPanic(lg *log.Entry, name string, r interface{}) {
+	if lg == nil {
+		lg = log.NewEntry(logger)
+	}
+	p := toPanicError(name, r, nil, "")
+	lg.WithField("stack", p.Stack).Errorf("panic recovered: %v", r)
+	if PanicReporter != nil {
+		PanicReporter(p)
+	}
+}
+
+// SafeGo runs f in a goroutine, a panic is logged instead of crashing the process
+func SafeGo(f func()) {
+	go func() {
+		defer Recover(nil)
+		f()
+	}()
+}
+
+// ParseCursor lets a parser report the line it's working on
+// so a panic can be attributed to the offending input line
+type ParseCursor struct {
+	Line int
+	Text string
+}
+
+// Set records the current line number (1 based) and text
+func (c *ParseCursor) Set(n int, text string) {
+	c.Line, c.Text = n, text
+}
+
+// ParseFunc parses device output, cur may be updated to track progress
+type ParseFunc func(input string, cur *ParseCursor) (interface{}, error)
+
+// RuleFunc checks parsed data and returns error on violation
+type RuleFunc func(data interface{}) error
+
+// toPanicError builds a PanicError from a recovered value
+func toPanicError(name string, r interface{}, cur *ParseCursor, input string) *PanicError {
+	e := &PanicError{Func: name, Value: r, Stack: string(debug.Stack())}
+	if cur != nil && cur.Line > 0 {
+		e.Line, e.Input = cur.Line, cur.Text
+	} else {
+		e.Input = Truncate(input, 200)
+	}
+	return e
+}
+
+// SafeCall runs f and converts a panic into *PanicError
+func SafeCall(name string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = toPanicError(name, r, nil, "")
+		}
+	}()
+	return f()
+}
+
+// SafeParse runs a parser and converts a panic into *PanicError
+// carrying the line last reported through the cursor
+func SafeParse(name, input string, f ParseFunc) (res interface{}, err error) {
+	cur := &ParseCursor{}
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, toPanicError(name, r, cur, input)
+		}
+	}()
+	return f(input, cur)
+}
+
+// SafeParseLines feeds the input to a line oriented parser one line at a time
+// a panic is converted to *PanicError with the exact offending line
+// parsing stops on the first error or panic
+func SafeParseLines(name, input string, f func(n int, line string) error) (err error) {
+	cur := &ParseCursor{}
+	defer func() {
+		if r := recover(); r != nil {
+			err = toPanicError(name, r, cur, input)
+		}
+	}()
+	for i, ln := range strings.Split(input, "\n") {
+		cur.Set(i+1, ln)
+		if err := f(i+1, ln); err != nil {
+			return fmt.Errorf("%s line %d: %w", name, i+1, err)
+		}
+	}
+	return nil
+}
+
+// ParserRegistry holds named parsers and rules and invokes them sandboxed
+// one malformed device output can't crash the whole audit run
+type ParserRegistry struct {
+	mu      sync.RWMutex
+	parsers map[string]ParseFunc
+	rules   map[string]RuleFunc
+}
+
+// NewParserRegistry creates an empty ParserRegistry
+func NewParserRegistry() *ParserRegistry {
+	return &ParserRegistry{parsers: make(map[string]ParseFunc), rules: make(map[string]RuleFunc)}
+}
+
+// RegisterParser adds or replaces a named parser
+func (pr *ParserRegistry) RegisterParser(name string, f ParseFunc) {
+	pr.mu.Lock()
+	pr.parsers[name] = f
+	pr.mu.Unlock()
+}
+
+// RegisterRule adds or replaces a named rule
+func (pr *ParserRegistry) RegisterRule(name string, f RuleFunc) {
+	pr.mu.Lock()
+	pr.rules[name] = f
+	pr.mu.Unlock()
+}
+
+// Parse runs the named parser sandboxed
+func (pr *ParserRegistry) Parse(name, input string) (interface{}, error) {
+	pr.mu.RLock()
+	f, ok := pr.parsers[name]
+	pr.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("parser %s not registered", name)
+	}
+	return SafeParse(name, input, f)
+}
+
+// Check runs the named rule sandboxed
+func (pr *ParserRegistry) Check(name string, data interface{}) error {
+	pr.mu.RLock()
+	f, ok := pr.rules[name]
+	pr.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("rule %s not registered", name)
+	}
+	return SafeCall(name, func() error { return f(data) })
+}
+
+// CheckAll runs all rules against the data, a failing or panicking rule
+// doesn't stop the others, returns rule name to error of the failed ones
+func (pr *ParserRegistry) CheckAll(data interface{}) map[string]error {
+	pr.mu.RLock()
+	names := make([]string, 0, len(pr.rules))
+	for n := range pr.rules {
+		names = append(names, n)
+	}
+	pr.mu.RUnlock()
+	sort.Strings(names)
+	res := make(map[string]error)
+	for _, n := range names {
+		if err := pr.Check(n, data); err != nil {
+			res[n] = err
+		}
+	}
+	return res
+}
@@ -0,0 +1,296 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+cron style scheduling
+**************************************** */
+
+// cronSpec holds the bitmap of each cron field
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// cronField defines the value range and names of a cron field
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+	cronMacro = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// value converts a number or name of the field
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// parse converts a cron field (*, 1,2,3, 1-5, */15, 10-40/5) to bitmap
+func (f cronField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		start, end := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			se := strings.SplitN(rng, "-", 2)
+			var err error
+			if start, err = f.value(se[0]); err != nil {
+				return 0, err
+			}
+			if end, err = f.value(se[1]); err != nil {
+				return 0, err
+			}
+			if start > end {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			var err error
+			if start, err = f.value(rng); err != nil {
+				return 0, err
+			}
+			if step == 1 {
+				end = start
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// parseCron parses a standard 5 field cron expression or a @macro
+func parseCron(expr string) (*cronSpec, error) {
+	if m, ok := cronMacro[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = m
+	}
+	fs := strings.Fields(expr)
+	if len(fs) != 5 {
+		return nil, fmt.Errorf("cron expression %q requires 5 fields", expr)
+	}
+	var spec cronSpec
+	var err error
+	for i, p := range []struct {
+		f   cronField
+		dst *uint64
+	}{
+		{cronMinute, &spec.minute},
+		{cronHour, &spec.hour},
+		{cronDom, &spec.dom},
+		{cronMonth, &spec.month},
+		{cronDow, &spec.dow},
+	} {
+		if *p.dst, err = p.f.parse(fs[i]); err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+	}
+	// 7 is an alias of sunday
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domStar = strings.HasPrefix(fs[2], "*")
+	spec.dowStar = strings.HasPrefix(fs[4], "*")
+	return &spec, nil
+}
+
+// dayMatch follows the cron convention, if both day of month and day of week
+// are restricted, either of them matches
+func (c *cronSpec) dayMatch(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after t, zero time if none in 5 years
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.dayMatch(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// NextRun returns the next time after the given one matching the cron expression
+// standard 5 fields "minute hour day-of-month month day-of-week" are supported
+// with lists, ranges, steps, month/weekday names and @hourly/@daily like macros
+func NextRun(cronExpr string, after time.Time) (time.Time, error) {
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := spec.next(after)
+	if t.IsZero() {
+		return t, fmt.Errorf("cron expression %q never matches", cronExpr)
+	}
+	return t, nil
+}
+
+// schedJob is a callback registered to the Scheduler
+type schedJob struct {
+	name string
+	spec *cronSpec
+	f    func(context.Context)
+	next time.Time
+}
+
+// Scheduler invokes callbacks on cron schedule until its context is done
+type Scheduler struct {
+	Log  *log.Entry
+	mu   sync.Mutex
+	jobs []*schedJob
+	wake chan struct{}
+}
+
+// NewScheduler creates a Scheduler logging to the package logger
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		Log:  logger.WithField("module", "scheduler"),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Add registers a named callback on the cron expression
+// jobs can be added before or while the scheduler is running
+func (s *Scheduler) Add(name, cronExpr string, f func(context.Context)) error {
+	spec, err := parseCron(cronExpr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.jobs = append(s.jobs, &schedJob{name: name, spec: spec, f: f, next: spec.next(time.Now())})
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Remove unregisters the named callback, returns false if not found
+func (s *Scheduler) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, j := range s.jobs {
+		if j.name == name {
+			s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Run blocks and triggers the due callbacks, each in its own goroutine
+// it returns once ctx is done and all running callbacks are finished
+// callbacks receive ctx and are expected to abort when it's cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		s.mu.Lock()
+		var earliest time.Time
+		for _, j := range s.jobs {
+			if !j.next.IsZero() && (earliest.IsZero() || j.next.Before(earliest)) {
+				earliest = j.next
+			}
+		}
+		s.mu.Unlock()
+		wait := time.Hour
+		if !earliest.IsZero() {
+			wait = time.Until(earliest)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+			continue
+		case now := <-timer.C:
+			s.mu.Lock()
+			for _, j := range s.jobs {
+				if j.next.IsZero() || j.next.After(now) {
+					continue
+				}
+				j.next = j.spec.next(now)
+				wg.Add(1)
+				go func(j *schedJob) {
+					defer wg.Done()
+					defer Recover(s.Log.WithField("job", j.name))
+					s.Log.WithField("job", j.name).Trace("scheduled job start")
+					j.f(ctx)
+				}(j)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
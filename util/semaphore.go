@@ -0,0 +1,157 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+/* ****************************************
+semaphore and per key mutex
+**************************************** */
+
+// Semaphore limits the number of concurrent holders
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore creates a Semaphore of n slots, minimum 1
+func NewSemaphore(n int) *Semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire takes a slot, blocks until one is free or ctx is done
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot if one is free without blocking
+func (s *Semaphore) TryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot, it panics if no slot is taken
+func (s *Semaphore) Release() {
+	select {
+	case <-s.slots:
+	default:
+		panic("semaphore released without acquire")
+	}
+}
+
+// InUse returns the number of taken slots
+func (s *Semaphore) InUse() int {
+	return len(s.slots)
+}
+
+// keyedLock is the lock of a key and the number of its holders and waiters
+type keyedLock struct {
+	ch  chan struct{}
+	ref int
+}
+
+// KeyedMutex is a mutex per key, e.g. device hostname, the locks of idle keys
+// are released so the key space can be unbounded, the zero value is ready to use
+/*
+	var devLock util.KeyedMutex
+	...
+	unlock, err := devLock.LockCtx(ctx, host)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+*/
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// ref gets the lock of the key and counts the caller in
+func (km *KeyedMutex) ref(key string) *keyedLock {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if km.locks == nil {
+		km.locks = make(map[string]*keyedLock)
+	}
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		km.locks[key] = l
+	}
+	l.ref++
+	return l
+}
+
+// unref counts the caller out, the lock of the key is removed once unused
+func (km *KeyedMutex) unref(key string, l *keyedLock) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if l.ref--; l.ref == 0 {
+		delete(km.locks, key)
+	}
+}
+
+// unlocker returns the function unlocking the key, safe to call more than once
+func (km *KeyedMutex) unlocker(key string, l *keyedLock) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.ch
+			km.unref(key, l)
+		})
+	}
+}
+
+// Lock locks the key and returns the function to unlock it
+func (km *KeyedMutex) Lock(key string) func() {
+	l := km.ref(key)
+	l.ch <- struct{}{}
+	return km.unlocker(key, l)
+}
+
+// LockCtx locks the key, gives up once ctx is done
+func (km *KeyedMutex) LockCtx(ctx context.Context, key string) (func(), error) {
+	l := km.ref(key)
+	select {
+	case l.ch <- struct{}{}:
+		return km.unlocker(key, l), nil
+	case <-ctx.Done():
+		km.unref(key, l)
+		return nil, ctx.Err()
+	}
+}
+
+// TryLock locks the key if it's free without blocking
+func (km *KeyedMutex) TryLock(key string) (func(), bool) {
+	l := km.ref(key)
+	select {
+	case l.ch <- struct{}{}:
+		return km.unlocker(key, l), true
+	default:
+		km.unref(key, l)
+		return nil, false
+	}
+}
+
+// Locked returns the keys currently locked or waited for
+func (km *KeyedMutex) Locked() []string {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	res := make([]string, 0, len(km.locks))
+	for k := range km.locks {
+		res = append(res, k)
+	}
+	return res
+}
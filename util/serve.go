@@ -0,0 +1,160 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/* ****************************************
+server bootstrap
+**************************************** */
+
+// serve defaults, WriteTimeout also bounds the handlers, raise it for
+// long downloads and streams
+var (
+	ServeReadTimeout  = 15 * time.Second
+	ServeWriteTimeout = 60 * time.Second
+	ServeIdleTimeout  = 120 * time.Second
+	ServeDrainTimeout = 15 * time.Second
+)
+
+// serveConfig is built by the ServeOption of Serve and ServeGRPC
+type serveConfig struct {
+	read, write, idle time.Duration
+	drain             time.Duration
+	tls               *tls.Config
+	http2             bool
+	grpcOpts          []grpc.ServerOption
+	grpcServer        *grpc.Server
+}
+
+// ServeOption configures Serve and ServeGRPC
+type ServeOption func(*serveConfig)
+
+// ServeTimeouts overrides the read, write and idle timeouts of the HTTP
+// server, zero disables the timeout
+func ServeTimeouts(read, write, idle time.Duration) ServeOption {
+	return func(c *serveConfig) {
+		c.read, c.write, c.idle = read, write, idle
+	}
+}
+
+// ServeTLS serves TLS, see NewServerTLSConfig
+func ServeTLS(cfg *tls.Config) ServeOption {
+	return func(c *serveConfig) {
+		c.tls = cfg
+	}
+}
+
+// ServeHTTP2 enables HTTP/2, over cleartext it's served as h2c, without it
+// the server speaks HTTP/1.1 only
+func ServeHTTP2(enable bool) ServeOption {
+	return func(c *serveConfig) {
+		c.http2 = enable
+	}
+}
+
+// ServeDrain overrides how long the open connections are drained on shutdown
+func ServeDrain(d time.Duration) ServeOption {
+	return func(c *serveConfig) {
+		c.drain = d
+	}
+}
+
+// ServeGRPCOptions appends gRPC server options, e.g. interceptors which run
+// after the auth interceptors
+func ServeGRPCOptions(opts ...grpc.ServerOption) ServeOption {
+	return func(c *serveConfig) {
+		c.grpcOpts = append(c.grpcOpts, opts...)
+	}
+}
+
+func newServeConfig(opts []ServeOption) *serveConfig {
+	c := &serveConfig{
+		read:  ServeReadTimeout,
+		write: ServeWriteTimeout,
+		idle:  ServeIdleTimeout,
+		drain: ServeDrainTimeout,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Serve serves the handler on addr until ctx is cancelled, then stops
+// accepting and drains the open connections
+/*
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	tlsCfg, err := util.NewServerTLSConfig(cert, key, "", false)
+	...
+	err = api.Serve(ctx, ":8443", mux, util.ServeTLS(tlsCfg), util.ServeTimeouts(10*time.Second, 0, time.Minute))
+*/
+func (api *API) Serve(ctx context.Context, addr string, handler http.Handler, opts ...ServeOption) error {
+	c := newServeConfig(opts)
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  c.read,
+		WriteTimeout: c.write,
+		IdleTimeout:  c.idle,
+		TLSConfig:    c.tls,
+	}
+	switch {
+	case !c.http2:
+		// a non-nil empty map disables the automatic HTTP/2 over TLS
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	case c.tls == nil:
+		srv.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: c.idle})
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if api.Log != nil {
+		api.Log.WithField("addr", lis.Addr().String()).Info("http server listening")
+	}
+	return serveHTTP(ctx, srv, lis, c.drain)
+}
+
+// ServeGRPC serves the gRPC services registered by register on addr until
+// ctx is cancelled, then stops gracefully, or forcibly once the drain
+// timeout is exceeded, the auth interceptors of the API are installed first,
+// see ServeGRPCServer to serve a server of NewGrpcServer instead
+/*
+	err := api.ServeGRPC(ctx, ":50051", func(s *grpc.Server) {
+		pb.RegisterInventoryServer(s, &inventory{})
+	}, util.ServeTLS(tlsCfg))
+*/
+func (api *API) ServeGRPC(ctx context.Context, addr string, register func(*grpc.Server), opts ...ServeOption) error {
+	c := newServeConfig(opts)
+	srv := c.grpcServer
+	if srv == nil {
+		sopts := []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(api.AuthGrpcUnary),
+			grpc.ChainStreamInterceptor(api.AuthGrpcStream),
+		}
+		if c.tls != nil {
+			sopts = append(sopts, grpc.Creds(credentials.NewTLS(c.tls)))
+		}
+		srv = grpc.NewServer(append(sopts, c.grpcOpts...)...)
+		register(srv)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if api.Log != nil {
+		api.Log.WithField("addr", lis.Addr().String()).Info("grpc server listening")
+	}
+	return serveGRPC(ctx, addr, srv, lis, c.drain)
+}
@@ -0,0 +1,359 @@
+package util
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/* ****************************************
+service scaffold
+**************************************** */
+
+// ServiceConfig is the base config of a scaffolded service
+// env var names are prefixed by the upper case service name, e.g. INVENTORY_LISTEN
+type ServiceConfig struct {
+	Listen   string        `default:":8080" yaml:"listen" json:"listen"`
+	TokenSec string        `yaml:"token_sec" json:"token_sec"`
+	TokenTTL time.Duration `default:"1h" yaml:"token_ttl" json:"token_ttl"`
+	// JWKSURL verifies the tokens of an identity provider, of JWKSIssuer for JWKSAudience
+	JWKSURL         string        `yaml:"jwks_url" json:"jwks_url"`
+	JWKSIssuer      string        `yaml:"jwks_issuer" json:"jwks_issuer"`
+	JWKSAudience    string        `yaml:"jwks_audience" json:"jwks_audience"`
+	MongoURI        string        `yaml:"mongo_uri" json:"mongo_uri"`
+	MongoDB         string        `yaml:"mongo_db" json:"mongo_db"`
+	ShutdownTimeout time.Duration `default:"10s" yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// TLS is served if the key pair is configured, see NewServerTLSConfig
+	TLSCert       string   `yaml:"tls_cert" json:"tls_cert"`
+	TLSKey        string   `yaml:"tls_key" json:"tls_key"`
+	TLSCA         string   `yaml:"tls_ca" json:"tls_ca"`
+	TLSClientAuth bool     `yaml:"tls_client_auth" json:"tls_client_auth"`
+	TLSClientSANs []string `yaml:"tls_client_sans" json:"tls_client_sans"`
+	// WSOrigins are the browser origins allowed on /ws, see WSConfig
+	WSOrigins []string `yaml:"ws_origins" json:"ws_origins"`
+}
+
+// Service wires the package subsystems into a runnable service
+/*
+svc, err := util.NewService("inventory", "inventory.yaml", &extraCfg)
+svc.Handle("/devices", listDevices)           // JWT protected
+svc.HandlePublic("/version", version)
+svc.Sched.Add("sync", "@hourly", syncJob)
+svc.Main()
+*/
+// built-in routes: /healthz, /readyz, /metrics and /token/refresh are public, /ws joins the websocket hub with JWT
+type Service struct {
+	Name   string
+	Config ServiceConfig
+	Loader *ConfigLoader
+	API    *API
+	Mux    *http.ServeMux
+	Sched  *Scheduler
+	Hub    *WsHub
+	// Metrics instruments the registered routes, served on /metrics
+	Metrics *Metrics
+	// Tracer traces the routes and the Mongo commands if set, optional
+	Tracer *Tracer
+	// Mongo is connected by Run if MongoURI is configured
+	Mongo *MongoOpr
+	Log   *log.Entry
+
+	client *mongo.Client
+}
+
+// NewService loads the config and assembles a service
+// ext optionally points to a struct of service specific config loaded the same way
+func NewService(name, configFile string, ext interface{}) (*Service, error) {
+	prefix := strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+	s := &Service{
+		Name:    name,
+		Loader:  NewConfigLoader(configFile, prefix, nil),
+		Mux:     http.NewServeMux(),
+		Sched:   NewScheduler(),
+		Hub:     NewWsHub(),
+		Metrics: NewMetrics(),
+		Log:     logger.WithField("service", name),
+	}
+	if err := s.Loader.Load(&s.Config); err != nil {
+		return nil, fmt.Errorf("service %s config: %w", name, err)
+	}
+	if ext != nil {
+		extLoader := NewConfigLoader(configFile, prefix, nil)
+		if err := extLoader.Load(ext); err != nil {
+			return nil, fmt.Errorf("service %s config: %w", name, err)
+		}
+	}
+	if s.Config.TokenSec == "" && s.Config.JWKSURL == "" {
+		s.Log.Warn("token secret not configured, protected routes will reject all requests")
+	}
+	s.API = &API{TokenSec: []byte(s.Config.TokenSec), Log: s.Log, TokenTTL: s.Config.TokenTTL}
+	if s.Config.JWKSURL != "" {
+		if s.Config.JWKSIssuer == "" || s.Config.JWKSAudience == "" {
+			return nil, fmt.Errorf("service %s config: jwks_issuer and jwks_audience required with jwks_url", name)
+		}
+		jwks := NewJWKS(s.Config.JWKSURL, s.Config.JWKSIssuer, s.Config.JWKSAudience, time.Hour)
+		jwks.Log = s.Log.WithField("module", "jwks")
+		s.API.Keys = jwks
+	}
+	s.Sched.Log = s.Log.WithField("module", "scheduler")
+	s.Hub.Log = s.Log.WithField("module", "wshub")
+	s.Hub.Config = &WSConfig{Origins: s.Config.WSOrigins}
+
+	s.API.Health().Name = name
+	s.HandlePublic("/healthz", s.API.Health().Healthz)
+	s.HandlePublic("/readyz", s.API.Health().Readyz)
+	s.Metrics.Gauge("websocket_clients", func() float64 { return float64(s.Hub.Len()) })
+	s.HandlePublic("/metrics", s.Metrics.Handler)
+	s.HandlePublic("/token/refresh", s.API.RefreshHandler(s.Config.TokenTTL))
+	s.Handle("/ws", s.Hub.ServeHTTP)
+	return s, nil
+}
+
+// Handle registers a JWT protected handler
+func (s *Service) Handle(pattern string, h http.HandlerFunc) {
+	s.Mux.HandleFunc(pattern, s.instrument(pattern, s.API.Auth(h)))
+}
+
+// HandlePublic registers a handler without authentication
+func (s *Service) HandlePublic(pattern string, h http.HandlerFunc) {
+	s.Mux.HandleFunc(pattern, s.instrument(pattern, h))
+}
+
+// AddCheck registers a named readiness check reported by /readyz, see Health
+func (s *Service) AddCheck(name string, f func(context.Context) error) {
+	s.API.Health().AddReadiness(name, f, 0)
+}
+
+// statusWriter records the response status code
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	wrote bool // the header was sent
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code, w.wrote = code, true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack lets websocket upgrade through the wrapper
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	w.code = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Flush lets streaming responses through the wrapper
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument assigns the request ID, records the request metrics of the
+// route, and traces it if the Tracer is set
+func (s *Service) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	h = s.Metrics.Middleware(route)(h)
+	return s.API.RequestID(func(w http.ResponseWriter, r *http.Request) {
+		if s.Tracer != nil {
+			s.Tracer.Middleware(route)(h)(w, r)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// connectMongo connects the configured database and registers its health check
+func (s *Service) connectMongo(ctx context.Context) error {
+	if s.Config.MongoURI == "" {
+		return nil
+	}
+	db, err := ConnectMongo(ctx, s.Config.MongoURI, &MongoOptions{Database: s.Config.MongoDB, AppName: s.Name, Tracer: s.Tracer})
+	if err != nil {
+		return err
+	}
+	s.Mongo, s.client = db, db.Mdb.Client()
+	s.AddCheck("mongo", db.Ping)
+	return nil
+}
+
+// Run starts the service and blocks until ctx is done, then shuts down gracefully
+func (s *Service) Run(ctx context.Context) error {
+	if err := s.connectMongo(ctx); err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              s.Config.Listen,
+		Handler:           s.Mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	if s.Config.TLSCert != "" {
+		cfg, err := NewServerTLSConfig(s.Config.TLSCert, s.Config.TLSKey, s.Config.TLSCA, s.Config.TLSClientAuth)
+		if err != nil {
+			return fmt.Errorf("service %s TLS: %w", s.Name, err)
+		}
+		if len(s.Config.TLSClientSANs) > 0 {
+			VerifySANs(cfg, s.Config.TLSClientSANs...)
+		}
+		srv.TLSConfig = cfg
+	}
+	sctx, stopSched := context.WithCancel(context.Background())
+	schedDone := make(chan struct{})
+	go func() {
+		s.Sched.Run(sctx)
+		close(schedDone)
+	}()
+	srvErr := make(chan error, 1)
+	go func() {
+		s.Log.WithFields(log.Fields{"listen": s.Config.Listen, "tls": srv.TLSConfig != nil}).Info("service started")
+		if err := listenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			srvErr <- err
+		}
+		close(srvErr)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-srvErr:
+	}
+	s.Log.Info("service stopping")
+	shut, cancel := context.WithTimeout(context.Background(), s.Config.ShutdownTimeout)
+	defer cancel()
+	if e := srv.Shutdown(shut); e != nil && err == nil {
+		err = e
+	}
+	s.Hub.Close()
+	stopSched()
+	select {
+	case <-schedDone:
+	case <-shut.Done():
+		s.Log.Warn("scheduled jobs didn't finish before shutdown timeout")
+	}
+	if s.client != nil {
+		s.client.Disconnect(shut)
+	}
+	return err
+}
+
+// Main runs the service until SIGINT or SIGTERM, exits on failure, see Runner
+func (s *Service) Main() {
+	// Run drains by itself, leave it some headroom
+	r := NewRunner(s.Config.ShutdownTimeout + 5*time.Second)
+	r.Log = s.Log
+	r.AddFunc(s.Name, s.Run).Main()
+}
+
+/* ****************************************
+websocket hub
+**************************************** */
+
+// WsHub broadcasts messages to the connected websocket clients
+// clients too slow to keep up are disconnected
+type WsHub struct {
+	Log *log.Entry
+	// Config is the upgrade policy, nil uses Upgrader
+	Config *WSConfig
+
+	mu      sync.Mutex
+	clients map[*WSSession]struct{}
+	closed  bool
+}
+
+// NewWsHub creates a WsHub
+func NewWsHub() *WsHub {
+	return &WsHub{Log: logger.WithField("module", "wshub"), clients: make(map[*WSSession]struct{})}
+}
+
+// ServeHTTP upgrades the request and registers the client until it disconnects
+func (h *WsHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrade := UpgradeWS
+	if h.Config != nil {
+		upgrade = h.Config.Upgrade
+	}
+	ws, err := upgrade(w, r, nil)
+	if err != nil {
+		h.Log.WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		ws.Close(websocket.CloseGoingAway, "")
+		return
+	}
+	h.clients[ws] = struct{}{}
+	h.mu.Unlock()
+	defer h.drop(ws)
+	defer Recover(h.Log)
+
+	// incoming messages are discarded, reading detects the disconnection
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// drop unregisters a client and closes its session
+func (h *WsHub) drop(ws *WSSession) {
+	h.mu.Lock()
+	delete(h.clients, ws)
+	h.mu.Unlock()
+	ws.Close(websocket.CloseNormalClosure, "")
+}
+
+// Broadcast sends v encoded in JSON to all clients
+func (h *WsHub) Broadcast(v interface{}) error {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ws := range h.clients {
+		if !ws.TrySend(websocket.TextMessage, msg) {
+			h.Log.WithField("remote", ws.Conn.RemoteAddr().String()).Warn("slow websocket client dropped")
+			delete(h.clients, ws)
+			ws.Close(websocket.ClosePolicyViolation, "too slow")
+		}
+	}
+	return nil
+}
+
+// Len returns the number of connected clients
+func (h *WsHub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Close disconnects all clients and rejects new ones
+func (h *WsHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ws := range h.clients {
+		delete(h.clients, ws)
+		ws.Close(websocket.CloseGoingAway, "")
+	}
+}
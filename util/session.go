@@ -0,0 +1,295 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* ****************************************
+browser sessions
+**************************************** */
+
+// session cookies and the CSRF header
+const (
+	SessionCookie = "goto_session"
+	CSRFCookie    = "goto_csrf"
+	CSRFHeader    = "X-CSRF-Token"
+)
+
+// Session is a server side browser session
+type Session struct {
+	ID      string        `bson:"_id" json:"id"`
+	Claims  jwt.MapClaims `bson:"claims" json:"claims"`
+	CSRF    string        `bson:"csrf" json:"-"`
+	Expires time.Time     `bson:"expires" json:"expires"`
+}
+
+// SessionStore keeps the sessions, GetSession returns nil session and nil error if not found
+type SessionStore interface {
+	GetSession(ctx context.Context, id string) (*Session, error)
+	SaveSession(ctx context.Context, s *Session) error
+	DeleteSession(ctx context.Context, id string) error
+}
+
+// MemorySessions is an in-process SessionStore, expired sessions are pruned
+// on write, suitable for single instance services and tests
+type MemorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessions creates an empty MemorySessions
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{sessions: make(map[string]Session)}
+}
+
+// GetSession returns the session if not expired
+func (m *MemorySessions) GetSession(ctx context.Context, id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || time.Now().After(s.Expires) {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// SaveSession stores the session
+func (m *MemorySessions) SaveSession(ctx context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, v := range m.sessions {
+		if now.After(v.Expires) {
+			delete(m.sessions, k)
+		}
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+// DeleteSession removes the session
+func (m *MemorySessions) DeleteSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	return nil
+}
+
+// MongoSessions is a SessionStore in a collection of the MongoOpr database,
+// shared by all instances of a service, see EnsureIndex
+type MongoSessions struct {
+	Opr        *MongoOpr
+	Collection string
+}
+
+// EnsureIndex creates the TTL index purging the expired sessions
+func (m *MongoSessions) EnsureIndex(ctx context.Context) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return mongoErr(err)
+}
+
+// GetSession returns the session if not expired
+// the TTL monitor runs once a minute, so the expiry is checked as well
+func (m *MongoSessions) GetSession(ctx context.Context, id string) (*Session, error) {
+	var s Session
+	err := m.Opr.Mdb.Collection(m.Collection).FindOne(ctx,
+		bson.M{"_id": id, "expires": bson.M{"$gt": time.Now()}}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mongoErr(err)
+	}
+	if s.Claims, err = jsonClaims(s.Claims); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// jsonClaims converts the claims decoded from BSON, e.g. primitive.A
+// arrays and int32 numbers, to the types of the claims of a parsed JWT
+func jsonClaims(claims jwt.MapClaims) (jwt.MapClaims, error) {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	var c jwt.MapClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SaveSession upserts the session
+func (m *MongoSessions) SaveSession(ctx context.Context, s *Session) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).ReplaceOne(ctx, bson.M{"_id": s.ID}, s, options.Replace().SetUpsert(true))
+	return mongoErr(err)
+}
+
+// DeleteSession removes the session
+func (m *MongoSessions) DeleteSession(ctx context.Context, id string) error {
+	_, err := m.Opr.Mdb.Collection(m.Collection).DeleteOne(ctx, bson.M{"_id": id})
+	return mongoErr(err)
+}
+
+// Sessions authenticates browser clients by a secure HttpOnly cookie, so
+// tokens are never exposed to scripts
+// with a Store the cookie carries a random session ID, otherwise the JWT
+// issued by the API, which is revocable with api.Revoker
+// state changing requests must echo the CSRF token, readable by scripts
+// from the goto_csrf cookie, in the X-CSRF-Token header
+/*
+	sess := util.NewSessions(svc.API, &util.MongoSessions{Opr: svc.Mongo, Collection: "sessions"}, 8*time.Hour)
+	svc.HandlePublic("/ui/", sess.Auth(ui))
+	// in the login handler, once the user is verified
+	sess.Start(w, r, jwt.MapClaims{"sub": user, "roles": roles})
+*/
+type Sessions struct {
+	API   *API
+	Store SessionStore // nil keeps the JWT in the cookie
+	TTL   time.Duration
+	Path  string
+	// Domain of the cookies, empty for the host only
+	Domain string
+	// Insecure allows the cookies over plain HTTP, for development only
+	Insecure bool
+}
+
+// NewSessions creates the session layer of the API
+func NewSessions(api *API, store SessionStore, ttl time.Duration) *Sessions {
+	return &Sessions{API: api, Store: store, TTL: ttl, Path: "/"}
+}
+
+// setCookies sets the session and CSRF cookies, negative maxAge deletes them
+func (s *Sessions) setCookies(w http.ResponseWriter, value, csrf string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name: SessionCookie, Value: value, Path: s.Path, Domain: s.Domain, MaxAge: maxAge,
+		HttpOnly: true, Secure: !s.Insecure, SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name: CSRFCookie, Value: csrf, Path: s.Path, Domain: s.Domain, MaxAge: maxAge,
+		Secure: !s.Insecure, SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Start creates a session of the claims and sets the cookies, returns the CSRF token
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, claims jwt.MapClaims) (string, error) {
+	c := jwt.MapClaims{"auth": "session"}
+	for k, v := range claims {
+		c[k] = v
+	}
+	csrf := SecureToken(32)
+	value := ""
+	if s.Store != nil {
+		sess := &Session{ID: SecureToken(32), Claims: c, CSRF: csrf, Expires: time.Now().Add(s.TTL)}
+		if err := s.Store.SaveSession(r.Context(), sess); err != nil {
+			return "", fmt.Errorf("save session: %w", err)
+		}
+		value = sess.ID
+	} else {
+		// bind the CSRF token to the JWT, so it can't be swapped
+		c["csrf"] = csrf
+		tok, err := s.API.IssueToken(c, s.TTL)
+		if err != nil {
+			return "", err
+		}
+		value = tok
+	}
+	s.setCookies(w, value, csrf, int(s.TTL/time.Second))
+	return csrf, nil
+}
+
+// End deletes the session, or revokes the JWT if the API has a Revoker, and clears the cookies
+func (s *Sessions) End(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	if c, e := r.Cookie(SessionCookie); e == nil && c.Value != "" {
+		if s.Store != nil {
+			err = s.Store.DeleteSession(r.Context(), c.Value)
+		} else if s.API.Revoker != nil {
+			if claims, e := s.API.parseToken(r.Context(), c.Value, TokenAccess); e == nil {
+				err = s.API.RevokeClaims(claims)
+			}
+		}
+	}
+	s.setCookies(w, "", "", -1)
+	return err
+}
+
+// load returns the claims and CSRF token of the session cookie
+func (s *Sessions) load(r *http.Request) (jwt.MapClaims, string, error) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, "", fmt.Errorf("missing session cookie")
+	}
+	if s.Store == nil {
+		claims, err := s.API.parseToken(r.Context(), c.Value, TokenAccess)
+		if err != nil {
+			return nil, "", err
+		}
+		csrf, _ := claims["csrf"].(string)
+		return claims, csrf, nil
+	}
+	sess, err := s.Store.GetSession(r.Context(), c.Value)
+	if err != nil {
+		return nil, "", fmt.Errorf("session lookup: %w", err)
+	}
+	if sess == nil {
+		return nil, "", fmt.Errorf("session expired")
+	}
+	return sess.Claims, sess.CSRF, nil
+}
+
+// safeMethod returns true for methods not changing state, exempt from CSRF check
+func safeMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
+
+// Auth is the session counterpart of API.Auth, verifying the session cookie
+// and the CSRF token of unsafe methods, the claims are passed by context
+// and checked against the API policy
+func (s *Sessions) Auth(next http.HandlerFunc) http.HandlerFunc {
+	api := s.API
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		claims := s.auth(sw, r, next)
+		if api.Audit != nil {
+			api.Audit.recordHTTP(r, sw, claims, time.Since(start))
+		}
+	}
+}
+
+// auth performs the authentication of Auth, returns the claims, nil if denied
+func (s *Sessions) auth(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) jwt.MapClaims {
+	api := s.API
+	claims, csrf, err := s.load(r)
+	if err != nil {
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("session auth fail: %v", err), "Unauthorized")
+		return nil
+	}
+	if !safeMethod(r.Method) && (csrf == "" || !SecureCompare(r.Header.Get(CSRFHeader), csrf)) {
+		api.Error(w, http.StatusForbidden, "CSRF token mismatch", "Forbidden")
+		return nil
+	}
+	ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+	w.Header().Set(RequestIDHeader, rid)
+	if err := api.Policy.check(claims, r.Method, r.URL.Path); err != nil {
+		api.Error(w, http.StatusForbidden, err, "Forbidden")
+		return claims
+	}
+	next(w, r.WithContext(ContextWithClaims(ctx, claims)))
+	return claims
+}
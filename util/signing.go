@@ -0,0 +1,188 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+/* ****************************************
+HMAC request signing
+**************************************** */
+
+// signature headers
+const (
+	SignatureHeader    = "X-Signature"
+	SignatureTSHeader  = "X-Signature-Timestamp"
+	SignatureKeyHeader = "X-Signature-Key"
+)
+
+// MaxSignedBody limits the body size of signed requests read by AuthSignature
+var MaxSignedBody int64 = 10 << 20
+
+// signPayload returns the HMAC-SHA256 hex of the timestamp, method,
+// request URI and body digest, separated by new lines
+func signPayload(secret []byte, ts, method, uri string, body []byte) string {
+	bs := sha256.Sum256(body)
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n%s\n%s", ts, method, uri, hex.EncodeToString(bs[:]))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SignRequest adds the signature headers to the request, the body is read and restored
+func SignRequest(r *http.Request, keyID string, secret []byte) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(SignatureTSHeader, ts)
+	if keyID != "" {
+		r.Header.Set(SignatureKeyHeader, keyID)
+	}
+	r.Header.Set(SignatureHeader, signPayload(secret, ts, r.Method, r.URL.RequestURI(), body))
+	return nil
+}
+
+// SigningTransport is a http.RoundTripper signing the outgoing requests
+/*
+	client := &http.Client{Transport: &util.SigningTransport{KeyID: "netbox", Secret: secret}}
+*/
+type SigningTransport struct {
+	Base   http.RoundTripper // nil uses http.DefaultTransport
+	KeyID  string
+	Secret []byte
+}
+
+// RoundTrip signs a clone of the request and sends it
+func (t *SigningTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	if err := SignRequest(r, t.KeyID, t.Secret); err != nil {
+		return nil, err
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
+
+// SignatureKeys returns the secret of a key ID, false if unknown
+type SignatureKeys func(keyID string) ([]byte, bool)
+
+// replayCache remembers the signatures seen within the replay window
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	every  time.Duration // between the prunes
+	pruned time.Time
+}
+
+func newReplayCache(every time.Duration) *replayCache {
+	return &replayCache{seen: make(map[string]time.Time), every: every, pruned: time.Now()}
+}
+
+// add returns false if the signature was seen, the expired entries are
+// pruned once per every, not on each request
+func (c *replayCache) add(sig string, until time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) > c.every {
+		for k, t := range c.seen {
+			if now.After(t) {
+				delete(c.seen, k)
+			}
+		}
+		c.pruned = now
+	}
+	if t, ok := c.seen[sig]; ok && !now.After(t) {
+		return false
+	}
+	c.seen[sig] = until
+	return true
+}
+
+// AuthSignature returns a middleware verifying signed requests, e.g. webhooks,
+// as an alternative to bearer tokens, the timestamp must be within the
+// window and a signature is accepted only once
+// the key ID is passed downstream as the "sub" claim, checked against the
+// API policy, and the request is recorded to the audit logger if configured
+func (api *API) AuthSignature(keys SignatureKeys, window time.Duration) func(http.HandlerFunc) http.HandlerFunc {
+	replay := newReplayCache(window)
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+			claims := api.authSignature(sw, r, next, keys, window, replay)
+			if api.Audit != nil {
+				api.Audit.recordHTTP(r, sw, claims, time.Since(start))
+			}
+		}
+	}
+}
+
+// authSignature performs the verification of AuthSignature, returns the claims, nil if denied
+func (api *API) authSignature(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, keys SignatureKeys, window time.Duration, replay *replayCache) jwt.MapClaims {
+	keyID := r.Header.Get(SignatureKeyHeader)
+	secret, ok := keys(keyID)
+	if !ok {
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("unknown signature key %q", keyID), "Unauthorized")
+		return nil
+	}
+	ts := r.Header.Get(SignatureTSHeader)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		api.Error(w, http.StatusUnauthorized, "malformed signature timestamp", "Unauthorized")
+		return nil
+	}
+	t := time.Unix(sec, 0)
+	if d := time.Since(t); d > window || d < -window {
+		api.Error(w, http.StatusUnauthorized, fmt.Sprintf("signature timestamp %s outside window", t.Format(time.RFC3339)), "Unauthorized")
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxSignedBody+1))
+	if err != nil {
+		api.Error(w, http.StatusBadRequest, err, "Bad request")
+		return nil
+	}
+	if int64(len(body)) > MaxSignedBody {
+		api.Error(w, http.StatusRequestEntityTooLarge, "signed body too large")
+		return nil
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	sig := r.Header.Get(SignatureHeader)
+	if !SecureCompare(sig, signPayload(secret, ts, r.Method, r.URL.RequestURI(), body)) {
+		api.Error(w, http.StatusUnauthorized, "signature mismatch", "Unauthorized")
+		return nil
+	}
+	if !replay.add(sig, t.Add(window)) {
+		api.Error(w, http.StatusUnauthorized, "signature replayed", "Unauthorized")
+		return nil
+	}
+	claims := jwt.MapClaims{"sub": keyID, "auth": "hmac"}
+	ctx, rid := withRequestID(r.Context(), api.Log, r.Header.Get(RequestIDHeader))
+	w.Header().Set(RequestIDHeader, rid)
+	if err := api.Policy.check(claims, r.Method, r.URL.Path); err != nil {
+		api.Error(w, http.StatusForbidden, err, "Forbidden")
+		return claims
+	}
+	next(w, r.WithContext(ContextWithClaims(ctx, claims)))
+	return claims
+}
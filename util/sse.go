@@ -0,0 +1,233 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ****************************************
+server-sent events
+**************************************** */
+
+// SSEHeartbeat is the default interval of the keep-alive comments, below
+// the idle timeout of the common proxies
+var SSEHeartbeat = 15 * time.Second
+
+// SSEWriter writes a text/event-stream response, safe for concurrent use
+// the server WriteTimeout bounds the stream, see ServeTimeouts
+// the handler must Close it before returning, so the writes of the other
+// goroutines, e.g. Heartbeat, stop before the response is completed
+/*
+	sse, err := util.NewSSEWriter(w, r)
+	if err != nil {
+		api.Error(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer sse.Close()
+	go sse.Heartbeat(r.Context(), 0)
+	for ev := range events {
+		if err := sse.Send("alarm", ev.ID, ev); err != nil {
+			return
+		}
+	}
+*/
+type SSEWriter struct {
+	// LastEventID is the ID of the last event received by a reconnecting
+	// client, from the Last-Event-ID header or the lastEventId parameter
+	LastEventID string
+
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	f      http.Flusher
+	closed bool
+}
+
+// errSSEClosed is the error of the writes after Close
+var errSSEClosed = errors.New("event stream closed")
+
+// NewSSEWriter starts the event stream response, the writer must support flushing
+func NewSSEWriter(w http.ResponseWriter, r *http.Request) (*SSEWriter, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("response writer doesn't support flushing")
+	}
+	s := &SSEWriter{w: w, f: f, LastEventID: r.Header.Get("Last-Event-ID")}
+	if s.LastEventID == "" {
+		s.LastEventID = r.URL.Query().Get("lastEventId")
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	// disable the response buffering of nginx
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	return s, nil
+}
+
+// Close ends the writes, the later ones fail
+func (s *SSEWriter) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// write writes the frame and flushes it
+func (s *SSEWriter) write(frame string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSSEClosed
+	}
+	if _, err := fmt.Fprint(s.w, frame); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+// sseField formats a field, new lines in the value are split into lines of the field
+func sseField(b *strings.Builder, name, value string) {
+	for _, ln := range strings.Split(strings.Replace(value, "\r\n", "\n", -1), "\n") {
+		fmt.Fprintf(b, "%s: %s\n", name, ln)
+	}
+}
+
+// Send writes an event, empty event is the default "message" event, an
+// empty id keeps the last ID of the client, string and []byte data are
+// sent as is, others encoded as JSON
+func (s *SSEWriter) Send(event, id string, data interface{}) error {
+	var payload string
+	switch v := data.(type) {
+	case string:
+		payload = v
+	case []byte:
+		payload = string(v)
+	default:
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		payload = string(b)
+	}
+	var b strings.Builder
+	if event != "" {
+		sseField(&b, "event", strings.Replace(event, "\n", " ", -1))
+	}
+	if id != "" {
+		sseField(&b, "id", strings.Replace(id, "\n", " ", -1))
+	}
+	sseField(&b, "data", payload)
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, ignored by the clients
+func (s *SSEWriter) Comment(text string) error {
+	return s.write(": " + strings.Replace(text, "\n", " ", -1) + "\n\n")
+}
+
+// Retry tells the client how long to wait before reconnecting
+func (s *SSEWriter) Retry(d time.Duration) error {
+	return s.write("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n")
+}
+
+// Heartbeat writes a comment every interval, zero means SSEHeartbeat,
+// so proxies keep the connection and broken clients are detected,
+// blocks until ctx is done or a write fails
+func (s *SSEWriter) Heartbeat(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = SSEHeartbeat
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := s.Comment("ping"); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// SSEHandler streams the messages of the hub topics as events named by
+// the topic, with the publish time in nanoseconds as ID, until the client
+// disconnects or the subscription is dropped by the hub slow policy
+// the hub keeps no history, a reconnecting client misses the messages
+// published while disconnected
+/*
+	hub := util.NewHub(64, util.DropOldest)
+	svc.Handle("/events", api.AuthSSE(util.SSEHandler(hub, "alarms", "inventory")))
+*/
+func SSEHandler(hub *Hub, topics ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sse, err := NewSSEWriter(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sub := hub.Subscribe(topics...)
+		defer sub.Unsubscribe()
+		ctx, cancel := context.WithCancel(r.Context())
+		beat := make(chan struct{})
+		go func() {
+			sse.Heartbeat(ctx, 0)
+			close(beat)
+		}()
+		// the heartbeat must not write once the handler returned
+		defer func() {
+			cancel()
+			<-beat
+			sse.Close()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if err := sse.Send(m.Topic, strconv.FormatInt(m.Time.UnixNano(), 10), m.Value); err != nil {
+					LoggerFromContext(r.Context()).WithError(err).Debug("SSE client gone")
+					return
+				}
+			}
+		}
+	}
+}
+
+// AuthSSE is Auth for event streams, the browser EventSource can't set
+// headers, so the JWT is also accepted in the access_token query parameter,
+// which is removed from the URL and RequestURI of the request passed to
+// next, the Tracer redacts it as well
+// prefer the session cookies of Sessions where possible, the URL may be
+// recorded by proxies
+func (api *API) AuthSSE(next http.HandlerFunc) http.HandlerFunc {
+	auth := api.Auth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if _, ok := q["access_token"]; ok {
+			tok := q.Get("access_token")
+			r = r.Clone(r.Context())
+			if tok != "" && r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", "Bearer "+tok)
+			}
+			q.Del("access_token")
+			r.URL.RawQuery = q.Encode()
+			r.RequestURI = r.URL.RequestURI()
+		}
+		auth(w, r)
+	}
+}
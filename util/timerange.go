@@ -0,0 +1,162 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+/* ****************************************
+business hours and maintenance windows
+**************************************** */
+
+// TimeRange defines either an absolute window (Start/End)
+// or a daily recurring window (From/To offset from midnight on the Weekdays)
+// recurring window with To not after From spans midnight
+type TimeRange struct {
+	Start    time.Time
+	End      time.Time
+	Weekdays []time.Weekday // empty means every day
+	From     time.Duration
+	To       time.Duration
+	Location *time.Location // timezone of recurring window, default Local
+}
+
+// MaintenanceWindow creates an absolute TimeRange
+func MaintenanceWindow(start, end time.Time) TimeRange {
+	return TimeRange{Start: start, End: end}
+}
+
+// BusinessHours creates a recurring TimeRange from "09:00" and "17:30" like strings
+// defaults to Monday to Friday if no weekday specified
+func BusinessHours(from, to string, days ...time.Weekday) (TimeRange, error) {
+	f, err := clockToDuration(from)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	t, err := clockToDuration(to)
+	if err != nil {
+		return TimeRange{}, err
+	}
+	if len(days) == 0 {
+		days = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	}
+	return TimeRange{Weekdays: days, From: f, To: t}, nil
+}
+
+// clockToDuration converts "15:04" to the offset from midnight
+func clockToDuration(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// recurring returns true if TimeRange is a daily recurring window
+func (tr *TimeRange) recurring() bool {
+	return tr.Start.IsZero() && tr.End.IsZero()
+}
+
+// onDay returns true if the recurring window starts on the weekday
+func (tr *TimeRange) onDay(d time.Weekday) bool {
+	if len(tr.Weekdays) == 0 {
+		return true
+	}
+	for _, w := range tr.Weekdays {
+		if w == d {
+			return true
+		}
+	}
+	return false
+}
+
+// intervals returns the occurrences of the TimeRange clipped into [start, end)
+func (tr *TimeRange) intervals(start, end time.Time) (r [][2]time.Time) {
+	clip := func(s, e time.Time) {
+		if s.Before(start) {
+			s = start
+		}
+		if e.After(end) {
+			e = end
+		}
+		if s.Before(e) {
+			r = append(r, [2]time.Time{s, e})
+		}
+	}
+	if !tr.recurring() {
+		clip(tr.Start, tr.End)
+		return
+	}
+	loc := tr.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	// start a day earlier for the window spanning midnight
+	ls := start.In(loc).AddDate(0, 0, -1)
+	day := time.Date(ls.Year(), ls.Month(), ls.Day(), 0, 0, 0, 0, loc)
+	for ; day.Before(end); day = day.AddDate(0, 0, 1) {
+		if !tr.onDay(day.Weekday()) {
+			continue
+		}
+		s := wallClock(day, tr.From)
+		e := wallClock(day, tr.To)
+		if tr.To <= tr.From {
+			e = wallClock(day.AddDate(0, 0, 1), tr.To)
+		}
+		clip(s, e)
+	}
+	return
+}
+
+// wallClock returns the time of day of the offset from midnight on the
+// day, by the clock of its location, so a window keeps its hours on the
+// days of a DST change
+func wallClock(day time.Time, off time.Duration) time.Time {
+	hh, mm := int(off/time.Hour), int(off%time.Hour/time.Minute)
+	return time.Date(day.Year(), day.Month(), day.Day(), hh, mm, 0, int(off%time.Minute), day.Location())
+}
+
+// InWindow returns true if t falls in any of the windows
+func InWindow(t time.Time, windows []TimeRange) bool {
+	return DurationWithin(t, t.Add(time.Nanosecond), windows) > 0
+}
+
+// DurationWithin returns the elapsed time between start and end that falls in the windows
+// overlapping windows are only counted once
+func DurationWithin(start, end time.Time, windows []TimeRange) time.Duration {
+	if !start.Before(end) {
+		return 0
+	}
+	iv := [][2]time.Time{}
+	for _, w := range windows {
+		iv = append(iv, w.intervals(start, end)...)
+	}
+	sort.Slice(iv, func(i, j int) bool { return iv[i][0].Before(iv[j][0]) })
+	var dur time.Duration
+	var cur [2]time.Time
+	for i, v := range iv {
+		if i == 0 {
+			cur = v
+			continue
+		}
+		if v[0].After(cur[1]) {
+			dur += cur[1].Sub(cur[0])
+			cur = v
+		} else if v[1].After(cur[1]) {
+			cur[1] = v[1]
+		}
+	}
+	if len(iv) > 0 {
+		dur += cur[1].Sub(cur[0])
+	}
+	return dur
+}
+
+// DurationOutside returns the elapsed time between start and end that falls out of the windows
+func DurationOutside(start, end time.Time, windows []TimeRange) time.Duration {
+	if !start.Before(end) {
+		return 0
+	}
+	return end.Sub(start) - DurationWithin(start, end, windows)
+}
@@ -0,0 +1,220 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/* ****************************************
+mTLS configuration
+**************************************** */
+
+// CertReloadInterval is how often the certificate files are checked for modification
+var CertReloadInterval = 10 * time.Second
+
+// CertReloader serves a key pair and reloads it once the files are modified,
+// e.g. renewed by the PKI agent, a failed reload keeps the current pair
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	mtime   time.Time
+	checked time.Time
+}
+
+// NewCertReloader loads the key pair
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// modTime returns the latest modification time of the files
+func (c *CertReloader) modTime() (time.Time, error) {
+	var t time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (c *CertReloader) load() error {
+	mtime, err := c.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair %s: %w", c.certFile, err)
+	}
+	c.cert, c.mtime, c.checked = &cert, mtime, time.Now()
+	return nil
+}
+
+// Certificate returns the key pair, reloaded if the files were modified
+func (c *CertReloader) Certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < CertReloadInterval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	if mtime, err := c.modTime(); err != nil || mtime.Equal(c.mtime) {
+		return c.cert
+	}
+	if err := c.load(); err != nil {
+		logger.WithError(err).WithField("file", c.certFile).Warn("certificate reload failed")
+		return c.cert
+	}
+	logger.WithField("file", c.certFile).Info("certificate reloaded")
+	return c.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate
+func (c *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(), nil
+}
+
+// LoadCertPool reads the PEM encoded CA certificates
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no CA certificate found", caFile)
+	}
+	return pool, nil
+}
+
+// NewServerTLSConfig returns the server TLS config of the key pair, which is
+// hot-reloaded, client certificates are verified against the CA if given and
+// mandatory if requireClientCert, see VerifySANs to restrict the clients
+/*
+	cfg, err := util.NewServerTLSConfig("/pki/svc.crt", "/pki/svc.key", "/pki/ca.crt", true)
+	util.VerifySANs(cfg, "spiffe://netops/*")
+*/
+func NewServerTLSConfig(certFile, keyFile, caFile string, requireClientCert bool) (*tls.Config, error) {
+	cr, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+	if caFile != "" {
+		if cfg.ClientCAs, err = LoadCertPool(caFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if requireClientCert {
+		if caFile == "" {
+			return nil, ErrBadInput.Wrap(fmt.Errorf("client certificate required without CA"))
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// NewClientTLSConfig returns the client TLS config verifying the server
+// against the CA, the system roots if caFile is empty, the client key pair
+// is optional and hot-reloaded, serverName overrides the dialed host name
+func NewClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if certFile != "" {
+		cr, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = cr.GetClientCertificate
+	}
+	if caFile != "" {
+		var err error
+		if cfg.RootCAs, err = LoadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// certSANs returns the DNS, IP, URI and email SANs of the certificate
+func certSANs(c *x509.Certificate) []string {
+	sans := append([]string{}, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, u := range c.URIs {
+		sans = append(sans, u.String())
+	}
+	return append(sans, c.EmailAddresses...)
+}
+
+// VerifySANs restricts the peers of the config to certificates with a SAN
+// matching one of the path.Match patterns, on top of the chain verification
+// on servers it applies to the client certificates, which must be presented
+func VerifySANs(cfg *tls.Config, patterns ...string) {
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("peer certificate missing")
+		}
+		for _, san := range certSANs(cs.PeerCertificates[0]) {
+			for _, p := range patterns {
+				if ok, _ := path.Match(p, san); ok {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("peer certificate %q SANs not allowed", cs.PeerCertificates[0].Subject.CommonName)
+	}
+}
+
+// GRPCServerTLS returns the gRPC server option of NewServerTLSConfig
+/*
+	creds, err := util.GRPCServerTLS(cert, key, ca, true)
+	srv := grpc.NewServer(creds, grpc.UnaryInterceptor(api.AuthGrpcUnary))
+*/
+func GRPCServerTLS(certFile, keyFile, caFile string, requireClientCert bool) (grpc.ServerOption, error) {
+	cfg, err := NewServerTLSConfig(certFile, keyFile, caFile, requireClientCert)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Creds(credentials.NewTLS(cfg)), nil
+}
+
+// GRPCDialTLS returns the gRPC dial option of NewClientTLSConfig
+func GRPCDialTLS(certFile, keyFile, caFile, serverName string) (grpc.DialOption, error) {
+	cfg, err := NewClientTLSConfig(certFile, keyFile, caFile, serverName)
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(cfg)), nil
+}
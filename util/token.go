@@ -0,0 +1,175 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+/* ****************************************
+JWT issuance and refresh
+**************************************** */
+
+// token types, carried by the TokenTypeClaim claim
+const (
+	TokenAccess  = "access"
+	TokenRefresh = "refresh"
+)
+
+// TokenTypeClaim carries the token type, namespaced as the standard "typ"
+// is set by the identity providers, e.g. "Bearer" or "ID"
+const TokenTypeClaim = "goto_typ"
+
+// reservedClaims are set by the issuer and not copied on refresh, "typ"
+// is the type claim of the tokens issued before TokenTypeClaim
+var reservedClaims = []string{"iat", "nbf", "exp", "jti", TokenTypeClaim, "typ"}
+
+// TokenResponse is the JSON body returned by the token handlers
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+}
+
+// IssueToken signs an access token with the claims, valid for ttl,
+// iat, exp and a unique jti are set, zero ttl means no expiry
+func (api *API) IssueToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	return api.issue(claims, ttl, TokenAccess)
+}
+
+// IssueRefreshToken signs a refresh token with the claims, valid for ttl,
+// it's only accepted by RefreshHandler, not by the auth middlewares
+func (api *API) IssueRefreshToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	return api.issue(claims, ttl, TokenRefresh)
+}
+
+func (api *API) issue(claims jwt.MapClaims, ttl time.Duration, typ string) (string, error) {
+	if len(api.TokenSec) == 0 {
+		return "", fmt.Errorf("token secret not configured")
+	}
+	c := jwt.MapClaims{}
+	for k, v := range claims {
+		c[k] = v
+	}
+	now := time.Now()
+	c["iat"] = now.Unix()
+	if ttl > 0 {
+		c["exp"] = now.Add(ttl).Unix()
+	}
+	c["jti"] = SecureRandString(24)
+	c[TokenTypeClaim] = typ
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(api.TokenSec)
+}
+
+// parseToken verifies the token and returns its claims, see keyFunc, the token type must
+// match, tokens without type are accepted as access tokens, revoked tokens are rejected
+// the refresh tokens issued before TokenTypeClaim carry "typ": "refresh"
+func (api *API) parseToken(ctx context.Context, raw, typ string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(raw, api.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+	t, _ := claims[TokenTypeClaim].(string)
+	if t == "" {
+		t = TokenAccess
+		if legacy, _ := claims["typ"].(string); legacy == TokenRefresh {
+			t = TokenRefresh
+		}
+	}
+	if t != typ {
+		return nil, fmt.Errorf("%s token not accepted", t)
+	}
+	if err := api.checkRevoked(ctx, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// keyFunc resolves the verification key, HMAC tokens are verified by
+// TokenSec, others by the Keys source if configured
+func (api *API) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok && len(api.TokenSec) > 0 {
+		return api.TokenSec, nil
+	}
+	if api.Keys != nil {
+		return api.Keys.Key(token)
+	}
+	return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+}
+
+// RefreshHandler exchanges a refresh token for a new access token valid for ttl
+// and a new refresh token of the same lifetime, the used one is revoked if
+// api.Revoker is set, otherwise it stays valid until it expires
+// the refresh token is read from the JSON body {"refresh_token": "..."}
+// or the Authorization bearer header
+/*
+	svc.HandlePublic("/token/refresh", svc.API.RefreshHandler(time.Hour))
+*/
+func (api *API) RefreshHandler(ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			api.Error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if r.ContentLength != 0 {
+			if err := api.Bind(r, &body); err != nil {
+				api.Error(w, 0, err)
+				return
+			}
+		}
+		raw := body.RefreshToken
+		if raw == "" {
+			raw = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		if raw == "" {
+			api.Error(w, http.StatusBadRequest, "missing refresh token")
+			return
+		}
+		claims, err := api.parseToken(r.Context(), raw, TokenRefresh)
+		if err != nil {
+			api.Error(w, http.StatusUnauthorized, fmt.Sprintf("refresh token: %v", err), "Unauthorized")
+			return
+		}
+		var life time.Duration
+		exp, eok := claims["exp"].(float64)
+		iat, iok := claims["iat"].(float64)
+		if eok && iok && exp > iat {
+			life = time.Duration(exp-iat) * time.Second
+		}
+		if api.Revoker != nil {
+			if err := api.RevokeClaims(claims); err != nil {
+				api.Error(w, http.StatusServiceUnavailable, fmt.Errorf("revoke refresh token: %w", err), "Refresh failed")
+				return
+			}
+		}
+		for _, k := range reservedClaims {
+			delete(claims, k)
+		}
+		tok, err := api.IssueToken(claims, ttl)
+		if err != nil {
+			api.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+		refresh, err := api.IssueRefreshToken(claims, life)
+		if err != nil {
+			api.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: tok, RefreshToken: refresh, TokenType: "Bearer", ExpiresIn: int64(ttl / time.Second)})
+	}
+}
@@ -0,0 +1,393 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/event"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/* ****************************************
+distributed tracing
+**************************************** */
+
+// TraceParentHeader carries the W3C trace context in HTTP headers and gRPC metadata
+const TraceParentHeader = "traceparent"
+
+// SpanContext identifies a span across services
+type SpanContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits
+	Sampled bool
+}
+
+// IsValid returns true if the IDs are set
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16
+}
+
+// TraceParent formats the W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent parses a W3C traceparent header value
+func ParseTraceParent(s string) (SpanContext, bool) {
+	p := strings.Split(strings.TrimSpace(s), "-")
+	if len(p) != 4 || len(p[0]) != 2 || p[0] == "ff" || len(p[1]) != 32 || len(p[2]) != 16 || len(p[3]) != 2 {
+		return SpanContext{}, false
+	}
+	for _, h := range p {
+		if _, err := hex.DecodeString(h); err != nil {
+			return SpanContext{}, false
+		}
+	}
+	if strings.Trim(p[1], "0") == "" || strings.Trim(p[2], "0") == "" {
+		return SpanContext{}, false
+	}
+	flags, _ := strconv.ParseUint(p[3], 16, 8)
+	return SpanContext{TraceID: p[1], SpanID: p[2], Sampled: flags&1 == 1}, true
+}
+
+// randHex returns n random bytes in hex
+func randHex(n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Span is a timed operation of a trace
+type Span struct {
+	Name     string                 `json:"name"`
+	Service  string                 `json:"service"`
+	Kind     string                 `json:"kind"` // server, client or internal
+	TraceID  string                 `json:"traceID"`
+	SpanID   string                 `json:"spanID"`
+	ParentID string                 `json:"parentID,omitempty"`
+	Start    time.Time              `json:"start"`
+	Duration time.Duration          `json:"duration"`
+	Attrs    map[string]interface{} `json:"attrs,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+
+	sampled bool
+	tracer  *Tracer
+	mu      sync.Mutex
+	ended   bool
+}
+
+// Context returns the span context to propagate
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Sampled: s.sampled}
+}
+
+// SetAttr sets an attribute of the span
+func (s *Span) SetAttr(key string, v interface{}) {
+	s.mu.Lock()
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]interface{})
+	}
+	s.Attrs[key] = v
+	s.mu.Unlock()
+}
+
+// SetError marks the span failed, nil is ignored
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and exports it if sampled, later calls are ignored
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.Duration = time.Since(s.Start)
+	s.mu.Unlock()
+	if s.sampled && s.tracer.Exporter != nil {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
+
+// SpanExporter receives the finished spans, e.g. forwards them to a collector
+type SpanExporter interface {
+	ExportSpan(s *Span)
+}
+
+// SpanExporterFunc adapts a function to SpanExporter
+type SpanExporterFunc func(s *Span)
+
+// ExportSpan calls the function
+func (f SpanExporterFunc) ExportSpan(s *Span) {
+	f(s)
+}
+
+// WriterSpanExporter writes the spans as JSON lines, e.g. to a file tailed by the collector
+type WriterSpanExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSpanExporter creates an exporter writing to w
+func NewWriterSpanExporter(w io.Writer) *WriterSpanExporter {
+	return &WriterSpanExporter{w: w}
+}
+
+// ExportSpan writes a JSON line
+func (e *WriterSpanExporter) ExportSpan(s *Span) {
+	s.mu.Lock()
+	b, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	e.w.Write(append(b, '\n'))
+	e.mu.Unlock()
+}
+
+// Tracer starts the spans of a service, the trace context is propagated
+// in the W3C traceparent format, so traces continue across services
+/*
+	tr := util.NewTracer("inventory", util.NewWriterSpanExporter(f))
+	mux.HandleFunc("/devices", tr.Middleware("/devices")(api.Auth(listDevices)))
+	srv := grpc.NewServer(grpc.ChainUnaryInterceptor(tr.GrpcUnary(), api.AuthGrpcUnary))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(tr.MongoMonitor()))
+*/
+type Tracer struct {
+	Service  string
+	Exporter SpanExporter
+	// SampleRate is the fraction of new traces exported, continued traces
+	// follow the sampling decision of the caller
+	SampleRate float64
+}
+
+// NewTracer creates a Tracer sampling all traces
+func NewTracer(service string, exporter SpanExporter) *Tracer {
+	return &Tracer{Service: service, Exporter: exporter, SampleRate: 1}
+}
+
+// spanKey carries the current span or the remote span context
+type spanKey struct{}
+
+// ContextWithRemoteSpan returns a context continuing the trace of a caller
+func ContextWithRemoteSpan(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// SpanFromContext returns the current span, nil if none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// spanContextOf returns the span context of the current or remote span
+func spanContextOf(ctx context.Context) (SpanContext, bool) {
+	switch v := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		return v.Context(), true
+	case SpanContext:
+		return v, v.IsValid()
+	}
+	return SpanContext{}, false
+}
+
+// Start starts a span, a child of the span of the context if any
+func (t *Tracer) Start(ctx context.Context, name, kind string) (context.Context, *Span) {
+	s := &Span{Name: name, Service: t.Service, Kind: kind, SpanID: randHex(8), Start: time.Now(), tracer: t}
+	if parent, ok := spanContextOf(ctx); ok {
+		s.TraceID, s.ParentID, s.sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else {
+		s.TraceID = randHex(16)
+		s.sampled = t.SampleRate >= 1 || (t.SampleRate > 0 && float64(secureIntn(1<<30))/(1<<30) < t.SampleRate)
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		s.SetAttr("request_id", id)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartChild starts a span with the tracer of the current span, nil span
+// and the unchanged context if the context isn't traced
+func StartChild(ctx context.Context, name, kind string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, kind)
+}
+
+// InjectHTTP sets the traceparent header of an outgoing request
+func InjectHTTP(ctx context.Context, h http.Header) {
+	if sc, ok := spanContextOf(ctx); ok {
+		h.Set(TraceParentHeader, sc.TraceParent())
+	}
+}
+
+// InjectGRPC returns the context with the traceparent in the outgoing metadata
+func InjectGRPC(ctx context.Context) context.Context {
+	if sc, ok := spanContextOf(ctx); ok {
+		return metadata.AppendToOutgoingContext(ctx, TraceParentHeader, sc.TraceParent())
+	}
+	return ctx
+}
+
+// Middleware traces the HTTP handler of the route, continuing the trace of
+// the traceparent header, websocket upgrades are named "WS route"
+func (t *Tracer) Middleware(route string) Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if sc, ok := ParseTraceParent(r.Header.Get(TraceParentHeader)); ok {
+				ctx = ContextWithRemoteSpan(ctx, sc)
+			}
+			name := r.Method + " " + route
+			if websocket.IsWebSocketUpgrade(r) {
+				name = "WS " + route
+			}
+			ctx, span := t.Start(ctx, name, "server")
+			span.SetAttr("http.method", r.Method)
+			span.SetAttr("http.target", redactURI(r.URL))
+			sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+			defer func() {
+				span.SetAttr("http.status_code", sw.code)
+				if sw.code >= 500 {
+					span.SetError(fmt.Errorf("HTTP %d", sw.code))
+				}
+				span.End()
+			}()
+			next(sw, r.WithContext(ctx))
+		}
+	}
+}
+
+// grpcSpan starts the server span of a gRPC call
+func (t *Tracer) grpcSpan(ctx context.Context, method string) (context.Context, *Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(TraceParentHeader); len(v) > 0 {
+			if sc, ok := ParseTraceParent(v[0]); ok {
+				ctx = ContextWithRemoteSpan(ctx, sc)
+			}
+		}
+	}
+	return t.Start(ctx, method, "server")
+}
+
+// endRPC records the status of the call and ends the span
+func endRPC(span *Span, err error) {
+	span.SetAttr("rpc.grpc.status_code", status.Code(err).String())
+	span.SetError(err)
+	span.End()
+}
+
+// GrpcUnary returns the gRPC unary server interceptor of the tracer
+func (t *Tracer) GrpcUnary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, span := t.grpcSpan(ctx, info.FullMethod)
+		res, err := handler(ctx, req)
+		endRPC(span, err)
+		return res, err
+	}
+}
+
+// GrpcStream returns the gRPC stream server interceptor of the tracer
+func (t *Tracer) GrpcStream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, span := t.grpcSpan(ss.Context(), info.FullMethod)
+		err := handler(srv, &ctxStream{ss, ctx})
+		endRPC(span, err)
+		return err
+	}
+}
+
+// GrpcClientUnary returns the gRPC unary client interceptor propagating the
+// trace of the context to the called service
+func GrpcClientUnary() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, span := StartChild(ctx, method, "client")
+		err := invoker(InjectGRPC(ctx), method, req, reply, cc, opts...)
+		if span != nil {
+			endRPC(span, err)
+		}
+		return err
+	}
+}
+
+// GrpcClientStream returns the gRPC stream client interceptor, see
+// GrpcClientUnary, the span ends with the stream
+func GrpcClientStream() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, span := StartChild(ctx, method, "client")
+		cs, err := streamer(InjectGRPC(ctx), desc, cc, method, opts...)
+		if span == nil {
+			return cs, err
+		}
+		if err != nil {
+			endRPC(span, err)
+			return nil, err
+		}
+		return &endClientStream{ClientStream: cs, end: func(err error) { endRPC(span, err) }}, nil
+	}
+}
+
+// MongoMonitor returns the command monitor of the mongo client options,
+// commands of a traced context are spanned as "mongo.<command> <collection>"
+func (t *Tracer) MongoMonitor() *event.CommandMonitor {
+	var spans sync.Map // request ID to span
+	end := func(id int64, err error) {
+		if v, ok := spans.Load(id); ok {
+			spans.Delete(id)
+			span := v.(*Span)
+			span.SetError(err)
+			span.End()
+		}
+	}
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			if _, ok := spanContextOf(ctx); !ok {
+				return
+			}
+			name := "mongo." + e.CommandName
+			if coll, ok := e.Command.Lookup(e.CommandName).StringValueOK(); ok {
+				name += " " + coll
+			}
+			_, span := t.Start(ctx, name, "client")
+			span.SetAttr("db.name", e.DatabaseName)
+			spans.Store(e.RequestID, span)
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			end(e.RequestID, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			end(e.RequestID, fmt.Errorf("%s", e.Failure))
+		},
+	}
+}
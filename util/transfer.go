@@ -0,0 +1,353 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ****************************************
+file transfer
+**************************************** */
+
+// upload headers of UploadFile and ReceiveUpload
+const (
+	// UploadOffsetHeader reports the bytes received so far on HEAD
+	UploadOffsetHeader = "X-Upload-Offset"
+	// ChecksumHeader carries "algo=hex" of the whole file
+	ChecksumHeader = "X-Checksum"
+)
+
+// ErrChecksum is the checksum mismatch of a transferred file
+var ErrChecksum = NewErr("CHECKSUM_MISMATCH", CatInput, "checksum mismatch")
+
+// TransferOptions configures DownloadFile and UploadFile
+type TransferOptions struct {
+	// Client sends the requests with its headers, token and TLS, nil uses NewClient("")
+	Client *Client
+	// Resume continues a partial transfer, the download is kept in path.part
+	Resume bool
+	// Progress is called on every chunk with the bytes done and the total, -1 if unknown
+	Progress func(done, total int64)
+	// BytesPerSec limits the bandwidth, zero means no limit
+	BytesPerSec int64
+	// Algo and Sum verify the file checksum, see FileHash, an upload with
+	// Algo only computes the sum
+	Algo string
+	Sum  string
+}
+
+func (o *TransferOptions) client() *Client {
+	if o.Client == nil {
+		return NewClient("")
+	}
+	return o.Client
+}
+
+// transferReader reports the progress and paces the reads to the bandwidth limit
+type transferReader struct {
+	ctx      context.Context
+	r        io.Reader
+	rate     int64
+	done     int64
+	total    int64
+	progress func(done, total int64)
+	start    time.Time
+	sent     int64
+}
+
+func newTransferReader(ctx context.Context, r io.Reader, done, total int64, o TransferOptions) *transferReader {
+	return &transferReader{ctx: ctx, r: r, rate: o.BytesPerSec, done: done, total: total, progress: o.Progress, start: time.Now()}
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	// read at most 100ms worth of data to keep the pace smooth
+	if chunk := t.rate / 10; t.rate > 0 && int64(len(p)) > chunk {
+		if chunk < 1 {
+			chunk = 1
+		}
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	t.done += int64(n)
+	t.sent += int64(n)
+	if n > 0 && t.progress != nil {
+		t.progress(t.done, t.total)
+	}
+	if t.rate > 0 && n > 0 {
+		due := time.Duration(float64(t.sent) / float64(t.rate) * float64(time.Second))
+		if e := SleepCtx(t.ctx, due-time.Since(t.start)); e != nil && err == nil {
+			err = e
+		}
+	}
+	return n, err
+}
+
+// verifySum checks the file against the expected checksum of the options
+func verifySum(path string, o TransferOptions) error {
+	if o.Algo == "" || o.Sum == "" {
+		return nil
+	}
+	ok, err := VerifyFile(path, o.Algo, o.Sum)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChecksum.Wrap(fmt.Errorf("%s %s doesn't match %s", path, o.Algo, o.Sum))
+	}
+	return nil
+}
+
+// DownloadFile streams the URL to path through path.part, renamed once
+// complete and the checksum verified, a failed checksum removes the part
+// with Resume the part left by an interrupted download is continued by a
+// Range request, restarted if the server doesn't support ranges
+/*
+	rep, err := util.DownloadFile(ctx, "https://repo/junos-21.4R1.tgz", "/images/junos-21.4R1.tgz",
+		util.TransferOptions{Resume: true, Algo: "sha256", Sum: sum, BytesPerSec: 50 << 20})
+*/
+func DownloadFile(ctx context.Context, url, path string, opts TransferOptions) (rep FileReport, err error) {
+	c := opts.client()
+	ctx, span := StartChild(ctx, "download "+url, "client")
+	if span != nil {
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+	}
+	part := path + ".part"
+	var offset int64
+	if opts.Resume {
+		if fi, err := os.Stat(part); err == nil {
+			offset = fi.Size()
+		}
+	}
+	hdr := http.Header{}
+	if offset > 0 {
+		hdr.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, url, nil, hdr)
+	if err != nil {
+		return rep, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return rep, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return rep, fmt.Errorf("download %s: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 &&
+		resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset):
+		// the part is already complete
+		return finishPart(part, path, opts)
+	default:
+		if err := httpStatusErr(resp); err != nil {
+			return rep, err
+		}
+		offset = 0
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return rep, err
+	}
+	_, err = io.Copy(f, newTransferReader(ctx, resp.Body, offset, total, opts))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return rep, fmt.Errorf("download %s: %w", url, err)
+	}
+	return finishPart(part, path, opts)
+}
+
+// finishPart verifies the part and renames it to path
+func finishPart(part, path string, opts TransferOptions) (FileReport, error) {
+	if err := verifySum(part, opts); err != nil {
+		os.Remove(part)
+		return FileReport{Path: path}, err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return FileReport{Path: path}, err
+	}
+	return FileExist(path)
+}
+
+// UploadFile streams the file to the URL by PUT, with the checksum in the
+// X-Checksum header if Algo is set, the sum is computed unless given
+// with Resume the server is asked by HEAD for the X-Upload-Offset of a
+// partial upload, which is continued with a Content-Range, see ReceiveUpload
+/*
+	err := util.UploadFile(ctx, "https://bundles/upload/case-4711.tgz", "/tmp/rsi.tgz",
+		util.TransferOptions{Client: c, Resume: true, Algo: "sha256", Progress: bar.Set})
+*/
+func UploadFile(ctx context.Context, url, path string, opts TransferOptions) (err error) {
+	c := opts.client()
+	ctx, span := StartChild(ctx, "upload "+url, "client")
+	if span != nil {
+		defer func() {
+			span.SetError(err)
+			span.End()
+		}()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	sum := opts.Sum
+	if opts.Algo != "" && sum == "" {
+		if sum, err = FileHash(path, opts.Algo); err != nil {
+			return err
+		}
+	}
+	var offset int64
+	if opts.Resume {
+		if offset, err = uploadOffset(ctx, c, url); err != nil {
+			return err
+		}
+		if offset >= size {
+			offset = 0
+		}
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	hdr := http.Header{}
+	hdr.Set("Content-Type", "application/octet-stream")
+	if size > 0 {
+		hdr.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+	}
+	if opts.Algo != "" {
+		hdr.Set(ChecksumHeader, normHashAlgo(opts.Algo)+"="+sum)
+	}
+	req, err := c.newRequest(ctx, http.MethodPut, url, newTransferReader(ctx, f, offset, size, opts), hdr)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size - offset
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	return httpStatusErr(resp)
+}
+
+// uploadOffset asks the server for the bytes already received, zero if unknown
+func uploadOffset(ctx context.Context, c *Client, url string) (int64, error) {
+	req, err := c.newRequest(ctx, http.MethodHead, url, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, nil
+	}
+	n, _ := strconv.ParseInt(resp.Header.Get(UploadOffsetHeader), 10, 64)
+	return n, nil
+}
+
+// ReceiveUpload is the server side of UploadFile saving the body to path
+// through path.part, maxSize limits the file, zero means no limit
+// HEAD is answered with the X-Upload-Offset of the part, a PUT continuing
+// at another offset is rejected with ErrConflict, the checksum of a
+// complete file is verified, returns the report of the complete file,
+// nil report if the upload is partial or HEAD
+/*
+	mux.HandleFunc("/upload/", func(w http.ResponseWriter, r *http.Request) {
+		rep, err := util.ReceiveUpload(w, r, filepath.Join(dir, path.Base(r.URL.Path)), 4<<30)
+		if err != nil {
+			api.Error(w, 0, err)
+			return
+		}
+		if rep != nil {
+			api.Created(w, rep)
+		}
+	})
+*/
+func ReceiveUpload(w http.ResponseWriter, r *http.Request, path string, maxSize int64) (*FileReport, error) {
+	part := path + ".part"
+	var have int64
+	if fi, err := os.Stat(part); err == nil {
+		have = fi.Size()
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(have, 10))
+		w.WriteHeader(http.StatusOK)
+		return nil, nil
+	}
+	start, end, total := int64(0), r.ContentLength-1, r.ContentLength
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &total); err != nil || start > end || end >= total {
+			return nil, ErrBadInput.Wrap(fmt.Errorf("invalid Content-Range %q", cr))
+		}
+	}
+	if maxSize > 0 && total > maxSize {
+		return nil, ErrBadInput.Wrap(fmt.Errorf("upload of %d bytes exceeds %d", total, maxSize))
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if start > 0 {
+		if start != have {
+			return nil, ErrConflict.Wrap(fmt.Errorf("upload continues at %d, %d received", start, have))
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	body := io.Reader(r.Body)
+	if maxSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxSize-start)
+	}
+	if total >= 0 {
+		body = io.LimitReader(body, total-start)
+	}
+	n, err := io.Copy(f, body)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("receive %s: %w", path, err)
+	}
+	if total >= 0 && start+n < total {
+		return nil, nil
+	}
+	var opts TransferOptions
+	if p := strings.SplitN(r.Header.Get(ChecksumHeader), "=", 2); len(p) == 2 {
+		opts.Algo, opts.Sum = p[0], p[1]
+	}
+	rep, err := finishPart(part, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
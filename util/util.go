@@ -2,28 +2,20 @@ package util
 
 import (
 	"fmt"
-	"io/ioutil"
 	"math"
 	"math/rand"
-	"os"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func init() {
-	// config package level default logger
-	log.SetFormatter(&log.JSONFormatter{})
-	log.SetOutput(os.Stdout)
-	log.SetLevel(log.TraceLevel)
-}
-
 /* ****************************************
 map manipulating
 **************************************** */
@@ -190,7 +182,7 @@ func SortMapByField(m []map[string]interface{}, f string, tseq []string) []map[s
 	// otherwise sort by field f based on the sequence of argument list
 	sorted := []map[string]interface{}{}
 	for _, k := range tseq {
-		for i := 0; i < len(withKey); i++ {
+		for n := len(withKey); n > 0; n-- {
 			q := withKey[0]
 			withKey = withKey[1:]
 			var mv string
@@ -260,7 +252,7 @@ func SortMapByTwoFields(m []map[string]interface{}, f1 string, fseq []string, f2
 	sorted := []map[string]interface{}{}
 	for _, k := range fseq {
 		tempSorted := []map[string]interface{}{}
-		for i := 0; i < len(withKey); i++ {
+		for n := len(withKey); n > 0; n-- {
 			q := withKey[0]
 			withKey = withKey[1:]
 			var mv string
@@ -298,7 +290,7 @@ func ConvToStrings(s interface{}) []string {
 			if es, ok := e.(string); ok {
 				oprS = append(oprS, es)
 			} else {
-				log.Warn("ConvToStrings returns empty: at least one member of the given slice is not a string")
+				logger.Warn("ConvToStrings returns empty: at least one member of the given slice is not a string")
 				return []string{}
 			}
 		}
@@ -314,7 +306,7 @@ func ConvToStrings(s interface{}) []string {
 	case *[]interface{}:
 		return process(*ts)
 	default:
-		log.Warn("ConvToStrings returns empty: neither []string nor []interface{}")
+		logger.Warn("ConvToStrings returns empty: neither []string nor []interface{}")
 		return []string{}
 	}
 }
@@ -526,6 +518,8 @@ func InSlice(v interface{}, s []interface{}) bool {
 
 /* ****************************************
 random string functions
+math/rand backed and predictable, NOT for security purposes
+use SecureRandString/SecureToken for session IDs, tokens and passwords
 **************************************** */
 // charset is the numeric and alphabetic character set
 const charset = "abcdefghijklmnopqrstuvwxyz" +
@@ -534,12 +528,17 @@ const charset = "abcdefghijklmnopqrstuvwxyz" +
 var seededRand *rand.Rand = rand.New(
 	rand.NewSource(time.Now().UnixNano()))
 
+// randMu serializes seededRand which is not safe for concurrent use
+var randMu sync.Mutex
+
 // StringWithCharset generates random string on a given length and character set
 func StringWithCharset(length int, charset string) string {
 	b := make([]byte, length)
+	randMu.Lock()
 	for i := range b {
 		b[i] = charset[seededRand.Intn(len(charset))]
 	}
+	randMu.Unlock()
 	return string(b)
 }
 
@@ -548,6 +547,73 @@ func RandString(length int) string {
 	return StringWithCharset(length, charset)
 }
 
+// PickWeighted selects one of the items randomly, proportional to its weight
+// returns empty string if no item has positive weight or the lengths mismatch
+func PickWeighted(items []string, weights []float64) string {
+	if len(items) != len(weights) {
+		return ""
+	}
+	total := 0.0
+	for _, w := range weights {
+		if w > 0 {
+			total += w
+		}
+	}
+	if total <= 0 {
+		return ""
+	}
+	randMu.Lock()
+	r := seededRand.Float64() * total
+	randMu.Unlock()
+	last := ""
+	for i, w := range weights {
+		if w <= 0 {
+			continue
+		}
+		last = items[i]
+		if r < w {
+			return items[i]
+		}
+		r -= w
+	}
+	// float rounding
+	return last
+}
+
+// Shuffle randomizes the order of a slice in place, any slice type is accepted
+// non-slice input is ignored
+func Shuffle(s interface{}) {
+	v := reflect.ValueOf(s)
+	if v.Kind() != reflect.Slice {
+		return
+	}
+	swap := reflect.Swapper(s)
+	randMu.Lock()
+	seededRand.Shuffle(v.Len(), swap)
+	randMu.Unlock()
+}
+
+// Sample returns n randomly selected distinct members of items, in random order
+// all items are returned shuffled if n is larger than the list
+func Sample(items []string, n int) []string {
+	if n > len(items) {
+		n = len(items)
+	}
+	if n <= 0 {
+		return []string{}
+	}
+	r := make([]string, len(items))
+	copy(r, items)
+	randMu.Lock()
+	// partial Fisher-Yates
+	for i := 0; i < n; i++ {
+		j := i + seededRand.Intn(len(r)-i)
+		r[i], r[j] = r[j], r[i]
+	}
+	randMu.Unlock()
+	return r[:n]
+}
+
 /* ****************************************
 timestamp functions
 **************************************** */
@@ -595,6 +661,26 @@ func EpochToString(t int64) string {
 	return time.Unix(t, 0).Format(time.UnixDate)
 }
 
+// EpochToStringUTC converts a int64 UTC epoch to a string in UTC, UnixDate format
+// reports rendered by it look the same regardless of the host timezone
+func EpochToStringUTC(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.UnixDate)
+}
+
+// EpochToStringIn converts a int64 UTC epoch to a string in the given timezone and layout
+// loc is a IANA zone name like "America/Toronto", "Local" or "" for UTC
+// layout defaults to UnixDate if empty
+func EpochToStringIn(t int64, loc string, layout string) (string, error) {
+	l, err := time.LoadLocation(loc)
+	if err != nil {
+		return "", err
+	}
+	if layout == "" {
+		layout = time.UnixDate
+	}
+	return time.Unix(t, 0).In(l).Format(layout), nil
+}
+
 // StringToDuration converts a duration string (8y10w7d6h5m20s)to time.Duration
 // add year, week and day unit support on top of time.ParseDuration
 // return 0 if invalid string
@@ -630,21 +716,33 @@ func StringToDuration(s string) time.Duration {
 }
 
 // HMSToDuration converts 6:10:30 format string to time.Duration
-func HMSToDuration(s string) time.Duration {
-	temp := []string{"s", "m", "h"}
-	ss := strings.Split(s, ":")
-	if len(ss) > 3 || len(ss) < 1 {
-		return time.Duration(0)
+// optional days field "1d 03:04:05", fractional seconds "03:04:05.250"
+// and a leading "-" for negative value are supported
+func HMSToDuration(s string) (time.Duration, error) {
+	ss := regexp.MustCompile(`^(-)?\s*(?:(\d+)d\s*)?(?:(?:(\d+):)?(\d+):)?(\d+(?:\.\d+)?)$`).FindStringSubmatch(strings.TrimSpace(s))
+	if len(ss) == 0 {
+		return time.Duration(0), fmt.Errorf("invalid duration %q", s)
 	}
-	k := 0
-	for i := len(ss) - 1; i >= 0; i-- {
-		ss[i] = strings.TrimSpace(ss[i]) + temp[k]
-		k += 1
+	dur := time.Duration(0)
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+		if ss[i+2] == "" {
+			continue
+		}
+		num, err := strconv.ParseInt(ss[i+2], 10, 64)
+		if err != nil {
+			return time.Duration(0), fmt.Errorf("invalid duration %q: %v", s, err)
+		}
+		dur += time.Duration(num) * unit
 	}
-	p := strings.Join(ss, "")
-	fmt.Println(p)
-	r, _ := time.ParseDuration(p)
-	return r
+	sec, err := strconv.ParseFloat(ss[5], 64)
+	if err != nil {
+		return time.Duration(0), fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	dur += time.Duration(math.Round(sec * float64(time.Second)))
+	if ss[1] != "" {
+		dur = -dur
+	}
+	return dur, nil
 }
 
 /* ****************************************
@@ -666,12 +764,29 @@ func UpDown(adm, opr bool) (s string) {
 	return
 }
 
-// LogWithFields attaches a slice of [k1,v1,k2,v2,...] to log entry
-func LogWithFields(log *log.Entry, f []string) *log.Entry {
-	for i := 0; i < len(f)-1; i += 2 {
-		log = log.WithField(f[i], f[i+1])
+// LogWithFields attaches a slice of [k1,v1,k2,v2,...] or a map to log entry
+// f can be []string, map[string]string, map[string]interface{} or log.Fields
+// values of sensitive keys are masked, see Redact
+// nil log entry uses the package logger
+func LogWithFields(lg *log.Entry, f interface{}) *log.Entry {
+	if lg == nil {
+		lg = log.NewEntry(logger)
 	}
-	return log
+	switch fs := f.(type) {
+	case []string:
+		for i := 0; i < len(fs)-1; i += 2 {
+			lg = lg.WithField(fs[i], redactField(fs[i], fs[i+1]))
+		}
+	case map[string]string:
+		for k, v := range fs {
+			lg = lg.WithField(k, redactField(k, v))
+		}
+	case map[string]interface{}:
+		lg = lg.WithFields(redactValue(fs).(map[string]interface{}))
+	case log.Fields:
+		lg = lg.WithFields(redactValue(fs).(log.Fields))
+	}
+	return lg
 }
 
 // RoundTo rounds a float to a given position, also a float type
@@ -679,21 +794,16 @@ func RoundTo(x, unit float64) float64 {
 	return math.Round(x/unit) * unit
 }
 
-// GetEnvHashFrFile getting a k/v map of env var from a file in shell format
+// GetEnvHashFrFile getting a k/v map of env var from a file in dotenv format
+// malformed lines are logged and skipped, the last definition of a key wins
 func GetEnvHashFrFile(fileName string) map[string]string {
 	res := make(map[string]string)
-	if data, err := ioutil.ReadFile(fileName); err == nil {
-		re := regexp.MustCompile(`^([\w\.-]+)=([\w\.-]+)$`)
-		for _, ln := range strings.Split(strings.TrimSpace(string(data)), "\n") {
-			m := re.FindStringSubmatch(strings.TrimSpace(ln))
-			if len(m) == 0 {
-				continue
-			}
-			if m[1] == "" {
-				continue
-			}
-			res[m[1]] = m[2]
-		}
+	vars, err := ParseEnvFile(fileName)
+	if err != nil {
+		logger.WithError(err).Warn("GetEnvHashFrFile")
+	}
+	for _, v := range vars {
+		res[v.Key] = v.Val
 	}
 	return res
 }
@@ -702,20 +812,12 @@ func GetEnvHashFrFile(fileName string) map[string]string {
 // original sequence will be preserved
 func GetEnvArrayFrFile(fileName string) []map[string]string {
 	res := []map[string]string{}
-	if data, err := ioutil.ReadFile(fileName); err == nil {
-		fmt.Println(string(data))
-		re := regexp.MustCompile(`^([\w\.-]+)=([\w\.-]+)$`)
-		for _, ln := range strings.Split(strings.TrimSpace(string(data)), "\n") {
-			m := re.FindStringSubmatch(strings.TrimSpace(ln))
-			if len(m) == 0 {
-				continue
-			}
-			if m[1] == "" {
-				continue
-			}
-			fmt.Println(m)
-			res = append(res, map[string]string{"key": m[1], "val": m[2]})
-		}
+	vars, err := ParseEnvFile(fileName)
+	if err != nil {
+		logger.WithError(err).Warn("GetEnvArrayFrFile")
+	}
+	for _, v := range vars {
+		res = append(res, map[string]string{"key": v.Key, "val": v.Val})
 	}
 	return res
 }
@@ -751,7 +853,7 @@ func (e ExeErr) Error(err ...interface{}) error {
 	if len(err) == 0 {
 		return fmt.Errorf("%v", e)
 	}
-	if len(err) == 0 {
+	if len(err) == 1 {
 		return fmt.Errorf("%v, %v", e, err[0])
 	}
 	addErr := ""
@@ -760,3 +862,147 @@ func (e ExeErr) Error(err ...interface{}) error {
 	}
 	return fmt.Errorf("%v, %v:%s", e, err[0], addErr)
 }
+
+// Wrap converts to a structured *Err keeping cause for errors.Is/As, nil cause returns nil
+func (e ExeErr) Wrap(cause error) error {
+	if cause == nil {
+		return nil
+	}
+	return &Err{Code: "EXEC_FAILED", Category: ErrCategory(cause), Msg: string(e), Cause: cause}
+}
+
+// exeErrFormat parses the text made by NewExeErr
+var exeErrFormat = regexp.MustCompile(`^(?:(.+) )?func (\S+) failed$`)
+
+// builder starts an ExeErrBuilder from the operation and resources of the ExeErr
+func (e ExeErr) builder() *ExeErrBuilder {
+	b := &ExeErrBuilder{op: string(e), attempt: -1}
+	if m := exeErrFormat.FindStringSubmatch(string(e)); m != nil {
+		b.op = m[2]
+		if m[1] != "" {
+			b.resources = strings.Split(m[1], "/")
+		}
+	}
+	return b
+}
+
+// Resource starts a fluent ExeErrBuilder with the resource, see ExeErrBuilder
+func (e ExeErr) Resource(r ...string) *ExeErrBuilder { return e.builder().Resource(r...) }
+
+// Attempt starts a fluent ExeErrBuilder with the attempt number
+func (e ExeErr) Attempt(n int) *ExeErrBuilder { return e.builder().Attempt(n) }
+
+// Field starts a fluent ExeErrBuilder with a key/value metadata
+func (e ExeErr) Field(k string, v interface{}) *ExeErrBuilder { return e.builder().Field(k, v) }
+
+// Cause starts a fluent ExeErrBuilder with the underlying error
+func (e ExeErr) Cause(err error) *ExeErrBuilder { return e.builder().Cause(err) }
+
+// ExeErrBuilder is a function execution failure with metadata
+/*
+err := util.NewExeErr("ConfigPush").Resource("router1").Attempt(3).Cause(err)
+// op=ConfigPush resource=router1 attempt=3 error="dial tcp: i/o timeout"
+log.WithFields(err.Fields()).Error(err.Msg())
+*/
+// the message is logfmt formatted, the cause is kept for errors.Is/As
+type ExeErrBuilder struct {
+	op        string
+	resources []string
+	attempt   int
+	fields    map[string]interface{}
+	cause     error
+}
+
+// Resource appends the resources the operation failed on
+func (b *ExeErrBuilder) Resource(r ...string) *ExeErrBuilder {
+	b.resources = append(b.resources, r...)
+	return b
+}
+
+// Attempt sets the attempt number
+func (b *ExeErrBuilder) Attempt(n int) *ExeErrBuilder {
+	b.attempt = n
+	return b
+}
+
+// Field adds a key/value metadata
+func (b *ExeErrBuilder) Field(k string, v interface{}) *ExeErrBuilder {
+	if b.fields == nil {
+		b.fields = make(map[string]interface{})
+	}
+	b.fields[k] = v
+	return b
+}
+
+// Cause sets the underlying error
+func (b *ExeErrBuilder) Cause(err error) *ExeErrBuilder {
+	b.cause = err
+	return b
+}
+
+// Fields returns the metadata as structured log fields
+func (b *ExeErrBuilder) Fields() log.Fields {
+	f := log.Fields{"op": b.op}
+	for k, v := range b.fields {
+		f[k] = v
+	}
+	if len(b.resources) > 0 {
+		f["resource"] = strings.Join(b.resources, "/")
+	}
+	if b.attempt >= 0 {
+		f["attempt"] = b.attempt
+	}
+	return f
+}
+
+// Msg returns the metadata formatted in logfmt, the cause excluded
+func (b *ExeErrBuilder) Msg() string {
+	f := b.Fields()
+	keys := []string{"op", "resource", "attempt"}
+	extra := []string{}
+	for k := range b.fields {
+		if k != "op" && k != "resource" && k != "attempt" {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	kv := []string{}
+	for _, k := range append(keys, extra...) {
+		if v, ok := f[k]; ok {
+			kv = append(kv, k+"="+logfmtValue(fmt.Sprintf("%v", v)))
+		}
+	}
+	return strings.Join(kv, " ")
+}
+
+// Error returns the logfmt formatted message including the cause
+func (b *ExeErrBuilder) Error() string {
+	if b.cause == nil {
+		return b.Msg()
+	}
+	return b.Msg() + " error=" + logfmtValue(b.cause.Error())
+}
+
+// Unwrap returns the cause for errors.Is/As
+func (b *ExeErrBuilder) Unwrap() error {
+	return b.cause
+}
+
+// Err converts to a structured *Err, the category is inherited from the cause
+func (b *ExeErrBuilder) Err() *Err {
+	return &Err{
+		Code:     "EXEC_FAILED",
+		Category: ErrCategory(b.cause),
+		Msg:      fmt.Sprintf("func %s failed", b.op),
+		Cause:    b.cause,
+		Fields:   b.Fields(),
+	}
+}
+
+// logfmtValue quotes a value containing space, quote or equal sign
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -1,8 +1,1698 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestDependencyImport(t *testing.T) {
 }
+
+func TestGetEnvHashFrFile(t *testing.T) {
+	want := map[string]string{
+		"BASIC":          "overridden",
+		"EXPORTED":       "exported",
+		"SPACED_KEY":     "spaced value",
+		"INLINE_COMMENT": "value",
+		"HASH_IN_VALUE":  "pass#word",
+		"EMPTY":          "",
+		"EMPTY_QUOTED":   "",
+		"SINGLE":         `single $HOME \n literal`,
+		"DOUBLE":         "double \"quoted\"\tvalue",
+		"DOUBLE_COMMENT": "quoted # not a comment",
+		"MULTI":          "first line\nsecond line",
+		"MULTI_SINGLE":   "a\nb",
+		"DOTTED.key-1":   "dotted",
+	}
+	got := GetEnvHashFrFile("testdata/dotenv.env")
+	if len(got) != len(want) {
+		t.Errorf("got %d keys, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestParseEnvErrors(t *testing.T) {
+	vars, err := ParseEnvFile("testdata/dotenv.env")
+	perr, ok := err.(*EnvParseError)
+	if !ok {
+		t.Fatalf("expect *EnvParseError, got %v", err)
+	}
+	if _, ok := perr.Lines[17]; !ok || len(perr.Lines) != 1 {
+		t.Errorf("expect malformed line 17, got %v", perr.Lines)
+	}
+	if vars[0].Key != "BASIC" || vars[len(vars)-1].Val != "overridden" {
+		t.Errorf("sequence not preserved: %v", vars)
+	}
+	if _, err := ParseEnv("KEY=\"unterminated\nNEXT=1"); err == nil {
+		t.Error("expect unterminated quote error")
+	}
+}
+
+func TestLoadEnvToProcess(t *testing.T) {
+	os.Setenv("EXPORTED", "preset")
+	defer os.Unsetenv("EXPORTED")
+	defer os.Unsetenv("MULTI")
+	LoadEnvToProcess("testdata/dotenv.env")
+	if v := os.Getenv("EXPORTED"); v != "preset" {
+		t.Errorf("existing variable overridden: %q", v)
+	}
+	if v := os.Getenv("MULTI"); v != "first line\nsecond line" {
+		t.Errorf("MULTI = %q", v)
+	}
+}
+
+func TestEnvExpansion(t *testing.T) {
+	os.Setenv("GOTO_TEST_PROCESS_VAR", "from process")
+	defer os.Unsetenv("GOTO_TEST_PROCESS_VAR")
+	want := map[string]string{
+		"URI":              "mongodb://db.local:27017/app",
+		"QUOTED":           "db.local:27017",
+		"LITERAL":          "${HOST}",
+		"ESCAPED":          "cost $5 at ${HOST}",
+		"ESCAPED_UNQUOTED": "$HOME",
+		"DEFAULT":          "fallback",
+		"MISSING":          "[]",
+		"FROM_PROCESS":     "from process",
+	}
+	got := GetEnvHashFrFile("testdata/expand.env")
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	os.Setenv("SCAFFOLD_TEST_TOKEN_SEC", "secret")
+	defer os.Unsetenv("SCAFFOLD_TEST_TOKEN_SEC")
+	svc, err := NewService("scaffold-test", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Config.Listen != ":8080" || svc.Loader.Source("TokenSec") != SrcEnv {
+		t.Errorf("unexpected config %+v, sources %v", svc.Config, svc.Loader.Sources)
+	}
+	svc.Handle("/hello", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) })
+	ts := httptest.NewServer(svc.Mux)
+	defer ts.Close()
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"uid": "tester"}).SignedString([]byte("secret"))
+
+	get := func(path string, auth bool) (int, string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		if auth {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, _ := get("/healthz", false); code != http.StatusOK {
+		t.Errorf("healthz = %d", code)
+	}
+	if code, _ := get("/hello", false); code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated hello = %d", code)
+	}
+	if code, body := get("/hello", true); code != http.StatusOK || body != "hello" {
+		t.Errorf("hello = %d %q", code, body)
+	}
+	if _, body := get("/metrics", false); !strings.Contains(body, `http_requests_total{route="/hello",method="GET",code="401"} 1`) {
+		t.Errorf("metrics missing hello counter:\n%s", body)
+	}
+
+	hdr := http.Header{"Authorization": []string{"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; svc.Hub.Len() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	svc.Hub.Broadcast(map[string]string{"event": "test"})
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != `{"event":"test"}` {
+		t.Errorf("broadcast = %q, %v", msg, err)
+	}
+}
+
+func TestDebouncerStaleFire(t *testing.T) {
+	var runs int32
+	db := NewDebouncer(func() { atomic.AddInt32(&runs, 1) }, time.Hour)
+	db.Call()
+	stale := db.gen
+	db.Call()
+	// a fire of the replaced timer already on its way
+	db.fire(stale)
+	if n := atomic.LoadInt32(&runs); n != 0 {
+		t.Fatalf("stale fire ran fn %d times", n)
+	}
+	if !db.Flush() || atomic.LoadInt32(&runs) != 1 {
+		t.Fatal("stale fire cleared the pending call")
+	}
+	db.Call()
+	armed := db.gen
+	db.Stop()
+	db.fire(armed)
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("fire after Stop ran fn, %d runs", n)
+	}
+}
+
+func TestDebouncerRace(t *testing.T) {
+	var runs int32
+	db := NewDebouncer(func() { atomic.AddInt32(&runs, 1) }, time.Microsecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				db.Call()
+				if j%50 == 0 {
+					db.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	db.Stop()
+	// fn started before Stop may still be finishing
+	time.Sleep(10 * time.Millisecond)
+	n := atomic.LoadInt32(&runs)
+	db.Call()
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != n {
+		t.Error("fn ran after Stop")
+	}
+}
+
+func TestCORSCredentialsWildcard(t *testing.T) {
+	api := &API{}
+	h := api.CORS(CORSConfig{AllowOrigins: []string{"*", "https://*", "https://*.example.com"}, AllowCredentials: true})(
+		func(w http.ResponseWriter, r *http.Request) {})
+	for origin, want := range map[string]string{
+		"https://evil.test":          "",
+		"https://netops.example.com": "https://netops.example.com",
+	} {
+		req := httptest.NewRequest("GET", "/devices", nil)
+		req.Header.Set("Origin", origin)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("origin %s allowed as %q, want %q", origin, got, want)
+		}
+		if want == "" && rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("origin %s allowed credentials", origin)
+		}
+	}
+}
+
+type redactTestErr struct {
+	Host     string
+	Password string
+}
+
+func (e *redactTestErr) Error() string { return "login to " + e.Host + " with " + e.Password }
+func (e redactTestErr) String() string { return e.Host + ":" + e.Password }
+
+func TestRedactErrorStringer(t *testing.T) {
+	for _, v := range []interface{}{&redactTestErr{"r1", "hunter2"}, redactTestErr{"r1", "hunter2"}} {
+		if s := DebugString(map[string]interface{}{"detail": v}); strings.Contains(s, "hunter2") || !strings.Contains(s, "r1") {
+			t.Errorf("%T redacted as %s", v, s)
+		}
+	}
+	if s := DebugString(errors.New("plain")); s != `"plain"` {
+		t.Errorf("plain error redacted as %s", s)
+	}
+}
+
+func TestSessionClaimsBSON(t *testing.T) {
+	in := Session{ID: "s1", Claims: jwt.MapClaims{"sub": "ops", "roles": []string{"admin", "viewer"}, "exp": float64(2e9), "n": 3}}
+	b, err := bson.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Session
+	if err := bson.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Claims, err = jsonClaims(out.Claims); err != nil {
+		t.Fatal(err)
+	}
+	id := NewIdentity(out.Claims)
+	if !id.HasRole("admin") || id.Subject != "ops" || id.Expiry.Unix() != 2e9 {
+		t.Errorf("identity of the stored session %+v", id)
+	}
+	if err := HasRole("viewer").Check(out.Claims); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPolicyPatterns(t *testing.T) {
+	p := Policy{
+		"DELETE /devices":        {HasRole("admin")},
+		"DELETE /devices/*":      {HasRole("admin")},
+		"/devices/*":             {HasRole("viewer")},
+		"/inventory.Inventory/*": {HasRole("inventory")},
+	}
+	viewer := jwt.MapClaims{"roles": []interface{}{"viewer"}}
+	for _, c := range []struct {
+		method, route string
+		allowed       bool
+	}{
+		{"DELETE", "/devices", false},
+		{"DELETE", "/devices/42", false},
+		{"GET", "/devices/42", true},
+		{"GET", "/sites", true},
+		{"", "/inventory.Inventory/List", false},
+	} {
+		if err := p.check(viewer, c.method, c.route); (err == nil) != c.allowed {
+			t.Errorf("%s %s allowed %t, want %t", c.method, c.route, err == nil, c.allowed)
+		}
+	}
+}
+
+func TestDeletedFilter(t *testing.T) {
+	since := map[string]interface{}{"$gte": time.Unix(0, 0)}
+	f := deletedFilter(map[string]interface{}{"site": "yyz", SoftDeletedAt: since})
+	if got, ok := f[SoftDeletedAt].(map[string]interface{}); !ok || got["$gte"] == nil {
+		t.Errorf("deletedAt condition of the caller replaced by %v", f[SoftDeletedAt])
+	}
+	f = deletedFilter(map[string]interface{}{"site": "yyz"})
+	if got, ok := f[SoftDeletedAt].(map[string]interface{}); !ok || len(got) != 1 || f["site"] != "yyz" {
+		t.Errorf("filter %v, want site and deletedAt $ne nil", f)
+	}
+}
+
+func TestWSPeerPanicBusy(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWS(w, r, nil)
+		if err != nil {
+			return
+		}
+		p := NewWSPeer(ws)
+		p.MaxInflight = 1
+		p.Handle("panic", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			panic("boom")
+		})
+		p.Handle("block", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			entered <- struct{}{}
+			<-release
+			return nil, nil
+		})
+		p.Serve(r.Context())
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWSSession(conn)
+	defer ws.Close(websocket.CloseNormalClosure, "")
+	c := NewWSPeer(ws)
+	go c.Serve(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var we *WSError
+	if err := c.Call(ctx, "panic", nil, nil); !errors.As(err, &we) || we.Code != "INTERNAL" {
+		t.Errorf("panicking handler answered %v, want INTERNAL", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Call(ctx, "block", nil, nil) }()
+	<-entered
+	if err := c.Call(ctx, "block", nil, nil); !errors.As(err, &we) || we.Code != "BUSY" {
+		t.Errorf("request over MaxInflight answered %v, want BUSY", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListQueryTyped(t *testing.T) {
+	r := httptest.NewRequest("GET", "/devices?serial=00123&mtu[gte]=9000&up=true", nil)
+	q, err := ParseListQuery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := q.MongoFilter(); m["serial"].(bson.M)["$eq"] != "00123" || m["mtu"].(bson.M)["$gte"] != "9000" {
+		t.Errorf("untyped filter %v, want string values", m)
+	}
+	if err := q.Typed(map[string]reflect.Kind{"mtu": reflect.Int64, "up": reflect.Bool}); err != nil {
+		t.Fatal(err)
+	}
+	m := q.MongoFilter()
+	if m["serial"].(bson.M)["$eq"] != "00123" || m["mtu"].(bson.M)["$gte"] != int64(9000) || m["up"].(bson.M)["$eq"] != true {
+		t.Errorf("typed filter %v", m)
+	}
+	r = httptest.NewRequest("GET", "/devices?mtu=jumbo", nil)
+	if q, err = ParseListQuery(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Typed(map[string]reflect.Kind{"mtu": reflect.Int64}); !errors.Is(err, ErrBadInput) {
+		t.Errorf("invalid typed value: %v, want ErrBadInput", err)
+	}
+}
+
+func TestBloomMerge(t *testing.T) {
+	a, b := NewBloomFilter(100, 0.01), NewBloomFilter(100, 0.01)
+	a.AddString("r1")
+	b.AddString("r2")
+	if err := a.Merge(a); err != nil || a.Count() != 1 {
+		t.Errorf("self merge: %v, count %d", err, a.Count())
+	}
+	// opposite merges at once must not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); a.Merge(b) }()
+		go func() { defer wg.Done(); b.Merge(a) }()
+	}
+	wg.Wait()
+	if !a.TestString("r2") || !b.TestString("r1") {
+		t.Error("merged elements missing")
+	}
+	if err := a.Merge(NewBloomFilter(1000, 0.01)); err == nil {
+		t.Error("merged filters of different size")
+	}
+	var huge bytes.Buffer
+	huge.WriteString(bloomMagic)
+	binary.Write(&huge, binary.BigEndian, []uint64{1 << 62, 3, 0})
+	if _, err := new(BloomFilter).ReadFrom(&huge); err == nil {
+		t.Error("read a filter of 2^62 bits")
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := RetryPolicy{MaxAttempts: 5, Initial: time.Second}
+	p.OnRetry = func(int, error, time.Duration) { cancel() }
+	err := Retry(ctx, p, func() error { return ErrTimeout })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("retry stopped by ctx returned %v, want context.Canceled", err)
+	}
+}
+
+func TestLeakyBucketZeroRate(t *testing.T) {
+	lb := NewLeakyBucket(0, 1)
+	if lb.Allow() {
+		t.Error("zero rate bucket allowed an event")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lb.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("zero rate wait returned %v", err)
+	}
+}
+
+func TestListQueryHugePage(t *testing.T) {
+	for _, qs := range []string{"page=922337203685477581&per_page=20", "offset=9223372036854775807"} {
+		r := httptest.NewRequest("GET", "/devices?"+qs, nil)
+		if _, err := ParseListQuery(r); !errors.Is(err, ErrBadInput) {
+			t.Errorf("%s: %v, want ErrBadInput", qs, err)
+		}
+	}
+	q := ListQuery{Page: 1, PerPage: 20, Offset: -16}
+	if page, _ := q.ApplyMaps([]map[string]interface{}{{"name": "r1"}}); len(page) != 1 {
+		t.Errorf("negative offset page %v", page)
+	}
+}
+
+// testJWKS serves the RSA key as a JWKS and counts the fetches
+func testJWKS(t *testing.T, key *rsa.PrivateKey, fetches *int32) *httptest.Server {
+	return httptest.NewServer(jwksHandler(key, fetches))
+}
+
+// jwksHandler serves the RSA key as the JWKS of kid k1
+func jwksHandler(key *rsa.PrivateKey, fetches *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(fetches, 1)
+		time.Sleep(20 * time.Millisecond)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}
+}
+
+func TestJWKSIssuerAudience(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	ts := testJWKS(t, key, &fetches)
+	defer ts.Close()
+	api := &API{Keys: NewJWKS(ts.URL, "https://sso.test", "inventory", time.Hour)}
+	sign := func(c jwt.MapClaims) string {
+		c["exp"] = time.Now().Add(time.Minute).Unix()
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+		tok.Header["kid"] = "k1"
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	ok := sign(jwt.MapClaims{"iss": "https://sso.test", "aud": []interface{}{"inventory", "account"}, "typ": "Bearer"})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := api.parseToken(context.Background(), ok, TokenAccess); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("%d JWKS fetches, want 1", n)
+	}
+	for name, c := range map[string]jwt.MapClaims{
+		"other audience": {"iss": "https://sso.test", "aud": "billing"},
+		"other issuer":   {"iss": "https://evil.test", "aud": "inventory"},
+		"no audience":    {"iss": "https://sso.test"},
+	} {
+		if _, err := api.parseToken(context.Background(), sign(c), TokenAccess); err == nil {
+			t.Errorf("token of %s accepted", name)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	api := &API{TokenSec: []byte("secret")}
+	ctx := context.Background()
+	access, _ := api.IssueToken(jwt.MapClaims{"sub": "alice"}, time.Minute)
+	refresh, _ := api.IssueRefreshToken(jwt.MapClaims{"sub": "alice"}, time.Hour)
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}).SignedString(api.TokenSec)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice"}).SignedString([]byte("guess"))
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "typ": TokenRefresh}).SignedString(api.TokenSec)
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "alice"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if _, err := api.parseToken(ctx, access, TokenAccess); err != nil {
+		t.Error(err)
+	}
+	if _, err := api.parseToken(ctx, refresh, TokenRefresh); err != nil {
+		t.Error(err)
+	}
+	for name, c := range map[string]struct{ raw, typ string }{
+		"expired":           {expired, TokenAccess},
+		"forged":            {forged, TokenAccess},
+		"unsigned":          {none, TokenAccess},
+		"refresh as access": {refresh, TokenAccess},
+		"access as refresh": {access, TokenRefresh},
+		"legacy refresh":    {legacy, TokenAccess},
+		"malformed":         {"not.a.token", TokenAccess},
+	} {
+		if _, err := api.parseToken(ctx, c.raw, c.typ); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
+
+func TestRefreshHandler(t *testing.T) {
+	api := &API{TokenSec: []byte("secret"), Revoker: NewMemoryRevoker(), Log: logger.WithField("test", "refresh")}
+	h := api.RefreshHandler(time.Minute)
+	refresh := func(body string) (*httptest.ResponseRecorder, TokenResponse) {
+		r := httptest.NewRequest("POST", "/token/refresh", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h(w, r)
+		var tr TokenResponse
+		json.NewDecoder(w.Body).Decode(&tr)
+		return w, tr
+	}
+	rt, _ := api.IssueRefreshToken(jwt.MapClaims{"sub": "alice", "roles": []string{"viewer"}}, time.Hour)
+	w, tr := refresh(`{"refresh_token":"` + rt + `"}`)
+	if w.Code != http.StatusOK || tr.AccessToken == "" || tr.RefreshToken == "" || tr.RefreshToken == rt {
+		t.Fatalf("refresh %d %+v, want a new access and refresh token", w.Code, tr)
+	}
+	claims, err := api.parseToken(context.Background(), tr.AccessToken, TokenAccess)
+	if err != nil || claims["sub"] != "alice" {
+		t.Errorf("refreshed access token %v %v", claims, err)
+	}
+	if w, _ := refresh(`{"refresh_token":"` + rt + `"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token answered %d, want 401", w.Code)
+	}
+	if w, _ := refresh(`{"refresh_token":"` + tr.RefreshToken + `"}`); w.Code != http.StatusOK {
+		t.Errorf("rotated refresh token answered %d", w.Code)
+	}
+	if w, _ := refresh(`{"refresh_token":`); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed body answered %d, want 400", w.Code)
+	}
+	if w, _ := refresh(`{"refresh_token":"` + tr.AccessToken + `"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("access token refreshed, %d", w.Code)
+	}
+}
+
+func TestCaptureMaxSize(t *testing.T) {
+	bundle := captureMagic + "\ndevice: r1\nlength: 9223372036854775807\n\n"
+	if _, err := NewCaptureReader(strings.NewReader(bundle)).Next(); !errors.Is(err, ErrBadInput) {
+		t.Errorf("oversized capture: %v, want ErrBadInput", err)
+	}
+}
+
+func TestBloomReadFromRace(t *testing.T) {
+	bf := NewBloomFilter(1000, 0.01)
+	small, _ := NewBloomFilter(10, 0.1).MarshalBinary()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() { defer wg.Done(); bf.UnmarshalBinary(small) }()
+		go func(i int) { defer wg.Done(); bf.AddString(strconv.Itoa(i)); bf.TestString("x") }(i)
+	}
+	wg.Wait()
+}
+
+// serveAuthed runs the request with the bearer token through the middleware
+func serveAuthed(mw func(http.HandlerFunc) http.HandlerFunc, r *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mw(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })(w, r)
+	return w
+}
+
+// failingRevoker is a TokenRevoker whose store is down
+type failingRevoker struct{}
+
+func (failingRevoker) Revoke(context.Context, string, time.Time) error {
+	return errors.New("store down")
+}
+func (failingRevoker) IsRevoked(context.Context, string) (bool, error) {
+	return false, errors.New("store down")
+}
+
+func TestTokenRevocation(t *testing.T) {
+	api := &API{TokenSec: []byte("secret"), Revoker: NewMemoryRevoker(), Log: logger.WithField("test", "revoke")}
+	tok, _ := api.IssueToken(jwt.MapClaims{"sub": "alice"}, time.Minute)
+	if w := serveAuthed(api.Auth, httptest.NewRequest("GET", "/devices", nil), tok); w.Code != http.StatusOK {
+		t.Fatalf("valid token answered %d", w.Code)
+	}
+	r := httptest.NewRequest("POST", "/logout", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	api.Auth(api.LogoutHandler)(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("logout answered %d", w.Code)
+	}
+	if w := serveAuthed(api.Auth, httptest.NewRequest("GET", "/devices", nil), tok); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token answered %d, want 401", w.Code)
+	}
+	api.Revoker = failingRevoker{}
+	if w := serveAuthed(api.Auth, httptest.NewRequest("GET", "/devices", nil), tok); w.Code != http.StatusUnauthorized {
+		t.Errorf("unavailable revoker answered %d, want 401", w.Code)
+	}
+	m := NewMemoryRevoker()
+	m.Revoke(context.Background(), "old", time.Now().Add(-time.Second))
+	if revoked, _ := m.IsRevoked(context.Background(), "old"); revoked {
+		t.Error("expired revocation still effective")
+	}
+}
+
+func TestAuthAPIKey(t *testing.T) {
+	api := &API{Log: logger.WithField("test", "apikey"), Policy: Policy{"/admin/*": {HasRole("admin")}}}
+	keys := StaticAPIKeys{
+		"good":     {Subject: "exporter", Roles: []string{"viewer"}},
+		"disabled": {Subject: "old", Disabled: true},
+		"expired":  {Subject: "temp", Expires: time.Now().Add(-time.Hour)},
+		"limited":  {Subject: "batch", Rate: 0.001, Burst: 1},
+	}
+	mw := api.AuthAPIKey(keys)
+	call := func(path, key string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			r.Header.Set(APIKeyHeader, key)
+		}
+		w := httptest.NewRecorder()
+		mw(func(w http.ResponseWriter, r *http.Request) {
+			if id, ok := IdentityFromContext(r.Context()); !ok || id.Subject == "" {
+				t.Error("no identity of the key")
+			}
+		})(w, r)
+		return w.Code
+	}
+	for _, c := range []struct {
+		path, key string
+		code      int
+	}{
+		{"/export", "good", http.StatusOK},
+		{"/export", "", http.StatusUnauthorized},
+		{"/export", "bad", http.StatusUnauthorized},
+		{"/export", "disabled", http.StatusUnauthorized},
+		{"/export", "expired", http.StatusUnauthorized},
+		{"/admin/users", "good", http.StatusForbidden},
+		{"/export", "limited", http.StatusOK},
+		{"/export", "limited", http.StatusTooManyRequests},
+	} {
+		if code := call(c.path, c.key); code != c.code {
+			t.Errorf("%s with key %q answered %d, want %d", c.path, c.key, code, c.code)
+		}
+	}
+	// a raised limit applies to the next request
+	keys["limited"] = APIKeyInfo{Subject: "batch", Rate: 0.001, Burst: 2}
+	if code := call("/export", "limited"); code != http.StatusOK {
+		t.Errorf("key of a raised limit answered %d", code)
+	}
+}
+
+func TestOIDCFlow(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		fetches  int32
+		idClaims jwt.MapClaims
+	)
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": ts.URL, "authorization_endpoint": ts.URL + "/auth",
+			"token_endpoint": ts.URL + "/token", "jwks_uri": ts.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", jwksHandler(key, &fetches))
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code1" || r.FormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+		tok.Header["kid"] = "k1"
+		s, _ := tok.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": s})
+	})
+	api := &API{TokenSec: []byte("secret"), Log: logger.WithField("test", "oidc")}
+	o := NewOIDC(api, ts.URL, "netops", "", "https://netops.test/cb")
+	if err := o.Discover(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// login returns the state cookie, the state and the nonce sent to the provider
+	login := func() (*http.Cookie, string, string) {
+		w := httptest.NewRecorder()
+		o.LoginHandler(w, httptest.NewRequest("GET", "/auth/login", nil))
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || w.Code != http.StatusFound {
+			t.Fatalf("login answered %d %s", w.Code, w.Header().Get("Location"))
+		}
+		return w.Result().Cookies()[0], u.Query().Get("state"), u.Query().Get("nonce")
+	}
+	callback := func(c *http.Cookie, state string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/auth/callback?code=code1&state="+state, nil)
+		r.AddCookie(c)
+		w := httptest.NewRecorder()
+		o.CallbackHandler(w, r)
+		return w
+	}
+	idFor := func(nonce string) jwt.MapClaims {
+		return jwt.MapClaims{"iss": ts.URL, "aud": "netops", "sub": "alice", "nonce": nonce,
+			"exp": time.Now().Add(time.Minute).Unix()}
+	}
+	c, state, nonce := login()
+	idClaims = idFor(nonce)
+	w := callback(c, state)
+	var tr TokenResponse
+	json.NewDecoder(w.Body).Decode(&tr)
+	if w.Code != http.StatusOK {
+		t.Fatalf("callback answered %d", w.Code)
+	}
+	if claims, err := api.parseToken(context.Background(), tr.AccessToken, TokenAccess); err != nil || claims["sub"] != "alice" {
+		t.Errorf("internal token %v %v", claims, err)
+	}
+	for name, c := range map[string]struct {
+		mutate func(id jwt.MapClaims, state *string)
+		code   int
+	}{
+		"state mismatch": {func(id jwt.MapClaims, state *string) { *state = "forged" }, http.StatusBadRequest},
+		"nonce mismatch": {func(id jwt.MapClaims, state *string) { id["nonce"] = "replayed" }, http.StatusUnauthorized},
+		"other audience": {func(id jwt.MapClaims, state *string) { id["aud"] = "billing" }, http.StatusUnauthorized},
+		"expired":        {func(id jwt.MapClaims, state *string) { id["exp"] = time.Now().Add(-time.Minute).Unix() }, http.StatusUnauthorized},
+	} {
+		ck, state, nonce := login()
+		idClaims = idFor(nonce)
+		c.mutate(idClaims, &state)
+		if w := callback(ck, state); w.Code != c.code {
+			t.Errorf("%s answered %d, want %d", name, w.Code, c.code)
+		}
+	}
+}
+
+func TestAuthSignature(t *testing.T) {
+	api := &API{Log: logger.WithField("test", "signing")}
+	secret := []byte("webhook secret")
+	mw := api.AuthSignature(func(id string) ([]byte, bool) { return secret, id == "netbox" }, time.Minute)
+	serve := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		mw(func(w http.ResponseWriter, r *http.Request) {
+			if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"event":"update"}` {
+				t.Errorf("signed body %q not restored", b)
+			}
+		})(w, r)
+		return w.Code
+	}
+	signed := func(key string) *http.Request {
+		r := httptest.NewRequest("POST", "/hooks/netbox?site=yyz", strings.NewReader(`{"event":"update"}`))
+		if err := SignRequest(r, key, secret); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r := signed("netbox")
+	replayed := r.Clone(r.Context())
+	replayed.Body = ioutil.NopCloser(strings.NewReader(`{"event":"update"}`))
+	if code := serve(r); code != http.StatusOK {
+		t.Fatalf("signed request answered %d", code)
+	}
+	if code := serve(replayed); code != http.StatusUnauthorized {
+		t.Errorf("replayed signature answered %d, want 401", code)
+	}
+	tampered := signed("netbox")
+	tampered.Body = ioutil.NopCloser(strings.NewReader(`{"event":"delete"}`))
+	stale := signed("netbox")
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	stale.Header.Set(SignatureTSHeader, ts)
+	stale.Header.Set(SignatureHeader, signPayload(secret, ts, "POST", "/hooks/netbox?site=yyz", []byte(`{"event":"update"}`)))
+	moved := signed("netbox")
+	moved.URL.RawQuery = "site=lax"
+	for name, r := range map[string]*http.Request{
+		"tampered body": tampered,
+		"unknown key":   signed("other"),
+		"stale":         stale,
+		"other query":   moved,
+	} {
+		if code := serve(r); code != http.StatusUnauthorized {
+			t.Errorf("%s answered %d, want 401", name, code)
+		}
+	}
+}
+
+// testCert writes a P-256 key pair signed by ca, self-signed if ca is nil,
+// to dir/name.crt and dir/name.key
+func testCert(t *testing.T, dir, name string, ca *tls.Certificate, tmpl *x509.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, signer := tmpl, interface{}(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(dir+"/"+name+".crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(dir+"/"+name+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestMTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := testCert(t, dir, "ca", nil, &x509.Certificate{IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	testCert(t, dir, "server", ca, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	spiffe := func(s string) []*url.URL { u, _ := url.Parse(s); return []*url.URL{u} }
+	clientUsage := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	testCert(t, dir, "agent", ca, &x509.Certificate{URIs: spiffe("spiffe://netops/agent"), ExtKeyUsage: clientUsage})
+	testCert(t, dir, "other", ca, &x509.Certificate{URIs: spiffe("spiffe://other/agent"), ExtKeyUsage: clientUsage})
+
+	cfg, err := NewServerTLSConfig(dir+"/server.crt", dir+"/server.key", dir+"/ca.crt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	VerifySANs(cfg, "spiffe://netops/*")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go srv.Serve(ln)
+	defer srv.Close()
+	get := func(client string) error {
+		cert, key := "", ""
+		if client != "" {
+			cert, key = dir+"/"+client+".crt", dir+"/"+client+".key"
+		}
+		ccfg, err := NewClientTLSConfig(cert, key, dir+"/ca.crt", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: ccfg}}
+		resp, err := c.Get("https://" + ln.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get("agent"); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if err := get(""); err == nil {
+		t.Error("client without certificate accepted")
+	}
+	if err := get("other"); err == nil {
+		t.Error("client of SAN spiffe://other/agent accepted")
+	}
+
+	cr, err := NewCertReloader(dir+"/agent.crt", dir+"/agent.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { CertReloadInterval = d }(CertReloadInterval)
+	CertReloadInterval = 0
+	renewed := testCert(t, dir, "agent", ca, &x509.Certificate{URIs: spiffe("spiffe://netops/agent"), ExtKeyUsage: clientUsage})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/agent.crt", later, later)
+	if got := cr.Certificate(); !bytes.Equal(got.Certificate[0], renewed.Certificate[0]) {
+		t.Error("renewed key pair not reloaded")
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	defer func(d time.Duration) { LoginFailDelay = d }(LoginFailDelay)
+	LoginFailDelay = time.Millisecond
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	users := map[string]string{"alice": string(hash)}
+	verifier := CredentialFunc(func(ctx context.Context, username, password string) (jwt.MapClaims, error) {
+		h, ok := users[username]
+		if !ok {
+			return nil, ErrUnauthorized.Wrap(fmt.Errorf("unknown user %s", username))
+		}
+		if bcrypt.CompareHashAndPassword([]byte(h), []byte(password)) != nil {
+			return nil, ErrUnauthorized.Wrap(fmt.Errorf("wrong password of %s", username))
+		}
+		return jwt.MapClaims{"roles": []string{"viewer"}}, nil
+	})
+	api := &API{TokenSec: []byte("secret"), Log: logger.WithField("test", "login"), MaxBody: 256}
+	h := api.LoginHandler(verifier)
+	login := func(method, body string) (int, TokenResponse) {
+		r := httptest.NewRequest(method, "/login", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h(w, r)
+		var tr TokenResponse
+		json.NewDecoder(w.Body).Decode(&tr)
+		return w.Code, tr
+	}
+	code, tr := login("POST", `{"username":"alice","password":"s3cret"}`)
+	if code != http.StatusOK {
+		t.Fatalf("login answered %d", code)
+	}
+	if claims, err := api.parseToken(context.Background(), tr.AccessToken, TokenAccess); err != nil || claims["sub"] != "alice" {
+		t.Errorf("login token %v %v", claims, err)
+	}
+	for _, c := range []struct {
+		method, body string
+		code         int
+	}{
+		{"POST", `{"username":"alice","password":"guess"}`, http.StatusUnauthorized},
+		{"POST", `{"username":"mallory","password":"s3cret"}`, http.StatusUnauthorized},
+		{"POST", `{"username":"","password":"s3cret"}`, http.StatusBadRequest},
+		{"POST", `{"username":`, http.StatusBadRequest},
+		{"POST", `{"username":"alice","password":"` + strings.Repeat("x", 512) + `"}`, http.StatusRequestEntityTooLarge},
+		{"GET", ``, http.StatusMethodNotAllowed},
+	} {
+		if code, tr := login(c.method, c.body); code != c.code || tr.AccessToken != "" {
+			t.Errorf("%s %s answered %d, want %d", c.method, c.body, code, c.code)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	api := &API{Log: logger.WithField("test", "ratelimit")}
+	call := func(mw Middleware, sub, remote, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/devices", nil)
+		r.RemoteAddr = remote + ":40000"
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if sub != "" {
+			r = r.WithContext(ContextWithClaims(r.Context(), jwt.MapClaims{"sub": sub}))
+		}
+		w := httptest.NewRecorder()
+		mw(func(w http.ResponseWriter, r *http.Request) {})(w, r)
+		return w
+	}
+	limit := api.RateLimit(RateLimitConfig{Rate: 0.001, Burst: 1})
+	if w := call(limit, "alice", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request answered %d", w.Code)
+	}
+	w := call(limit, "alice", "10.0.0.2", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("subject over the limit from another IP answered %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := call(limit, "bob", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Errorf("other subject of the same IP answered %d", w.Code)
+	}
+	// unauthenticated clients are limited by IP, X-Forwarded-For is untrusted
+	if w := call(limit, "", "10.0.0.3", "1.1.1.1"); w.Code != http.StatusOK {
+		t.Errorf("anonymous client answered %d", w.Code)
+	}
+	if w := call(limit, "", "10.0.0.3", "2.2.2.2"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed X-Forwarded-For bypassed the limit, %d", w.Code)
+	}
+	// behind a trusted proxy the entries prepended by the client are ignored
+	proxied := api.RateLimit(RateLimitConfig{Rate: 0.001, Burst: 1, By: RateByIP, TrustProxy: true})
+	if w := call(proxied, "", "10.9.9.9", "1.1.1.1, 203.0.113.7"); w.Code != http.StatusOK {
+		t.Errorf("proxied client answered %d", w.Code)
+	}
+	if w := call(proxied, "", "10.9.9.9", "6.6.6.6, 203.0.113.7"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("spoofed leftmost X-Forwarded-For bypassed the limit, %d", w.Code)
+	}
+	if w := call(proxied, "", "10.9.9.9", "203.0.113.8"); w.Code != http.StatusOK {
+		t.Errorf("other proxied client answered %d", w.Code)
+	}
+}
+
+func TestClient(t *testing.T) {
+	var posts, gets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer tok1":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/api/devices/r1":
+			json.NewEncoder(w).Encode(map[string]string{"name": "r1", "q": r.URL.Query().Get("view")})
+		case r.URL.Path == "/api/flaky" && r.Method == "GET":
+			if atomic.AddInt32(&gets, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		case r.URL.Path == "/api/flaky":
+			atomic.AddInt32(&posts, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no such device"})
+		}
+	}))
+	defer ts.Close()
+	c := NewClient(ts.URL+"/api/",
+		ClientRetry(RetryPolicy{MaxAttempts: 3, Initial: time.Millisecond}),
+		ClientToken(func(context.Context) (string, error) { return "tok1", nil }))
+	ctx := context.Background()
+	var dev map[string]string
+	if err := c.Get(ctx, "/devices/r1", &dev, WithQuery(url.Values{"view": {"full"}})); err != nil || dev["name"] != "r1" || dev["q"] != "full" {
+		t.Errorf("get %v %v", dev, err)
+	}
+	err := c.Get(ctx, "devices/r9", nil)
+	var he *HTTPError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &he) || he.Message != "no such device" {
+		t.Errorf("404 returned %v", err)
+	}
+	if err := c.Get(ctx, "/flaky", nil); err != nil || atomic.LoadInt32(&gets) != 3 {
+		t.Errorf("GET retried %d times: %v", gets, err)
+	}
+	if err := c.Post(ctx, "/flaky", map[string]int{"n": 1}, nil); err == nil || atomic.LoadInt32(&posts) != 1 {
+		t.Errorf("POST sent %d times: %v, want once", posts, err)
+	}
+	if err := c.Post(ctx, "/flaky", nil, nil, Idempotent()); err == nil || atomic.LoadInt32(&posts) != 4 {
+		t.Errorf("idempotent POST sent %d times in all, want 4", posts)
+	}
+	anon := NewClient(ts.URL + "/api")
+	if err := anon.Get(ctx, "/devices/r1", nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("request without token returned %v", err)
+	}
+	// the token isn't sent outside the base url
+	leak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request outside the base url with %q", r.Header.Get("Authorization"))
+	}))
+	defer leak.Close()
+	if err := c.Get(ctx, leak.URL+"/devices/r1", nil); !errors.Is(err, ErrBadInput) {
+		t.Errorf("absolute url of another host returned %v", err)
+	}
+	if err := c.Get(ctx, ts.URL+"/api/devices/r1", &dev); err != nil {
+		t.Errorf("absolute url of the base host: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/sync", nil)
+	r.Header.Set("Authorization", "Bearer tok1")
+	if err := ApiPost(r, ts.URL+"/api/devices/r1", map[string]string{}, &dev); err != nil {
+		t.Errorf("forwarded authorization: %v", err)
+	}
+}
+
+// offlineMongo is a MongoOpr of an unreachable server, its operations fail
+// once the server selection times out
+func offlineMongo(t *testing.T) *MongoOpr {
+	c, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Disconnect(context.Background()) })
+	db := &MongoOpr{Mdb: c.Database("test")}
+	return db.Collection("devices")
+}
+
+func TestMongoWrite(t *testing.T) {
+	u, err := updateDoc(map[string]interface{}{"status": "up"})
+	if err != nil || u.Lookup("$set", "status").StringValue() != "up" {
+		t.Errorf("plain fields update %v, %v", u, err)
+	}
+	u, err = updateDoc(map[string]interface{}{"$inc": bson.M{"flaps": 1}})
+	if err != nil || u.Lookup("$inc", "flaps").Int32() != 1 || len(u.Lookup("$set").Value) != 0 {
+		t.Errorf("operators update %v, %v", u, err)
+	}
+	for _, bad := range []map[string]interface{}{nil, {"status": "up", "$inc": bson.M{"flaps": 1}}} {
+		if _, err := updateDoc(bad); !errors.Is(err, ErrBadInput) {
+			t.Errorf("update %v: %v, want ErrBadInput", bad, err)
+		}
+	}
+
+	db := offlineMongo(t)
+	db.Audit = true
+	ctx := ContextWithClaims(context.Background(), jwt.MapClaims{"sub": "ops"})
+	u, err = db.auditUpdate(ctx, map[string]interface{}{"status": "up"})
+	if err != nil || u.Lookup("$set", AuditUpdatedBy).StringValue() != "ops" ||
+		len(u.Lookup("$setOnInsert", AuditCreatedAt).Value) == 0 || u.Lookup("$set", "status").StringValue() != "up" {
+		t.Errorf("audited update %v, %v", u, err)
+	}
+	// the invalid input is rejected before reaching the server
+	if _, err := db.UpdateMany(ctx, nil, map[string]interface{}{"status": "up", "$unset": bson.M{"x": ""}}); !errors.Is(err, ErrBadInput) {
+		t.Errorf("mixed update: %v, want ErrBadInput", err)
+	}
+	if _, err := db.DeleteMany(ctx, nil); !errors.Is(err, ErrBadInput) {
+		t.Errorf("empty delete filter: %v, want ErrBadInput", err)
+	}
+	if ids, err := db.InsertMany(ctx, nil); ids != nil || err != nil {
+		t.Errorf("empty insert %v, %v", ids, err)
+	}
+	if _, err := db.InsertOne(ctx, bson.M{"name": "r1"}); err == nil {
+		t.Error("insert without server succeeded")
+	}
+
+	dup := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key"}}}
+	for _, c := range []struct {
+		err  error
+		want error
+	}{
+		{mongo.ErrNoDocuments, ErrNotFound},
+		{dup, ErrConflict},
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: dup.WriteErrors[0]}}}, ErrConflict},
+		{fmt.Errorf("find: %w", context.DeadlineExceeded), ErrTimeout},
+	} {
+		if err := mongoErr(c.err); !errors.Is(err, c.want) {
+			t.Errorf("mongoErr(%v) = %v, want %v", c.err, err, c.want)
+		}
+	}
+}
+
+func TestMongoOpCtx(t *testing.T) {
+	db := &MongoOpr{Timeout: time.Minute}
+	ctx, cancel := db.opCtx(context.Background())
+	dl, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(dl) > time.Minute || time.Until(dl) < 50*time.Second {
+		t.Errorf("deadline %v, want Timeout from now", dl)
+	}
+	parent, stop := context.WithTimeout(context.Background(), time.Hour)
+	defer stop()
+	if ctx, cancel = db.opCtx(parent); ctx != parent {
+		t.Error("deadline of the caller replaced")
+	}
+	cancel()
+	// nil falls back to the deprecated Mctx
+	gone, abort := context.WithCancel(context.Background())
+	abort()
+	db.Mctx = gone
+	ctx, cancel = db.opCtx(nil)
+	defer cancel()
+	if ctx.Err() == nil {
+		t.Error("Mctx not used for a nil context")
+	}
+
+	off := offlineMongo(t)
+	off.Timeout = time.Hour
+	start := time.Now()
+	if _, err := off.Count(gone, nil); err == nil || time.Since(start) > time.Second {
+		t.Errorf("count of a cancelled context %v after %v", err, time.Since(start))
+	}
+}
+
+func TestMongoStages(t *testing.T) {
+	sort, ok := SortStage("-count", "_id")["$sort"].(bson.D)
+	if !ok || !reflect.DeepEqual(sort, bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}) {
+		t.Errorf("sort stage %v", sort)
+	}
+	g := GroupStage("$vendor", map[string]interface{}{"count": Sum(1)})["$group"].(map[string]interface{})
+	if g["_id"] != "$vendor" || !reflect.DeepEqual(g["count"], map[string]interface{}{"$sum": 1}) {
+		t.Errorf("group stage %v", g)
+	}
+	u := UnwindStage("$ports", true)["$unwind"].(map[string]interface{})
+	if u["path"] != "$ports" || u["preserveNullAndEmptyArrays"] != true {
+		t.Errorf("unwind stage %v", u)
+	}
+
+	db := offlineMongo(t)
+	var rows []bson.M
+	if err := db.Aggregate(context.Background(), &rows, nil); !errors.Is(err, ErrBadInput) {
+		t.Errorf("empty pipeline: %v, want ErrBadInput", err)
+	}
+	two := map[string]interface{}{"$match": bson.M{}, "$limit": 1}
+	if err := db.Aggregate(context.Background(), &rows, []map[string]interface{}{LimitStage(5), two}); !errors.Is(err, ErrBadInput) {
+		t.Errorf("stage of two operators: %v, want ErrBadInput", err)
+	}
+}
+
+func TestMongoCursor(t *testing.T) {
+	doc, _ := bson.Marshal(bson.M{"_id": "r7", "state": bson.M{"updated": int64(42)}})
+	tok, err := encodeCursor(doc, "state.updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := decodeCursor(tok)
+	if err != nil || c.ID.StringValue() != "r7" || c.Value.Int64() != 42 {
+		t.Errorf("cursor %+v, %v", c, err)
+	}
+	// a missing sort field is null, so the nulls last of a descending
+	// order are reached and the nulls first of an ascending one are left
+	noField, _ := bson.Marshal(bson.M{"_id": "r8"})
+	tok, err = encodeCursor(noField, "state.updated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err = decodeCursor(tok); err != nil {
+		t.Fatal(err)
+	}
+	if f := c.after("state.updated", true); f["state.updated"] != nil || f["_id"] == nil {
+		t.Errorf("descending filter after null %v", f)
+	}
+	if f, _ := bson.Marshal(c.after("state.updated", false)); bson.Raw(f).Lookup("$or", "0", "state.updated", "$ne").Type != bsontype.Null {
+		t.Errorf("ascending filter after null %v", f)
+	}
+	// the client can't smuggle query operators in a cursor
+	for _, v := range []interface{}{bson.M{"$ne": nil}, bson.A{"r1"}} {
+		b, _ := bson.Marshal(bson.M{"id": "r7", "v": v})
+		if _, err := decodeCursor(base64.RawURLEncoding.EncodeToString(b)); !errors.Is(err, ErrBadInput) {
+			t.Errorf("cursor value %v: %v, want ErrBadInput", v, err)
+		}
+	}
+	b, _ := bson.Marshal(bson.M{"id": bson.M{"$gt": ""}})
+	if _, err := decodeCursor(base64.RawURLEncoding.EncodeToString(b)); !errors.Is(err, ErrBadInput) {
+		t.Errorf("cursor _id operator: %v, want ErrBadInput", err)
+	}
+	noID, _ := bson.Marshal(bson.M{"name": "r7"})
+	if _, err := encodeCursor(noID, "_id"); !errors.Is(err, ErrBadInput) {
+		t.Errorf("document without _id: %v, want ErrBadInput", err)
+	}
+	for _, bad := range []string{"%%", base64.RawURLEncoding.EncodeToString([]byte("not bson"))} {
+		if _, err := decodeCursor(bad); !errors.Is(err, ErrBadInput) {
+			t.Errorf("cursor %q: %v, want ErrBadInput", bad, err)
+		}
+	}
+
+	db := offlineMongo(t)
+	var one bson.M
+	if _, err := db.GetPage(context.Background(), &one, nil, nil, "", 10, ""); !errors.Is(err, ErrBadInput) {
+		t.Errorf("res not a slice: %v, want ErrBadInput", err)
+	}
+	var devs []bson.M
+	if _, err := db.GetPage(context.Background(), &devs, nil, nil, "-updated", 10, "%%"); !errors.Is(err, ErrBadInput) {
+		t.Errorf("invalid cursor: %v, want ErrBadInput", err)
+	}
+}
+
+// countingTokens counts the loads of the resume token, one per stream opened
+type countingTokens struct {
+	*MemoryResumeTokens
+	loads int32
+}
+
+func (c *countingTokens) LoadResumeToken(ctx context.Context, key string) (bson.Raw, error) {
+	atomic.AddInt32(&c.loads, 1)
+	return c.MemoryResumeTokens.LoadResumeToken(ctx, key)
+}
+
+func TestMongoWatch(t *testing.T) {
+	m := NewMemoryResumeTokens()
+	if tok, err := m.LoadResumeToken(context.Background(), "hub"); tok != nil || err != nil {
+		t.Errorf("token of an unknown key %v, %v", tok, err)
+	}
+	saved, _ := bson.Marshal(bson.M{"_data": "8263"})
+	m.SaveResumeToken(context.Background(), "hub", saved)
+	if tok, _ := m.LoadResumeToken(context.Background(), "hub"); !bytes.Equal(tok, saved) {
+		t.Errorf("token %v, want %v", tok, saved)
+	}
+
+	// the stream is reopened after each failure until ctx is done
+	store := &countingTokens{MemoryResumeTokens: m}
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+	err := offlineMongo(t).Watch(ctx, nil, func(ChangeEvent) error {
+		t.Error("event without server")
+		return nil
+	}, WatchResume(store, "hub"), WatchBackoff(RetryPolicy{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("watch ended by %v, want the deadline", err)
+	}
+	if n := atomic.LoadInt32(&store.loads); n < 2 {
+		t.Errorf("stream opened %d times, want reopened", n)
+	}
+}
+
+func TestMongoTransaction(t *testing.T) {
+	db := offlineMongo(t)
+	ran := false
+	err := db.WithTransaction(context.Background(), func(sc mongo.SessionContext) error {
+		ran = true
+		if mongo.SessionFromContext(sc) == nil {
+			t.Error("fn called without session")
+		}
+		if _, ok := sc.Deadline(); !ok {
+			t.Error("transaction not bounded by Timeout")
+		}
+		return ErrConflict.Wrap(errors.New("job already done"))
+	})
+	if !ran || !errors.Is(err, ErrConflict) {
+		t.Errorf("error of fn returned as %v", err)
+	}
+	err = db.WithSession(context.Background(), func(sc mongo.SessionContext) error {
+		return ErrNotFound
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("error of the session fn returned as %v", err)
+	}
+}
+
+func TestMongoBulk(t *testing.T) {
+	db := offlineMongo(t)
+	ctx := context.Background()
+	if res, err := db.BulkWrite(ctx, nil, true); err != nil || res == nil {
+		t.Errorf("empty bulk %v, %v", res, err)
+	}
+	for _, op := range []BulkOp{
+		{Kind: BulkInsert},
+		{Kind: BulkReplace, Filter: map[string]interface{}{"_id": "r1"}},
+		{Kind: BulkDelete},
+		{Kind: BulkUpdate, Filter: map[string]interface{}{"_id": "r1"}},
+		{Kind: "merge"},
+	} {
+		ops := []BulkOp{{Kind: BulkInsert, Doc: bson.M{"_id": "r0"}}, op}
+		if _, err := db.BulkWrite(ctx, ops, false); !errors.Is(err, ErrBadInput) || !strings.Contains(err.Error(), "bulk op 1") {
+			t.Errorf("op %+v: %v, want ErrBadInput of op 1", op, err)
+		}
+	}
+	del := BulkOp{Kind: BulkDelete, Filter: map[string]interface{}{"_id": "r1"}, Many: true}
+	if m, _ := del.model(ctx, db); reflect.TypeOf(m) != reflect.TypeOf(&mongo.DeleteManyModel{}) {
+		t.Errorf("delete model %T", m)
+	}
+	db.SoftDelete = true
+	if m, _ := del.model(ctx, db); reflect.TypeOf(m) != reflect.TypeOf(&mongo.UpdateManyModel{}) {
+		t.Errorf("soft delete model %T, want an update", m)
+	}
+	if _, err := db.BulkWrite(ctx, []BulkOp{del}, true); err == nil {
+		t.Error("bulk without server succeeded")
+	}
+}
+
+func TestMongoIndexDiff(t *testing.T) {
+	s := IndexSpec{Keys: []string{"site", "-updated"}}
+	keys, name := s.keys()
+	if name != "site_1_updated_-1" || !reflect.DeepEqual(keys, bson.D{{Key: "site", Value: 1}, {Key: "updated", Value: -1}}) {
+		t.Errorf("keys %v, name %s", keys, name)
+	}
+	// the listing numbers are doubles or int32
+	ix := existingIndex{Name: name, Key: bson.D{{Key: "site", Value: float64(1)}, {Key: "updated", Value: int32(-1)}}}
+	if r := ix.diff(s, keys); r != "" {
+		t.Errorf("same index differs: %s", r)
+	}
+	ttl := IndexSpec{Keys: []string{"expires"}, TTL: time.Hour}
+	tk, _ := ttl.keys()
+	ix = existingIndex{Key: tk, TTL: int32(60)}
+	if r := ix.diff(ttl, tk); r != "expireAfterSeconds is 60" {
+		t.Errorf("ttl diff %q", r)
+	}
+	ix = existingIndex{Key: keys, Unique: true, Partial: bson.M{"deletedAt": nil}}
+	if r := ix.diff(s, tk); r != "keys differ, unique is true, partial filter differs" {
+		t.Errorf("diff %q", r)
+	}
+	partial := IndexSpec{Keys: []string{"email"}, Unique: true, Partial: map[string]interface{}{"deletedAt": nil}}
+	pk, _ := partial.keys()
+	ix = existingIndex{Key: pk, Unique: true, Partial: bson.M{"deletedAt": nil}}
+	if r := ix.diff(partial, pk); r != "" {
+		t.Errorf("same partial index differs: %s", r)
+	}
+}
+
+func TestMongoCount(t *testing.T) {
+	db := offlineMongo(t)
+	ctx := context.Background()
+	if _, err := db.Distinct(ctx, "", nil); !errors.Is(err, ErrBadInput) {
+		t.Errorf("empty distinct field: %v, want ErrBadInput", err)
+	}
+	bad := map[string]interface{}{"site": make(chan int)}
+	if _, err := db.Count(ctx, bad); !errors.Is(err, ErrBadInput) {
+		t.Errorf("count filter not encodable: %v, want ErrBadInput", err)
+	}
+	if ok, err := db.Exists(ctx, map[string]interface{}{"site": "yyz"}); ok || err == nil {
+		t.Errorf("exists without server %t, %v", ok, err)
+	}
+}
+
+func TestMongoFile(t *testing.T) {
+	db := offlineMongo(t)
+	if _, err := db.PutFile(context.Background(), "", strings.NewReader("cfg"), nil); !errors.Is(err, ErrBadInput) {
+		t.Errorf("empty file name: %v, want ErrBadInput", err)
+	}
+	// GridFS only knows deadlines, the reads stop once ctx is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	r := ctxReader{ctx, strings.NewReader("hostname r1")}
+	p := make([]byte, 4)
+	if n, err := r.Read(p); n != 4 || err != nil {
+		t.Errorf("read %d, %v", n, err)
+	}
+	cancel()
+	if _, err := r.Read(p); !errors.Is(err, context.Canceled) {
+		t.Errorf("read after cancel: %v", err)
+	}
+	if f, err := db.PutFile(ctx, "r1.cfg", strings.NewReader("hostname r1"), nil); f != nil || err == nil {
+		t.Errorf("upload without server %v, %v", f, err)
+	}
+}
+
+func TestConnectMongo(t *testing.T) {
+	ctx := context.Background()
+	for _, uri := range []string{"http://127.0.0.1:1/inventory", "mongodb://127.0.0.1:1"} {
+		if _, err := ConnectMongo(ctx, uri, nil); !errors.Is(err, ErrBadInput) {
+			t.Errorf("uri %s: %v, want ErrBadInput", uri, err)
+		}
+	}
+	start := time.Now()
+	_, err := ConnectMongo(ctx, "mongodb://127.0.0.1:1", &MongoOptions{Database: "inventory", ServerSelection: 100 * time.Millisecond})
+	if err == nil || errors.Is(err, ErrBadInput) || time.Since(start) > 2*time.Second {
+		t.Errorf("connect to no server: %v after %v", err, time.Since(start))
+	}
+	if err := offlineMongo(t).Ping(ctx); err == nil {
+		t.Error("ping without server succeeded")
+	}
+}
+
+func TestServeHTTP2Default(t *testing.T) {
+	if newServeConfig(nil).http2 {
+		t.Error("HTTP/2, and h2c over cleartext, enabled by default")
+	}
+	if !newServeConfig([]ServeOption{ServeHTTP2(true)}).http2 {
+		t.Error("ServeHTTP2 ignored")
+	}
+}
+
+func TestSecureStringCharset(t *testing.T) {
+	for _, c := range []struct {
+		n       int
+		charset string
+	}{{8, ""}, {-1, "ab"}} {
+		if _, err := SecureStringWithCharset(c.n, c.charset); !errors.Is(err, ErrBadInput) {
+			t.Errorf("length %d charset %q: %v, want ErrBadInput", c.n, c.charset, err)
+		}
+	}
+	if s, err := SecureStringWithCharset(16, "ab"); err != nil || len(s) != 16 || strings.Trim(s, "ab") != "" {
+		t.Errorf("string %q, %v", s, err)
+	}
+}
+
+func TestLimiterEdges(t *testing.T) {
+	tb := NewTokenBucket(0, 1)
+	tb.Allow()
+	if d := tb.Delay(); d >= 0 {
+		t.Errorf("empty zero rate bucket delay %v, want never", d)
+	}
+
+	sw := NewSlidingWindow(3, 0)
+	for i := 0; i < 3; i++ {
+		if !sw.Allow() {
+			t.Fatalf("event %d of a zero window refused", i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sw.Wait(ctx); err != nil {
+		t.Errorf("wait of a clamped window: %v", err)
+	}
+	start := time.Now()
+	if err := NewSlidingWindow(0, time.Minute).Wait(ctx); !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("zero limit wait: %v", err)
+	}
+
+	kl := NewKeyedLimiter(func() Limiter { return NewTokenBucket(1, 1) })
+	kl.Idle = 10 * time.Millisecond
+	a := kl.Get("a")
+	time.Sleep(30 * time.Millisecond)
+	kl.Get("b")
+	if len(kl.lim) != 1 || kl.Get("a") == a {
+		t.Errorf("idle key kept, %d limiters", len(kl.lim))
+	}
+}
+
+func TestGrpcPoolZero(t *testing.T) {
+	var p GrpcPool
+	cc, err := p.Get(context.Background(), "passthrough:///127.0.0.1:1")
+	if err != nil || cc == nil {
+		t.Fatalf("get of the zero pool %v, %v", cc, err)
+	}
+	if again, _ := p.Get(context.Background(), "passthrough:///127.0.0.1:1"); again != cc {
+		t.Error("single connection not shared")
+	}
+	p.Close()
+	if _, err := p.Get(context.Background(), "passthrough:///127.0.0.1:1"); err != ErrGrpcPoolClosed {
+		t.Errorf("get after close: %v", err)
+	}
+	var unused GrpcPool
+	unused.Close()
+}
+
+func TestWSPeerErrorDetail(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := UpgradeWS(w, r, nil)
+		if err != nil {
+			return
+		}
+		p := NewWSPeer(ws)
+		p.Handle("plain", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			return nil, errors.New("dial tcp 10.0.0.7:5432: connection refused")
+		})
+		p.Handle("coded", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+			return nil, ErrNotFound.Wrap(errors.New("device r9"))
+		})
+		p.Serve(r.Context())
+	}))
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := NewWSSession(conn)
+	defer ws.Close(websocket.CloseNormalClosure, "")
+	c := NewWSPeer(ws)
+	go c.Serve(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var we *WSError
+	if err := c.Call(ctx, "plain", nil, nil); !errors.As(err, &we) || we.Code != "INTERNAL" || strings.Contains(we.Message, "10.0.0.7") {
+		t.Errorf("plain error answered %v", err)
+	}
+	if err := c.Call(ctx, "coded", nil, nil); !errors.As(err, &we) || we.Code != ErrCode(ErrNotFound) {
+		t.Errorf("coded error answered %v", err)
+	}
+}
+
+func TestAuthSSEToken(t *testing.T) {
+	api := &API{TokenSec: []byte("secret"), Log: logger.WithField("test", "sse")}
+	tok, err := api.IssueToken(jwt.MapClaims{"sub": "ops"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := api.AuthSSE(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "access_token") || strings.Contains(r.RequestURI, "access_token") {
+			t.Errorf("token left in %s", r.RequestURI)
+		}
+		if r.URL.Query().Get("topic") != "alarms" {
+			t.Errorf("query %q", r.URL.RawQuery)
+		}
+	})
+	r := httptest.NewRequest("GET", "/events?topic=alarms&access_token="+tok, nil)
+	w := httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("token of the query answered %d", w.Code)
+	}
+	// the query token is dropped when the header authorizes
+	r = httptest.NewRequest("GET", "/events?topic=alarms&access_token=stale", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	h(httptest.NewRecorder(), r)
+
+	u, _ := url.Parse("/events?topic=alarms&access_token=" + tok)
+	if got := redactURI(u); strings.Contains(got, tok) || !strings.Contains(got, "topic=alarms") {
+		t.Errorf("traced target %s", got)
+	}
+}
+
+func TestBindContentType(t *testing.T) {
+	api := &API{}
+	for ct, want := range map[string]error{
+		"":                 ErrUnsupportedMedia,
+		"text/plain":       ErrUnsupportedMedia,
+		"application/json": nil,
+		"application/merge-patch+json; charset=utf-8": nil,
+	} {
+		r := httptest.NewRequest("POST", "/devices", strings.NewReader(`{"name":"r1"}`))
+		if ct != "" {
+			r.Header.Set("Content-Type", ct)
+		}
+		var v struct{ Name string }
+		if err := api.Bind(r, &v); !errors.Is(err, want) || want == nil && err != nil {
+			t.Errorf("content type %q: %v, want %v", ct, err, want)
+		}
+	}
+}
+
+func TestParseJunosEVPNRoutes(t *testing.T) {
+	out := `bgp.evpn.0: 4 destinations, 4 routes (4 active, 0 holddown, 0 hidden)
+2:10.255.0.2:1::10010::00:50:56:aa:00:02/304 MAC/IP (1 entry, 1 announced)
+        *BGP    Preference: 170/-101
+                Protocol next hop: 10.255.0.2
+3:10.255.0.2:1::10010::10.255.0.2/248 IM (1 entry, 1 announced)
+        *BGP    Preference: 170/-101
+                Route Distinguisher: 10.255.0.2:1
+                Protocol next hop: 10.255.0.2
+5:10.255.0.2:100::0::10.1.1.0::24/248 (1 entry, 1 announced)
+        *BGP    Preference: 170/-101
+                Route Distinguisher: 10.255.0.2:100
+                Protocol next hop: 10.255.0.2
+                Route Label: 10100
+5:10.255.0.1:100::0::2001:db8:1::::64/248 (1 entry, 1 announced)
+        *EVPN   Preference: 170
+                Route Distinguisher: 10.255.0.1:100
+                Route Label: 10100
+`
+	want := []EVPNRoute{
+		{Type: 3, RD: "10.255.0.2:1", VNI: 10010, NextHop: "10.255.0.2"},
+		{Type: 5, RD: "10.255.0.2:100", VNI: 10100, IP: "10.1.1.0/24", NextHop: "10.255.0.2"},
+		{Type: 5, RD: "10.255.0.1:100", VNI: 10100, IP: "2001:db8:1::/64", Local: true},
+	}
+	if got := ParseJunosEVPNRoutes(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestTimeRangeDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tr, _ := BusinessHours("09:00", "17:00", time.Sunday)
+	tr.Location = ny
+	// 2026-03-08 is 23 hours long, clocks move from 02:00 to 03:00
+	dst := func(hh, mm int) time.Time { return time.Date(2026, 3, 8, hh, mm, 0, 0, ny) }
+	for _, c := range []struct {
+		t  time.Time
+		in bool
+	}{{dst(8, 59), false}, {dst(9, 0), true}, {dst(16, 59), true}, {dst(17, 0), false}} {
+		if InWindow(c.t, []TimeRange{tr}) != c.in {
+			t.Errorf("%s in window %t", c.t, !c.in)
+		}
+	}
+	if d := DurationWithin(dst(0, 0), dst(23, 0), []TimeRange{tr}); d != 8*time.Hour {
+		t.Errorf("window of the DST day %v, want 8h", d)
+	}
+}
+
+func TestThrottlerSlowFn(t *testing.T) {
+	var active, overlap, runs int32
+	th := NewThrottler(func() {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlap, 1)
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&runs, 1)
+		atomic.AddInt32(&active, -1)
+	}, time.Millisecond)
+	defer th.Stop()
+	for i := 0; i < 50; i++ {
+		th.Call()
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if atomic.LoadInt32(&overlap) != 0 {
+		t.Error("runs overlapped")
+	}
+	// the run during the last calls is followed by a trailing one
+	if n := atomic.LoadInt32(&runs); n < 3 || n > 7 {
+		t.Errorf("%d runs of 100ms of calls to a 20ms fn", n)
+	}
+}
+
+func TestReplayCachePrune(t *testing.T) {
+	c := newReplayCache(20 * time.Millisecond)
+	past := time.Now().Add(-time.Second)
+	for i := 0; i < 100; i++ {
+		c.add(strconv.Itoa(i), past)
+	}
+	if len(c.seen) != 100 {
+		t.Errorf("%d entries, pruned before the interval", len(c.seen))
+	}
+	// an expired entry no longer counts as seen
+	if !c.add("7", time.Now().Add(time.Minute)) || c.add("7", time.Now().Add(time.Minute)) {
+		t.Error("replay of a live signature accepted")
+	}
+	time.Sleep(30 * time.Millisecond)
+	c.add("fresh", time.Now().Add(time.Minute))
+	if len(c.seen) != 2 {
+		t.Errorf("%d entries after the prune, want 2", len(c.seen))
+	}
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"context"
+	"crypto/md5"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/* ****************************************
+file watching
+**************************************** */
+
+// WatchPollInterval is how often WatchFile checks the file for modification
+var WatchPollInterval = time.Second
+
+// WatchFile polls a file and calls onChange with its new content once it
+// stayed unchanged for the debounce period, e.g. to hot-reload a config file
+// a modification leaving the content as is, checked by MD5, is not reported
+// a file temporarily missing (e.g. being replaced) is tolerated
+// it blocks until ctx is done, onChange runs in the watching goroutine
+func WatchFile(ctx context.Context, path string, debounce time.Duration, onChange func([]byte)) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	size, mtime := fi.Size(), fi.ModTime()
+
+	poll := WatchPollInterval
+	if debounce > 0 && debounce < poll {
+		poll = debounce
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	var changed time.Time // last time a modification was observed, zero if settled
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if fi.Size() != size || !fi.ModTime().Equal(mtime) {
+				size, mtime = fi.Size(), fi.ModTime()
+				changed = now
+				continue
+			}
+			if changed.IsZero() || now.Sub(changed) < debounce {
+				continue
+			}
+			changed = time.Time{}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.WithError(err).WithField("file", path).Warn("WatchFile")
+				continue
+			}
+			if s := md5.Sum(data); s != sum {
+				sum = s
+				onChange(data)
+			}
+		}
+	}
+}
+
+// WatchEnvFile watches a dotenv style file and calls onChange with the
+// reloaded key/value pairs, see WatchFile and GetEnvHashFrFile
+func WatchEnvFile(ctx context.Context, path string, debounce time.Duration, onChange func(map[string]string)) error {
+	return WatchFile(ctx, path, debounce, func(data []byte) {
+		vars, err := ParseEnv(string(data))
+		if err != nil {
+			logger.WithError(err).WithField("file", path).Warn("WatchEnvFile")
+		}
+		res := make(map[string]string)
+		for _, v := range vars {
+			res[v.Key] = v.Val
+		}
+		onChange(res)
+	})
+}
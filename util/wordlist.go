@@ -0,0 +1,49 @@
+package util
+
+// passWords is the embedded word list of RandPassphrase
+// short, common and unambiguous lowercase english words
+var passWords = []string{
+	"able", "acid", "aged", "also", "area", "army", "away", "baby", "back", "ball",
+	"band", "bank", "base", "bath", "bear", "beat", "bell", "belt", "best", "bird",
+	"blue", "boat", "body", "bone", "book", "boot", "born", "boss", "both", "bowl",
+	"bulk", "burn", "bush", "busy", "cake", "calm", "camp", "card", "care", "cart",
+	"case", "cash", "cast", "cell", "chef", "chip", "city", "clay", "club", "coal",
+	"coat", "code", "cold", "cook", "cool", "copy", "corn", "cost", "crew", "crop",
+	"dark", "data", "date", "dawn", "deal", "deep", "desk", "dial", "diet", "dish",
+	"dock", "door", "dose", "down", "draw", "drop", "drum", "dual", "duck", "dust",
+	"duty", "each", "earn", "east", "easy", "edge", "else", "even", "ever", "exit",
+	"face", "fact", "fair", "fall", "farm", "fast", "fear", "feed", "feel", "file",
+	"film", "fine", "fire", "firm", "fish", "flag", "flat", "flow", "fold", "folk",
+	"food", "foot", "fork", "form", "fort", "four", "free", "frog", "fuel", "full",
+	"fund", "gain", "game", "gate", "gear", "gift", "girl", "glad", "glow", "goal",
+	"gold", "golf", "good", "grab", "gray", "grid", "grow", "gulf", "hair", "half",
+	"hall", "hand", "hard", "harm", "hawk", "head", "heat", "help", "herb", "hero",
+	"high", "hill", "hint", "hold", "hole", "home", "hook", "hope", "horn", "host",
+	"hour", "huge", "idea", "inch", "iron", "item", "jazz", "join", "joke", "jump",
+	"jury", "just", "keen", "keep", "kind", "king", "kite", "knee", "knot", "lake",
+	"lamp", "land", "lane", "last", "late", "lawn", "lead", "leaf", "lean", "left",
+	"lens", "life", "lift", "like", "lime", "line", "link", "lion", "list", "live",
+	"load", "loan", "lock", "loft", "long", "look", "loop", "lord", "loud", "love",
+	"luck", "lung", "made", "mail", "main", "make", "mall", "many", "mark", "mask",
+	"mass", "meal", "mean", "meat", "meet", "menu", "mild", "milk", "mill", "mind",
+	"mint", "miss", "mode", "mood", "moon", "more", "most", "move", "much", "myth",
+	"nail", "name", "navy", "near", "neat", "neck", "need", "nest", "news", "next",
+	"nice", "node", "noon", "norm", "nose", "note", "oval", "over", "pace", "pack",
+	"page", "pain", "pair", "palm", "park", "part", "pass", "past", "path", "peak",
+	"pear", "pier", "pine", "pink", "pipe", "plan", "play", "plot", "plug", "poem",
+	"pole", "pond", "pool", "port", "pose", "post", "pour", "pure", "push", "quit",
+	"race", "rack", "rail", "rain", "rank", "rare", "rate", "read", "real", "reef",
+	"rest", "rice", "rich", "ride", "ring", "rise", "risk", "road", "rock", "role",
+	"roof", "room", "root", "rope", "rose", "ruby", "rule", "safe", "sail", "salt",
+	"sand", "save", "seal", "seat", "seed", "self", "sell", "send", "ship", "shoe",
+	"shop", "shot", "show", "side", "sign", "silk", "sing", "site", "size", "skin",
+	"slow", "snow", "soap", "sock", "soft", "soil", "song", "sort", "soup", "spin",
+	"spot", "star", "stay", "stem", "step", "stop", "such", "suit", "sure", "swim",
+	"tail", "take", "tale", "talk", "tall", "tank", "tape", "task", "team", "tell",
+	"tent", "term", "test", "text", "tide", "tile", "time", "tiny", "tone", "tool",
+	"tour", "town", "tree", "trip", "true", "tube", "tune", "turn", "twin", "type",
+	"unit", "used", "vast", "verb", "view", "vote", "wage", "wait", "wake", "walk",
+	"wall", "warm", "wave", "weak", "wear", "week", "well", "west", "wide", "wild",
+	"wind", "wine", "wing", "wire", "wise", "wish", "wolf", "wood", "wool", "word",
+	"work", "yard", "year", "zero", "zone",
+}
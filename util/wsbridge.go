@@ -0,0 +1,153 @@
+package util
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+/* ****************************************
+websocket to gRPC stream bridge
+**************************************** */
+
+// WSGRPCBridge proxies a browser websocket to a gRPC stream of the
+// backend, the messages are exchanged in the protobuf JSON mapping
+// for a server stream the first websocket message is the request, for a
+// bidirectional stream every websocket message is sent on the stream and
+// closing the websocket half-closes it
+// the bearer token and the request ID of the authenticated request are
+// forwarded in the metadata, a slow browser holds back the reads of the
+// stream, so the gRPC flow control throttles the backend
+// the stream end closes the websocket, normally on success, otherwise
+// with code 1011 and "<grpc code>: <message>" as reason
+/*
+	b := &util.WSGRPCBridge{
+		Conn:        conn,
+		Method:      "/telemetry.Telemetry/Subscribe",
+		NewRequest:  func() proto.Message { return &pb.SubscribeRequest{} },
+		NewResponse: func() proto.Message { return &pb.Update{} },
+	}
+	svc.Handle("/ws/telemetry", api.AuthSSE(b.ServeHTTP)) // token in header or access_token parameter
+*/
+type WSGRPCBridge struct {
+	Conn   *grpc.ClientConn
+	Method string // full method name, e.g. /pkg.Service/Method
+	// Bidi is set for a bidirectional stream
+	Bidi        bool
+	NewRequest  func() proto.Message
+	NewResponse func() proto.Message
+	// Config is the upgrade policy, nil uses Upgrader
+	Config *WSConfig
+}
+
+// outgoingContext forwards the token, the request ID and the trace of the request
+func (b *WSGRPCBridge) outgoingContext(ctx context.Context) context.Context {
+	if tok, ok := TokenFromContext(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+tok)
+	}
+	return InjectGRPC(InjectRequestID(ctx))
+}
+
+// ServeHTTP upgrades the request and bridges it until either side ends
+func (b *WSGRPCBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upgrade := UpgradeWS
+	if b.Config != nil {
+		upgrade = b.Config.Upgrade
+	}
+	ws, err := upgrade(w, r, nil)
+	if err != nil {
+		LoggerFromContext(r.Context()).WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	desc := &grpc.StreamDesc{StreamName: b.Method, ServerStreams: true, ClientStreams: b.Bidi}
+	cs, err := b.Conn.NewStream(b.outgoingContext(ctx), desc, b.Method)
+	if err != nil {
+		b.closeWS(ws, err)
+		return
+	}
+	go func() {
+		defer Recover(ws.Log)
+		err := b.pumpRequests(ws, cs)
+		if err != nil && ctx.Err() == nil {
+			ws.Log.WithError(err).Debug("websocket to gRPC ended")
+			cancel()
+		}
+	}()
+	for {
+		msg := b.NewResponse()
+		err := cs.RecvMsg(msg)
+		if err == io.EOF {
+			ws.Close(websocket.CloseNormalClosure, "")
+			return
+		}
+		if err != nil {
+			b.closeWS(ws, err)
+			return
+		}
+		js, err := protojson.Marshal(msg)
+		if err != nil {
+			b.closeWS(ws, err)
+			return
+		}
+		// blocks while the browser is behind
+		if err := ws.Send(websocket.TextMessage, js); err != nil {
+			return
+		}
+	}
+}
+
+// pumpRequests sends the websocket messages on the stream, only the first
+// one unless bidirectional, then half-closes the stream
+func (b *WSGRPCBridge) pumpRequests(ws *WSSession, cs grpc.ClientStream) error {
+	defer cs.CloseSend()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		req := b.NewRequest()
+		if err := protojson.Unmarshal(data, req); err != nil {
+			b.closeWS(ws, ErrBadInput.Wrap(err))
+			return err
+		}
+		if err := cs.SendMsg(req); err != nil {
+			return err
+		}
+		if !b.Bidi {
+			// keep reading to detect the browser closing
+			if err := cs.CloseSend(); err != nil {
+				return err
+			}
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// closeWS closes the websocket with the status of the error
+func (b *WSGRPCBridge) closeWS(ws *WSSession, err error) {
+	reason := err.Error()
+	if st, ok := status.FromError(err); ok {
+		reason = st.Code().String() + ": " + st.Message()
+	} else if ErrCode(err) != "" {
+		reason = GRPCCode(err).String() + ": " + strings.TrimPrefix(err.Error(), "["+ErrCode(err)+"] ")
+	}
+	// control frames are limited to 125 bytes
+	ws.Close(websocket.CloseInternalServerErr, Truncate(reason, 120))
+}
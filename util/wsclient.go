@@ -0,0 +1,209 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+reconnecting websocket client
+**************************************** */
+
+// wsSubscription is replayed on every reconnect
+type wsSubscription struct {
+	typ     string
+	payload interface{}
+}
+
+// WSClient keeps a WSPeer connected to the URL, reconnecting with backoff
+// until the context of Run is done, the token of the TokenSource is sent
+// on every dial and renewed once rejected, the subscriptions are replayed
+// after each reconnect
+/*
+	c := util.NewWSClient("wss://events:8443/ws")
+	c.Tokens = util.NewTokenSource(util.RefreshTokenFunc(nil, refreshURL, refreshToken))
+	c.Handle("device.event", func(ctx context.Context, p json.RawMessage) (interface{}, error) {
+		fmt.Println(string(p))
+		return nil, nil
+	})
+	c.Subscribe(ctx, "subscribe", map[string]string{"device": "r1"})
+	err := c.Run(ctx)
+*/
+type WSClient struct {
+	URL    string
+	Header http.Header
+	// Tokens authenticates the dials, optional
+	Tokens *TokenSource
+	Dialer *websocket.Dialer
+	// Backoff paces the reconnects, MaxAttempts bounds the consecutive
+	// failed dials, zero means forever
+	Backoff RetryPolicy
+	// OnConnect is called after each connect and the subscription replay, optional
+	OnConnect func(ctx context.Context, p *WSPeer) error
+	Log       *log.Entry
+
+	mu       sync.Mutex
+	peer     *WSPeer
+	handlers map[string]WSHandler
+	subs     []wsSubscription
+}
+
+// NewWSClient creates a WSClient reconnecting with the waits of the
+// DefaultRetryPolicy without attempt limit
+func NewWSClient(url string) *WSClient {
+	b := DefaultRetryPolicy
+	b.MaxAttempts = 0
+	return &WSClient{
+		URL:      url,
+		Header:   http.Header{},
+		Dialer:   websocket.DefaultDialer,
+		Backoff:  b,
+		Log:      logger.WithFields(log.Fields{"module": "wsclient", "url": url}),
+		handlers: make(map[string]WSHandler),
+	}
+}
+
+// Handle registers the handler of the message type on every connection
+func (c *WSClient) Handle(typ string, h WSHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[typ] = h
+	if c.peer != nil {
+		c.peer.Handle(typ, h)
+	}
+}
+
+// Peer returns the connected peer, nil while disconnected
+func (c *WSClient) Peer() *WSPeer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer
+}
+
+// Call calls on the connected peer, ErrWSClosed while disconnected
+func (c *WSClient) Call(ctx context.Context, typ string, payload, out interface{}) error {
+	p := c.Peer()
+	if p == nil {
+		return ErrWSClosed
+	}
+	return p.Call(ctx, typ, payload, out)
+}
+
+// Notify notifies the connected peer, ErrWSClosed while disconnected
+func (c *WSClient) Notify(typ string, payload interface{}) error {
+	p := c.Peer()
+	if p == nil {
+		return ErrWSClosed
+	}
+	return p.Notify(typ, payload)
+}
+
+// Subscribe records the request to be replayed after each reconnect and
+// calls it now if connected
+func (c *WSClient) Subscribe(ctx context.Context, typ string, payload interface{}) error {
+	c.mu.Lock()
+	c.subs = append(c.subs, wsSubscription{typ, payload})
+	p := c.peer
+	c.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.Call(ctx, typ, payload, nil)
+}
+
+// dial connects with the current token, a rejected token is invalidated
+func (c *WSClient) dial(ctx context.Context) (*websocket.Conn, error) {
+	hdr := http.Header{}
+	for k, vs := range c.Header {
+		hdr[k] = append([]string(nil), vs...)
+	}
+	if c.Tokens != nil {
+		tok, err := c.Tokens.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Set("Authorization", "Bearer "+tok)
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		hdr.Set(RequestIDHeader, id)
+	}
+	conn, resp, err := c.Dialer.DialContext(ctx, c.URL, hdr)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized && c.Tokens != nil {
+			c.Tokens.Invalidate()
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("dial %s: %w (%s)", c.URL, err, resp.Status)
+		}
+		return nil, fmt.Errorf("dial %s: %w", c.URL, err)
+	}
+	return conn, nil
+}
+
+// connect sets up the peer of the connection and replays the subscriptions
+func (c *WSClient) connect(ctx context.Context, conn *websocket.Conn) (*WSPeer, error) {
+	s := newWSSession(conn, c.Log)
+	p := NewWSPeer(s)
+	c.mu.Lock()
+	for typ, h := range c.handlers {
+		p.Handle(typ, h)
+	}
+	subs := append([]wsSubscription(nil), c.subs...)
+	c.peer = p
+	c.mu.Unlock()
+	go p.Serve(ctx)
+	for _, sub := range subs {
+		if err := p.Call(ctx, sub.typ, sub.payload, nil); err != nil {
+			return p, fmt.Errorf("replay %s: %w", sub.typ, err)
+		}
+	}
+	if c.OnConnect != nil {
+		if err := c.OnConnect(ctx, p); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Run connects and keeps reconnecting until ctx is done, which is returned,
+// or MaxAttempts consecutive dials failed
+func (c *WSClient) Run(ctx context.Context) error {
+	failures := 0
+	for {
+		conn, err := c.dial(ctx)
+		if err == nil {
+			var p *WSPeer
+			p, err = c.connect(ctx, conn)
+			if err == nil {
+				failures = 0
+				c.Log.Info("websocket connected")
+			} else {
+				p.Session.Close(websocket.CloseNormalClosure, "")
+			}
+			<-p.Session.Done()
+			c.mu.Lock()
+			c.peer = nil
+			c.mu.Unlock()
+			if err == nil {
+				err = p.Session.Err()
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		failures++
+		if c.Backoff.MaxAttempts > 0 && failures >= c.Backoff.MaxAttempts {
+			return fmt.Errorf("gave up after %d attempts: %w", failures, err)
+		}
+		wait := jitter(c.Backoff.Backoff(failures), c.Backoff.Jitter)
+		c.Log.WithError(err).Warnf("websocket disconnected, reconnect in %s", wait)
+		if e := SleepCtx(ctx, wait); e != nil {
+			return e
+		}
+	}
+}
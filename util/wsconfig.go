@@ -0,0 +1,96 @@
+package util
+
+import (
+	"compress/flate"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/* ****************************************
+websocket upgrade policy
+**************************************** */
+
+// WSConfig is the upgrade policy of a websocket endpoint
+/*
+	wsc := util.WSConfig{Origins: []string{"https://netops.example.com"}, Compression: true, MaxMessage: 64 << 10}
+	mux.HandleFunc("/ws", api.Auth(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := wsc.Upgrade(w, r, nil)
+		...
+	}))
+*/
+type WSConfig struct {
+	// Origins are the allowed browser origins, exact, "*" or path.Match
+	// patterns as CORSConfig.AllowOrigins, empty allows the same origin only
+	Origins []string
+	// Compression negotiates permessage-deflate, CompressionLevel zero
+	// means flate.DefaultCompression
+	Compression      bool
+	CompressionLevel int
+	// MaxMessage limits the size of the received messages, zero means WSMaxMessage
+	MaxMessage int64
+	// Subprotocols are the supported subprotocols in the order of preference
+	Subprotocols     []string
+	ReadBufferSize   int
+	WriteBufferSize  int
+	HandshakeTimeout time.Duration
+}
+
+// CheckOriginAllowList returns a CheckOrigin accepting the origins, exact,
+// "*" or path.Match patterns, and the requests without Origin header,
+// which don't come from browsers
+func CheckOriginAllowList(origins ...string) func(r *http.Request) bool {
+	c := &CORSConfig{AllowOrigins: origins}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || c.allowOrigin(origin)
+	}
+}
+
+// Upgrader returns the upgrader of the policy
+func (c WSConfig) Upgrader() *websocket.Upgrader {
+	u := &websocket.Upgrader{
+		ReadBufferSize:    c.ReadBufferSize,
+		WriteBufferSize:   c.WriteBufferSize,
+		HandshakeTimeout:  c.HandshakeTimeout,
+		Subprotocols:      c.Subprotocols,
+		EnableCompression: c.Compression,
+	}
+	if u.ReadBufferSize == 0 {
+		u.ReadBufferSize = 1024
+	}
+	if u.WriteBufferSize == 0 {
+		u.WriteBufferSize = 1024
+	}
+	// nil CheckOrigin is the same origin check of gorilla
+	if len(c.Origins) > 0 {
+		u.CheckOrigin = CheckOriginAllowList(c.Origins...)
+	}
+	return u
+}
+
+// Upgrade upgrades the request with the policy and starts the session, the
+// negotiated subprotocol is available from ws.Conn.Subprotocol()
+func (c WSConfig) Upgrade(w http.ResponseWriter, r *http.Request, h http.Header) (*WSSession, error) {
+	conn, err := c.Upgrader().Upgrade(w, r, h)
+	if err != nil {
+		return nil, err
+	}
+	if c.Compression {
+		conn.EnableWriteCompression(true)
+		lvl := c.CompressionLevel
+		if lvl == 0 {
+			lvl = flate.DefaultCompression
+		}
+		if err := conn.SetCompressionLevel(lvl); err != nil {
+			conn.Close()
+			return nil, ErrBadInput.Wrap(err)
+		}
+	}
+	s := newWSSession(conn, LoggerFromContext(r.Context()).WithField("remote", conn.RemoteAddr().String()))
+	if c.MaxMessage > 0 {
+		conn.SetReadLimit(c.MaxMessage)
+	}
+	return s, nil
+}
@@ -0,0 +1,259 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+/* ****************************************
+websocket message protocol
+**************************************** */
+
+// WSMaxInflight is the default WSPeer.MaxInflight
+var WSMaxInflight = 64
+
+// WSMessage is the envelope of the websocket protocol, a request carries
+// an ID answered by the response with the same ReplyTo, a notification
+// carries no ID and isn't answered
+type WSMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	ReplyTo string          `json:"replyTo,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   *WSError        `json:"error,omitempty"`
+}
+
+// WSError is the error of a response, the code is the *Err code of the
+// handler error if any
+type WSError struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *WSError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("[%s] %s", e.Code, e.Message)
+	}
+	return e.Message
+}
+
+// WSHandler handles the payload of a message type, the result is the
+// payload of the response, ignored for notifications
+type WSHandler func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+// WSPeer speaks the message protocol over a session, the same on both
+// ends: Call sends a request and awaits the correlated response, Handle
+// registers the handlers of the incoming requests and notifications
+// handlers run concurrently, each in its own goroutine, up to MaxInflight
+/*
+	peer := util.NewWSPeer(ws)
+	peer.Handle("device.get", func(ctx context.Context, p json.RawMessage) (interface{}, error) {
+		var req struct{ Name string }
+		if err := json.Unmarshal(p, &req); err != nil {
+			return nil, util.ErrBadInput.Wrap(err)
+		}
+		return inventory.Get(ctx, req.Name)
+	})
+	go peer.Serve(ctx)
+	var st Status
+	err := peer.Call(ctx, "status", nil, &st)
+*/
+type WSPeer struct {
+	Session *WSSession
+	// MaxInflight bounds the handlers running at once, default
+	// WSMaxInflight, the requests beyond are answered with BUSY and the
+	// notifications dropped, set before Serve
+	MaxInflight int
+
+	mu       sync.Mutex
+	handlers map[string]WSHandler
+	pending  map[string]chan *WSMessage
+	seq      uint64
+}
+
+// NewWSPeer creates a WSPeer of the session
+func NewWSPeer(s *WSSession) *WSPeer {
+	return &WSPeer{Session: s, handlers: make(map[string]WSHandler), pending: make(map[string]chan *WSMessage)}
+}
+
+// Handle registers the handler of the message type
+func (p *WSPeer) Handle(typ string, h WSHandler) {
+	p.mu.Lock()
+	p.handlers[typ] = h
+	p.mu.Unlock()
+}
+
+// sendMsg encodes and queues the message
+func (p *WSPeer) sendMsg(m *WSMessage) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return p.Session.Send(websocket.TextMessage, b)
+}
+
+// encodePayload encodes v in JSON, nil v has no payload
+func encodePayload(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, ErrBadInput.Wrap(err)
+	}
+	return b, nil
+}
+
+// Notify sends a message not expecting a response
+func (p *WSPeer) Notify(typ string, payload interface{}) error {
+	b, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+	return p.sendMsg(&WSMessage{Type: typ, Payload: b})
+}
+
+// Call sends the request and decodes the payload of the response into out,
+// unless nil, the error of the response is returned as *WSError
+// Serve must be running to receive the response
+func (p *WSPeer) Call(ctx context.Context, typ string, payload, out interface{}) error {
+	b, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&p.seq, 1), 10)
+	ch := make(chan *WSMessage, 1)
+	p.mu.Lock()
+	p.pending[id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+	if err := p.sendMsg(&WSMessage{Type: typ, ID: id, Payload: b}); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.Session.Done():
+		return ErrWSClosed
+	case res := <-ch:
+		if res.Error != nil {
+			return res.Error
+		}
+		if out == nil || len(res.Payload) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(res.Payload, out); err != nil {
+			return fmt.Errorf("decode %s response: %w", typ, err)
+		}
+		return nil
+	}
+}
+
+// Serve reads the messages until the session is closed, responses are
+// passed to the pending calls, the others dispatched to the handlers,
+// a request of unknown type is answered with an error
+func (p *WSPeer) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	n := p.MaxInflight
+	if n <= 0 {
+		n = WSMaxInflight
+	}
+	sem := make(chan struct{}, n)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Session.Close(websocket.CloseGoingAway, "")
+		case <-p.Session.Done():
+		}
+	}()
+	for {
+		_, b, err := p.Session.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var m WSMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			p.Session.Log.WithError(err).Warn("invalid websocket message")
+			continue
+		}
+		if m.ReplyTo != "" {
+			p.mu.Lock()
+			ch := p.pending[m.ReplyTo]
+			p.mu.Unlock()
+			if ch != nil {
+				select {
+				case ch <- &m:
+				default: // duplicate response
+				}
+			}
+			continue
+		}
+		p.mu.Lock()
+		h := p.handlers[m.Type]
+		p.mu.Unlock()
+		select {
+		case sem <- struct{}{}:
+		default:
+			// blocking the reads would hold the responses awaited by the handlers
+			p.Session.Log.WithField("type", m.Type).Warn("websocket handlers busy")
+			p.reply(&m, &WSMessage{Type: m.Type, ReplyTo: m.ID, Error: &WSError{Code: "BUSY", Message: "too many requests in flight"}})
+			continue
+		}
+		go func(m *WSMessage) {
+			defer func() { <-sem }()
+			p.dispatch(ctx, h, m)
+		}(&m)
+	}
+}
+
+// dispatch runs the handler and answers a request, a panic of the
+// handler or an error without code is answered with INTERNAL
+func (p *WSPeer) dispatch(ctx context.Context, h WSHandler, m *WSMessage) {
+	res := &WSMessage{Type: m.Type, ReplyTo: m.ID}
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic(p.Session.Log.WithField("type", m.Type), m.Type, r)
+			res.Payload, res.Error = nil, &WSError{Code: "INTERNAL", Message: "internal error"}
+			p.reply(m, res)
+		}
+	}()
+	if h == nil {
+		res.Error = &WSError{Code: "UNKNOWN_TYPE", Message: fmt.Sprintf("unknown message type %q", m.Type)}
+	} else {
+		v, err := h(ctx, m.Payload)
+		if err == nil {
+			res.Payload, err = encodePayload(v)
+		}
+		if err != nil {
+			p.Session.Log.WithFields(ErrFields(err)).WithField("type", m.Type).Warn(err.Error())
+			// the detail of an unclassified error stays in the log
+			res.Error = &WSError{Code: "INTERNAL", Message: "internal error"}
+			if code := ErrCode(err); code != "" {
+				res.Error = &WSError{Code: code, Message: strings.TrimPrefix(err.Error(), "["+code+"] ")}
+			}
+		}
+	}
+	p.reply(m, res)
+}
+
+// reply sends the response of a request, notifications aren't answered
+func (p *WSPeer) reply(m, res *WSMessage) {
+	if m.ID == "" {
+		return
+	}
+	if err := p.sendMsg(res); err != nil {
+		p.Session.Log.WithError(err).WithField("type", m.Type).Debug("websocket response not sent")
+	}
+}
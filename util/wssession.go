@@ -0,0 +1,234 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+/* ****************************************
+websocket session
+**************************************** */
+
+// websocket session defaults, the ping period must be below the pong wait
+var (
+	WSWriteWait        = 10 * time.Second
+	WSPongWait         = 60 * time.Second
+	WSPingPeriod       = 54 * time.Second
+	WSMaxMessage int64 = 1 << 20
+	WSSendBuffer       = 64
+)
+
+// ErrWSClosed is returned by the sends of a closed session
+var ErrWSClosed = errors.New("websocket session closed")
+
+// wsFrame is a queued message of the write pump
+type wsFrame struct {
+	typ  int
+	data []byte
+}
+
+// WSSession owns a websocket connection, a single write goroutine
+// serializes the messages queued by concurrent senders and pings the peer,
+// the read deadline is extended by every pong, so a dead peer is detected
+// within WSPongWait
+// reads are not serialized, only one goroutine may read
+/*
+	ws, err := util.UpgradeWS(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close(websocket.CloseNormalClosure, "")
+	go func() {
+		for ev := range events {
+			ws.SendJSON(ev)
+		}
+	}()
+	var cmd Command
+	for ws.ReadJSON(&cmd) == nil {
+		...
+	}
+*/
+type WSSession struct {
+	Conn *websocket.Conn
+	Log  *log.Entry
+
+	send      chan wsFrame
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	code      int
+	reason    string
+	err       error
+}
+
+// UpgradeWS upgrades the request with Upgrader and starts the session
+func UpgradeWS(w http.ResponseWriter, r *http.Request, h http.Header) (*WSSession, error) {
+	conn, err := Upgrader.Upgrade(w, r, h)
+	if err != nil {
+		return nil, err
+	}
+	return newWSSession(conn, LoggerFromContext(r.Context()).WithField("remote", conn.RemoteAddr().String())), nil
+}
+
+// NewWSSession starts the write pump and the keepalive of the connection
+func NewWSSession(conn *websocket.Conn) *WSSession {
+	return newWSSession(conn, logger.WithField("remote", conn.RemoteAddr().String()))
+}
+
+// newWSSession starts the session logging to l, set before the write
+// pump reads it
+func newWSSession(conn *websocket.Conn, l *log.Entry) *WSSession {
+	s := &WSSession{
+		Conn: conn,
+		Log:  l,
+		send: make(chan wsFrame, WSSendBuffer),
+		done: make(chan struct{}),
+	}
+	conn.SetReadLimit(WSMaxMessage)
+	conn.SetReadDeadline(time.Now().Add(WSPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(WSPongWait))
+	})
+	go s.writePump()
+	return s
+}
+
+// writePump writes the queued messages and the pings until the session is closed
+func (s *WSSession) writePump() {
+	defer Recover(s.Log)
+	ping := time.NewTicker(WSPingPeriod)
+	defer func() {
+		ping.Stop()
+		s.Conn.Close()
+	}()
+	for {
+		select {
+		case f := <-s.send:
+			s.Conn.SetWriteDeadline(time.Now().Add(WSWriteWait))
+			if err := s.Conn.WriteMessage(f.typ, f.data); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-ping.C:
+			if err := s.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WSWriteWait)); err != nil {
+				s.fail(err)
+				return
+			}
+		case <-s.done:
+			s.mu.Lock()
+			code, reason := s.code, s.reason
+			s.mu.Unlock()
+			if code != 0 {
+				s.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WSWriteWait))
+			}
+			return
+		}
+	}
+}
+
+// fail closes the session on a connection error without close frame
+func (s *WSSession) fail(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Send queues a message of the type, e.g. websocket.TextMessage, waiting
+// up to WSWriteWait for room, a peer too slow to keep up is disconnected
+func (s *WSSession) Send(typ int, data []byte) error {
+	t := time.NewTimer(WSWriteWait)
+	defer t.Stop()
+	select {
+	case <-s.done:
+		return ErrWSClosed
+	default:
+	}
+	select {
+	case s.send <- wsFrame{typ, data}:
+		return nil
+	case <-s.done:
+		return ErrWSClosed
+	case <-t.C:
+		s.Log.Warn("slow websocket peer disconnected")
+		s.Close(websocket.ClosePolicyViolation, "too slow")
+		return ErrWSClosed
+	}
+}
+
+// TrySend queues a message without waiting, returns false if the buffer is
+// full or the session closed
+func (s *WSSession) TrySend(typ int, data []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	select {
+	case s.send <- wsFrame{typ, data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// SendJSON queues v encoded in JSON as text message
+func (s *WSSession) SendJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(websocket.TextMessage, b)
+}
+
+// ReadMessage reads the next message, a read error closes the session
+func (s *WSSession) ReadMessage() (int, []byte, error) {
+	typ, b, err := s.Conn.ReadMessage()
+	if err != nil {
+		s.fail(err)
+	}
+	return typ, b, err
+}
+
+// ReadJSON reads the next message decoded from JSON into v, a read error
+// closes the session, a decode error doesn't
+func (s *WSSession) ReadJSON(v interface{}) error {
+	_, b, err := s.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Close sends the close frame with the code and reason, e.g.
+// websocket.CloseNormalClosure, and closes the connection, the messages
+// still queued are discarded
+func (s *WSSession) Close(code int, reason string) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.code, s.reason = code, reason
+		s.mu.Unlock()
+		close(s.done)
+	})
+}
+
+// Done is closed once the session is closed
+func (s *WSSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the connection error which closed the session, nil if
+// closed by Close or still open
+func (s *WSSession) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}